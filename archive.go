@@ -0,0 +1,225 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"image-compressor/pkg/compressor"
+)
+
+// isArchive reports whether path names a zip or tar archive to compress the
+// images of, rather than an image.
+func isArchive(path string) bool {
+	name := strings.ToLower(path)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractArchive extracts the images of the archive at archivePath that the
+// filters of opts select into dir, keeping their paths and modification
+// times. It returns how many were extracted and skipped.
+func extractArchive(archivePath, dir string, opts compressor.Options) (extracted, skipped int, err error) {
+	extract := func(name string, size int64, modTime time.Time, open func() (io.ReadCloser, error)) error {
+		name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+		if name == ".." || strings.HasPrefix(name, "../") {
+			logger.Warnf("Skipping %s in %s: outside the archive", name, archivePath)
+			return nil
+		}
+		if !compressor.IsSupportedImage(path.Base(name)) || inSkippedFolder(name) {
+			return nil
+		}
+		if opts.PathFilter.Reason(name) != "" || size < opts.MinSize {
+			skipped++
+			return nil
+		}
+		r, err := open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s from %s: %v", name, archivePath, err)
+		}
+		defer r.Close()
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read %s from %s: %v", name, archivePath, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		// -since and -until go by the dates stored in the archive
+		os.Chtimes(target, modTime, modTime)
+		extracted++
+		return nil
+	}
+
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		archive, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open archive: %v", err)
+		}
+		defer archive.Close()
+		for _, file := range archive.File {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			if err := extract(file.Name, int64(file.UncompressedSize64), file.Modified, file.Open); err != nil {
+				return extracted, skipped, err
+			}
+		}
+		return extracted, skipped, nil
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if name := strings.ToLower(archivePath); strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open archive: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	// Tar entries can only be read in order, while the reader is on them
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return extracted, skipped, nil
+		}
+		if err != nil {
+			return extracted, skipped, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return io.NopCloser(archive), nil }
+		if err := extract(header.Name, header.Size, header.ModTime, open); err != nil {
+			return extracted, skipped, err
+		}
+	}
+}
+
+// writeArchive packs every file below dir except the manifest into a new
+// zip or tar archive at archivePath, chosen by its extension, with the files'
+// paths relative to dir. It returns how many files it packed.
+func writeArchive(archivePath, dir string) (int, error) {
+	tmp := archivePath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create archive: %v", err)
+	}
+	n, err := packArchive(f, strings.ToLower(archivePath), dir)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, archivePath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("failed to write archive %s: %v", archivePath, err)
+	}
+	return n, nil
+}
+
+func packArchive(w io.Writer, name, dir string) (int, error) {
+	var add func(rel string, info os.FileInfo, r io.Reader) error
+	var finish func() error
+	if strings.HasSuffix(name, ".zip") {
+		archive := zip.NewWriter(w)
+		add = func(rel string, info os.FileInfo, r io.Reader) error {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = rel
+			if compressor.IsSupportedImage(rel) {
+				header.Method = zip.Store // already compressed
+			} else {
+				header.Method = zip.Deflate
+			}
+			entry, err := archive.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(entry, r)
+			return err
+		}
+		finish = archive.Close
+	} else {
+		var gz *gzip.Writer
+		if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+			gz = gzip.NewWriter(w)
+			w = gz
+		}
+		archive := tar.NewWriter(w)
+		add = func(rel string, info os.FileInfo, r io.Reader) error {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = rel
+			if err := archive.WriteHeader(header); err != nil {
+				return err
+			}
+			_, err = io.Copy(archive, r)
+			return err
+		}
+		finish = func() error {
+			if err := archive.Close(); err != nil {
+				return err
+			}
+			if gz != nil {
+				return gz.Close()
+			}
+			return nil
+		}
+	}
+
+	n := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || path == filepath.Join(dir, "manifest.jsonl") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n++
+		return add(filepath.ToSlash(rel), info, f)
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, finish()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"image-compressor/pkg/compressor"
+
+	"github.com/nfnt/resize"
+)
+
+// runBench compresses a sample of images in memory with every combination of
+// the given thread counts, filters and encoders, and prints how fast each
+// went and how small the outputs came out.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	threadCounts := "1"
+	if n := runtime.NumCPU(); n > 1 {
+		threadCounts += fmt.Sprintf(",%d", n)
+		if n >= 8 {
+			threadCounts = fmt.Sprintf("1,%d,%d", n/2, n)
+		}
+	}
+	encoders := "std"
+	if _, err := compressor.MozJPEGVersion(); err == nil {
+		encoders += ",mozjpeg"
+	}
+	var threadsFlag, filtersFlag, encodersFlag, synthetic string
+	var sample, quality, maxPixels int
+	var resampling bool
+	fs.IntVar(&sample, "n", 20, "number of images in the sample: taken evenly from the folder, or generated")
+	fs.StringVar(&threadsFlag, "threads", threadCounts, "comma separated worker counts to compare")
+	fs.StringVar(&filtersFlag, "filters", "lanczos3,bilinear", "comma separated resampling filters to compare: nearest, bilinear, bicubic, lanczos2 or lanczos3")
+	fs.StringVar(&encodersFlag, "encoders", encoders, "comma separated jpeg encoders to compare: std or mozjpeg")
+	fs.StringVar(&synthetic, "synthetic", "6000x4000", "size of the generated images when no folder is given; larger than -s, so the filters are compared")
+	fs.IntVar(&quality, "q", 80, "JPEG quality (1-100)")
+	fs.IntVar(&maxPixels, "s", 12000000, "maximum number of pixels for the resized image")
+	fs.BoolVar(&resampling, "resample", false, "instead, time the built-in resampler against github.com/nfnt/resize on the decoded sample, for each of -filters")
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor bench [flags] [folder]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	threads, err := parseCounts(threadsFlag)
+	if err != nil {
+		fmt.Printf("Invalid threads %q: must be comma separated counts of at least 1\n", threadsFlag)
+		return
+	}
+	var filters []string
+	for _, name := range strings.Split(filtersFlag, ",") {
+		if _, ok := compressor.ResizeFilters[strings.TrimSpace(name)]; !ok {
+			fmt.Printf("Invalid filter %q: must be nearest, bilinear, bicubic, lanczos2 or lanczos3\n", name)
+			return
+		}
+		filters = append(filters, strings.TrimSpace(name))
+	}
+	var jpegEncoders []string
+	for _, name := range strings.Split(encodersFlag, ",") {
+		if name = strings.TrimSpace(name); !compressor.JPEGEncoders[name] {
+			fmt.Printf("Invalid jpeg encoder %q: must be std or mozjpeg\n", name)
+			return
+		}
+		if name == "mozjpeg" {
+			if _, err := compressor.MozJPEGVersion(); err != nil {
+				fmt.Printf("-encoders mozjpeg cannot be used: %v\n", err)
+				return
+			}
+		}
+		jpegEncoders = append(jpegEncoders, name)
+	}
+	if quality < 1 || quality > 100 {
+		fmt.Printf("Invalid quality %d: must be between 1 and 100\n", quality)
+		return
+	}
+	if sample < 1 {
+		fmt.Printf("Invalid sample size %d: must be at least 1\n", sample)
+		return
+	}
+
+	var images [][]byte
+	if fs.NArg() > 0 {
+		images, err = loadBenchSample(fs.Arg(0), sample)
+	} else {
+		images, err = syntheticImages(synthetic, sample)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var inputBytes int64
+	for _, data := range images {
+		inputBytes += int64(len(data))
+	}
+	fmt.Printf("Sample: %d images, %s\n\n", len(images), compressor.HumanReadableSize(inputBytes))
+	if resampling {
+		if err := benchResample(images, filters, maxPixels); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+
+	fmt.Printf("%-8s %-9s %-8s %10s %10s %8s %10s\n", "Threads", "Filter", "Encoder", "Images/s", "MB/s", "Output", "Time")
+	var fastest string
+	var best time.Duration
+	for _, encoder := range jpegEncoders {
+		for _, filter := range filters {
+			for _, n := range threads {
+				opts := compressor.DefaultOptions()
+				opts.MaxPixels, opts.JPEGQuality, opts.JPEGEncoder = maxPixels, quality, encoder
+				opts.Filter = compressor.ResizeFilters[filter]
+				elapsed, outputBytes, failed := benchRun(images, opts, n)
+				row := fmt.Sprintf("%-8d %-9s %-8s %10.2f %10.2f %7.1f%% %10v", n, filter, encoder,
+					float64(len(images))/elapsed.Seconds(), float64(inputBytes)/1e6/elapsed.Seconds(),
+					float64(outputBytes)*100/float64(inputBytes), elapsed.Round(time.Millisecond))
+				if failed > 0 {
+					row += fmt.Sprintf(" (%d failed)", failed)
+				}
+				fmt.Println(row)
+				if best == 0 || elapsed < best {
+					best, fastest = elapsed, fmt.Sprintf("-t %d -filter %s -jpeg-encoder %s", n, filter, encoder)
+				}
+			}
+		}
+	}
+	fmt.Printf("\nFastest: %s\n", fastest)
+}
+
+// benchRun compresses every image with threads workers and returns the wall
+// time, the total output size and how many failed.
+func benchRun(images [][]byte, opts compressor.Options, threads int) (time.Duration, int64, int) {
+	var mu sync.Mutex
+	var outputBytes int64
+	var failed int
+	next := make(chan []byte)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for data := range next {
+				encoded, _, err := compressor.CompressBytes(data, opts)
+				mu.Lock()
+				if err != nil {
+					failed++
+				} else {
+					outputBytes += int64(len(encoded))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, data := range images {
+		next <- data
+	}
+	close(next)
+	wg.Wait()
+	return time.Since(start), outputBytes, failed
+}
+
+// benchResample resizes every image to fit in maxPixels, or to half its
+// size if it already does, with nfnt/resize and with compressor.Resample.
+func benchResample(images [][]byte, filters []string, maxPixels int) error {
+	decoded := make([]image.Image, len(images))
+	for i, data := range images {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to decode image %d: %v", i+1, err)
+		}
+		decoded[i] = img
+	}
+	fmt.Printf("%-9s %12s %12s %8s\n", "Filter", "nfnt/resize", "Resample", "Speedup")
+	for _, name := range filters {
+		filter := compressor.ResizeFilters[name]
+		var nfnt, ours time.Duration
+		for _, img := range decoded {
+			b := img.Bounds()
+			scale := 0.5
+			if pixels := b.Dx() * b.Dy(); pixels > maxPixels {
+				scale = math.Sqrt(float64(maxPixels) / float64(pixels))
+			}
+			width, height := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+			start := time.Now()
+			resize.Resize(uint(width), uint(height), img, filter)
+			nfnt += time.Since(start)
+			start = time.Now()
+			compressor.Resample(img, width, height, filter)
+			ours += time.Since(start)
+		}
+		fmt.Printf("%-9s %12v %12v %7.1fx\n", name, nfnt.Round(time.Millisecond), ours.Round(time.Millisecond), float64(nfnt)/float64(ours))
+	}
+	return nil
+}
+
+func parseCounts(value string) ([]int, error) {
+	var counts []int
+	for _, field := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid count %q", field)
+		}
+		counts = append(counts, n)
+	}
+	return counts, nil
+}
+
+// loadBenchSample reads n images spread evenly over the supported images in
+// folder, so a sample isn't all from its first subfolder.
+func loadBenchSample(folder string, n int) ([][]byte, error) {
+	files, err := compressor.Plan(folder, filepath.Join(folder, "compressed_files"), compressor.DefaultOptions(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, file := range files {
+		if file.Action != "skip" && file.Action != "link" {
+			paths = append(paths, file.Path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no images in %s", folder)
+	}
+	if n > len(paths) {
+		n = len(paths)
+	}
+	images := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		data, err := ioutil.ReadFile(paths[i*len(paths)/n])
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, data)
+	}
+	return images, nil
+}
+
+// syntheticImages generates n JPEGs of size WIDTHxHEIGHT with gradients,
+// shapes and noise, roughly as hard to compress as photos.
+func syntheticImages(size string, n int) ([][]byte, error) {
+	width, height, err := compressor.ParseDimensions(size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid synthetic size %q: must be WIDTHxHEIGHT", size)
+	}
+	random := rand.New(rand.NewSource(1))
+	images := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		cx, cy, radius := random.Intn(width), random.Intn(height), (width+height)/(4+random.Intn(6))
+		base := uint8(random.Intn(128))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				noise := uint8(random.Intn(24))
+				r, g, b := base+uint8(x*127/width)+noise, uint8(y*200/height)+noise, uint8((x+y)*100/(width+height))+noise
+				if dx, dy := x-cx, y-cy; dx*dx+dy*dy < radius*radius {
+					r, g, b = 255-r, 255-g, b/2
+				}
+				offset := img.PixOffset(x, y)
+				img.Pix[offset], img.Pix[offset+1], img.Pix[offset+2], img.Pix[offset+3] = r, g, b, 255
+			}
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+			return nil, err
+		}
+		images = append(images, buf.Bytes())
+	}
+	return images, nil
+}
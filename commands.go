@@ -0,0 +1,428 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+// commands maps each subcommand to its entry point, which gets the arguments
+// after the command name.
+var commands = map[string]func(args []string){
+	"bench":         runBench,
+	"compress":      runCompress,
+	"contact-sheet": runContactSheet,
+	"dedupe":        runDedupe,
+	"pipe":          runPipe,
+	"scan":          runScan,
+	"verify":        runVerify,
+	"report":        runReport,
+	"retry":         runRetry,
+	"serve":         runServe,
+	"undo":          runUndo,
+	"watch":         runWatch,
+}
+
+func usage() {
+	fmt.Println(`Usage: image-compressor <command> [flags] <path>
+
+Commands:
+  bench          compare thread counts, filters and encoders on a sample of images
+  compress       resize, watermark and re-encode images (the default when no command is given)
+  contact-sheet  render the images of a folder as pages of captioned thumbnails, in JPEGs or a PDF
+  dedupe         find sets of near-duplicate images, such as burst shots, by perceptual hash
+  pipe           compress one image from stdin to stdout
+  scan           list what compress would do with each file, without writing anything
+  verify         check the outputs recorded in a manifest are intact and decodable
+  report         summarize the files recorded in a manifest, including failures
+  retry          compress again only the files a report or manifest lists as failed
+  serve          run an HTTP server that compresses uploaded images
+  undo           restore the originals replaced by compress -in-place from their backups
+  watch          compress a folder, then keep compressing new images as they are dropped into it
+
+Run "image-compressor <command> -h" for the flags of a command.`)
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			run(os.Args[2:])
+			return
+		}
+		if os.Args[1] == "help" {
+			usage()
+			return
+		}
+	}
+	runCompress(os.Args[1:])
+}
+
+// loadManifestArg loads the manifest named on the command line, which may be
+// the manifest itself or the folder holding one.
+func loadManifestArg(path string) (*compressor.Manifest, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "manifest.jsonl")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("no manifest: %v", err)
+	}
+	return compressor.LoadManifest(path)
+}
+
+// pathFilter builds the filter of the -include and -exclude flags, which are
+// comma separated globs, and their regex variants; nil when none are given.
+func pathFilter(include, exclude, includeRegex, excludeRegex string) (*compressor.PathFilter, error) {
+	if include == "" && exclude == "" && includeRegex == "" && excludeRegex == "" {
+		return nil, nil
+	}
+	split := func(list string) []string {
+		if list == "" {
+			return nil
+		}
+		return strings.Split(list, ",")
+	}
+	return compressor.NewPathFilter(split(include), split(exclude), includeRegex, excludeRegex)
+}
+
+// setDateRange applies the -since, -until and -date-from flags to opts. An
+// -until date without a time includes that whole day.
+func setDateRange(opts *compressor.Options, since, until, source string) error {
+	if !compressor.DateSources[source] {
+		return fmt.Errorf("invalid date source %q: must be mtime or exif", source)
+	}
+	opts.DateSource = source
+	if since != "" {
+		date, _, err := compressor.ParseDate(since)
+		if err != nil {
+			return err
+		}
+		opts.Since = date
+	}
+	if until != "" {
+		date, dateOnly, err := compressor.ParseDate(until)
+		if err != nil {
+			return err
+		}
+		if dateOnly {
+			date = date.AddDate(0, 0, 1)
+		}
+		opts.Until = date
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+		return fmt.Errorf("-since %s is not before -until %s", since, until)
+	}
+	return nil
+}
+
+func runScan(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	var outputDir, convertTo, sizesFlag, incremental, outsideSymlinks, include, exclude, includeRegex, excludeRegex, minSize, since, until, dateFrom, exifConditions string
+	var minPixels int
+	var resume, followSymlinks, organizeByDate, flatten bool
+	fs.StringVar(&outputDir, "d", "", "directory compressed images would be saved to")
+	fs.StringVar(&convertTo, "convert-to", "", "output format that would be written: jpeg, png or gif")
+	fs.StringVar(&sizesFlag, "sizes", "", "comma separated widths that would be written")
+	fs.StringVar(&incremental, "incremental", "", "compare sources against manifest.jsonl by mtime or hash")
+	fs.BoolVar(&resume, "resume", false, "skip files manifest.jsonl records as done")
+	fs.BoolVar(&followSymlinks, "follow-symlinks", false, "also walk symlinked folders")
+	fs.StringVar(&include, "include", "", "comma separated globs of the files to consider, relative to the input folder")
+	fs.StringVar(&exclude, "exclude", "", "comma separated globs of files and folders to leave out")
+	fs.StringVar(&includeRegex, "include-regex", "", "regular expression relative paths must match")
+	fs.StringVar(&excludeRegex, "exclude-regex", "", "regular expression of relative paths to leave out")
+	fs.StringVar(&exifConditions, "exif", "", "only images whose EXIF fields meet these comma separated conditions, e.g. ISO>3200")
+	fs.StringVar(&minSize, "min-size", "", "skip files smaller than this, e.g. 200KB")
+	fs.IntVar(&minPixels, "min-pixels", 0, "skip images with fewer pixels than this")
+	fs.StringVar(&since, "since", "", "only files dated on or after this, e.g. 2023-01-01")
+	fs.StringVar(&until, "until", "", "only files dated up to this, e.g. 2023-12-31 (the whole day)")
+	fs.StringVar(&dateFrom, "date-from", "mtime", "what -since and -until compare: mtime, or exif capture time")
+	fs.StringVar(&outsideSymlinks, "outside-symlinks", "skip", "with -follow-symlinks, links pointing outside the input folder: skip, copy-link or follow")
+	fs.BoolVar(&organizeByDate, "organize-by-date", false, "name outputs in YYYY/MM/DD folders by capture date")
+	fs.BoolVar(&flatten, "flatten", false, "name every output directly in compressed_files")
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor scan [flags] <path>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return
+	}
+	if convertTo != "" {
+		format, err := compressor.ParseFormat(convertTo)
+		if err != nil {
+			fmt.Printf("Invalid output format %q: %v\n", convertTo, err)
+			return
+		}
+		convertTo = format
+	}
+	if incremental != "" && !compressor.ChangeDetectionModes[incremental] {
+		fmt.Printf("Invalid incremental mode %q: must be mtime or hash\n", incremental)
+		return
+	}
+	if !compressor.SymlinkPolicies[outsideSymlinks] {
+		fmt.Printf("Invalid outside symlinks policy %q: must be skip, copy-link or follow\n", outsideSymlinks)
+		return
+	}
+	filter, err := pathFilter(include, exclude, includeRegex, excludeRegex)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	opts := compressor.DefaultOptions()
+	opts.ConvertTo = convertTo
+	opts.PathFilter = filter
+	if exifConditions != "" {
+		if opts.ExifFilter, err = compressor.ParseExifFilter(exifConditions); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	if minSize != "" {
+		if opts.MinSize, err = compressor.ParseSize(minSize); err != nil {
+			fmt.Printf("Invalid min size %q\n", minSize)
+			return
+		}
+	}
+	opts.MinPixels = minPixels
+	if err := setDateRange(&opts, since, until, dateFrom); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	opts.FollowSymlinks, opts.OutsideSymlinks = followSymlinks, outsideSymlinks
+	opts.OrganizeByDate, opts.Flatten = organizeByDate, flatten
+	if sizesFlag != "" {
+		for _, field := range strings.Split(sizesFlag, ",") {
+			width, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || width <= 0 {
+				fmt.Printf("Invalid sizes %q: must be comma separated widths in pixels\n", sizesFlag)
+				return
+			}
+			opts.Sizes = append(opts.Sizes, width)
+		}
+	}
+
+	inputPath := fs.Arg(0)
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		fmt.Printf("Error accessing the path: %v\n", err)
+		return
+	}
+	if outputDir == "" {
+		outputDir = inputPath
+	}
+
+	plan, err := describePlan(inputPath, info, filepath.Join(outputDir, "compressed_files"), opts, resume, incremental, 0, 1)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Print(plan)
+}
+
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor verify <compressed_files folder or manifest.jsonl>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return
+	}
+	manifest, err := loadManifestArg(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var checked, broken int
+	for _, entry := range manifest.Entries() {
+		if entry.Status != "done" {
+			continue
+		}
+		for _, out := range entry.Outputs {
+			checked++
+			if err := compressor.VerifyOutput(out); err != nil {
+				broken++
+				fmt.Printf("FAILED %s: %v\n", out.Path, err)
+			}
+		}
+	}
+	fmt.Printf("Outputs verified: %d, failed: %d\n", checked, broken)
+	if broken > 0 {
+		os.Exit(1)
+	}
+}
+
+func runDedupe(args []string) {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	var algorithm, rawMode string
+	var threshold, threads int
+	var listOnly bool
+	fs.StringVar(&algorithm, "hash", "dhash", "perceptual hash: dhash, or phash (slower, more tolerant of crops and exposure changes)")
+	fs.IntVar(&threshold, "threshold", 6, "images whose hashes differ in at most this many of 64 bits are near-duplicates")
+	fs.IntVar(&threads, "t", 10, "number of images decoded at once")
+	fs.StringVar(&rawMode, "raw", "preview", "how to decode camera RAW files: preview or full")
+	fs.BoolVar(&listOnly, "list", false, "only print the paths of the redundant images, one per line")
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor dedupe [flags] <folder>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return
+	}
+	if compressor.PerceptualHashes[algorithm] == nil {
+		fmt.Printf("Invalid hash %q: must be dhash or phash\n", algorithm)
+		return
+	}
+	if threshold < 0 || threshold > 64 {
+		fmt.Printf("Invalid threshold %d: must be between 0 and 64\n", threshold)
+		return
+	}
+	if threads < 1 {
+		fmt.Printf("Invalid thread count %d: must be at least 1\n", threads)
+		return
+	}
+	folder := fs.Arg(0)
+	files, err := compressor.Plan(folder, filepath.Join(folder, "compressed_files"), compressor.DefaultOptions(), nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var paths []string
+	for _, file := range files {
+		if file.Action != "skip" && file.Action != "link" && !compressor.IsPDFFile(file.Path) {
+			paths = append(paths, file.Path)
+		}
+	}
+
+	sets, failed := compressor.FindNearDuplicates(paths, algorithm, threshold, threads, rawMode)
+	if listOnly {
+		for _, set := range sets {
+			for _, other := range set.Others {
+				fmt.Println(other)
+			}
+		}
+		return
+	}
+	var redundant int
+	var redundantBytes int64
+	for i, set := range sets {
+		fmt.Printf("Set %d: keep %s\n", i+1, set.Keep)
+		for j, other := range set.Others {
+			var size int64
+			if info, err := os.Stat(other); err == nil {
+				size = info.Size()
+			}
+			fmt.Printf("  %s (%d bits apart, %s)\n", other, set.Distances[j], compressor.HumanReadableSize(size))
+			redundant++
+			redundantBytes += size
+		}
+	}
+	for path, err := range failed {
+		fmt.Printf("Not hashed %s: %v\n", path, err)
+	}
+	fmt.Printf("Images hashed: %d, near-duplicate sets: %d, redundant images: %d (%s)\n",
+		len(paths)-len(failed), len(sets), redundant, compressor.HumanReadableSize(redundantBytes))
+}
+
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	var failedOnly bool
+	fs.BoolVar(&failedOnly, "failed", false, "only print the paths of failed files, one per line")
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor report [flags] <compressed_files folder or manifest.jsonl>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return
+	}
+	manifest, err := loadManifestArg(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var done int
+	var inputBytes int64
+	var failed []compressor.ManifestEntry
+	for _, entry := range manifest.Entries() {
+		if entry.Status == "done" {
+			done++
+			inputBytes += entry.InputSize
+		} else {
+			failed = append(failed, entry)
+		}
+	}
+
+	if failedOnly {
+		for _, entry := range failed {
+			fmt.Println(entry.Input)
+		}
+		return
+	}
+	fmt.Printf("Files done: %d (%s of originals)\n", done, compressor.HumanReadableSize(inputBytes))
+	fmt.Printf("Files failed: %d\n", len(failed))
+	for _, entry := range failed {
+		fmt.Printf("  %s: %s\n", entry.Input, entry.Error)
+	}
+}
+
+func runUndo(args []string) {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor undo <backup_files folder or backups.jsonl>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return
+	}
+	path := fs.Arg(0)
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "backups.jsonl")
+	}
+	entries, err := compressor.LoadBackupLog(path)
+	if err != nil {
+		fmt.Printf("Error: no backups: %v\n", err)
+		return
+	}
+
+	// Backups carry the originals' permissions, and as root their owners too
+	opts := compressor.DefaultOptions()
+	opts.PreserveOwner = os.Geteuid() == 0
+
+	// Entries that fail stay in the log, so undo can be run again
+	var failed []compressor.BackupEntry
+	for _, entry := range entries {
+		if err := compressor.RestoreBackup(entry, opts); err != nil {
+			fmt.Printf("FAILED %s: %v\n", entry.Original, err)
+			failed = append(failed, entry)
+			continue
+		}
+		fmt.Printf("Restored %s\n", entry.Original)
+	}
+	if err := compressor.SaveBackupLog(path, failed); err != nil {
+		fmt.Printf("Failed to update %s: %v\n", path, err)
+	}
+	fmt.Printf("Originals restored: %d, failed: %d\n", len(entries)-len(failed), len(failed))
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
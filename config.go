@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is loaded from the working directory when -config is not
+// given.
+const defaultConfigFile = "compressor.yaml"
+
+// configAliases maps readable config file keys to the short flags they set.
+var configAliases = map[string]string{
+	"max-pixels": "s",
+	"threads":    "t",
+	"quality":    "q",
+	"output-dir": "d",
+	"watermark":  "w",
+	"fonts":      "f",
+}
+
+// loadConfig sets every flag of fs named in the YAML file at path that was not
+// already given on the command line, so flags override the file. Keys are flag
+// names (with - or _) or one of configAliases; lists are joined with commas.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ReplaceAll(key, "_", "-")
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, configValue(values[key])); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func configValue(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	if list, ok := value.([]interface{}); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+)
+
+// runContactSheet renders the images of a folder as grid pages of captioned
+// thumbnails, written as JPEGs or as one PDF.
+func runContactSheet(args []string) {
+	fs := flag.NewFlagSet("contact-sheet", flag.ExitOnError)
+	var output, fontPath, background, rawMode string
+	var columns, rows, cellSize, quality, dpi, threads int
+	var captions bool
+	fs.StringVar(&output, "o", "", "file to write, a .jpg (numbered _1, _2, ... when there are several pages) or a .pdf Default: contact_sheet.jpg")
+	fs.IntVar(&columns, "columns", 6, "thumbnails per row")
+	fs.IntVar(&rows, "rows", 0, "rows per page; 0 puts every image on one page")
+	fs.IntVar(&cellSize, "cell", 240, "longest side of each thumbnail, in pixels")
+	fs.BoolVar(&captions, "captions", true, "write the file name under each thumbnail")
+	fs.StringVar(&fontPath, "f", "", "comma separated TrueType/OpenType font files for the captions, with the embedded Go Regular font as the last fallback")
+	fs.StringVar(&background, "background", "#ffffff", "page color")
+	fs.IntVar(&quality, "q", 85, "JPEG quality of the pages (1-100)")
+	fs.IntVar(&dpi, "dpi", 150, "resolution the pages are printed at in a PDF, which sets its page size")
+	fs.IntVar(&threads, "t", 10, "number of images decoded at once")
+	fs.StringVar(&rawMode, "raw", "preview", "how to decode camera RAW files: preview or full")
+	fs.Usage = func() {
+		fmt.Println("Usage: image-compressor contact-sheet [flags] <folder>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return
+	}
+	if columns < 1 {
+		fmt.Printf("Invalid columns %d: must be at least 1\n", columns)
+		return
+	}
+	if rows < 0 {
+		fmt.Printf("Invalid rows %d: must be at least 0\n", rows)
+		return
+	}
+	if cellSize < 16 {
+		fmt.Printf("Invalid cell size %d: must be at least 16 pixels\n", cellSize)
+		return
+	}
+	if quality < 1 || quality > 100 {
+		fmt.Printf("Invalid quality %d: must be between 1 and 100\n", quality)
+		return
+	}
+	if dpi < 1 {
+		fmt.Printf("Invalid dpi %d: must be at least 1\n", dpi)
+		return
+	}
+	if threads < 1 {
+		fmt.Printf("Invalid thread count %d: must be at least 1\n", threads)
+		return
+	}
+	backgroundColor, err := compressor.ParseHexColor(background)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fonts, err := compressor.LoadFonts(fontPath)
+	if err != nil {
+		fmt.Printf("Error: failed to load fonts: %v\n", err)
+		return
+	}
+	folder := fs.Arg(0)
+	if output == "" {
+		output = "contact_sheet.jpg"
+	}
+	pdf := strings.EqualFold(filepath.Ext(output), ".pdf")
+
+	files, err := compressor.Plan(folder, filepath.Join(folder, "compressed_files"), compressor.DefaultOptions(), nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	var paths []string
+	for _, file := range files {
+		// Images compressed before are still shown
+		if file.Action != "link" && (file.Action != "skip" || file.Reason == "output exists") && !compressor.IsPDFFile(file.Path) {
+			paths = append(paths, file.Path)
+		}
+	}
+
+	sheet := compressor.ContactSheet{
+		Columns:    columns,
+		Rows:       rows,
+		CellSize:   cellSize,
+		Captions:   captions,
+		Fonts:      fonts,
+		Background: backgroundColor,
+		RawMode:    rawMode,
+		Threads:    threads,
+	}
+	pages, failed := sheet.Render(paths)
+	for path, err := range failed {
+		fmt.Printf("Not included %s: %v\n", path, err)
+	}
+	if len(pages) == 0 {
+		fmt.Println("No images to put on a contact sheet")
+		return
+	}
+
+	var pdfPages []compressor.PDFPage
+	for i, page := range pages {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, page, &jpeg.Options{Quality: quality}); err != nil {
+			fmt.Printf("Error: failed to encode page %d: %v\n", i+1, err)
+			return
+		}
+		if pdf {
+			width, height := page.Bounds().Dx(), page.Bounds().Dy()
+			points := func(pixels int) float64 { return float64(pixels) * 72 / float64(dpi) }
+			pdfPages = append(pdfPages, compressor.PDFPage{
+				Image:      buf.Bytes(),
+				Width:      width,
+				Height:     height,
+				PageWidth:  points(width),
+				PageHeight: points(height),
+				ImageRect:  [4]float64{0, 0, points(width), points(height)},
+			})
+			continue
+		}
+		path := output
+		if len(pages) > 1 {
+			ext := filepath.Ext(output)
+			path = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(output, ext), i+1, ext)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			fmt.Printf("Error: failed to write contact sheet: %v\n", err)
+			return
+		}
+		fmt.Printf("Contact sheet written to %s\n", path)
+	}
+	if pdf {
+		f, err := os.Create(output)
+		if err != nil {
+			fmt.Printf("Error: failed to write contact sheet: %v\n", err)
+			return
+		}
+		if err = compressor.WritePDF(f, pdfPages); err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err != nil {
+			fmt.Printf("Error: failed to write contact sheet: %v\n", err)
+			return
+		}
+		fmt.Printf("Contact sheet of %d pages written to %s\n", len(pages), output)
+	}
+	fmt.Printf("Images on the contact sheet: %d, not included: %d\n", len(paths)-len(failed), len(failed))
+}
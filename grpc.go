@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"image-compressor/pkg/compressor"
+	"image-compressor/pkg/compressorpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcChunk is the size of the chunks compressed images are streamed in,
+// well below gRPC's default 4MB message limit.
+const grpcChunk = 1 << 20
+
+// grpcServer serves the Compressor service of compressor.proto with the
+// same options, workers and job queue as the HTTP API.
+type grpcServer struct {
+	compressorpb.UnimplementedCompressorServer
+	server *compressServer
+	queue  *jobQueue
+}
+
+func newGRPCServer(server *compressServer, queue *jobQueue) *grpc.Server {
+	s := grpc.NewServer()
+	compressorpb.RegisterCompressorServer(s, &grpcServer{server: server, queue: queue})
+	return s
+}
+
+// grpcOptions turns the options of a request into the query parameters of
+// the HTTP API, so requestOptions checks them the same way.
+func grpcOptions(options *compressorpb.Options) map[string]string {
+	query := make(map[string]string)
+	if options == nil {
+		return query
+	}
+	if options.Quality != 0 {
+		query["quality"] = strconv.Itoa(int(options.Quality))
+	}
+	if options.MaxWidth != 0 {
+		query["max-width"] = strconv.Itoa(int(options.MaxWidth))
+	}
+	if options.MaxHeight != 0 {
+		query["max-height"] = strconv.Itoa(int(options.MaxHeight))
+	}
+	for name, value := range map[string]string{
+		"scale":          options.Scale,
+		"format":         options.Format,
+		"target-size":    options.TargetSize,
+		"strip-metadata": options.StripMetadata,
+	} {
+		if value != "" {
+			query[name] = value
+		}
+	}
+	return query
+}
+
+func (g *grpcServer) Compress(stream compressorpb.Compressor_CompressServer) error {
+	var data bytes.Buffer
+	var options *compressorpb.Options
+	for first := true; ; first = false {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if first {
+			options = req.Options
+		}
+		if int64(data.Len()+len(req.Data)) > g.server.maxUpload {
+			return status.Errorf(codes.ResourceExhausted, "image larger than %d bytes", g.server.maxUpload)
+		}
+		data.Write(req.Data)
+	}
+	query := make(map[string][]string)
+	for name, value := range grpcOptions(options) {
+		query[name] = []string{value}
+	}
+	opts, err := requestOptions(g.server.opts, query)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := g.server.acquire(stream.Context()); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	encoded, result, err := compressor.CompressBytes(data.Bytes(), opts)
+	g.server.slots.Release(1)
+	result.Err = err
+	observeResult(result)
+	if err != nil {
+		logger.Errorf("Failed to compress gRPC upload: %v", err)
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	info := &compressorpb.ImageInfo{
+		ContentType: http.DetectContentType(encoded),
+		InputSize:   result.InputSize,
+		OutputSize:  result.OutputSize,
+		Width:       int32(result.OutputWidth),
+		Height:      int32(result.OutputHeight),
+	}
+	for offset := 0; offset == 0 || offset < len(encoded); offset += grpcChunk {
+		end := offset + grpcChunk
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		resp := &compressorpb.CompressResponse{Data: encoded[offset:end]}
+		if offset == 0 {
+			resp.Info = info
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *grpcServer) BatchCompress(req *compressorpb.BatchCompressRequest, stream compressorpb.Compressor_BatchCompressServer) error {
+	j := &job{Input: req.Input, Output: req.Output, Options: grpcOptions(req.Options)}
+	if len(j.Options) == 0 {
+		j.Options = nil
+	}
+	if _, err := g.queue.add(j); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	// The job lives as long as the call
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stream.Context().Done():
+			j.cancel()
+		case <-done:
+		}
+	}()
+
+	return g.queue.watch(j, func(snapshot job, results []jobResult) error {
+		progress := &compressorpb.Progress{
+			Files:      int32(snapshot.Progress.Files),
+			Done:       int32(snapshot.Progress.Done),
+			Failed:     int32(snapshot.Progress.Failed),
+			InputSize:  snapshot.Progress.InputSize,
+			OutputSize: snapshot.Progress.OutputSize,
+		}
+		resp := &compressorpb.BatchCompressResponse{JobId: snapshot.ID, Status: snapshot.Status, Progress: progress}
+		for _, result := range results {
+			resp.File = &compressorpb.FileResult{
+				Input:      result.Input,
+				Outputs:    result.Outputs,
+				InputSize:  result.InputSize,
+				OutputSize: result.OutputSize,
+				Error:      result.Error,
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &compressorpb.BatchCompressResponse{JobId: snapshot.ID, Status: snapshot.Status, Progress: progress}
+		}
+		if len(results) > 0 && snapshot.Finished == nil {
+			return nil // the status went out with the files
+		}
+		resp.Error = snapshot.Error
+		return stream.Send(resp)
+	})
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"image-compressor/pkg/compressor"
+	"image-compressor/pkg/storage"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// job is a folder, file or storage URL submitted to the serve command's
+// /jobs API. Its files are compressed by the server's workers, shared with
+// uploads, into a compressed_files folder with a manifest and report.json,
+// as compress -incremental mtime would: originals are left in place.
+type job struct {
+	ID       string            `json:"id"`
+	Input    string            `json:"input"`
+	Output   string            `json:"output,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+	Status   string            `json:"status"` // queued, running, done, failed or cancelled
+	Error    string            `json:"error,omitempty"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Progress jobProgress       `json:"progress"`
+	Results  []jobResult       `json:"results,omitempty"`
+
+	input, output string // resolved local paths or URLs
+	opts          compressor.Options
+	cancel        context.CancelFunc
+}
+
+type jobProgress struct {
+	Files      int   `json:"files"`
+	Done       int   `json:"done"`
+	Failed     int   `json:"failed"`
+	InputSize  int64 `json:"input_size"`
+	OutputSize int64 `json:"output_size"`
+}
+
+type jobResult struct {
+	Input      string   `json:"input"`
+	Outputs    []string `json:"outputs,omitempty"`
+	InputSize  int64    `json:"input_size"`
+	OutputSize int64    `json:"output_size"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// jobQueue runs submitted jobs in order, a few at once, and keeps every job
+// for status queries until the server stops.
+type jobQueue struct {
+	server  *compressServer
+	root    string              // local paths must be inside it
+	running *semaphore.Weighted // jobs at once; the rest wait in order
+
+	mu      sync.Mutex
+	changed *sync.Cond // broadcast on every update, for watch
+	jobs    map[string]*job
+	order   []*job
+}
+
+func newJobQueue(server *compressServer, root string, concurrent int) (*jobQueue, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	q := &jobQueue{server: server, root: root, running: semaphore.NewWeighted(int64(concurrent)), jobs: make(map[string]*job)}
+	q.changed = sync.NewCond(&q.mu)
+	return q, nil
+}
+
+// handleJobs serves POST /jobs to submit a job, GET /jobs to list them, and
+// GET or DELETE /jobs/<id> to query or cancel one.
+func (q *jobQueue) handleJobs(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		q.submit(w, r)
+	case id == "" && r.Method == http.MethodGet:
+		q.mu.Lock()
+		list := make([]job, 0, len(q.order))
+		for _, j := range q.order {
+			snapshot := *j
+			snapshot.Results = nil // only in the job's own status
+			list = append(list, snapshot)
+		}
+		q.mu.Unlock()
+		writeJSON(w, http.StatusOK, list)
+	case id != "" && (r.Method == http.MethodGet || r.Method == http.MethodDelete):
+		q.mu.Lock()
+		j := q.jobs[id]
+		if j != nil && r.Method == http.MethodDelete && j.Finished == nil {
+			j.cancel()
+		}
+		var snapshot job
+		if j != nil {
+			snapshot = *j
+			snapshot.Results = append([]jobResult(nil), j.Results...)
+		}
+		q.mu.Unlock()
+		if j == nil {
+			httpError(w, http.StatusNotFound, fmt.Errorf("no job %q", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, snapshot)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("POST a job to /jobs, or GET or DELETE /jobs/<id>"))
+	}
+}
+
+// jobRequest is the body of POST /jobs: what a client may set of a job.
+type jobRequest struct {
+	Input   string            `json:"input"`
+	Output  string            `json:"output"`
+	Options map[string]string `json:"options"`
+}
+
+func (q *jobQueue) submit(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("invalid job: %v", err))
+		return
+	}
+	j := &job{Input: req.Input, Output: req.Output, Options: req.Options}
+	snapshot, err := q.add(j)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// add checks the input, output and options of a new job and queues it,
+// returning a copy of it as queued.
+func (q *jobQueue) add(j *job) (job, error) {
+	if j.Input == "" {
+		return job{}, fmt.Errorf("invalid job: no input")
+	}
+	query := make(map[string][]string, len(j.Options))
+	for name, value := range j.Options {
+		query[name] = []string{value}
+	}
+	var err error
+	if j.opts, err = requestOptions(q.server.opts, query); err != nil {
+		return job{}, err
+	}
+	if j.input, err = q.resolve(j.Input); err != nil {
+		return job{}, err
+	}
+	if j.Output != "" {
+		if j.output, err = q.resolve(j.Output); err != nil {
+			return job{}, err
+		}
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	j.ID, j.Status, j.Created = hex.EncodeToString(id), "queued", time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	q.mu.Lock()
+	q.jobs[j.ID] = j
+	q.order = append(q.order, j)
+	snapshot := *j
+	q.mu.Unlock()
+	go q.run(ctx, j)
+
+	logger.Infof("Queued job %s for %s", j.ID, j.Input)
+	return snapshot, nil
+}
+
+// resolve returns the path a job names, relative to the job root and not
+// outside it, or the storage URL unchanged.
+func (q *jobQueue) resolve(name string) (string, error) {
+	if storage.IsURL(name) {
+		return name, nil
+	}
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(q.root, path)
+	}
+	path = filepath.Clean(path)
+	if rel, err := filepath.Rel(q.root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q: outside the job root", name)
+	}
+	return path, nil
+}
+
+// update changes a job under the queue's lock.
+func (q *jobQueue) update(j *job, change func(j *job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	change(j)
+	q.changed.Broadcast()
+}
+
+// watch calls fn with a copy of j, and the results added since the last
+// call, whenever j changes, until j finishes.
+func (q *jobQueue) watch(j *job, fn func(snapshot job, results []jobResult) error) error {
+	seen, status := 0, ""
+	for {
+		q.mu.Lock()
+		for len(j.Results) == seen && j.Status == status {
+			q.changed.Wait()
+		}
+		snapshot := *j
+		results := append([]jobResult(nil), j.Results[seen:]...)
+		snapshot.Results = nil
+		q.mu.Unlock()
+		seen, status = seen+len(results), snapshot.Status
+		if err := fn(snapshot, results); err != nil {
+			return err
+		}
+		if snapshot.Finished != nil {
+			return nil
+		}
+	}
+}
+
+func (q *jobQueue) run(ctx context.Context, j *job) {
+	defer j.cancel()
+	if err := q.running.Acquire(ctx, 1); err != nil {
+		q.finish(j, err)
+		return
+	}
+	defer q.running.Release(1)
+	q.update(j, func(j *job) {
+		now := time.Now()
+		j.Status, j.Started = "running", &now
+	})
+	logger.Infof("Started job %s", j.ID)
+	q.finish(j, q.execute(ctx, j))
+}
+
+func (q *jobQueue) finish(j *job, err error) {
+	var progress jobProgress
+	q.update(j, func(j *job) {
+		now := time.Now()
+		progress = j.Progress
+		j.Finished = &now
+		switch {
+		case err == context.Canceled:
+			j.Status = "cancelled"
+		case err != nil:
+			j.Status, j.Error = "failed", err.Error()
+		default:
+			j.Status = "done"
+		}
+	})
+	if err != nil {
+		logger.Errorf("Job %s %s: %v", j.ID, j.Status, err)
+		return
+	}
+	logger.Summaryf("Finished job %s: %d files compressed, %d failed", j.ID, progress.Done, progress.Failed)
+}
+
+// execute compresses the files of j that are new or changed since an
+// earlier job over the same folder.
+func (q *jobQueue) execute(ctx context.Context, j *job) error {
+	input, output := j.input, j.output
+	var remote *remoteRun
+	if storage.IsURL(input) || storage.IsURL(output) {
+		var err error
+		if remote, err = newRemoteRun(ctx, input, output, false, q.server.threads); err != nil {
+			return err
+		}
+		defer remote.cleanup()
+		if _, _, err := remote.stage(ctx, j.opts); err != nil {
+			return err
+		}
+		input, output = remote.inputDir, remote.outputDir
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = input
+		if !info.IsDir() {
+			output = filepath.Dir(input)
+		}
+	}
+	compressedFolder := filepath.Join(output, "compressed_files")
+	if err := os.MkdirAll(compressedFolder, 0755); err != nil {
+		return fmt.Errorf("failed to create compressed_files folder: %v", err)
+	}
+	manifest, err := compressor.OpenManifest(filepath.Join(compressedFolder, "manifest.jsonl"))
+	if err != nil {
+		return err
+	}
+	// Closed once the results are recorded, or on the way out before that
+	closed := false
+	closeManifest := func() error {
+		if closed {
+			return nil
+		}
+		closed = true
+		return manifest.Close()
+	}
+	defer closeManifest()
+	manifest.ChangeDetection = "mtime"
+
+	var files []compressor.PlannedFile
+	if info.IsDir() {
+		planned, err := compressor.Plan(input, compressedFolder, j.opts, manifest)
+		if err != nil {
+			return err
+		}
+		for _, file := range planned {
+			if file.Action == "compress" || file.Action == "overwrite" {
+				files = append(files, file)
+			}
+		}
+	} else if !manifest.Done(input) {
+		output := compressor.OutputPath(input, filepath.Dir(input), compressedFolder, j.opts.ConvertTo)
+		files = append(files, compressor.PlannedFile{Path: input, Output: output})
+	}
+	q.update(j, func(j *job) { j.Progress.Files = len(files) })
+
+	report := compressor.NewReport(j.Input, compressedFolder)
+	start := time.Now()
+	var wg sync.WaitGroup
+	queueDepth.Add(float64(len(files)))
+	for i, file := range files {
+		err := q.server.slots.Acquire(ctx, 1)
+		queueDepth.Dec()
+		if err != nil {
+			queueDepth.Sub(float64(len(files) - i - 1))
+			break
+		}
+		wg.Add(1)
+		go func(i int, file compressor.PlannedFile) {
+			defer wg.Done()
+			defer q.server.slots.Release(1)
+			result, _ := compressor.CompressFile(ctx, compressor.Job{Input: file.Path, Output: file.Output, Index: i + 1}, j.opts)
+			if ctx.Err() != nil {
+				return // interrupted files are not results
+			}
+			observeResult(result)
+			manifest.Record(result)
+			report.AddResult(result)
+			q.update(j, func(j *job) {
+				res := jobResult{Input: result.InputPath, Outputs: result.Outputs, InputSize: result.InputSize, OutputSize: result.OutputSize}
+				if result.Err != nil {
+					res.Error = result.Err.Error()
+					j.Progress.Failed++
+				} else {
+					j.Progress.Done++
+				}
+				j.Progress.InputSize += result.InputSize
+				j.Progress.OutputSize += result.OutputSize
+				j.Results = append(j.Results, res)
+			})
+		}(i, file)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	report.Duration = time.Since(start)
+	if len(files) == 0 {
+		return closeManifest() // keep the report of the job that did the work
+	}
+	if err := report.WriteJSON(filepath.Join(compressedFolder, "report.json")); err != nil {
+		return fmt.Errorf("failed to write report: %v", err)
+	}
+	if err := closeManifest(); err != nil {
+		return err
+	}
+	if remote != nil {
+		return remote.upload(ctx, compressedFolder, "")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelQuiet logLevel = iota // errors, warnings and the final summary only
+	levelInfo
+	levelDebug // -v: a line per file
+	levelTrace // -vv: workers, memory waits and every file started
+)
+
+// logFormats lists the -log-format values.
+var logFormats = map[string]bool{
+	"text": true,
+	"json": true,
+}
+
+// logFields are the details of an event, such as "path" or "input_size",
+// added to its JSON line.
+type logFields map[string]interface{}
+
+// leveledLogger prints the compress command's messages up to its level, as
+// text or as JSON lines. Lines go through print, which the progress display
+// replaces so they don't break up the bar.
+type leveledLogger struct {
+	level logLevel
+	json  bool
+	print func(format string, args ...interface{})
+}
+
+var logger = &leveledLogger{
+	level: levelInfo,
+	print: func(format string, args ...interface{}) { fmt.Printf(format, args...) },
+}
+
+func (l *leveledLogger) logf(level logLevel, name, event string, fields logFields, format string, args ...interface{}) {
+	if level > l.level {
+		return
+	}
+	if !l.json {
+		l.print(format+"\n", args...)
+		return
+	}
+	line := logFields{}
+	for key, value := range fields {
+		line[key] = value
+	}
+	line["time"] = time.Now().Format(time.RFC3339Nano)
+	line["level"] = name
+	line["msg"] = strings.TrimSpace(fmt.Sprintf(format, args...))
+	if event != "" {
+		line["event"] = event
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	l.print("%s\n", data)
+}
+
+func (l *leveledLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelQuiet, "error", "", nil, format, args...)
+}
+
+func (l *leveledLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelQuiet, "warn", "", nil, format, args...)
+}
+
+// Summaryf prints a line of the final summary, which -quiet keeps.
+func (l *leveledLogger) Summaryf(format string, args ...interface{}) {
+	l.logf(levelQuiet, "info", "", nil, format, args...)
+}
+
+func (l *leveledLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, "info", "", nil, format, args...)
+}
+
+func (l *leveledLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, "debug", "", nil, format, args...)
+}
+
+func (l *leveledLogger) Tracef(format string, args ...interface{}) {
+	l.logf(levelTrace, "trace", "", nil, format, args...)
+}
+
+// Event logs a named event such as "file_done" with its fields. As text it is
+// only the message, at level; JSON logs always carry the events (unless
+// -quiet), since they are what scripts read.
+func (l *leveledLogger) Event(level logLevel, event string, fields logFields, format string, args ...interface{}) {
+	name := "info"
+	switch {
+	case event == "file_failed":
+		name = "error"
+	case l.json && level > levelInfo:
+		level = levelInfo
+	}
+	l.logf(level, name, event, fields, format, args...)
+}
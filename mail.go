@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"image-compressor/pkg/compressor"
+)
+
+// mailSettings are the -smtp-server, -smtp-user, -mail-from, -mail-to and
+// -mail-html flags. The password comes from SMTP_PASSWORD.
+type mailSettings struct {
+	server string // host:port; port 465 is TLS from the start, others use STARTTLS when offered
+	user   string
+	from   string
+	to     []string
+	html   bool // also send the HTML report, as an alternative body
+}
+
+// mailReport sends the text report of a run ended by event, with the failed
+// files attached as failed_files.txt when there are any.
+func mailReport(settings mailSettings, event string, report *compressor.Report) error {
+	summary := report.Summary()
+	subject := fmt.Sprintf("Image compressor: %d compressed, %d failed in %s", summary.FilesCompressed, summary.FilesFailed, summary.Input)
+	if event != "completed" {
+		subject = fmt.Sprintf("Image compressor run %s: %d compressed, %d failed in %s", event, summary.FilesCompressed, summary.FilesFailed, summary.Input)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", settings.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(settings.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	mixed := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+
+	var body bytes.Buffer
+	alternative := multipart.NewWriter(&body)
+	if err := writeQuotedPart(alternative, "text/plain; charset=utf-8", []byte(report.Text())); err != nil {
+		return err
+	}
+	if settings.html {
+		var page bytes.Buffer
+		if err := report.RenderHTML(&page); err != nil {
+			return err
+		}
+		if err := writeQuotedPart(alternative, "text/html; charset=utf-8", page.Bytes()); err != nil {
+			return err
+		}
+	}
+	alternative.Close()
+	part, err := mixed.CreatePart(textproto.MIMEHeader{"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()}})
+	if err != nil {
+		return err
+	}
+	part.Write(body.Bytes())
+
+	if len(summary.Failures) > 0 {
+		var failed strings.Builder
+		for _, failure := range summary.Failures {
+			fmt.Fprintf(&failed, "%s: %s\n", failure.Input, failure.Error)
+		}
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Disposition":       {`attachment; filename="failed_files.txt"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return err
+		}
+		encoded := base64.StdEncoding.EncodeToString([]byte(failed.String()))
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	mixed.Close()
+
+	if err := sendMail(settings, msg.Bytes()); err != nil {
+		return fmt.Errorf("failed to mail the report: %v", err)
+	}
+	return nil
+}
+
+func writeQuotedPart(w *multipart.Writer, contentType string, data []byte) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}, "Content-Transfer-Encoding": {"quoted-printable"}})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write(data); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func sendMail(settings mailSettings, msg []byte) error {
+	host, port, err := net.SplitHostPort(settings.server)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if settings.user != "" {
+		auth = smtp.PlainAuth("", settings.user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	if port != "465" {
+		return smtp.SendMail(settings.server, auth, settings.from, settings.to, msg)
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", settings.server, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(settings.from); err != nil {
+		return err
+	}
+	for _, to := range settings.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -2,232 +2,295 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"image"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
+	"image-compressor/pkg/compressor"
+	"image-compressor/pkg/storage"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
-	"github.com/nfnt/resize"
-	"github.com/schollz/progressbar/v3"
-	"golang.org/x/image/font"
+	"github.com/go-text/typesetting/font"
+	"golang.org/x/sync/semaphore"
 )
 
 const maxPixels = 12000000 // 12 Megapixels
-const batchSize = 200      // Number of files to process in each batch
 
-func humanReadableSize(size int64) string {
-	const (
-		KB = 1024
-		MB = KB * 1024
-		GB = MB * 1024
-	)
-
-	switch {
-	case size >= GB:
-		return fmt.Sprintf("%.2f GB", float64(size)/float64(GB))
-	case size >= MB:
-		return fmt.Sprintf("%.2f MB", float64(size)/float64(MB))
-	case size >= KB:
-		return fmt.Sprintf("%.2f KB", float64(size)/float64(KB))
-	default:
-		return fmt.Sprintf("%d bytes", size)
-	}
-}
-
-func calculateTotalSizeAndCount(folderPath, outputFolder string) (int, int64, []string, error) {
-	var totalFiles int
-	var totalSize int64
-	var filePaths []string
-
-	err := filepath.Walk(folderPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() && (filepath.Base(path) == "compressed_files" || filepath.Base(path) == "processed_files" || path == outputFolder) {
-			return filepath.SkipDir
-		}
-
-		if !info.IsDir() && (strings.HasSuffix(strings.ToLower(info.Name()), ".jpg") || strings.HasSuffix(strings.ToLower(info.Name()), ".png")) {
-			compressedFilePath := filepath.Join(outputFolder, strings.TrimPrefix(path, folderPath))
-			compressedFilePath = strings.TrimSuffix(compressedFilePath, filepath.Ext(compressedFilePath)) + "_compressed" + filepath.Ext(compressedFilePath)
-			if _, err := os.Stat(compressedFilePath); os.IsNotExist(err) {
-				totalFiles++
-				totalSize += info.Size()
-				filePaths = append(filePaths, path)
-			}
-		}
+func moveOriginalFile(filePath, processedFolder, inputDir string) error {
+	relativePath := strings.TrimPrefix(filePath, inputDir)
+	newFilePath := filepath.Join(processedFolder, relativePath)
 
-		return nil
-	})
+	// Create the necessary directories
+	os.MkdirAll(filepath.Dir(newFilePath), os.ModePerm)
 
-	if err != nil {
-		return 0, 0, nil, fmt.Errorf("failed to walk the directory: %v", err)
-	}
+	return os.Rename(filePath, newFilePath)
+}
 
-	return totalFiles, totalSize, filePaths, nil
+// memoryBudget admits files while their estimated decoded size fits within
+// -max-memory. A nil budget admits everything.
+type memoryBudget struct {
+	sem   *semaphore.Weighted
+	limit int64
 }
 
-func addWatermark(img image.Image, text string, fontPath string) (image.Image, error) {
-	rgba := image.NewRGBA(img.Bounds())
-	draw.Draw(rgba, rgba.Bounds(), img, image.Point{}, draw.Src)
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{sem: semaphore.NewWeighted(limit), limit: limit}
+}
 
-	fontBytes, err := ioutil.ReadFile(fontPath)
-	if err != nil {
-		return nil, err
+// acquire blocks until path's estimated memory fits in the budget and returns
+// a func that gives it back. Files bigger than the whole budget (or whose size
+// can't be estimated) take all of it, so they run on their own.
+func (m *memoryBudget) acquire(ctx context.Context, path string) (func(), error) {
+	if m == nil {
+		return func() {}, nil
 	}
-
-	fnt, err := freetype.ParseFont(fontBytes)
-	if err != nil {
-		return nil, err
+	weight, err := compressor.EstimateMemory(path)
+	if err != nil || weight > m.limit {
+		weight = m.limit
 	}
+	if !m.sem.TryAcquire(weight) {
+		logger.Tracef("Waiting for %s of memory for %s", compressor.HumanReadableSize(weight), path)
+		if err := m.sem.Acquire(ctx, weight); err != nil {
+			return nil, err
+		}
+	}
+	return func() { m.sem.Release(weight) }, nil
+}
 
-	c := freetype.NewContext()
-	c.SetDPI(72)
-	c.SetFont(fnt)
-	c.SetFontSize(20)
-	c.SetClip(rgba.Bounds())
-	c.SetDst(rgba)
-	c.SetSrc(image.Black)
-	c.SetHinting(font.HintingNone)
+// queuedFile is a file waiting in the work queue, with its position in the run
+// and the output planned for it.
+type queuedFile struct {
+	index  int
+	path   string
+	output string
+}
 
-	// Measure the text dimensions
-	face := truetype.NewFace(fnt, &truetype.Options{Size: 20, DPI: 72})
-	d := &font.Drawer{
-		Face: face,
-	}
-	textBounds, _ := d.BoundString(text)
-	textWidth := (textBounds.Max.X - textBounds.Min.X).Ceil()
-	textHeight := (textBounds.Max.Y - textBounds.Min.Y).Ceil()
+func compressWorker(ctx context.Context, threadID int, queue <-chan queuedFile, outputDir, inputDir, processedFolder string, opts compressor.Options, memory *memoryBudget, manifest *compressor.Manifest, backups *compressor.BackupLog, deleteOriginals bool, prog *progress, report *compressor.Report) {
+	prog.workerf("Thread %d starting.", threadID)
 
-	pt := freetype.Pt(rgba.Bounds().Dx()-textWidth-10, rgba.Bounds().Dy()-textHeight+int(c.PointToFixed(20)>>6)-10)
+	processed := 0
+	for file := range queue {
+		queueDepth.Dec()
+		path := file.path
+		if info, err := os.Stat(path); err == nil {
+			if !info.IsDir() && compressor.IsSupportedImage(info.Name()) {
+				job := compressor.Job{
+					Input:     path,
+					Output:    file.output,
+					Thumbnail: filepath.Join(outputDir, "thumbs", strings.TrimPrefix(file.output, outputDir)),
+					Index:     file.index,
+				}
+				logger.Event(levelTrace, "file_started", logFields{"worker": threadID, "path": path, "input_size": info.Size()},
+					"Thread %d compressing %s", threadID, path)
+				release, err := memory.acquire(ctx, path)
+				if err != nil {
+					logger.Event(levelQuiet, "file_failed", logFields{"worker": threadID, "path": path, "input_size": info.Size(), "error": err.Error()},
+						"Thread %d failed to compress file %s: %v", threadID, path, err)
+					prog.fileDone(threadID, info.Size())
+					continue
+				}
+				result, err := compressor.CompressFile(ctx, job, opts)
+				release()
+				if err == nil && backups != nil {
+					if err = backups.ReplaceInPlace(&result, opts); err != nil {
+						result.Err = err
+					}
+				}
+				observeResult(result)
+				if err := manifest.Record(result); err != nil {
+					logger.Errorf("Thread %d failed to record file %s: %v", threadID, path, err)
+				} else if deleteOriginals && result.Err == nil {
+					// Only once the manifest has the output's checksum
+					if err := compressor.DeleteOriginal(&result); err != nil {
+						logger.Errorf("Thread %d kept original %s: %v", threadID, path, err)
+					}
+				}
+				report.AddResult(result)
+				processed++
+				prog.fileDone(threadID, info.Size())
 
-	_, err = c.DrawString(text, pt)
-	if err != nil {
-		return nil, err
+				if err == nil {
+					logger.Event(levelDebug, "file_done", logFields{
+						"worker":      threadID,
+						"path":        path,
+						"outputs":     result.Outputs,
+						"input_size":  result.InputSize,
+						"output_size": result.OutputSize,
+						"duration_ms": result.Duration.Milliseconds(),
+					}, "Compressed %s (%s to %s in %v)", path, compressor.HumanReadableSize(result.InputSize), compressor.HumanReadableSize(result.OutputSize), result.Duration.Round(time.Millisecond))
+					// An empty processedFolder leaves originals in place
+					if processedFolder != "" {
+						if err := moveOriginalFile(path, processedFolder, inputDir); err != nil {
+							logger.Errorf("Thread %d failed to move file %s: %v", threadID, path, err)
+						}
+					}
+				} else {
+					logger.Event(levelQuiet, "file_failed", logFields{"worker": threadID, "path": path, "input_size": result.InputSize, "duration_ms": result.Duration.Milliseconds(), "error": err.Error()},
+						"Thread %d failed to compress file %s: %v", threadID, path, err)
+				}
+			}
+		} else {
+			logger.Errorf("Thread %d failed to stat file %s: %v", threadID, path, err)
+			prog.fileDone(threadID, 0)
+		}
 	}
 
-	return rgba, nil
+	prog.workerf("Thread %d finished compressing %d images.", threadID, processed)
 }
 
-func compressImage(inputPath, outputPath string, maxPixels int, watermarkText, fontPath string) error {
-	file, err := os.Open(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to open image: %v", err)
+// linkDuplicates gives each duplicate the outputs of its first copy, once
+// that is compressed, and records it like a compressed file. Duplicates of
+// files that failed or were never started are left for the next run.
+func linkDuplicates(duplicates []compressor.Duplicate, mode, outputDir, inputDir, processedFolder string, opts compressor.Options, manifest *compressor.Manifest, deleteOriginals bool, report *compressor.Report) {
+	results := report.ResultsByInput()
+	for _, dup := range duplicates {
+		of, ok := results[dup.Of]
+		if !ok || of.Err != nil {
+			continue
+		}
+		thumbnail := filepath.Join(outputDir, "thumbs", strings.TrimPrefix(dup.Output, outputDir))
+		result, err := compressor.LinkDuplicate(dup, of, thumbnail, opts, mode)
+		if err != nil {
+			logger.Errorf("Failed to give duplicate %s the outputs of %s: %v", dup.Path, dup.Of, err)
+			continue
+		}
+		if err := manifest.Record(result); err != nil {
+			logger.Errorf("Failed to record file %s: %v", dup.Path, err)
+			continue
+		}
+		report.AddDuplicate(dup, mode)
+		logger.Debugf("Gave duplicate %s the outputs of %s", dup.Path, dup.Of)
+		switch {
+		case deleteOriginals:
+			if err := compressor.DeleteOriginal(&result); err != nil {
+				logger.Errorf("Kept original %s: %v", dup.Path, err)
+			}
+		case processedFolder != "":
+			if err := moveOriginalFile(dup.Path, processedFolder, inputDir); err != nil {
+				logger.Errorf("Failed to move file %s: %v", dup.Path, err)
+			}
+		}
 	}
-	defer file.Close()
+}
 
-	img, format, err := image.Decode(file)
+// printDryRun prints what a run over inputPath would do with each file and
+// the expected savings, and saves the same listing to reportPath. Nothing
+// else is written.
+func printDryRun(inputPath string, info os.FileInfo, compressedFolder, reportPath string, opts compressor.Options, resume bool, incremental string, pilot, threads int) error {
+	plan, err := describePlan(inputPath, info, compressedFolder, opts, resume, incremental, pilot, threads)
 	if err != nil {
-		return fmt.Errorf("failed to decode image: %v", err)
+		return err
 	}
-
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-	totalPixels := width * height
-
-	var newImg image.Image
-	if totalPixels > maxPixels {
-		scaleFactor := float64(maxPixels) / float64(totalPixels)
-		newWidth := uint(float64(width) * scaleFactor)
-		newHeight := uint(float64(height) * scaleFactor)
-		newImg = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
-	} else {
-		newImg = img
+	report := "Dry run: no files were written\n\n" + plan
+	fmt.Print(report)
+	if err := os.WriteFile(reportPath, []byte(report), 0644); err != nil {
+		return fmt.Errorf("failed to write dry run report: %v", err)
 	}
+	fmt.Printf("Dry run report written to %s\n", reportPath)
+	return nil
+}
 
-	if watermarkText != "" {
-		// Add watermark
-		newImg, err = addWatermark(newImg, watermarkText, fontPath)
+// describePlan lists what a run over inputPath would do with each file,
+// followed by totals and the expected savings, estimated from pilot files
+// compressed with threads workers.
+func describePlan(inputPath string, info os.FileInfo, compressedFolder string, opts compressor.Options, resume bool, incremental string, pilot, threads int) (string, error) {
+	var manifest *compressor.Manifest
+	if resume || incremental != "" {
+		m, err := compressor.LoadManifest(filepath.Join(compressedFolder, "manifest.jsonl"))
 		if err != nil {
-			return fmt.Errorf("failed to add watermark: %v", err)
+			return "", err
 		}
+		m.ChangeDetection = incremental
+		manifest = m
 	}
 
-	outFile, err := os.Create(outputPath)
+	files, err := compressor.Plan(inputPath, compressedFolder, opts, manifest)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return "", err
 	}
-	defer outFile.Close()
 
-	switch format {
-	case "jpeg":
-		err = jpeg.Encode(outFile, newImg, &jpeg.Options{Quality: 80})
-	case "png":
-		err = png.Encode(outFile, newImg)
-	default:
-		return fmt.Errorf("unsupported image format: %s", format)
+	var b strings.Builder
+	var compress, overwrite, skip, tooSmall, links int
+	var totalSize int64
+	var paths []string
+	for _, file := range files {
+		// A single input file is compressed even when its output exists
+		if !info.IsDir() && file.Reason == "output exists" {
+			file.Action, file.Reason = "overwrite", ""
+		}
+		switch file.Action {
+		case "skip":
+			skip++
+			if file.TooSmall {
+				tooSmall++
+			}
+			fmt.Fprintf(&b, "  skip      %s (%s)\n", file.Path, file.Reason)
+			continue
+		case "link":
+			links++
+			fmt.Fprintf(&b, "  link      %s -> %s (to %s)\n", file.Path, file.Output, file.Link)
+			continue
+		case "overwrite":
+			overwrite++
+		}
+		compress++
+		totalSize += file.Size
+		paths = append(paths, file.Path)
+		fmt.Fprintf(&b, "  %-9s %s -> %s\n", file.Action, file.Path, file.Output)
+		if file.Conflict != "" {
+			fmt.Fprintf(&b, "            (renamed: same output as %s)\n", file.Conflict)
+		}
 	}
 
-	if err != nil {
-		return fmt.Errorf("failed to encode image: %v", err)
+	fmt.Fprintf(&b, "\nFiles to be compressed: %d (%d overwriting existing outputs)\n", compress, overwrite)
+	if tooSmall > 0 {
+		fmt.Fprintf(&b, "Files skipped: %d (%d too small)\n", skip, tooSmall)
+	} else {
+		fmt.Fprintf(&b, "Files skipped: %d\n", skip)
 	}
-
-	return nil
-}
-
-func moveOriginalFile(filePath, processedFolder, inputDir string) error {
-	relativePath := strings.TrimPrefix(filePath, inputDir)
-	newFilePath := filepath.Join(processedFolder, relativePath)
-
-	// Create the necessary directories
-	os.MkdirAll(filepath.Dir(newFilePath), os.ModePerm)
-
-	return os.Rename(filePath, newFilePath)
-}
-
-func compressImages(threadID int, files []string, outputDir, inputDir, processedFolder, watermarkText, fontPath string, maxPixels int, bar *progressbar.ProgressBar) {
-	fmt.Printf("Thread %d starting to compress %d images.\n", threadID, len(files))
-
-	filesPerBatch := batchSize
-	if len(files) < batchSize {
-		filesPerBatch = len(files)
+	if links > 0 {
+		fmt.Fprintf(&b, "Symlinks copied: %d\n", links)
 	}
+	fmt.Fprintf(&b, "Total size of current files: %s\n", compressor.HumanReadableSize(totalSize))
+	for _, line := range estimateSavings(paths, totalSize, opts, pilot, threads) {
+		fmt.Fprintln(&b, line)
+	}
+	return b.String(), nil
+}
 
-	for i := 0; i < len(files); i += filesPerBatch {
-		end := i + filesPerBatch
-		if end > len(files) {
-			end = len(files)
-		}
-		batch := files[i:end]
-		fmt.Printf("Thread %d processing batch of %d files.\n", threadID, len(batch))
-		for _, path := range batch {
-			if info, err := os.Stat(path); err == nil {
-				if !info.IsDir() && (strings.HasSuffix(strings.ToLower(info.Name()), ".jpg") || strings.HasSuffix(strings.ToLower(info.Name()), ".png")) {
-					relativePath := strings.TrimPrefix(path, inputDir)
-					outputFile := filepath.Join(outputDir, relativePath)
-					outputFile = strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + "_compressed" + filepath.Ext(outputFile)
-
-					// Create the necessary directories
-					os.MkdirAll(filepath.Dir(outputFile), os.ModePerm)
-
-					if err := compressImage(path, outputFile, maxPixels, watermarkText, fontPath); err == nil {
-						bar.Add(1)
-						if err := moveOriginalFile(path, processedFolder, inputDir); err != nil {
-							fmt.Printf("Thread %d failed to move file %s: %v\n", threadID, path, err)
-						}
-					} else {
-						fmt.Printf("Thread %d failed to compress file %s: %v\n", threadID, path, err)
-					}
-				}
-			} else {
-				fmt.Printf("Thread %d failed to stat file %s: %v\n", threadID, path, err)
+// estimateSavings describes the expected output size and time of compressing
+// paths, totalSize bytes, from a pilot pass over pilot of them, or guesses
+// half the size without one.
+func estimateSavings(paths []string, totalSize int64, opts compressor.Options, pilot, threads int) []string {
+	var lines []string
+	if pilot > 0 && len(paths) > 0 {
+		est, err := compressor.EstimateRun(paths, totalSize, opts, pilot, threads)
+		if err == nil {
+			lines = append(lines,
+				fmt.Sprintf("Approximate size after conversion: %s (saving %s; %.0f%% of the size of %d sample files)", compressor.HumanReadableSize(est.Size), compressor.HumanReadableSize(totalSize-est.Size), est.Ratio*100, est.Sampled-est.Failed),
+				fmt.Sprintf("Estimated time required: %v", est.Duration.Round(time.Second)))
+			if est.Failed > 0 {
+				lines = append(lines, fmt.Sprintf("Sample files that failed to compress: %d", est.Failed))
 			}
+			return lines
 		}
+		lines = append(lines, fmt.Sprintf("No estimate from the sample (%v); guessing half the size", err))
 	}
-
-	fmt.Printf("Thread %d finished compressing %d images.\n", threadID, len(files))
+	approxSize := totalSize / 2
+	return append(lines, fmt.Sprintf("Approximate size after conversion: %s (saving %s)", compressor.HumanReadableSize(approxSize), compressor.HumanReadableSize(totalSize-approxSize)))
 }
 
 func getConfirmation() bool {
@@ -248,112 +311,1436 @@ func getConfirmation() bool {
 	}
 }
 
-func main() {
-	var maxPixels, numThreads int
-	var outputDir, watermarkText, fontPath string
-	var skipConfirmation bool
-	flag.IntVar(&maxPixels, "s", 12000000, "maximum number of pixels for the resized image")
-	flag.IntVar(&numThreads, "t", 10, "number of threads")
-	flag.StringVar(&outputDir, "d", "", "directory to save compressed images")
-	flag.StringVar(&watermarkText, "w", "", "watermark text")
-	flag.StringVar(&fontPath, "f", "InkType.ttf", "path to the font file")
-	flag.BoolVar(&skipConfirmation, "y", false, "skip confirmation")
-	flag.Parse()
+// runCompress implements the compress command, which is also what runs when
+// no command is named.
+func runCompress(args []string) {
+	compressCommand("compress", args)
+}
 
-	if len(flag.Args()) < 1 {
-		fmt.Println("Usage: image-compressor -s <maxPixels> -t <numThreads> -d <outputDir> -w <watermarkText> -f <fontPath> -y <path>")
-		return
+// runWatch implements the watch command: compress's flags plus -debounce and
+// -metrics-addr, with a compress run over the folder every time new images
+// have settled.
+func runWatch(args []string) {
+	compressCommand("watch", args)
+}
+
+// runRetry implements the retry command: compress's flags, run on only the
+// files a report or manifest lists as failed.
+func runRetry(args []string) {
+	compressCommand("retry", args)
+}
+
+func compressCommand(name string, args []string) {
+	watching := name == "watch"
+	retrying := name == "retry"
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	var debounce time.Duration
+	var metricsAddr string
+	if watching {
+		fs.DurationVar(&debounce, "debounce", 2*time.Second, "how long the folder must see no new writes before a run starts, so files still being copied are left for the next one")
+		fs.StringVar(&metricsAddr, "metrics-addr", "", "address to serve Prometheus metrics on at /metrics while watching, e.g. :9100")
 	}
+	var maxPixels, maxWidth, maxHeight, numThreads, quality, watermarkMargin, watermarkSpacing, outlineWidth, shadowOffset, progressFiles, minPixels, notifyFailures, retries, skipNear, tilePixels, pilot, colors, gifColors, pdfDPI int
+	var progressInterval, retryDelay time.Duration
+	var ssimTarget, watermarkScale, watermarkOpacity, watermarkAngle, denoise float64
+	var scaleFlag, sizesFlag, thumbs, archiveOutput, filterName, engine, jpegEncoder, chroma, crop, cropGravity, outputDir, watermarkText, fontPath, rawMode, convertTo, background, pngCompression, pngOptimize, outsideSymlinks, include, exclude, includeRegex, excludeRegex, incremental, dedupe, configPath, reportFormat, webhookURL, smtpServer, smtpUser, mailFrom, mailTo, notifyChats, progressMode, logFormat, targetSize, maxMemory, minSize, since, until, dateFrom, stripMetadata, watermarkImagePath, watermarkPosition, watermarkSizeFlag, watermarkColor, outlineColor, shadowColor, autoContrast, nameTemplate, exifConditions, sharpenFlag, adjustFlag, dither, placeholders, pdfPath, pdfPageSize string
+	var skipConfirmation, keepMetadata, autoOrient, convertToSRGB, watermarkTile, progressive, lossless, resume, dryRun, htmlReport, perWorker, verbose, veryVerbose, quiet, preserveOwner, followSymlinks, inPlace, deleteOriginals, mailHTML, verify, qualityMetrics, organizeByDate, flatten, grayscale, autoEnhance bool
+	fs.IntVar(&maxPixels, "s", 12000000, "maximum number of pixels for the resized image")
+	fs.IntVar(&maxWidth, "max-width", 0, "maximum width in pixels of the resized image (0 for no limit)")
+	fs.IntVar(&maxHeight, "max-height", 0, "maximum height in pixels of the resized image (0 for no limit)")
+	fs.StringVar(&scaleFlag, "scale", "", "downscale every image by a percentage, e.g. 50%")
+	fs.StringVar(&sizesFlag, "sizes", "", "comma separated widths of responsive variants written for every image instead of one output, e.g. 320,640,1280")
+	fs.StringVar(&thumbs, "thumbs", "", "also write a WIDTHxHEIGHT cropped thumbnail of every image into a thumbs folder in the output directory, e.g. 200x200")
+	fs.StringVar(&crop, "crop", "", "scale and center-crop every image to exactly WIDTHxHEIGHT, e.g. 400x300")
+	fs.StringVar(&cropGravity, "crop-gravity", "center", "part of the image kept by -crop: center, top, bottom, left, right, tl, tr, bl or br")
+	fs.StringVar(&engine, "engine", "go", "image pipeline: go, vips for faster decode, resize and encode (needs a build with -tags vips; other features fall back to go), or gpu to resize on an OpenCL GPU (needs a build with -tags gpu; falls back to the CPU)")
+	fs.StringVar(&jpegEncoder, "jpeg-encoder", "std", "jpeg encoder: std (image/jpeg) or mozjpeg (runs mozjpeg's cjpeg from PATH; slower, smaller files)")
+	fs.StringVar(&chroma, "chroma", "420", "jpeg chroma subsampling: 444 (sharp text and edges), 422 or 420 (smallest, fine for photos); other than 420 needs -jpeg-encoder mozjpeg")
+	fs.BoolVar(&progressive, "progressive", false, "write progressive jpegs (needs -jpeg-encoder mozjpeg or -lossless)")
+	fs.BoolVar(&lossless, "lossless", false, "never change pixels: only optimize jpeg entropy coding (with jpegtran from PATH), re-deflate pngs and apply the metadata options")
+	fs.StringVar(&filterName, "filter", "lanczos3", "resampling filter: nearest, bilinear, bicubic, lanczos2 or lanczos3 (slowest, sharpest)")
+	fs.IntVar(&tilePixels, "tile-pixels", 50000000, "resample images of at least this many pixels in strips on every CPU at once, so a huge panorama does not wait on one core (0 to never)")
+	fs.IntVar(&numThreads, "t", 10, "number of worker threads pulling files from a shared queue")
+	fs.IntVar(&retries, "retries", 0, "retry files failing with transient IO errors (such as EIO or ETIMEDOUT on a network share) this many times; undecodable images are not retried")
+	fs.DurationVar(&retryDelay, "retry-delay", 2*time.Second, "wait before the first retry, doubled for each one after")
+	fs.BoolVar(&verify, "verify", false, "read back and fully decode every output once written, checking its dimensions; files failing this are reported as failed and leave no outputs")
+	fs.IntVar(&quality, "q", 80, "JPEG quality (1-100)")
+	fs.StringVar(&maxMemory, "max-memory", "", "memory budget for images being compressed at once, e.g. 4GB; large images wait for room instead of running in parallel")
+	fs.StringVar(&targetSize, "target-size", "", "maximum output file size, e.g. 500KB; quality is searched (and the image downscaled) to fit")
+	fs.Float64Var(&ssimTarget, "ssim-target", 0, "pick the lowest JPEG quality whose SSIM against the source is at least this value (e.g. 0.95)")
+	fs.BoolVar(&qualityMetrics, "quality-metrics", false, "measure the SSIM and PSNR of every output against the resized source and list them in the report (slower)")
+	fs.StringVar(&pngOptimize, "png-optimize", "off", "png optimization: off, lossless (palette/grayscale when exact, best compression) or lossy (also quantizes to 256 colors)")
+	fs.IntVar(&colors, "colors", 0, "quantize png and gif output to a palette of at most this many colors (2-256), e.g. 256 for screenshots and diagrams")
+	fs.StringVar(&dither, "dither", "floyd-steinberg", "dithering when quantizing with -colors or -gif-colors: floyd-steinberg or none")
+	fs.StringVar(&pngCompression, "png-compression", "default", "PNG compression level: default, none, speed or best")
+	fs.IntVar(&gifColors, "gif-colors", 256, "GIF palette size (2-256); fewer colors make smaller gifs, which -colors overrides")
+	fs.StringVar(&outputDir, "d", "", "directory, or s3://, gs://, az:// or sftp:// URL, to save compressed images")
+	fs.StringVar(&watermarkText, "w", "", "watermark text; may contain {filename}, {basename}, {dir}, {date} and {index}")
+	fs.StringVar(&fontPath, "f", "", "comma separated TrueType/OpenType font files; characters missing from one font are taken from the next, with the embedded Go Regular font as the last fallback")
+	fs.StringVar(&watermarkImagePath, "watermark-image", "", "PNG logo to composite over each image")
+	fs.Float64Var(&watermarkScale, "watermark-image-scale", 0.15, "logo width as a fraction of the image width")
+	fs.StringVar(&watermarkPosition, "watermark-position", "br", "watermark placement: tl, tr, bl, br or center")
+	fs.IntVar(&watermarkMargin, "watermark-margin", 10, "watermark distance in pixels from the image edges")
+	fs.StringVar(&watermarkSizeFlag, "watermark-size", "20", "watermark font size in points, or a percentage of the image width (e.g. 5%)")
+	fs.StringVar(&watermarkColor, "watermark-color", "#000000", "watermark text color")
+	fs.Float64Var(&watermarkOpacity, "watermark-opacity", 1, "watermark opacity from 0 to 1")
+	fs.IntVar(&outlineWidth, "watermark-outline", 0, "width in pixels of an outline drawn around the watermark text")
+	fs.StringVar(&outlineColor, "watermark-outline-color", "#ffffff", "watermark outline color")
+	fs.IntVar(&shadowOffset, "watermark-shadow", 0, "offset in pixels of a drop shadow behind the watermark text")
+	fs.StringVar(&shadowColor, "watermark-shadow-color", "#00000099", "watermark drop shadow color")
+	fs.StringVar(&autoContrast, "watermark-auto-contrast", "off", "adapt the watermark to the image: off, color (black or white text by brightness) or box (translucent backing box)")
+	fs.BoolVar(&watermarkTile, "watermark-tile", false, "repeat the watermark text diagonally across the whole image")
+	fs.Float64Var(&watermarkAngle, "watermark-angle", 30, "rotation of the tiled watermark in degrees")
+	fs.IntVar(&watermarkSpacing, "watermark-spacing", 100, "pixels between repeats of the tiled watermark")
+	fs.StringVar(&rawMode, "raw", "preview", "how to decode camera RAW files: preview (embedded JPEG) or full (demosaic via dcraw)")
+	fs.StringVar(&convertTo, "convert-to", "", "output format (jpeg, png or gif; webp cannot be written, for lack of an encoder); defaults to the input format")
+	fs.StringVar(&background, "background", "#ffffff", "background color used to flatten transparency when the output cannot store alpha (jpeg, and gif from other formats)")
+	fs.BoolVar(&keepMetadata, "keep-metadata", true, "copy EXIF metadata and the color profile from the source into the compressed image")
+	fs.BoolVar(&autoOrient, "auto-orient", true, "rotate pixels according to the EXIF orientation and reset the tag")
+	fs.BoolVar(&convertToSRGB, "convert-to-srgb", false, "convert images with an embedded RGB color profile to sRGB")
+	fs.Float64Var(&denoise, "denoise", 0, "strength of a bilateral noise filter applied after resizing, in 8-bit levels of noise to smooth out, e.g. 8 (0 disables it)")
+	fs.BoolVar(&autoEnhance, "auto-enhance", false, "stretch the levels of each color channel to the full range after resizing, which also balances white, e.g. for old scanned photos")
+	fs.StringVar(&adjustFlag, "adjust", "", "tone adjustments applied after resizing, e.g. brightness=5,contrast=10,gamma=1.1,saturation=-20 (brightness, contrast and saturation in percent from -100 to 100)")
+	fs.StringVar(&sharpenFlag, "sharpen", "", "unsharp mask applied after resizing, as amount,radius,threshold, e.g. 0.8,1,2 (amount 1 is 100%, radius in pixels, threshold 0-255)")
+	fs.BoolVar(&grayscale, "grayscale", false, "convert images to 8-bit grayscale before encoding, e.g. for scanned documents")
+	fs.StringVar(&placeholders, "placeholders", "", "comma separated lazy loading placeholders to compute for every output, blurhash and/or lqip (a tiny base64 JPEG), written to placeholders.json")
+	fs.StringVar(&pdfPath, "pdf", "", "also pack the compressed images into this PDF, one image per page in the order they were compressed")
+	fs.StringVar(&pdfPageSize, "pdf-page-size", "fit", "page size of -pdf: fit (each page the size of its image), a3, a4, a5, letter or legal")
+	fs.IntVar(&pdfDPI, "pdf-dpi", 300, "resolution images are placed at in -pdf; larger ones are shrunk to fit the page")
+	fs.StringVar(&stripMetadata, "strip-metadata", "", "comma separated metadata to remove: gps, serial, exif, xmp, iptc, icc or all")
+	fs.BoolVar(&resume, "resume", false, "continue an interrupted run: redo every file not recorded as done in manifest.jsonl, including half-written outputs")
+	fs.StringVar(&dedupe, "dedupe", "off", "compress identical sources once and give the others its outputs: off, hardlink, symlink or copy")
+	fs.IntVar(&skipNear, "skip-near-duplicates", 0, "only compress the largest image of each set of near-duplicates, such as burst shots, whose perceptual hashes (dhash) differ in at most this many of 64 bits, e.g. 6; 0 compresses them all")
+	fs.StringVar(&incremental, "incremental", "", "only compress new or changed files, detected by mtime (size and modification time) or hash (size and SHA-256) against manifest.jsonl; originals are left in place")
+	fs.BoolVar(&inPlace, "in-place", false, "replace each original with its compressed version, keeping a copy in a backup_files folder of the output directory for \"image-compressor undo\"")
+	fs.StringVar(&archiveOutput, "archive-output", "", "write the compressed files, with their relative paths, and the report into this .zip, .tar, .tar.gz or .tgz archive instead of a compressed_files folder")
+	fs.BoolVar(&deleteOriginals, "delete-originals", false, "delete each original once its outputs are written, synced to disk and decoded again, instead of moving it to processed_files; deleted paths are listed in the report")
+	fs.BoolVar(&dryRun, "dry-run", false, "list which files would be compressed, overwritten or skipped and the estimated savings, without writing any output")
+	fs.StringVar(&reportFormat, "report-format", "text", "format of the run report in the compressed_files folder: text (report.txt), json (report.json) or csv (report.csv, one row per file)")
+	fs.StringVar(&webhookURL, "webhook-url", "", "POST a JSON summary of each run (totals, savings, failed files, duration and report path) to this URL when it finishes or is interrupted")
+	fs.StringVar(&mailTo, "mail-to", "", "comma separated addresses to email the report of each run to, with any failed files attached, through -smtp-server")
+	fs.StringVar(&mailFrom, "mail-from", "", "sender address of the report emails (Default: -smtp-user)")
+	fs.BoolVar(&mailHTML, "mail-html", false, "also send the HTML report in report emails, as an alternative to the text one")
+	fs.StringVar(&smtpServer, "smtp-server", "", "host:port of the SMTP server for -mail-to; port 465 uses TLS, others STARTTLS when offered")
+	fs.StringVar(&smtpUser, "smtp-user", "", "SMTP user name, with the password in SMTP_PASSWORD; the server must offer TLS")
+	fs.StringVar(&notifyChats, "notify", "", "post a one-line summary of each run to chat webhooks, comma separated kind=url with kind slack, discord or teams")
+	fs.IntVar(&notifyFailures, "notify-failures", 0, "only send -notify messages for runs with at least this many failed files; 0 for every run")
+	fs.StringVar(&progressMode, "progress", "auto", "progress display: bar, plain (a text line every -progress-interval, for logs and CI) or auto (plain when stdout is not a terminal) or off")
+	fs.DurationVar(&progressInterval, "progress-interval", 10*time.Second, "time between plain progress lines; 0 for none")
+	fs.IntVar(&progressFiles, "progress-files", 0, "also print a plain progress line every this many files; 0 for none")
+	fs.BoolVar(&verbose, "v", false, "verbose: also log every file compressed")
+	fs.BoolVar(&veryVerbose, "vv", false, "more verbose: also log workers, memory waits and every file started")
+	fs.BoolVar(&quiet, "quiet", false, "only print errors, warnings and the final summary, without progress")
+	fs.StringVar(&logFormat, "log-format", "text", "log format: text, or json for one JSON line per event (file_started, file_done, file_failed, run_summary) with no progress display")
+	fs.BoolVar(&perWorker, "per-worker", false, "show a progress bar and status lines per worker instead of one overall bar")
+	fs.StringVar(&include, "include", "", "comma separated globs of the files to compress, relative to the input folder, e.g. **/*.jpg; ** matches any number of folders and a pattern without / matches file names")
+	fs.StringVar(&exclude, "exclude", "", "comma separated globs of files to leave out, e.g. **/thumbnails/**,*.png; folders matched with /** are not walked")
+	fs.StringVar(&includeRegex, "include-regex", "", "regular expression the relative path of every compressed file must match")
+	fs.StringVar(&excludeRegex, "exclude-regex", "", "regular expression of relative paths to leave out")
+	fs.StringVar(&minSize, "min-size", "", "skip files smaller than this, e.g. 200KB, which rarely get smaller")
+	fs.IntVar(&minPixels, "min-pixels", 0, "skip images with fewer pixels than this, e.g. 40000 for 200x200; 0 for no limit")
+	fs.StringVar(&since, "since", "", "only compress files dated on or after this, e.g. 2023-01-01 or 2023-01-01T18:00:00")
+	fs.StringVar(&until, "until", "", "only compress files dated up to this; a date without a time includes the whole day")
+	fs.StringVar(&dateFrom, "date-from", "mtime", "date compared by -since and -until: mtime (modification time) or exif (capture time, falling back to mtime)")
+	fs.StringVar(&nameTemplate, "name-template", "", "name outputs after this template instead of the source, e.g. \"{basename}_{width}x{height}_q{quality}.{ext}\"; placeholders are {basename}, {filename}, {dir}, {ext}, {width}, {height}, {quality}, {index} and {date}")
+	fs.BoolVar(&flatten, "flatten", false, "put every output directly in compressed_files instead of mirroring the input folders, numbering clashing names, and list where each original went in output_map.csv")
+	fs.BoolVar(&organizeByDate, "organize-by-date", false, "put outputs in YYYY/MM/DD folders of compressed_files by EXIF DateTimeOriginal (falling back to mtime) instead of mirroring the input folders")
+	fs.StringVar(&exifConditions, "exif", "", "only compress images whose EXIF fields meet all of these comma separated conditions, e.g. \"Model=Canon EOS R5,ISO>3200\"")
+	fs.BoolVar(&followSymlinks, "follow-symlinks", false, "also walk symlinked folders, skipping links that loop back into a folder being walked")
+	fs.StringVar(&outsideSymlinks, "outside-symlinks", "skip", "with -follow-symlinks, what to do with links pointing outside the input folder: skip, copy-link (recreate the link in the output folder) or follow")
+	fs.BoolVar(&preserveOwner, "preserve-owner", false, "give outputs and created directories the owner and group of their sources (needs root); permission bits are always copied")
+	fs.BoolVar(&htmlReport, "html-report", false, "also write report.html, a sortable table of the files with before/after previews to compare quality")
+	fs.StringVar(&configPath, "config", "", "YAML file of flag values, e.g. quality: 85; defaults to "+defaultConfigFile+" in the working directory if present, and flags given on the command line win")
+	fs.BoolVar(&skipConfirmation, "y", false, "skip confirmation")
+	fs.IntVar(&pilot, "pilot", 20, "before asking for confirmation (and in -dry-run), compress this many files picked at random in memory to estimate the output size and time; 0 guesses half the size")
+	fs.Parse(args)
 
-	inputPath := flag.Arg(0)
-	info, err := os.Stat(inputPath)
-	if err != nil {
-		fmt.Printf("Error accessing the path: %v\n", err)
-		return
+	if configPath == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			configPath = defaultConfigFile
+		}
+	}
+	if configPath != "" {
+		if err := loadConfig(fs, configPath); err != nil {
+			fmt.Printf("Invalid config %s: %v\n", configPath, err)
+			return
+		}
 	}
 
-	if outputDir == "" {
-		outputDir = inputPath
+	switch {
+	case quiet:
+		logger.level = levelQuiet
+		progressMode = "off"
+	case veryVerbose:
+		logger.level = levelTrace
+	case verbose:
+		logger.level = levelDebug
+	}
+	if !logFormats[logFormat] {
+		fmt.Printf("Invalid log format %q: must be text or json\n", logFormat)
+		return
+	}
+	if logFormat == "json" {
+		logger.json = true
+		progressMode = "off"
 	}
 
-	compressedFolder := filepath.Join(outputDir, "compressed_files")
-	processedFolder := filepath.Join(outputDir, "processed_files")
-	err = os.MkdirAll(compressedFolder, 0755)
-	if err != nil {
-		fmt.Printf("Failed to create compressed_files folder: %v\n", err)
+	if !compressor.SymlinkPolicies[outsideSymlinks] {
+		fmt.Printf("Invalid outside symlinks policy %q: must be skip, copy-link or follow\n", outsideSymlinks)
 		return
 	}
-	err = os.MkdirAll(processedFolder, 0755)
+	fileFilter, err := pathFilter(include, exclude, includeRegex, excludeRegex)
 	if err != nil {
-		fmt.Printf("Failed to create processed_files folder: %v\n", err)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if denoise < 0 || denoise > 100 {
+		fmt.Printf("Invalid denoise strength %g: must be between 0 and 100\n", denoise)
+		return
+	}
+	var adjust *compressor.Adjust
+	if adjustFlag != "" {
+		if adjust, err = compressor.ParseAdjust(adjustFlag); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	var sharpen compressor.Sharpen
+	if sharpenFlag != "" {
+		if sharpen, err = compressor.ParseSharpen(sharpenFlag); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	var exifFilter *compressor.ExifFilter
+	if exifConditions != "" {
+		if exifFilter, err = compressor.ParseExifFilter(exifConditions); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	if preserveOwner && os.Geteuid() != 0 {
+		fmt.Println("-preserve-owner needs root: only root can give files to other users")
 		return
 	}
 
-	var totalFiles int
-	var totalSize int64
-	var filePaths []string
+	if numThreads < 1 {
+		fmt.Printf("Invalid thread count %d: must be at least 1\n", numThreads)
+		return
+	}
+	if retries < 0 || retryDelay < 0 {
+		fmt.Printf("Invalid retries %d or retry delay %v: must not be negative\n", retries, retryDelay)
+		return
+	}
+	if maxWidth < 0 || maxHeight < 0 {
+		fmt.Printf("Invalid max width %d or height %d: must not be negative\n", maxWidth, maxHeight)
+		return
+	}
+	var scale float64
+	if scaleFlag != "" {
+		ratio, err := compressor.ParseScale(scaleFlag)
+		if err != nil {
+			fmt.Printf("Invalid scale %q: must be a percentage between 0 and 100\n", scaleFlag)
+			return
+		}
+		scale = ratio
+	}
+	var sizes []int
+	if sizesFlag != "" {
+		for _, field := range strings.Split(sizesFlag, ",") {
+			width, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || width <= 0 {
+				fmt.Printf("Invalid sizes %q: must be comma separated widths in pixels\n", sizesFlag)
+				return
+			}
+			sizes = append(sizes, width)
+		}
+	}
+	var thumbWidth, thumbHeight int
+	if thumbs != "" {
+		w, h, err := compressor.ParseDimensions(thumbs)
+		if err != nil {
+			fmt.Printf("Invalid thumbs %q: must be WIDTHxHEIGHT\n", thumbs)
+			return
+		}
+		thumbWidth, thumbHeight = w, h
+	}
+	var cropWidth, cropHeight int
+	if crop != "" {
+		w, h, err := compressor.ParseDimensions(crop)
+		if err != nil {
+			fmt.Printf("Invalid crop %q: must be WIDTHxHEIGHT\n", crop)
+			return
+		}
+		cropWidth, cropHeight = w, h
+	}
+	if _, ok := compressor.CropGravities[cropGravity]; !ok {
+		fmt.Printf("Invalid crop gravity %q: must be center, top, bottom, left, right, tl, tr, bl or br\n", cropGravity)
+		return
+	}
+	filter, ok := compressor.ResizeFilters[filterName]
+	if !ok {
+		fmt.Printf("Invalid filter %q: must be nearest, bilinear, bicubic, lanczos2 or lanczos3\n", filterName)
+		return
+	}
+	if tilePixels < 0 {
+		fmt.Printf("Invalid tile pixels %d: must be at least 0\n", tilePixels)
+		return
+	}
+	if pilot < 0 {
+		fmt.Printf("Invalid pilot sample %d: must be at least 0\n", pilot)
+		return
+	}
+	if !compressor.Engines[engine] {
+		fmt.Printf("Invalid engine %q: must be go, vips or gpu\n", engine)
+		return
+	}
+	engineSetting := engine
+	if engine == "vips" && !compressor.VipsAvailable() {
+		logger.Warnf("This build has no vips support; falling back to the go engine")
+		engineSetting = "go (vips not available in this build)"
+	}
+	if engine == "gpu" {
+		if !compressor.GPUAvailable() {
+			logger.Warnf("This build has no gpu support; resizing on the CPU")
+			engineSetting = "go (gpu not available in this build)"
+		} else if device, err := compressor.GPUDevice(); err != nil {
+			logger.Warnf("No usable GPU (%v); resizing on the CPU", err)
+			engineSetting = "go (no usable gpu)"
+		} else {
+			engineSetting = fmt.Sprintf("gpu (%s)", device)
+		}
+	}
+	if !compressor.JPEGEncoders[jpegEncoder] {
+		fmt.Printf("Invalid jpeg encoder %q: must be std or mozjpeg\n", jpegEncoder)
+		return
+	}
+	if _, ok := compressor.ChromaSubsampling[chroma]; !ok {
+		fmt.Printf("Invalid chroma %q: must be 444, 422 or 420\n", chroma)
+		return
+	}
+	if chroma != "420" && jpegEncoder != "mozjpeg" {
+		fmt.Println("-chroma 444 and 422 need -jpeg-encoder mozjpeg: image/jpeg always subsamples 4:2:0")
+		return
+	}
+	if progressive && jpegEncoder != "mozjpeg" && !lossless {
+		fmt.Println("-progressive needs -jpeg-encoder mozjpeg or -lossless: image/jpeg only writes baseline jpegs")
+		return
+	}
+	if incremental != "" && !compressor.ChangeDetectionModes[incremental] {
+		fmt.Printf("Invalid incremental mode %q: must be mtime or hash\n", incremental)
+		return
+	}
+	if !compressor.DedupeModes[dedupe] {
+		fmt.Printf("Invalid dedupe mode %q: must be off, hardlink, symlink or copy\n", dedupe)
+		return
+	}
+	if skipNear < 0 || skipNear > 64 {
+		fmt.Printf("Invalid near-duplicate threshold %d: must be between 0 and 64\n", skipNear)
+		return
+	}
+	if dedupe != "off" && inPlace {
+		fmt.Println("-dedupe cannot be used with -in-place: duplicates would need replacing too")
+		return
+	}
+	if dedupe == "symlink" && archiveOutput != "" {
+		fmt.Println("-dedupe symlink cannot be used with -archive-output; use hardlink or copy")
+		return
+	}
+	if inPlace && sizesFlag != "" {
+		fmt.Println("-in-place cannot be combined with -sizes: each original is replaced by a single output")
+		return
+	}
+	if nameTemplate != "" {
+		if err := compressor.ValidateNameTemplate(nameTemplate); err != nil {
+			fmt.Printf("Invalid name template: %v\n", err)
+			return
+		}
+		if inPlace {
+			fmt.Println("-in-place cannot be combined with -name-template: each original is replaced under its own name")
+			return
+		}
+		if sizesFlag != "" && (strings.Contains(nameTemplate, "{width}") || strings.Contains(nameTemplate, "{height}")) {
+			fmt.Println("-name-template cannot use {width} or {height} with -sizes: the variants of a file differ in size")
+			return
+		}
+	}
+	if flatten && (inPlace || organizeByDate) {
+		fmt.Println("-flatten cannot be combined with -in-place or -organize-by-date, which decide the output folders themselves")
+		return
+	}
+	if inPlace && organizeByDate {
+		fmt.Println("-in-place cannot be combined with -organize-by-date: each original is replaced where it is")
+		return
+	}
+	if inPlace && deleteOriginals {
+		fmt.Println("-in-place and -delete-originals cannot be used together: -in-place already replaces the originals")
+		return
+	}
+	if archiveOutput != "" {
+		switch {
+		case !isArchive(archiveOutput):
+			fmt.Printf("Invalid archive output %q: must end in .zip, .tar, .tar.gz or .tgz\n", archiveOutput)
+			return
+		case inPlace, deleteOriginals:
+			fmt.Println("-archive-output cannot be used with -in-place or -delete-originals, which would remove originals before the archive is written")
+			return
+		case resume || incremental != "":
+			fmt.Println("-archive-output cannot be used with -resume or -incremental, which read the compressed_files folder of earlier runs")
+			return
+		case watching:
+			fmt.Println("-archive-output cannot be used with watch")
+			return
+		}
+	}
+	if lossless {
+		if scaleFlag != "" || sizesFlag != "" || thumbs != "" || crop != "" || maxWidth > 0 || maxHeight > 0 ||
+			watermarkText != "" || watermarkImagePath != "" || convertTo != "" || targetSize != "" || ssimTarget > 0 || convertToSRGB || grayscale || sharpenFlag != "" || denoise > 0 || adjustFlag != "" || autoEnhance || colors > 0 {
+			fmt.Println("-lossless cannot be combined with resizing, cropping, watermarks, format conversion, size targets, -convert-to-srgb, -grayscale, -sharpen, -denoise, -auto-enhance, -adjust or -colors")
+			return
+		}
+		if _, err := exec.LookPath(compressor.JPEGTranCommand); err != nil {
+			if progressive {
+				fmt.Printf("-progressive -lossless needs %s in PATH: %v\n", compressor.JPEGTranCommand, err)
+				return
+			}
+			logger.Warnf("%s not found in PATH; lossless jpegs will only have their metadata rewritten", compressor.JPEGTranCommand)
+		}
+	}
+	// -chroma and -progressive rely on it too, so a cjpeg that is missing or
+	// not mozjpeg's fails the run before any file is written
+	jpegEncoderName := jpegEncoder
+	if jpegEncoder == "mozjpeg" {
+		version, err := compressor.MozJPEGVersion()
+		if err != nil {
+			fmt.Printf("-jpeg-encoder mozjpeg cannot be used: %v\n", err)
+			return
+		}
+		jpegEncoderName = "mozjpeg " + version
+	}
+	if rawMode != "preview" && rawMode != "full" {
+		fmt.Printf("Invalid raw mode %q: must be preview or full\n", rawMode)
+		return
+	}
 
-	if info.IsDir() {
-		totalFiles, totalSize, filePaths, err = calculateTotalSizeAndCount(inputPath, compressedFolder)
-	} else {
-		totalFiles = 1
-		totalSize = info.Size()
-		filePaths = []string{inputPath}
+	if quality < 1 || quality > 100 {
+		fmt.Printf("Invalid quality %d: must be between 1 and 100\n", quality)
+		return
+	}
+	pngLevel, ok := compressor.PNGCompressionLevels[pngCompression]
+	if !ok {
+		fmt.Printf("Invalid png compression %q: must be default, none, speed or best\n", pngCompression)
+		return
 	}
 
-	approxSize := int64(float64(totalSize) * 0.5) // Approximate size after compression (50% of original)
+	if !compressor.PNGOptimizeModes[pngOptimize] {
+		fmt.Printf("Invalid png optimize %q: must be off, lossless or lossy\n", pngOptimize)
+		return
+	}
 
-	fmt.Printf("Total files to be compressed: %d\n", totalFiles)
-	fmt.Printf("Total size of current files: %s\n", humanReadableSize(totalSize))
-	fmt.Printf("Approximate size after conversion: %s\n", humanReadableSize(approxSize))
+	if colors != 0 && (colors < 2 || colors > 256) {
+		fmt.Printf("Invalid colors %d: must be between 2 and 256\n", colors)
+		return
+	}
+	if gifColors < 2 || gifColors > 256 {
+		fmt.Printf("Invalid gif colors %d: must be between 2 and 256\n", gifColors)
+		return
+	}
+	if !compressor.DitherModes[dither] {
+		fmt.Printf("Invalid dither %q: must be floyd-steinberg or none\n", dither)
+		return
+	}
 
-	// Estimate time required (assuming each file takes 0.5 seconds to compress)
-	estimatedTime := time.Duration(totalFiles) * 500 * time.Millisecond
-	fmt.Printf("Estimated time required: %v\n", estimatedTime)
+	if !progressModes[progressMode] {
+		fmt.Printf("Invalid progress mode %q: must be auto, bar, plain or off\n", progressMode)
+		return
+	}
 
-	// Ask for confirmation if the -y flag is not provided
-	if !skipConfirmation {
-		if !getConfirmation() {
-			fmt.Println("Operation cancelled.")
+	reportFile, ok := compressor.ReportFormats[reportFormat]
+	if !ok {
+		fmt.Printf("Invalid report format %q: must be text, json or csv\n", reportFormat)
+		return
+	}
+	var notifiers []notifier
+	if webhookURL != "" {
+		if u, err := url.Parse(webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Printf("Invalid webhook URL %q: must be an http or https URL\n", webhookURL)
 			return
 		}
+		notifiers = append(notifiers, webhookNotifier{url: webhookURL})
 	}
-
-	// Start the compression and measure the actual time taken
-	startTime := time.Now()
-
-	// Create a progress bar for each thread
-	bars := make([]*progressbar.ProgressBar, numThreads)
-	for i := range bars {
-		bars[i] = progressbar.NewOptions(len(filePaths)/numThreads+1, progressbar.OptionSetDescription(fmt.Sprintf("Thread %d", i+1)))
-	}
-
-	// Divide files among threads
-	var wg sync.WaitGroup
-	chunkSize := (len(filePaths) + numThreads - 1) / numThreads
-	for i := 0; i < numThreads; i++ {
-		start := i * chunkSize
-		end := start + chunkSize
-		if end > len(filePaths) {
-			end = len(filePaths)
+	if mailTo != "" {
+		mail := mailSettings{server: smtpServer, user: smtpUser, from: mailFrom, html: mailHTML}
+		for _, address := range strings.Split(mailTo, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				mail.to = append(mail.to, address)
+			}
 		}
-		if start < end {
-			wg.Add(1)
-			go func(threadID int, files []string, bar *progressbar.ProgressBar) {
-				defer wg.Done()
-				compressImages(threadID, files, compressedFolder, inputPath, processedFolder, watermarkText, fontPath, maxPixels, bar)
-			}(i+1, filePaths[start:end], bars[i])
+		if mail.from == "" {
+			mail.from = smtpUser
+		}
+		if _, _, err := net.SplitHostPort(smtpServer); err != nil {
+			fmt.Printf("Invalid SMTP server %q: -mail-to needs -smtp-server host:port\n", smtpServer)
+			return
+		}
+		if mail.from == "" {
+			fmt.Println("-mail-to needs -mail-from or -smtp-user")
+			return
 		}
+		notifiers = append(notifiers, mail)
 	}
-
-	wg.Wait()
-
-	actualTimeTaken := time.Since(startTime)
-	fmt.Printf("\nActual time taken: %v\n", actualTimeTaken)
-
+	if notifyFailures < 0 {
+		fmt.Printf("Invalid notify failures %d: must not be negative\n", notifyFailures)
+		return
+	}
+	chats, err := parseChatNotifiers(notifyChats, notifyFailures)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
-	} else {
-		fmt.Println("Compression completed successfully")
+		return
+	}
+	for _, chat := range chats {
+		notifiers = append(notifiers, chat)
+	}
+
+	var targetBytes int64
+	if targetSize != "" {
+		size, err := compressor.ParseSize(targetSize)
+		if err != nil || size == 0 {
+			fmt.Printf("Invalid target size %q\n", targetSize)
+			return
+		}
+		targetBytes = size
+	}
+
+	var minBytes int64
+	if minSize != "" {
+		size, err := compressor.ParseSize(minSize)
+		if err != nil {
+			fmt.Printf("Invalid min size %q\n", minSize)
+			return
+		}
+		minBytes = size
+	}
+	if minPixels < 0 {
+		fmt.Printf("Invalid min pixels %d: must not be negative\n", minPixels)
+		return
+	}
+
+	var memory *memoryBudget
+	if maxMemory != "" {
+		limit, err := compressor.ParseSize(maxMemory)
+		if err != nil || limit == 0 {
+			fmt.Printf("Invalid max memory %q\n", maxMemory)
+			return
+		}
+		memory = newMemoryBudget(limit)
+	}
+
+	if ssimTarget < 0 || ssimTarget > 1 {
+		fmt.Printf("Invalid ssim target %v: must be between 0 and 1\n", ssimTarget)
+		return
+	}
+	if ssimTarget > 0 && targetBytes > 0 {
+		fmt.Println("-ssim-target and -target-size cannot be used together")
+		return
+	}
+
+	if convertTo != "" {
+		format, err := compressor.ParseFormat(convertTo)
+		if err != nil {
+			fmt.Printf("Unsupported output format %q: %v\n", convertTo, err)
+			return
+		}
+		convertTo = format
+	}
+
+	strip := make(map[string]bool)
+	for _, category := range strings.Split(stripMetadata, ",") {
+		category = strings.TrimSpace(strings.ToLower(category))
+		if category == "" {
+			continue
+		}
+		if !compressor.MetadataCategories[category] {
+			fmt.Printf("Invalid metadata category %q: must be gps, serial, exif, xmp, iptc, icc or all\n", category)
+			return
+		}
+		strip[category] = true
+	}
+
+	if _, ok := compressor.PDFPageSizes[pdfPageSize]; !ok {
+		fmt.Printf("Invalid pdf page size %q: must be fit, a3, a4, a5, letter or legal\n", pdfPageSize)
+		return
+	}
+	if pdfDPI < 1 {
+		fmt.Printf("Invalid pdf dpi %d: must be at least 1\n", pdfDPI)
+		return
+	}
+
+	placeholderKinds := make(map[string]bool)
+	for _, kind := range strings.Split(placeholders, ",") {
+		kind = strings.TrimSpace(strings.ToLower(kind))
+		if kind == "" {
+			continue
+		}
+		if !compressor.PlaceholderKinds[kind] {
+			fmt.Printf("Invalid placeholder %q: must be blurhash or lqip\n", kind)
+			return
+		}
+		placeholderKinds[kind] = true
+	}
+
+	backgroundColor, err := compressor.ParseHexColor(background)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if !compressor.WatermarkPositions[watermarkPosition] {
+		fmt.Printf("Invalid watermark position %q: must be tl, tr, bl, br or center\n", watermarkPosition)
+		return
+	}
+
+	wmSize, err := compressor.ParseWatermarkSize(watermarkSizeFlag)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	wmColor, err := compressor.ParseHexColor(watermarkColor)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	wmOutlineColor, err := compressor.ParseHexColor(outlineColor)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	wmShadowColor, err := compressor.ParseHexColor(shadowColor)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if !compressor.AutoContrastModes[autoContrast] {
+		fmt.Printf("Invalid watermark auto contrast %q: must be off, color or box\n", autoContrast)
+		return
+	}
+	if outlineWidth < 0 || shadowOffset < 0 {
+		fmt.Println("Watermark outline and shadow sizes must not be negative")
+		return
+	}
+	if watermarkSpacing < 0 {
+		fmt.Printf("Invalid watermark spacing %d: must not be negative\n", watermarkSpacing)
+		return
+	}
+	if watermarkOpacity < 0 || watermarkOpacity > 1 {
+		fmt.Printf("Invalid watermark opacity %v: must be between 0 and 1\n", watermarkOpacity)
+		return
+	}
+
+	var watermarkFonts []*font.Font
+	if watermarkText != "" {
+		if watermarkFonts, err = compressor.LoadFonts(fontPath); err != nil {
+			fmt.Printf("Failed to load font: %v\n", err)
+			return
+		}
+	}
+
+	var watermarkImage image.Image
+	if watermarkImagePath != "" {
+		if watermarkScale <= 0 || watermarkScale > 1 {
+			fmt.Printf("Invalid watermark image scale %v: must be between 0 and 1\n", watermarkScale)
+			return
+		}
+		logoFile, err := os.Open(watermarkImagePath)
+		if err != nil {
+			fmt.Printf("Failed to open watermark image: %v\n", err)
+			return
+		}
+		watermarkImage, _, err = image.Decode(logoFile)
+		logoFile.Close()
+		if err != nil {
+			fmt.Printf("Failed to decode watermark image: %v\n", err)
+			return
+		}
+	}
+
+	opts := compressor.Options{
+		MaxPixels:      maxPixels,
+		MaxWidth:       maxWidth,
+		MaxHeight:      maxHeight,
+		Scale:          scale,
+		Filter:         filter,
+		CropWidth:      cropWidth,
+		CropHeight:     cropHeight,
+		CropGravity:    cropGravity,
+		Sizes:          sizes,
+		ThumbWidth:     thumbWidth,
+		ThumbHeight:    thumbHeight,
+		JPEGQuality:    quality,
+		JPEGEncoder:    jpegEncoder,
+		Progressive:    progressive,
+		Chroma:         chroma,
+		Lossless:       lossless,
+		PNGCompression: pngLevel,
+		PNGOptimize:    pngOptimize,
+		Colors:         colors,
+		GIFColors:      gifColors,
+		Dither:         dither,
+		TargetSize:     targetBytes,
+		SSIMTarget:     ssimTarget,
+		KeepMetadata:   keepMetadata,
+		StripMetadata:  strip,
+		Placeholders:   placeholderKinds,
+		AutoOrient:     autoOrient,
+		ConvertToSRGB:  convertToSRGB,
+		Watermark: compressor.Watermark{
+			Text:       watermarkText,
+			Fonts:      watermarkFonts,
+			Image:      watermarkImage,
+			ImageScale: watermarkScale,
+			Position:   watermarkPosition,
+			Margin:     watermarkMargin,
+			Size:       wmSize,
+			Color:      wmColor,
+			Opacity:    watermarkOpacity,
+			Tile:       watermarkTile,
+			TileAngle:  watermarkAngle,
+			TileGap:    watermarkSpacing,
+
+			OutlineWidth: outlineWidth,
+			OutlineColor: wmOutlineColor,
+			ShadowOffset: shadowOffset,
+			ShadowColor:  wmShadowColor,
+			AutoContrast: autoContrast,
+		},
+		RawMode:         rawMode,
+		ConvertTo:       convertTo,
+		Background:      backgroundColor,
+		Engine:          engine,
+		PreserveOwner:   preserveOwner,
+		FollowSymlinks:  followSymlinks,
+		OutsideSymlinks: outsideSymlinks,
+		PathFilter:      fileFilter,
+		ExifFilter:      exifFilter,
+		MinSize:         minBytes,
+		MinPixels:       minPixels,
+		Retries:         retries,
+		RetryDelay:      retryDelay,
+		Verify:          verify,
+		QualityMetrics:  qualityMetrics,
+		Denoise:         denoise,
+		AutoEnhance:     autoEnhance,
+		Adjust:          adjust,
+		Sharpen:         sharpen,
+		Grayscale:       grayscale,
+		TilePixels:      tilePixels,
+		OrganizeByDate:  organizeByDate,
+		Flatten:         flatten,
+		NameTemplate:    nameTemplate,
+	}
+	if htmlReport {
+		opts.PreviewWidth = compressor.HTMLPreviewWidth
+	}
+	if err := setDateRange(&opts, since, until, dateFrom); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if fs.NArg() < 1 && watching {
+		fmt.Println("Usage: image-compressor watch [-debounce <duration>] [-metrics-addr <host:port>] [compress flags] <folder>")
+		return
+	}
+	if fs.NArg() < 1 && retrying {
+		fmt.Println("Usage: image-compressor retry [compress flags] <report.txt, report.json, manifest.jsonl or compressed_files folder>")
+		return
+	}
+	if fs.NArg() < 1 {
+		fmt.Println("Usage: image-compressor [compress] -s <maxPixels> -t <numThreads> -q <quality> -d <outputDir> -w <watermarkText> -f <fontPath> -raw <preview|full> -convert-to <format> -background <color> -y <path>")
+		return
+	}
+
+	inputPath := fs.Arg(0)
+	// A retry runs in the input and output folders of the earlier run
+	var failed failedRun
+	if retrying {
+		failed, err = loadFailedRun(inputPath)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if storage.IsURL(failed.input) || isArchive(failed.input) || storage.IsURL(outputDir) {
+			fmt.Printf("Cannot retry the run of %s: retry needs a run of a local folder or file, whose inputs are still there\n", failed.input)
+			return
+		}
+		if len(failed.files) == 0 {
+			logger.Summaryf("No failed files to retry in %s", fs.Arg(0))
+			return
+		}
+		inputPath = failed.input
+		if outputDir == "" && filepath.Base(failed.output) == "compressed_files" {
+			outputDir = filepath.Dir(failed.output)
+		}
+	}
+	source := inputPath // named in the report when the input is staged
+	var remote *remoteRun
+	if storage.IsURL(inputPath) || storage.IsURL(outputDir) {
+		switch {
+		case watching:
+			fmt.Println("watch needs a local folder, not a storage URL")
+			return
+		case dryRun:
+			fmt.Println("-dry-run needs a local input and output folder")
+			return
+		case deleteOriginals:
+			fmt.Println("-delete-originals cannot be used with storage URLs")
+			return
+		case archiveOutput != "":
+			fmt.Println("-archive-output cannot be used with storage URLs")
+			return
+		}
+		remote, err = newRemoteRun(context.Background(), inputPath, outputDir, inPlace, numThreads)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer remote.cleanup()
+		downloaded, skipped, err := remote.stage(context.Background(), opts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if remote.src != nil {
+			source = remote.src.URL("") // without any password or query
+			logger.Infof("Downloaded %d images from %s (%d skipped)", downloaded, remote.src.URL(""), skipped)
+			if downloaded == 0 {
+				logger.Summaryf("No new or changed images to compress in %s", remote.src.URL(""))
+				return
+			}
+		}
+		inputPath, outputDir = remote.inputDir, remote.outputDir
+	}
+	// Archives are extracted to a staging folder too, and their outputs go
+	// next to the archive unless -d says otherwise
+	staged := remote != nil
+	if !staged && isArchive(inputPath) {
+		switch {
+		case watching:
+			fmt.Printf("watch needs a folder: %s is an archive\n", inputPath)
+			return
+		case inPlace:
+			fmt.Println("-in-place cannot be used with an archive")
+			return
+		case deleteOriginals:
+			fmt.Println("-delete-originals cannot be used with an archive")
+			return
+		}
+		stageDir, err := ioutil.TempDir("", "image-compressor-")
+		if err != nil {
+			fmt.Printf("Failed to create staging folder: %v\n", err)
+			return
+		}
+		defer os.RemoveAll(stageDir)
+		extracted, skipped, err := extractArchive(inputPath, stageDir, opts)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		logger.Infof("Extracted %d images from %s (%d skipped)", extracted, inputPath, skipped)
+		if outputDir == "" {
+			outputDir = filepath.Dir(inputPath)
+		}
+		inputPath, staged = stageDir, true
+	}
+	info, err := os.Stat(inputPath)
+	if err != nil {
+		fmt.Printf("Error accessing the path: %v\n", err)
+		return
+	}
+
+	if watching {
+		if !info.IsDir() {
+			fmt.Printf("watch needs a folder: %s is a file\n", inputPath)
+			return
+		}
+		if dryRun {
+			fmt.Println("-dry-run cannot be used with watch; use scan to see what a run would do")
+			return
+		}
+		skipConfirmation = true
+	}
+
+	if outputDir == "" {
+		outputDir = inputPath
+	}
+
+	compressedFolder := filepath.Join(outputDir, "compressed_files")
+	processedFolder := filepath.Join(outputDir, "processed_files")
+	backupFolder := filepath.Join(outputDir, "backup_files")
+	if archiveOutput != "" {
+		// Outputs are gathered in a temporary folder and packed when done
+		packDir, err := ioutil.TempDir("", "image-compressor-")
+		if err != nil {
+			fmt.Printf("Failed to create staging folder: %v\n", err)
+			return
+		}
+		defer os.RemoveAll(packDir)
+		compressedFolder = packDir
+	}
+
+	if dryRun {
+		reportPath := filepath.Join(outputDir, "dry_run_report.txt")
+		if err := printDryRun(inputPath, info, compressedFolder, reportPath, opts, resume, incremental, pilot, numThreads); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+		return
+	}
+
+	err = os.MkdirAll(compressedFolder, 0755)
+	if err != nil {
+		fmt.Printf("Failed to create compressed_files folder: %v\n", err)
+		return
+	}
+	if !inPlace && !deleteOriginals && !staged {
+		err = os.MkdirAll(processedFolder, 0755)
+		if err != nil {
+			fmt.Printf("Failed to create processed_files folder: %v\n", err)
+			return
+		}
+	}
+
+	// notify tells the notifiers about the last run, once its outputs are
+	// where they are going
+	var lastReport *compressor.Report
+	var lastReportPath, lastEvent string
+	notify := func(event string) {
+		if lastReport == nil || len(notifiers) == 0 {
+			return
+		}
+		finished := finishedRun{event: event, report: lastReport, summary: lastReport.Summary(), reportPath: lastReportPath}
+		switch {
+		case archiveOutput != "":
+			finished.summary.Output = archiveOutput
+		case remote != nil && remote.dst != nil:
+			finished.summary.Output = remote.dst.URL("")
+		}
+		for _, n := range notifiers {
+			if err := n.notify(finished); err != nil {
+				logger.Warnf("%v", err)
+			} else {
+				logger.Debugf("Sent the run summary to %s", n.target())
+			}
+		}
+	}
+
+	run := func() {
+		manifest, err := compressor.OpenManifest(filepath.Join(compressedFolder, "manifest.jsonl"))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		defer manifest.Close()
+		manifest.ChangeDetection = incremental
+		// Replaced originals are compressed outputs themselves, so in-place runs
+		// always go by the manifest rather than by existing outputs
+		var resumeFrom *compressor.Manifest
+		if resume || incremental != "" || inPlace {
+			resumeFrom = manifest
+		}
+
+		var backups *compressor.BackupLog
+		if inPlace {
+			backups, err = compressor.OpenBackupLog(backupFolder, inputPath)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer backups.Close()
+		}
+
+		var totalFiles int
+		var totalSize int64
+		var filePaths, outputs []string
+		var renamed []compressor.PlannedFile
+
+		var links []compressor.PlannedFile
+		var tooSmall int
+		var walkErr error // files found before a failed walk are still compressed
+
+		if retrying {
+			for _, path := range failed.files {
+				fileInfo, err := os.Stat(path)
+				if err != nil {
+					logger.Warnf("Not retrying %s: %v", path, err)
+					continue
+				}
+				if backups != nil && backups.Replaces(path) {
+					continue
+				}
+				filePaths = append(filePaths, path)
+				outputs = append(outputs, compressor.PlannedOutputPath(path, inputPath, compressedFolder, len(filePaths)+1, opts))
+				totalSize += fileInfo.Size()
+			}
+			totalFiles = len(filePaths)
+		} else if info.IsDir() {
+			var files []compressor.PlannedFile
+			files, walkErr = compressor.Plan(inputPath, compressedFolder, opts, resumeFrom)
+			for _, file := range files {
+				switch {
+				case file.Action == "skip":
+					if file.TooSmall {
+						tooSmall++
+					}
+				case file.Action == "link":
+					links = append(links, file)
+				case backups != nil && backups.Replaces(file.Path):
+				default:
+					filePaths = append(filePaths, file.Path)
+					outputs = append(outputs, file.Output)
+					if file.Conflict != "" {
+						renamed = append(renamed, file)
+					}
+					totalSize += file.Size
+				}
+			}
+			totalFiles = len(filePaths)
+		} else if (resumeFrom == nil || !manifest.Done(inputPath)) && (backups == nil || !backups.Replaces(inputPath)) {
+			totalFiles = 1
+			totalSize = info.Size()
+			filePaths = []string{inputPath}
+			outputs = []string{compressor.PlannedOutputPath(inputPath, inputPath, compressedFolder, 1, opts)}
+		}
+
+		var duplicates []compressor.Duplicate
+		if dedupe != "off" && len(filePaths) > 1 {
+			filePaths, outputs, duplicates, err = compressor.FindDuplicates(filePaths, outputs)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			for _, dup := range duplicates {
+				totalSize -= dup.Size
+			}
+			totalFiles = len(filePaths)
+		}
+		// Near-duplicates that cannot be hashed are compressed, and fail, as usual
+		var nearDuplicates []compressor.NearDuplicateSet
+		if skipNear > 0 && len(filePaths) > 1 {
+			nearDuplicates, _ = compressor.FindNearDuplicates(filePaths, "dhash", skipNear, numThreads, rawMode)
+			redundant := make(map[string]bool)
+			for _, set := range nearDuplicates {
+				for _, other := range set.Others {
+					redundant[other] = true
+				}
+			}
+			var keptPaths, keptOutputs []string
+			for i, path := range filePaths {
+				if !redundant[path] {
+					keptPaths = append(keptPaths, path)
+					keptOutputs = append(keptOutputs, outputs[i])
+				} else if info, err := os.Stat(path); err == nil {
+					totalSize -= info.Size()
+				}
+			}
+			filePaths, outputs = keptPaths, keptOutputs
+			totalFiles = len(filePaths)
+		}
+
+		if watching && totalFiles == 0 && len(links) == 0 {
+			return // nothing new since the last run
+		}
+
+		for _, file := range renamed {
+			logger.Warnf("%s would have the same output as %s; writing %s", file.Path, file.Conflict, file.Output)
+		}
+		logger.Infof("Total files to be compressed: %d", totalFiles)
+		if tooSmall > 0 {
+			logger.Infof("Files skipped as too small: %d", tooSmall)
+		}
+		if len(duplicates) > 0 {
+			logger.Infof("Duplicates to be given the outputs of their first copy: %d", len(duplicates))
+		}
+		if len(nearDuplicates) > 0 {
+			logger.Infof("Near-duplicate sets of which only the largest image is compressed: %d", len(nearDuplicates))
+		}
+		logger.Infof("Total size of current files: %s", compressor.HumanReadableSize(totalSize))
+		// Only a run waiting for confirmation is worth a pilot pass
+		samples := 0
+		if !skipConfirmation {
+			samples = pilot
+			if samples > totalFiles {
+				samples = totalFiles
+			}
+			if samples > 0 {
+				logger.Infof("Compressing %d sample files to estimate the savings...", samples)
+			}
+		}
+		for _, line := range estimateSavings(filePaths, totalSize, opts, samples, numThreads) {
+			logger.Infof("%s", line)
+		}
+
+		// Ask for confirmation if the -y flag is not provided
+		if !skipConfirmation {
+			if !getConfirmation() {
+				fmt.Println("Operation cancelled.")
+				return
+			}
+		}
+
+		// Start the compression and measure the actual time taken
+		startTime := time.Now()
+
+		for _, link := range links {
+			if err := compressor.CopyLink(link); err != nil {
+				logger.Errorf("Failed to copy symlink %s: %v", link.Path, err)
+			} else {
+				logger.Debugf("Copied symlink %s to %s", link.Path, link.Output)
+			}
+		}
+
+		report := compressor.NewReport(source, compressedFolder)
+		report.TooSmall = tooSmall
+		if configPath != "" {
+			report.AddSetting("Config", configPath)
+		}
+		for _, file := range renamed {
+			report.AddRename(file.Path, file.Output, file.Conflict)
+		}
+		report.AddSetting("Max pixels", fmt.Sprintf("%d", maxPixels))
+		report.AddSetting("Engine", engineSetting)
+		report.AddSetting("Resize filter", filterName)
+		if tilePixels > 0 {
+			report.AddSetting("Tile-parallel resampling", fmt.Sprintf("images of %d+ pixels on %d CPUs", tilePixels, runtime.GOMAXPROCS(0)))
+		}
+		if scaleFlag != "" {
+			report.AddSetting("Scale", scaleFlag)
+		}
+		if sizesFlag != "" {
+			report.AddSetting("Sizes", sizesFlag)
+		}
+		if thumbs != "" {
+			report.AddSetting("Thumbnails", thumbs)
+		}
+		if crop != "" {
+			report.AddSetting("Crop", fmt.Sprintf("%s (%s)", crop, cropGravity))
+		}
+		if maxWidth > 0 {
+			report.AddSetting("Max width", fmt.Sprintf("%dpx", maxWidth))
+		}
+		if maxHeight > 0 {
+			report.AddSetting("Max height", fmt.Sprintf("%dpx", maxHeight))
+		}
+		report.AddSetting("Threads", fmt.Sprintf("%d", numThreads))
+		if retries > 0 {
+			report.AddSetting("Retries", fmt.Sprintf("%d, from %v", retries, retryDelay))
+		}
+		if verify {
+			report.AddSetting("Verify", "outputs decoded after writing")
+		}
+		if incremental != "" {
+			report.AddSetting("Incremental", incremental)
+		}
+		if dedupe != "off" {
+			report.AddSetting("Dedupe", dedupe)
+		}
+		if skipNear > 0 {
+			report.AddSetting("Skip near-duplicates", fmt.Sprintf("within %d bits", skipNear))
+			report.AddNearDuplicates(nearDuplicates)
+		}
+		if archiveOutput != "" {
+			report.AddSetting("Archive output", archiveOutput)
+		}
+		if minSize != "" {
+			report.AddSetting("Min size", minSize)
+		}
+		if minPixels > 0 {
+			report.AddSetting("Min pixels", fmt.Sprintf("%d", minPixels))
+		}
+		if exifConditions != "" {
+			report.AddSetting("EXIF filter", exifConditions)
+		}
+		if since != "" || until != "" {
+			report.AddSetting("Date range", fmt.Sprintf("%s to %s by %s", since, until, dateFrom))
+		}
+		for _, setting := range [][2]string{{"Include", include}, {"Exclude", exclude}, {"Include regex", includeRegex}, {"Exclude regex", excludeRegex}} {
+			if setting[1] != "" {
+				report.AddSetting(setting[0], setting[1])
+			}
+		}
+		if organizeByDate {
+			report.AddSetting("Organize by date", "YYYY/MM/DD folders")
+		}
+		if flatten {
+			report.AddSetting("Flatten", "single folder, originals listed in output_map.csv")
+		}
+		if nameTemplate != "" {
+			report.AddSetting("Name template", nameTemplate)
+		}
+		if inPlace {
+			report.AddSetting("In place", "backups in "+backupFolder)
+		}
+		if deleteOriginals {
+			report.AddSetting("Delete originals", "true")
+		}
+		if lossless {
+			report.AddSetting("Lossless", "true")
+		}
+		if maxMemory != "" {
+			report.AddSetting("Max memory", maxMemory)
+		}
+		report.AddSetting("JPEG quality", fmt.Sprintf("%d", quality))
+		report.AddSetting("JPEG encoder", jpegEncoderName)
+		report.AddSetting("Chroma subsampling", fmt.Sprintf("%s:%s:%s", chroma[:1], chroma[1:2], chroma[2:]))
+		if progressive {
+			report.AddSetting("Progressive", "true")
+		}
+		report.AddSetting("PNG compression", pngCompression)
+		report.AddSetting("GIF colors", fmt.Sprintf("%d", gifColors))
+		if pngOptimize != "off" {
+			report.AddSetting("PNG optimize", pngOptimize)
+		}
+		if colors > 0 {
+			report.AddSetting("Colors", fmt.Sprintf("%d, %s dithering", colors, dither))
+		}
+		if targetSize != "" {
+			report.AddSetting("Target size", targetSize)
+		}
+		if ssimTarget > 0 {
+			report.AddSetting("SSIM target", fmt.Sprintf("%.3f", ssimTarget))
+		}
+		if qualityMetrics {
+			report.AddSetting("Quality metrics", "SSIM and PSNR")
+		}
+		if convertTo != "" {
+			report.AddSetting("Output format", convertTo)
+		}
+		report.AddSetting("Keep metadata", fmt.Sprintf("%t", keepMetadata))
+		report.AddSetting("Auto orient", fmt.Sprintf("%t", autoOrient))
+		report.AddSetting("Convert to sRGB", fmt.Sprintf("%t", convertToSRGB))
+		if denoise > 0 {
+			report.AddSetting("Denoise", fmt.Sprintf("%g", denoise))
+		}
+		if autoEnhance {
+			report.AddSetting("Auto enhance", "true")
+		}
+		if adjust != nil {
+			report.AddSetting("Adjust", adjust.String())
+		}
+		if sharpenFlag != "" {
+			report.AddSetting("Sharpen", fmt.Sprintf("amount %g, radius %g, threshold %d", sharpen.Amount, sharpen.Radius, sharpen.Threshold))
+		}
+		if grayscale {
+			report.AddSetting("Grayscale", "true")
+		}
+		if stripMetadata != "" {
+			report.AddSetting("Stripped metadata", stripMetadata)
+		}
+		if placeholders != "" {
+			report.AddSetting("Placeholders", placeholders)
+		}
+		if pdfPath != "" {
+			report.AddSetting("PDF", fmt.Sprintf("%s, %s pages at %d dpi", pdfPath, pdfPageSize, pdfDPI))
+		}
+		if watermarkText != "" {
+			report.AddSetting("Watermark", watermarkText)
+			if fontPath != "" {
+				report.AddSetting("Watermark fonts", fontPath)
+			}
+			report.AddSetting("Watermark style", fmt.Sprintf("size %s, color %s, opacity %.2f", watermarkSizeFlag, watermarkColor, watermarkOpacity))
+			if autoContrast != "off" && autoContrast != "" {
+				report.AddSetting("Watermark auto contrast", autoContrast)
+			}
+			if outlineWidth > 0 {
+				report.AddSetting("Watermark outline", fmt.Sprintf("%dpx %s", outlineWidth, outlineColor))
+			}
+			if shadowOffset > 0 {
+				report.AddSetting("Watermark shadow", fmt.Sprintf("%dpx %s", shadowOffset, shadowColor))
+			}
+		}
+		if watermarkImagePath != "" {
+			report.AddSetting("Watermark image", fmt.Sprintf("%s (scale %.2f)", watermarkImagePath, watermarkScale))
+		}
+		if watermarkTile && watermarkText != "" {
+			report.AddSetting("Watermark tiling", fmt.Sprintf("angle %.0f, spacing %dpx", watermarkAngle, watermarkSpacing))
+		}
+		if watermarkText != "" || watermarkImagePath != "" {
+			report.AddSetting("Watermark position", fmt.Sprintf("%s (margin %dpx)", watermarkPosition, watermarkMargin))
+		}
+
+		// Incremental runs compare against the originals next time, so keep them,
+		// and in-place and deleting runs have already replaced or removed them.
+		// Staged copies of remote and archived originals are just left behind.
+		movedFolder := processedFolder
+		if incremental != "" || inPlace || deleteOriginals || staged {
+			movedFolder = ""
+		}
+
+		prog := newProgress(totalFiles, totalSize, numThreads, progressMode, perWorker, progressInterval, progressFiles)
+		previous := logger.print
+		logger.print = prog.printf
+		defer func() { logger.print = previous }()
+
+		// Workers pull from a shared queue so a few large files don't hold up one thread
+		// The first SIGINT or SIGTERM stops handing out files and lets the ones in
+		// progress finish; a second one cancels those too
+		dispatchCtx, stopDispatch := context.WithCancel(context.Background())
+		ctx, cancelWork := context.WithCancel(context.Background())
+		defer stopDispatch()
+		defer cancelWork()
+		signals := make(chan os.Signal, 2)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		go func() {
+			select {
+			case <-signals:
+			case <-ctx.Done():
+				return
+			}
+			logger.Warnf("Interrupted: finishing the files in progress; interrupt again to abort them")
+			stopDispatch()
+			select {
+			case <-signals:
+			case <-ctx.Done():
+				return
+			}
+			logger.Warnf("Aborting the files in progress")
+			cancelWork()
+		}()
+
+		queue := make(chan queuedFile)
+		var wg sync.WaitGroup
+		for i := 0; i < numThreads; i++ {
+			wg.Add(1)
+			go func(threadID int) {
+				defer wg.Done()
+				compressWorker(ctx, threadID, queue, compressedFolder, inputPath, movedFolder, opts, memory, manifest, backups, deleteOriginals, prog, report)
+			}(i + 1)
+		}
+
+		dispatched := 0
+		queueDepth.Add(float64(len(filePaths)))
+	dispatch:
+		for i, path := range filePaths {
+			select {
+			case queue <- queuedFile{index: i + 1, path: path, output: outputs[i]}:
+				dispatched++
+			case <-dispatchCtx.Done():
+				break dispatch
+			}
+		}
+		close(queue)
+		queueDepth.Sub(float64(len(filePaths) - dispatched))
+
+		wg.Wait()
+		prog.finish()
+		linkDuplicates(duplicates, dedupe, compressedFolder, inputPath, movedFolder, opts, manifest, deleteOriginals, report)
+		interrupted := dispatchCtx.Err() != nil
+		if interrupted {
+			report.Interrupted = true
+			report.NotStarted = len(filePaths) - dispatched
+		}
+
+		actualTimeTaken := time.Since(startTime)
+		compressed, failed, inputBytes, outputBytes := report.Counts()
+		logger.Event(levelQuiet, "run_summary", logFields{
+			"files_compressed": compressed,
+			"files_failed":     failed,
+			"input_size":       inputBytes,
+			"output_size":      outputBytes,
+			"duration_ms":      actualTimeTaken.Milliseconds(),
+			"interrupted":      interrupted,
+		}, "\nActual time taken: %v", actualTimeTaken)
+
+		report.Duration = actualTimeTaken
+		reportPath := filepath.Join(compressedFolder, reportFile)
+		if err = report.WriteFormat(reportPath, reportFormat); err == nil {
+			logger.Summaryf("Report written to %s", reportPath)
+		}
+		if flatten && err == nil {
+			mapPath := filepath.Join(compressedFolder, "output_map.csv")
+			if err = manifest.WriteOutputMap(mapPath); err == nil {
+				logger.Summaryf("Output map written to %s", mapPath)
+			}
+		}
+		if len(placeholderKinds) > 0 && err == nil {
+			placeholdersPath := filepath.Join(compressedFolder, "placeholders.json")
+			if err = report.WritePlaceholders(placeholdersPath); err == nil {
+				logger.Summaryf("Placeholders written to %s", placeholdersPath)
+			}
+		}
+		if pdfPath != "" && err == nil {
+			album := compressor.Album{PageSize: pdfPageSize, DPI: pdfDPI, Background: backgroundColor}
+			if err = report.WriteAlbum(pdfPath, album); err == nil {
+				logger.Summaryf("PDF written to %s", pdfPath)
+			}
+		}
+		if htmlReport && err == nil {
+			htmlPath := filepath.Join(compressedFolder, "report.html")
+			if err = report.WriteHTML(htmlPath); err == nil {
+				logger.Summaryf("HTML report written to %s", htmlPath)
+			}
+		}
+		if walkErr != nil {
+			// The first error the run hit, ahead of any writing the reports
+			err = walkErr
+		}
+
+		lastReport, lastReportPath, lastEvent = report, reportPath, "completed"
+		switch {
+		case err != nil:
+			logger.Errorf("Error: %v", err)
+			lastReportPath, lastEvent = "", "failed"
+		case interrupted:
+			logger.Summaryf("Compression interrupted: %d files were not started", report.NotStarted)
+			manifest.Close()
+			if backups != nil {
+				backups.Close()
+			}
+			notify("interrupted")
+			os.Exit(130)
+		default:
+			logger.Summaryf("Compression completed successfully")
+		}
+		if watching {
+			notify(lastEvent)
+		}
+	}
+
+	if !watching {
+		run()
+		if archiveOutput != "" {
+			n, err := writeArchive(archiveOutput, compressedFolder)
+			if err != nil {
+				logger.Errorf("Error: %v", err)
+				lastReportPath = ""
+				notify("failed")
+				os.Exit(1)
+			}
+			logger.Summaryf("Wrote %d files to %s", n, archiveOutput)
+			if lastReportPath != "" {
+				lastReportPath = archiveOutput
+			}
+		}
+		if remote != nil {
+			if err := remote.upload(context.Background(), compressedFolder, pdfPath); err != nil {
+				logger.Errorf("Error: %v", err)
+				lastReportPath, lastEvent = "", "failed"
+			} else if lastReportPath != "" {
+				lastReportPath = remote.url(lastReportPath)
+			}
+		}
+		notify(lastEvent)
+		return
+	}
+	if metricsAddr != "" {
+		listener, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			logger.Errorf("Error: %v", err)
+			return
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler())
+		go http.Serve(listener, mux)
+		logger.Infof("Serving metrics on %s/metrics", metricsAddr)
 	}
+	watchFolder(inputPath, []string{compressedFolder, processedFolder, backupFolder}, debounce, run)
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"image-compressor/pkg/compressor"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of every file compressed, served on /metrics by serve
+// and by watch with -metrics-addr.
+var (
+	imagesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_compressor_images_processed_total",
+		Help: "Images compressed successfully, by engine.",
+	}, []string{"engine"})
+	imageFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_compressor_failures_total",
+		Help: "Images that failed to compress, by category: decode, encode, write, verify, cancelled or other.",
+	}, []string{"category"})
+	bytesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "image_compressor_input_bytes_total",
+		Help: "Size of the images compressed successfully.",
+	})
+	bytesOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "image_compressor_output_bytes_total",
+		Help: "Size of their outputs.",
+	})
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_compressor_stage_duration_seconds",
+		Help:    "Time spent per image in each stage: decode, resize or encode.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8), // 1ms to 16s
+	}, []string{"stage"})
+	queueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "image_compressor_queue_depth",
+		Help: "Images waiting for a worker.",
+	})
+)
+
+// observeResult counts a finished file in the metrics.
+func observeResult(result compressor.FileResult) {
+	if result.Err != nil {
+		imageFailures.WithLabelValues(failureCategory(result.Err)).Inc()
+		return
+	}
+	imagesProcessed.WithLabelValues(result.Engine).Inc()
+	bytesIn.Add(float64(result.InputSize))
+	bytesOut.Add(float64(result.OutputSize))
+	if result.DecodeTime > 0 {
+		stageDuration.WithLabelValues("decode").Observe(result.DecodeTime.Seconds())
+	}
+	if result.ResizeTime > 0 {
+		stageDuration.WithLabelValues("resize").Observe(result.ResizeTime.Seconds())
+	}
+	if result.EncodeTime > 0 {
+		stageDuration.WithLabelValues("encode").Observe(result.EncodeTime.Seconds())
+	}
+}
+
+// failureCategory sorts a compression error by the stage it came from, as
+// far as its message tells.
+func failureCategory(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return "cancelled"
+	}
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "failed to decode"), strings.Contains(message, "failed to open image"),
+		strings.Contains(message, "unsupported image format"):
+		return "decode"
+	case strings.Contains(message, "failed to verify"):
+		return "verify"
+	case strings.Contains(message, "failed to encode"):
+		return "encode"
+	case strings.Contains(message, "failed to write"), strings.Contains(message, "failed to create"):
+		return "write"
+	}
+	return "other"
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"image-compressor/pkg/compressor"
+)
+
+// finishedRun is what notifiers are told about a run that ended.
+type finishedRun struct {
+	event      string // completed, interrupted or failed
+	report     *compressor.Report
+	summary    compressor.RunSummary // Output is where the outputs went
+	reportPath string                // empty if the report failed to write
+}
+
+// notifier tells someone that a run ended: -webhook-url, -mail-to or a
+// -notify chat webhook.
+type notifier interface {
+	notify(run finishedRun) error
+	target() string // for logs
+}
+
+// webhookPayload is the JSON body POSTed to -webhook-url when a run ends.
+type webhookPayload struct {
+	Event  string `json:"event"`            // completed, interrupted or failed
+	Report string `json:"report,omitempty"` // path of the report, unless it failed to write
+	compressor.RunSummary
+}
+
+type webhookNotifier struct{ url string }
+
+func (n webhookNotifier) target() string { return n.url }
+
+func (n webhookNotifier) notify(run finishedRun) error {
+	return postJSON(n.url, n.url, webhookPayload{Event: run.event, Report: run.reportPath, RunSummary: run.summary})
+}
+
+// chatFormats are the kinds of -notify webhook, each taking its own JSON.
+var chatFormats = map[string]func(text string, failed bool) interface{}{
+	"slack": func(text string, failed bool) interface{} {
+		return map[string]string{"text": text}
+	},
+	"discord": func(text string, failed bool) interface{} {
+		return map[string]string{"content": text}
+	},
+	"teams": func(text string, failed bool) interface{} {
+		color := "2EB67D"
+		if failed {
+			color = "E01E5A"
+		}
+		return map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    "Image compressor run",
+			"themeColor": color,
+			"text":       text,
+		}
+	},
+}
+
+// chatNotifier posts a one-line summary to a Slack, Discord or Teams
+// incoming webhook, for runs with at least minFailures failed files.
+type chatNotifier struct {
+	kind, url   string
+	minFailures int
+}
+
+// parseChatNotifiers parses comma separated -notify values of the form
+// kind=url.
+func parseChatNotifiers(value string, minFailures int) ([]chatNotifier, error) {
+	var notifiers []chatNotifier
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		kind, target, _ := strings.Cut(item, "=")
+		kind = strings.ToLower(kind)
+		if chatFormats[kind] == nil {
+			return nil, fmt.Errorf("invalid notifier %q: must be slack=<url>, discord=<url> or teams=<url>", item)
+		}
+		if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid %s webhook URL %q: must be an http or https URL", kind, target)
+		}
+		notifiers = append(notifiers, chatNotifier{kind: kind, url: target, minFailures: minFailures})
+	}
+	return notifiers, nil
+}
+
+// target is the kind alone: chat webhook URLs are secrets.
+func (n chatNotifier) target() string { return n.kind }
+
+func (n chatNotifier) notify(run finishedRun) error {
+	s := run.summary
+	if s.FilesFailed < n.minFailures {
+		return nil
+	}
+	duration := time.Duration(s.DurationMS) * time.Millisecond
+	if duration >= time.Second {
+		duration = duration.Round(time.Second)
+	}
+	text := fmt.Sprintf("Image compressor run %s for %s: %d files compressed, %s saved (%.1f%%), %d failed, in %v",
+		run.event, s.Input, s.FilesCompressed, compressor.HumanReadableSize(s.SavedBytes), s.SavedPercent, s.FilesFailed, duration)
+	if s.NotStarted > 0 {
+		text += fmt.Sprintf(", %d not started", s.NotStarted)
+	}
+	return postJSON(n.kind, n.url, chatFormats[n.kind](text, s.FilesFailed > 0 || run.event != "completed"))
+}
+
+func (m mailSettings) target() string { return strings.Join(m.to, ", ") }
+
+func (m mailSettings) notify(run finishedRun) error {
+	return mailReport(m, run.event, run.report)
+}
+
+// postJSON posts v to address, giving up after 10 seconds. Errors call the
+// address name, so they can leave out secret URLs.
+func postJSON(name, address string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(address, "application/json", bytes.NewReader(data))
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err // without the URL
+	}
+	if err != nil {
+		return fmt.Errorf("failed to post to %s: %v", name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post to %s: answered %s", name, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"image-compressor/pkg/compressor"
+)
+
+// pipeSettings are the pipe command's flags, named like the serve command's
+// query parameters and checked by the same code.
+var pipeSettings = []struct{ name, usage string }{
+	{"quality", "JPEG quality (1-100) Default: 80"},
+	{"max-width", "maximum width in pixels"},
+	{"max-height", "maximum height in pixels"},
+	{"scale", "resize to this percentage"},
+	{"format", "output format: jpeg, png or gif; defaults to the input format"},
+	{"target-size", "largest output size, e.g. 200KB"},
+	{"strip-metadata", "comma separated metadata to remove: gps, serial, exif, xmp, iptc, icc or all"},
+}
+
+// runPipe compresses one image read from stdin to stdout. Only the image
+// goes to stdout; errors go to stderr with exit status 1.
+func runPipe(args []string) {
+	fs := flag.NewFlagSet("pipe", flag.ExitOnError)
+	fs.SetOutput(os.Stderr)
+	query := make(map[string][]string)
+	for _, setting := range pipeSettings {
+		name := setting.name
+		fs.Func(name, setting.usage, func(value string) error {
+			query[name] = []string{value}
+			return nil
+		})
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: image-compressor pipe [flags] < in.jpg > out.jpg
+
+Read one JPEG, PNG, PDF or RAW image from stdin and write it compressed to stdout.`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	opts, err := requestOptions(compressor.DefaultOptions(), query)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read stdin: %v\n", err)
+		os.Exit(1)
+	}
+	encoded, _, err := compressor.CompressBytes(data, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to compress image: %v\n", err)
+		os.Exit(1)
+	}
+	if _, err := os.Stdout.Write(encoded); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write stdout: %v\n", err)
+		os.Exit(1)
+	}
+}
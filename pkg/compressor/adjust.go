@@ -0,0 +1,216 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Adjust holds tone adjustments applied after resizing, such as brightening
+// a slightly dark scan.
+type Adjust struct {
+	Brightness float64 // -100 to 100, percent of full scale added to every level
+	Contrast   float64 // -100 to 100, percent by which levels spread from mid gray
+	Gamma      float64 // 0.1 to 10; above 1 brightens the midtones
+	Saturation float64 // -100 (gray) to 100, percent by which colors spread from their gray
+}
+
+// ParseAdjust parses comma separated name=value pairs such as
+// "brightness=5,contrast=10,gamma=1.1"; names left out are not adjusted.
+func ParseAdjust(s string) (*Adjust, error) {
+	a := &Adjust{Gamma: 1}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid adjustment %q: must be name=value", pair)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid adjustment %q: %s needs a number", pair, name)
+		}
+		switch name {
+		case "brightness", "contrast", "saturation":
+			if number < -100 || number > 100 {
+				return nil, fmt.Errorf("invalid adjustment %q: %s must be between -100 and 100", pair, name)
+			}
+			switch name {
+			case "brightness":
+				a.Brightness = number
+			case "contrast":
+				a.Contrast = number
+			default:
+				a.Saturation = number
+			}
+		case "gamma":
+			if number < 0.1 || number > 10 {
+				return nil, fmt.Errorf("invalid adjustment %q: gamma must be between 0.1 and 10", pair)
+			}
+			a.Gamma = number
+		default:
+			return nil, fmt.Errorf("unknown adjustment %q: must be brightness, contrast, gamma or saturation", name)
+		}
+	}
+	return a, nil
+}
+
+// String lists the adjustments that change anything, for reports.
+func (a *Adjust) String() string {
+	var parts []string
+	if a.Brightness != 0 {
+		parts = append(parts, fmt.Sprintf("brightness %g", a.Brightness))
+	}
+	if a.Contrast != 0 {
+		parts = append(parts, fmt.Sprintf("contrast %g", a.Contrast))
+	}
+	if a.Gamma != 1 {
+		parts = append(parts, fmt.Sprintf("gamma %g", a.Gamma))
+	}
+	if a.Saturation != 0 {
+		parts = append(parts, fmt.Sprintf("saturation %g", a.Saturation))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// toneTable maps every 8-bit level through brightness, contrast and gamma,
+// in that order.
+func (a *Adjust) toneTable() *[256]uint8 {
+	var table [256]uint8
+	contrast := 1 + a.Contrast/100
+	for i := range table {
+		v := float64(i)/255 + a.Brightness/100
+		v = (v-0.5)*contrast + 0.5
+		if v <= 0 {
+			continue
+		}
+		if v > 1 {
+			v = 1
+		}
+		table[i] = uint8(math.Round(255 * math.Pow(v, 1/a.Gamma)))
+	}
+	return &table
+}
+
+// adjustImage applies a to img, splitting the work over threads strips of
+// rows. YCbCr images have their tones adjusted in luma and their saturation
+// in chroma; others as RGBA with mapRGBA.
+func adjustImage(img image.Image, a *Adjust, threads int) image.Image {
+	table := a.toneTable()
+	saturation := int32(math.Round(256 * (1 + a.Saturation/100)))
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	switch src := img.(type) {
+	case *image.YCbCr:
+		if shift, ok := chromaShift[src.SubsampleRatio]; ok && src.Rect.Min == (image.Point{}) {
+			dst := newPooledYCbCr(width, height, src.SubsampleRatio)
+			cw, ch := (width+shift.X)>>shift.X, (height+shift.Y)>>shift.Y
+			parallelRows(height, threads, func(y0, y1 int) {
+				for y := y0; y < y1; y++ {
+					row, out := src.Y[y*src.YStride:y*src.YStride+width], dst.Y[y*dst.YStride:]
+					for x, v := range row {
+						out[x] = table[v]
+					}
+				}
+			})
+			parallelRows(ch, threads, func(y0, y1 int) {
+				for y := y0; y < y1; y++ {
+					for x := 0; x < cw; x++ {
+						dst.Cb[y*dst.CStride+x] = saturate(src.Cb[y*src.CStride+x], 128, saturation)
+						dst.Cr[y*dst.CStride+x] = saturate(src.Cr[y*src.CStride+x], 128, saturation)
+					}
+				}
+			})
+			return dst
+		}
+	case *image.Gray:
+		return mapGray(src, table, threads)
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = newPooledRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		defer recycleImage(rgba)
+	}
+	dst := newPooledRGBA(image.Rect(0, 0, width, height))
+	mapRGBA(rgba, dst, [3]*[256]uint8{table, table, table}, saturation, threads)
+	return dst
+}
+
+// mapGray returns src with every level mapped through table.
+func mapGray(src *image.Gray, table *[256]uint8, threads int) *image.Gray {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dst := newPooledGray(image.Rect(0, 0, width, height))
+	parallelRows(height, threads, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+y):]
+			out := dst.Pix[y*dst.Stride : (y+1)*dst.Stride]
+			for x := range out {
+				out[x] = table[row[x]]
+			}
+		}
+	})
+	return dst
+}
+
+// mapRGBA writes src into dst with each color mapped through its table and
+// then saturated by saturation/256, undoing the premultiplied alpha of
+// translucent pixels so their colors map like opaque ones.
+func mapRGBA(src, dst *image.RGBA, tables [3]*[256]uint8, saturation int32, threads int) {
+	width := src.Rect.Dx()
+	parallelRows(src.Rect.Dy(), threads, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+y):]
+			out := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+			for x := 0; x < width; x++ {
+				p, o := row[x*4:x*4+4:x*4+4], out[x*4:x*4+4:x*4+4]
+				alpha := uint32(p[3])
+				if alpha == 0 {
+					o[0], o[1], o[2], o[3] = 0, 0, 0, 0
+					continue
+				}
+				var c [3]uint8
+				for i := range c {
+					v := uint32(p[i])
+					if alpha < 255 {
+						v = (v*255 + alpha/2) / alpha
+						if v > 255 {
+							v = 255
+						}
+					}
+					c[i] = tables[i][v]
+				}
+				if saturation != 256 {
+					gray := luma(c[0], c[1], c[2])
+					for i := range c {
+						c[i] = saturate(c[i], gray, saturation)
+					}
+				}
+				for i := range c {
+					o[i] = uint8((uint32(c[i])*alpha + 127) / 255)
+				}
+				o[3] = p[3]
+			}
+		}
+	})
+}
+
+// saturate spreads v away from center by factor/256.
+func saturate(v, center uint8, factor int32) uint8 {
+	x := int32(center) + (factor*(int32(v)-int32(center))+128)>>8
+	if x < 0 {
+		return 0
+	} else if x > 255 {
+		return 255
+	}
+	return uint8(x)
+}
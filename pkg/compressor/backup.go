@@ -0,0 +1,267 @@
+package compressor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupEntry is one line of backups.jsonl: an original that was replaced in
+// place and where its copy is kept.
+type BackupEntry struct {
+	Original    string    `json:"original"`
+	Replacement string    `json:"replacement"` // differs from Original when the format changed, e.g. photo.dng to photo.jpg
+	Backup      string    `json:"backup"`
+	Time        time.Time `json:"time"`
+	Restored    bool      `json:"restored,omitempty"` // put back already, by ReplaceInPlace
+}
+
+// BackupLog records the originals replaced by ReplaceInPlace, so the undo
+// command can put them back. It is safe for concurrent use.
+type BackupLog struct {
+	dir      string
+	inputDir string
+	renamed  map[string]bool // replacements of earlier runs with a new extension
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenBackupLog opens dir/backups.jsonl, if there is one, for appending.
+// Backups of files below inputDir are kept at the same relative path below
+// dir.
+func OpenBackupLog(dir, inputDir string) (*BackupLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup folder: %v", err)
+	}
+	path := filepath.Join(dir, "backups.jsonl")
+	l := &BackupLog{dir: dir, inputDir: inputDir, renamed: make(map[string]bool)}
+	if entries, err := LoadBackupLog(path); err == nil {
+		for _, entry := range entries {
+			if entry.Replacement != entry.Original {
+				l.renamed[entry.Replacement] = true
+			}
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup log: %v", err)
+	}
+	l.f = f
+	return l, nil
+}
+
+// Replaces reports whether path was written by an earlier run in place of an
+// original with another extension, such as photo.jpg for photo.dng. It is an
+// output, not an original to compress again.
+func (l *BackupLog) Replaces(path string) bool {
+	abs, _ := filepath.Abs(path)
+	return l.renamed[abs]
+}
+
+// Close closes the log file.
+func (l *BackupLog) Close() error {
+	return l.f.Close()
+}
+
+func (l *BackupLog) record(entry BackupEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write backup log: %v", err)
+	}
+	return l.f.Sync()
+}
+
+// ReplaceInPlace moves the first output of result over its original, after
+// copying the original into the backup folder and logging it. The
+// replacement is decoded once it is in place, and if that fails the original
+// is restored and logged as such, leaving undo nothing to do for it. A RAW
+// original is replaced by a file with the output's extension next to it.
+// result is updated to point at the replacement.
+//
+// An original that already has a backup, from an earlier run, keeps that one,
+// so undo always gets back the file as it was before any in-place run.
+func (l *BackupLog) ReplaceInPlace(result *FileResult, opts Options) error {
+	if len(result.Outputs) != 1 {
+		return fmt.Errorf("in-place mode needs exactly one output, got %d", len(result.Outputs))
+	}
+	original, output := result.InputPath, result.Outputs[0]
+	replacement := strings.TrimSuffix(original, filepath.Ext(original)) + filepath.Ext(output)
+	if replacement != original {
+		if _, err := os.Stat(replacement); err == nil {
+			return fmt.Errorf("failed to replace in place: %s already exists", replacement)
+		}
+	}
+
+	rel := strings.TrimPrefix(original, l.inputDir)
+	if rel == "" {
+		rel = filepath.Base(original) // the input is this file itself
+	}
+	entry := BackupEntry{
+		Original:    original,
+		Replacement: replacement,
+		Backup:      filepath.Join(l.dir, rel),
+		Time:        time.Now(),
+	}
+	// Absolute, so undo works from any directory
+	entry.Original, _ = filepath.Abs(entry.Original)
+	entry.Replacement, _ = filepath.Abs(entry.Replacement)
+	entry.Backup, _ = filepath.Abs(entry.Backup)
+	if _, err := os.Stat(entry.Backup); err != nil {
+		data, err := ioutil.ReadFile(original)
+		if err != nil {
+			return fmt.Errorf("failed to read original: %v", err)
+		}
+		if err := mkdirLike(filepath.Dir(entry.Backup), filepath.Dir(original), opts.PreserveOwner); err != nil {
+			return fmt.Errorf("failed to create backup directory: %v", err)
+		}
+		if err := writeFileAtomic(entry.Backup, data, original, opts); err != nil {
+			return fmt.Errorf("failed to write backup: %v", err)
+		}
+	}
+	// Logged before the original is touched, so undo can restore a file
+	// whose replacement was cut short
+	if err := l.record(entry); err != nil {
+		return err
+	}
+
+	if err := moveFile(output, replacement, original, opts); err != nil {
+		return fmt.Errorf("failed to move output into place: %v", err)
+	}
+	if replacement != original {
+		if err := os.Remove(original); err != nil {
+			return fmt.Errorf("failed to remove original: %v", err)
+		}
+	}
+	if err := decodeFile(replacement); err != nil {
+		if restoreErr := RestoreBackup(entry, opts); restoreErr != nil {
+			return fmt.Errorf("replacement does not decode (%v) and restoring the original failed: %v", err, restoreErr)
+		}
+		entry.Restored, entry.Time = true, time.Now()
+		if logErr := l.record(entry); logErr != nil {
+			return fmt.Errorf("replacement does not decode (%v), original restored but not logged: %v", err, logErr)
+		}
+		return fmt.Errorf("replacement does not decode, original restored: %v", err)
+	}
+
+	result.OutputPath = replacement
+	result.Outputs = []string{replacement}
+	result.Replaced = true
+	return nil
+}
+
+// RestoreBackup puts the backup of entry back in place of its original,
+// removing the replacement, and then removes the backup.
+func RestoreBackup(entry BackupEntry, opts Options) error {
+	data, err := ioutil.ReadFile(entry.Backup)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %v", err)
+	}
+	if err := writeFileAtomic(entry.Original, data, entry.Backup, opts); err != nil {
+		return fmt.Errorf("failed to restore original: %v", err)
+	}
+	if entry.Replacement != entry.Original {
+		if err := os.Remove(entry.Replacement); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove replacement: %v", err)
+		}
+	}
+	return os.Remove(entry.Backup)
+}
+
+// LoadBackupLog reads the backups.jsonl at path and returns the latest entry
+// of every original, sorted by path. Originals whose latest entry says they
+// were restored already are left out.
+func LoadBackupLog(path string) ([]BackupEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	latest := make(map[string]BackupEntry)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry BackupEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			latest[entry.Original] = entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read backup log: %v", err)
+	}
+	entries := make([]BackupEntry, 0, len(latest))
+	for _, entry := range latest {
+		if !entry.Restored {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Original < entries[j].Original })
+	return entries, nil
+}
+
+// SaveBackupLog replaces the backups.jsonl at path with entries, or removes
+// it when there are none left.
+func SaveBackupLog(path string, entries []BackupEntry) error {
+	if len(entries) == 0 {
+		return os.Remove(path)
+	}
+	var data []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return writeFileAtomic(path, data, path, Options{})
+}
+
+// moveFile moves src to dst, copying when they are on different devices.
+// dst gets the permissions of perms.
+func moveFile(src, dst, perms string, opts Options) error {
+	if err := os.Rename(src, dst); err == nil {
+		if info, err := os.Stat(perms); err == nil {
+			copyPermissions(dst, info, opts.PreserveOwner)
+		}
+		return nil
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dst, data, perms, opts); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+func decodeFile(path string) error {
+	if IsPDFFile(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return checkPDF(data)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, err := image.Decode(f); err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func pngBytes(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// replaceSetup writes original to input/photo.png and replacement to
+// output/photo.png, and opens a backup log for them.
+func replaceSetup(t *testing.T, original, replacement []byte) (*BackupLog, *FileResult, string) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input")
+	for _, d := range []string{input, filepath.Join(dir, "output")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputPath := filepath.Join(input, "photo.png")
+	outputPath := filepath.Join(dir, "output", "photo.png")
+	if err := ioutil.WriteFile(inputPath, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(outputPath, replacement, 0644); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := OpenBackupLog(filepath.Join(dir, "backup_files"), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backups.Close() })
+	result := &FileResult{InputPath: inputPath, OutputPath: outputPath, Outputs: []string{outputPath}}
+	return backups, result, filepath.Join(dir, "backup_files", "backups.jsonl")
+}
+
+func assertContents(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s holds %d bytes, want the %d expected", path, len(got), len(want))
+	}
+}
+
+func TestReplaceInPlaceUndo(t *testing.T) {
+	original, replacement := pngBytes(t, 64, 64), pngBytes(t, 8, 8)
+	backups, result, logPath := replaceSetup(t, original, replacement)
+	inputPath := result.InputPath
+	if err := backups.ReplaceInPlace(result, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	assertContents(t, inputPath, replacement)
+
+	entries, err := LoadBackupLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d backup entries, want 1", len(entries))
+	}
+	if err := RestoreBackup(entries[0], DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	assertContents(t, inputPath, original)
+	if _, err := os.Stat(entries[0].Backup); !os.IsNotExist(err) {
+		t.Fatalf("backup %s left behind after undo", entries[0].Backup)
+	}
+}
+
+func TestReplaceInPlaceRestoresUndecodable(t *testing.T) {
+	original := pngBytes(t, 64, 64)
+	backups, result, logPath := replaceSetup(t, original, []byte("not an image"))
+	err := backups.ReplaceInPlace(result, DefaultOptions())
+	if err == nil || !strings.Contains(err.Error(), "original restored") {
+		t.Fatalf("got error %v, want the original restored", err)
+	}
+	assertContents(t, result.InputPath, original)
+
+	// The restore is logged, so undo has nothing left to put back
+	entries, err := LoadBackupLog(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %d backup entries after the restore, want none: %+v", len(entries), entries)
+	}
+}
+
+func TestReplaceInPlaceManifest(t *testing.T) {
+	backups, result, logPath := replaceSetup(t, pngBytes(t, 64, 64), pngBytes(t, 8, 8))
+	if err := checksumResult(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := backups.ReplaceInPlace(result, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(filepath.Dir(logPath), "manifest.jsonl")
+	for _, mode := range []string{"hash", "mtime"} {
+		manifest, err := OpenManifest(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := manifest.Record(*result); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Close()
+
+		// The replacement is what the next run finds
+		manifest, err = OpenManifest(manifestPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.ChangeDetection = mode
+		if !manifest.Done(result.InputPath) {
+			t.Errorf("replaced file is not done with -incremental %s", mode)
+		}
+		manifest.Close()
+	}
+}
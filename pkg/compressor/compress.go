@@ -0,0 +1,687 @@
+// Package compressor resizes, watermarks and re-encodes JPEG, PNG and camera
+// RAW images, and the images inside PDFs. It is the engine behind the
+// image-compressor command and can be used on its own:
+//
+//	opts := compressor.DefaultOptions()
+//	opts.MaxWidth = 1920
+//	result, err := compressor.CompressFile(ctx, compressor.Job{Input: "in.jpg", Output: "out.jpg"}, opts)
+package compressor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// Options holds the per-image settings shared by every file of a run.
+type Options struct {
+	MaxPixels       int
+	MaxWidth        int     // 0 disables the limit
+	MaxHeight       int     // 0 disables the limit
+	Scale           float64 // downscale ratio applied before the limits; 0 disables it
+	Filter          resize.InterpolationFunction
+	CropWidth       int // 0 disables cropping
+	CropHeight      int
+	CropGravity     string // one of CropGravities
+	Sizes           []int  // widths of the responsive variants; empty writes a single output
+	ThumbWidth      int    // 0 disables thumbnails
+	ThumbHeight     int
+	JPEGQuality     int
+	JPEGEncoder     string // one of JPEGEncoders; empty uses image/jpeg
+	Progressive     bool   // multi-scan jpeg output; ignored by image/jpeg
+	Chroma          string // jpeg chroma subsampling, one of ChromaSubsampling; image/jpeg always uses 420
+	Lossless        bool   // rewrite entropy coding and metadata only; see writeLossless
+	PNGCompression  png.CompressionLevel
+	PNGOptimize     string  // one of PNGOptimizeModes; empty or "off" encodes as is
+	Colors          int     // palette size png and gif output is quantized to; 0 disables it
+	GIFColors       int     // palette size of gif output without Colors; 256 (or 0) keeps image/gif's
+	Dither          string  // one of DitherModes, for Colors and GIFColors
+	TargetSize      int64   // maximum output size in bytes; 0 disables the search
+	SSIMTarget      float64 // minimum SSIM for JPEG output; 0 disables the search
+	KeepMetadata    bool
+	StripMetadata   map[string]bool // metadata categories removed before writing
+	Placeholders    map[string]bool // PlaceholderKinds kept in FileResult for the first output
+	AutoOrient      bool
+	ConvertToSRGB   bool
+	Watermark       Watermark
+	RawMode         string // "preview" or "full"; see decodeRaw
+	ConvertTo       string // output format; empty keeps the input format
+	Background      color.Color
+	Engine          string        // one of Engines; empty or "go" uses the Go pipeline
+	PreviewWidth    int           // width of the before/after previews kept in FileResult; 0 skips them
+	PreserveOwner   bool          // copy the source uid and gid to outputs and created directories, as root
+	FollowSymlinks  bool          // enter symlinked folders when planning; see Plan
+	OutsideSymlinks string        // one of SymlinkPolicies; empty skips
+	PathFilter      *PathFilter   // files Plan selects; nil selects all
+	MinSize         int64         // smallest file Plan selects, in bytes; 0 for no limit
+	MinPixels       int           // fewest pixels of an image Plan selects; 0 for no limit
+	Since           time.Time     // earliest file date Plan selects; zero for no limit
+	Until           time.Time     // file dates Plan selects are before this; zero for no limit
+	DateSource      string        // one of DateSources; empty uses mtime
+	ExifFilter      *ExifFilter   // files Plan selects by EXIF fields; nil selects all
+	OrganizeByDate  bool          // Plan puts outputs in YYYY/MM/DD folders by capture date; see PlannedOutputPath
+	Flatten         bool          // Plan puts every output directly in the output folder, numbering clashing names
+	NameTemplate    string        // output file names with NameTemplatePlaceholders; empty mirrors the source names
+	Retries         int           // extra attempts at files failing with transient IO errors; see IsTransient
+	RetryDelay      time.Duration // wait before the first retry, doubled for each one after
+	Verify          bool          // read back and decode every output once written; see CompressFile
+	QualityMetrics  bool          // measure the SSIM and PSNR of every output against the pixels it was encoded from
+	Denoise         float64       // strength of the bilateral filter after resizing, in 8-bit levels; 0 disables it
+	AutoEnhance     bool          // stretch the levels of each channel after denoising, which also balances white
+	Adjust          *Adjust       // tone adjustments after denoising and auto enhancement; nil leaves tones alone
+	Sharpen         Sharpen       // unsharp mask after resizing, cropping, denoising and adjusting
+	Grayscale       bool          // convert to 8-bit grayscale before encoding
+	TilePixels      int           // images of at least this many pixels are resampled in strips on every CPU at once; 0 for never
+}
+
+// DefaultOptions returns the settings used by the command line tool when no
+// flags are given.
+func DefaultOptions() Options {
+	return Options{
+		MaxPixels:      12000000,
+		Filter:         resize.Lanczos3,
+		CropGravity:    "center",
+		JPEGQuality:    80,
+		JPEGEncoder:    "std",
+		Chroma:         "420",
+		PNGCompression: png.DefaultCompression,
+		GIFColors:      256,
+		KeepMetadata:   true,
+		AutoOrient:     true,
+		Watermark: Watermark{
+			ImageScale: 0.15,
+			Position:   "br",
+			Margin:     10,
+			Size:       WatermarkSize{Value: 20},
+			Color:      color.NRGBA{A: 255},
+			Opacity:    1,
+			TileAngle:  30,
+			TileGap:    100,
+		},
+		RawMode:    "preview",
+		Background: color.White,
+		Engine:     "go",
+		TilePixels: 50000000,
+	}
+}
+
+// Job names a single file to compress and where its outputs go.
+type Job struct {
+	Input     string
+	Output    string // -sizes variants are named after it; see variantPath
+	Thumbnail string // used when Options.ThumbWidth is set
+	Index     int    // 1-based position of the file in the run, for {index}
+}
+
+// PNGCompressionLevels maps the -png-compression names to encoder levels.
+var PNGCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"speed":   png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// FormatExtensions maps each output format to its file extension.
+var FormatExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+}
+
+// ParseFormat returns the output format called name, in any case, with jpg
+// standing for jpeg. WebP is refused with its own error: Go has a decoder
+// for it but no encoder, so it can't be written.
+func ParseFormat(name string) (string, error) {
+	format := strings.ToLower(name)
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	switch {
+	case format == "webp":
+		return "", fmt.Errorf("webp output is not supported, for lack of a webp encoder: use jpeg or png")
+	case FormatExtensions[format] == "":
+		return "", fmt.Errorf("must be jpeg, png or gif")
+	}
+	return format, nil
+}
+
+// HumanReadableSize formats size in bytes with a binary unit, e.g. "1.50 MB".
+func HumanReadableSize(size int64) string {
+	const (
+		KB = 1024
+		MB = KB * 1024
+		GB = MB * 1024
+	)
+
+	switch {
+	case size >= GB:
+		return fmt.Sprintf("%.2f GB", float64(size)/float64(GB))
+	case size >= MB:
+		return fmt.Sprintf("%.2f MB", float64(size)/float64(MB))
+	case size >= KB:
+		return fmt.Sprintf("%.2f KB", float64(size)/float64(KB))
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
+
+// ParseHexColor parses a #rgb, #rrggbb or #rrggbbaa color.
+func ParseHexColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	var c color.NRGBA
+	if len(hex) != 8 {
+		return c, fmt.Errorf("invalid color %q", s)
+	}
+	if _, err := fmt.Sscanf(hex, "%02x%02x%02x%02x", &c.R, &c.G, &c.B, &c.A); err != nil {
+		return c, fmt.Errorf("invalid color %q", s)
+	}
+	return c, nil
+}
+
+// flattenImage composites img onto a solid background, for output formats
+// that cannot store an alpha channel. Opaque images are returned unchanged.
+func flattenImage(img image.Image, background color.Color) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	rgba := newPooledRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Over)
+	return rgba
+}
+
+// ParseSize parses sizes such as "500KB", "1.5MB" or "2048" (bytes), using
+// the same 1024-based units as HumanReadableSize.
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+	value := strings.ToUpper(strings.TrimSpace(s))
+	scale := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * scale), nil
+}
+
+// decodeImage returns the decoded image, its format and the encoded bytes it
+// was decoded from (the embedded preview for RAW files, nil for full decode).
+// A RAW preview is oriented when autoOrient is set; other images never are.
+func decodeImage(inputPath, rawMode string, autoOrient bool) (image.Image, string, []byte, error) {
+	if IsRawFile(inputPath) {
+		img, preview, err := decodeRaw(inputPath, rawMode, autoOrient)
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("failed to decode raw image: %w", err)
+		}
+		return img, "jpeg", preview, nil
+	}
+
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to open image: %w", err)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return img, format, data, nil
+}
+
+// sourceImage is a decoded, oriented input shared by all of its outputs.
+type sourceImage struct {
+	path     string
+	img      image.Image
+	format   string
+	data     []byte // original file contents, for metadata and color profiles
+	oriented bool
+}
+
+// CompressFile compresses job.Input into job.Output (or its -sizes variants)
+// and, when opts asks for thumbnails, writes one to job.Thumbnail. Transient
+// IO errors are retried opts.Retries times with exponential backoff. With
+// opts.Verify the outputs are decoded again from disk, and a file failing
+// that (or anything else) leaves none behind. A compressed file's result
+// carries the SHA-256 of its source and outputs. The returned result is
+// filled in even when compression fails.
+func CompressFile(ctx context.Context, job Job, opts Options) (FileResult, error) {
+	start := time.Now()
+	var result FileResult
+	var err error
+	for attempt := 0; ; attempt++ {
+		result = FileResult{Index: job.Index, InputPath: job.Input, OutputPath: job.Output, Retries: attempt}
+		err = compressFile(ctx, job, opts, &result)
+		if err == nil && opts.Verify {
+			err = verifyOutputs(&result)
+		}
+		if err == nil {
+			err = checksumResult(&result)
+		}
+		if err == nil {
+			break
+		}
+		// A failed file leaves no outputs behind, rather than some of its
+		// variants or a thumbnail without its image
+		removeOutputs(&result)
+		if attempt >= opts.Retries || !IsTransient(err) {
+			break
+		}
+		timer := time.NewTimer(opts.RetryDelay << attempt)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	result.Duration = time.Since(start)
+	result.Err = err
+	return result, err
+}
+
+// removeOutputs deletes the files written for result and clears them from it.
+func removeOutputs(result *FileResult) {
+	for _, path := range result.Outputs {
+		os.Remove(path)
+	}
+	if result.Thumbnail != "" {
+		os.Remove(result.Thumbnail)
+	}
+	result.Outputs, result.OutputSize, result.Thumbnail = nil, 0, ""
+}
+
+// CompressBytes compresses the image file contents data in memory, for
+// callers without files such as the pipe command. RAW data is read through
+// its embedded preview, and PDFs have their images recompressed. Sizes,
+// thumbnails, lossless mode and the vips engine do not apply; names in
+// watermark text are empty.
+func CompressBytes(data []byte, opts Options) ([]byte, FileResult, error) {
+	start := time.Now()
+	result := FileResult{Index: 1, InputSize: int64(len(data)), Engine: "go"}
+	if isPDFData(data) {
+		opts.Lossless = false
+		encoded, err := recompressPDF(data, opts, &result)
+		result.OutputSize = int64(len(encoded))
+		result.Duration = time.Since(start)
+		result.Err = err
+		return encoded, result, err
+	}
+	// RAW containers are TIFF files, which a registered TIFF decoder would
+	// otherwise read as their first, often tiny, image
+	var img image.Image
+	var format string
+	preview, err := extractRawPreview(data)
+	raw := err == nil
+	if raw {
+		if img, err = jpeg.Decode(bytes.NewReader(preview)); err != nil {
+			return nil, result, fmt.Errorf("failed to decode raw image: %v", err)
+		}
+		if opts.AutoOrient {
+			img = applyOrientation(img, exifOrientation(data))
+		}
+		format, data = "jpeg", preview
+	} else if img, format, err = image.Decode(bytes.NewReader(data)); err != nil {
+		return nil, result, fmt.Errorf("failed to decode image: %v", err)
+	}
+	result.DecodeTime = time.Since(start)
+	src := sourceImage{img: img, format: format, data: data}
+	if opts.AutoOrient && !raw {
+		if orientation := exifOrientation(readExif(data)); orientation != 1 {
+			src.img = applyOrientation(img, orientation)
+			src.oriented = true
+		}
+	}
+	result.Width, result.Height = src.img.Bounds().Dx(), src.img.Bounds().Dy()
+	if src.oriented {
+		defer recycleImage(src.img)
+	}
+	encoded, err := renderOutput(src, opts, &result, new(bytes.Buffer))
+	result.OutputSize = int64(len(encoded))
+	result.Duration = time.Since(start)
+	result.Err = err
+	return encoded, result, err
+}
+
+func compressFile(ctx context.Context, job Job, opts Options, result *FileResult) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	info, err := os.Stat(job.Input)
+	if err != nil {
+		return err
+	}
+	result.InputSize = info.Size()
+	inputPath, outputPath := job.Input, job.Output
+
+	// Create the necessary directories
+	if err := mkdirLike(filepath.Dir(outputPath), filepath.Dir(inputPath), opts.PreserveOwner); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	if IsPDFFile(inputPath) {
+		result.Engine = "go"
+		return compressPDF(inputPath, outputPath, opts, result)
+	}
+	if opts.Lossless {
+		result.Engine = "go"
+		if err := writeLossless(inputPath, outputPath, opts, result); err != nil {
+			return err
+		}
+		addPreviews(result, nil, opts)
+		addPlaceholders(result, opts)
+		return nil
+	}
+	if useVips(inputPath, opts) {
+		result.Engine = "vips"
+		if err := compressWithVips(ctx, job, opts, result); err != nil {
+			return err
+		}
+		addPreviews(result, nil, opts)
+		addPlaceholders(result, opts)
+		return nil
+	}
+	result.Engine = "go"
+
+	decodeStart := time.Now()
+	img, format, data, err := decodeImage(inputPath, opts.RawMode, opts.AutoOrient)
+	if err != nil {
+		return err
+	}
+	result.DecodeTime = time.Since(decodeStart)
+	src := sourceImage{path: inputPath, img: img, format: format, data: data}
+
+	if opts.AutoOrient && !IsRawFile(inputPath) {
+		if orientation := exifOrientation(readExif(data)); orientation != 1 {
+			src.img = applyOrientation(img, orientation)
+			src.oriented = true
+			defer recycleImage(src.img)
+		}
+	}
+	result.Width, result.Height = src.img.Bounds().Dx(), src.img.Bounds().Dy()
+
+	if len(opts.Sizes) == 0 {
+		if err := writeOutput(src, outputPath, opts, result); err != nil {
+			return err
+		}
+	}
+	// Responsive variants are limited to each width in turn on top of the
+	// other limits; the decoded source is reused for all of them.
+	for _, width := range opts.Sizes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		variant := opts
+		if variant.MaxWidth == 0 || width < variant.MaxWidth {
+			variant.MaxWidth = width
+		}
+		if err := writeOutput(src, variantPath(outputPath, width), variant, result); err != nil {
+			return err
+		}
+	}
+
+	if opts.ThumbWidth > 0 {
+		// Thumbnails are cropped from the same pixels, without watermarks or
+		// size searches, and are not counted in the output totals.
+		thumb := opts
+		thumb.CropWidth, thumb.CropHeight = opts.ThumbWidth, opts.ThumbHeight
+		thumb.Watermark = Watermark{}
+		thumb.TargetSize, thumb.SSIMTarget = 0, 0
+		if err := mkdirLike(filepath.Dir(job.Thumbnail), filepath.Dir(inputPath), opts.PreserveOwner); err != nil {
+			return fmt.Errorf("failed to create thumbnail directory: %w", err)
+		}
+		if err := writeOutput(src, job.Thumbnail, thumb, &FileResult{}); err != nil {
+			return fmt.Errorf("failed to write thumbnail: %w", err)
+		}
+		result.Thumbnail = job.Thumbnail
+	}
+	addPreviews(result, src.img, opts)
+	addPlaceholders(result, opts)
+	return nil
+}
+
+// writeFileAtomic writes data to path through a uniquely named hidden file
+// next to it and a rename, so an output is either complete or absent even if
+// the process dies mid-write, and concurrent writers of one path never share
+// a temporary file. The output gets the permissions of the source file src,
+// or 0644 without one.
+func writeFileAtomic(path string, data []byte, src string, opts Options) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if info, err := os.Stat(src); err == nil {
+		err = copyPermissions(tmp, info, opts.PreserveOwner)
+	} else {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// measureQuality records the SSIM and PSNR of encoded against img, the
+// resized and watermarked pixels it was encoded from. With several variants
+// the report shows the worst of each.
+func measureQuality(img image.Image, encoded []byte, format string, opts Options, result *FileResult) error {
+	decoded, _, err := image.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		return fmt.Errorf("failed to decode encoded image: %v", err)
+	}
+	reference := img
+	if format == "jpeg" {
+		reference = flattenImage(img, opts.Background)
+		if reference != img {
+			defer recycleImage(reference)
+		}
+	}
+	if score := ssim(reference, decoded); result.SSIM == 0 || score < result.SSIM {
+		result.SSIM = score
+	}
+	if score := psnr(reference, decoded); result.PSNR == 0 || score < result.PSNR {
+		result.PSNR = score
+	}
+	return nil
+}
+
+// writeOutput resizes, watermarks and encodes src into outputPath, recording
+// the output in result.
+func writeOutput(src sourceImage, outputPath string, opts Options, result *FileResult) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	encoded, err := renderOutput(src, opts, result, buf)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(outputPath, encoded, src.path, opts); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	result.Outputs = append(result.Outputs, outputPath)
+	result.OutputSize += int64(len(encoded))
+	return nil
+}
+
+// renderOutput returns src resized, watermarked and encoded by opts, recording
+// its dimensions in result. The encoding is written to buf, which it may
+// share.
+func renderOutput(src sourceImage, opts Options, result *FileResult, buf *bytes.Buffer) ([]byte, error) {
+	var err error
+	resizeStart := time.Now()
+	newImg, onGPU := resizeImage(src.img, opts)
+	if onGPU {
+		result.Engine = "gpu"
+	}
+	// Every image made on the way is recycled for the next output once it
+	// has been replaced or encoded; the source is shared by all the outputs.
+	replace := func(img image.Image) {
+		if newImg != src.img && newImg != img {
+			recycleImage(newImg)
+		}
+		newImg = img
+	}
+	defer func() { replace(src.img) }()
+	if opts.CropWidth > 0 {
+		replace(cropImage(newImg, opts.CropWidth, opts.CropHeight, opts.CropGravity, opts.Filter))
+	}
+	if opts.Denoise > 0 {
+		replace(denoiseImage(newImg, opts.Denoise, stripThreads(newImg.Bounds(), opts)))
+	}
+	if opts.AutoEnhance {
+		replace(autoEnhanceImage(newImg, stripThreads(newImg.Bounds(), opts)))
+	}
+	if opts.Adjust != nil {
+		replace(adjustImage(newImg, opts.Adjust, stripThreads(newImg.Bounds(), opts)))
+	}
+	if opts.Sharpen.Amount > 0 {
+		replace(sharpenImage(newImg, opts.Sharpen, stripThreads(newImg.Bounds(), opts)))
+	}
+	if newImg.Bounds() != src.img.Bounds() {
+		result.ResizeTime += time.Since(resizeStart)
+	}
+
+	// Color profiles are kept, if metadata is, unless the pixels are converted
+	// to sRGB, in which case the profile no longer applies. Unsupported
+	// profiles are kept as is.
+	profile := readICCProfile(src.data)
+	if profile != nil && opts.ConvertToSRGB {
+		if transform, err := parseICCTransform(profile); err == nil {
+			replace(transform.convert(newImg))
+			profile = nil
+		}
+	}
+
+	if opts.Watermark.Text != "" {
+		// Add watermark, dated by EXIF capture time or else modification time
+		wm := opts.Watermark
+		date, ok := exifDateTime(readExif(src.data))
+		if info, statErr := os.Stat(src.path); !ok && statErr == nil {
+			date = info.ModTime()
+		}
+		wm.Text = expandWatermarkText(wm.Text, src.path, result.Index, date)
+		watermarked, err := addWatermark(newImg, wm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add watermark: %v", err)
+		}
+		replace(watermarked)
+	}
+
+	if opts.Watermark.Image != nil {
+		replace(addImageWatermark(newImg, opts.Watermark))
+	}
+
+	format := src.format
+	if opts.ConvertTo != "" {
+		format = opts.ConvertTo
+	}
+	if opts.Grayscale {
+		if format == "jpeg" {
+			replace(flattenImage(newImg, opts.Background))
+		}
+		replace(grayscaleImage(newImg))
+		profile = nil // a color profile does not describe gray pixels
+	}
+
+	// The profile and metadata of the source go into the encoding, which
+	// size targets count them in
+	addMetadata := func(encoded []byte) []byte {
+		if profile != nil && keepICCProfile(opts) {
+			encoded = embedICCProfile(encoded, profile, format)
+		}
+		if opts.KeepMetadata {
+			encoded = copyMetadata(encoded, src.data, format, opts.StripMetadata, src.oriented, newImg.Bounds().Dx(), newImg.Bounds().Dy())
+		}
+		return encoded
+	}
+
+	var encoded []byte
+	encodeStart := time.Now()
+	if opts.TargetSize > 0 {
+		encoded, err = encodeToTargetSize(newImg, format, opts, addMetadata)
+		if err != nil {
+			return nil, err
+		}
+	} else if opts.SSIMTarget > 0 && format == "jpeg" {
+		var score float64
+		encoded, score, err = encodeToSSIMTarget(newImg, opts)
+		if err != nil {
+			return nil, err
+		}
+		// With several variants the report shows the worst one
+		if result.SSIM == 0 || score < result.SSIM {
+			result.SSIM = score
+		}
+	} else {
+		if err := encodeImage(buf, newImg, format, opts); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %v", err)
+		}
+		encoded = buf.Bytes()
+	}
+	result.EncodeTime += time.Since(encodeStart)
+
+	if opts.QualityMetrics {
+		if err := measureQuality(newImg, encoded, format, opts, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.TargetSize == 0 {
+		encoded = addMetadata(encoded)
+	}
+
+	if result.OutputWidth == 0 {
+		result.OutputWidth, result.OutputHeight = newImg.Bounds().Dx(), newImg.Bounds().Dy()
+	}
+	return encoded, nil
+}
@@ -0,0 +1,165 @@
+package compressor
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-text/typesetting/font"
+	"github.com/nfnt/resize"
+)
+
+// ContactSheet lays images out in a grid of thumbnails, for reviewing a
+// shoot at a glance.
+type ContactSheet struct {
+	Columns    int
+	Rows       int // rows per page; 0 puts every image on one page
+	CellSize   int // longest side of a thumbnail, in pixels
+	Captions   bool
+	Fonts      []*font.Font // for the captions; see LoadFonts
+	Background color.Color
+	RawMode    string
+	Threads    int // images decoded at once
+}
+
+// Render decodes paths, oriented as compress would, and returns the pages of
+// the sheet. Images that cannot be decoded are returned in failed and left
+// out.
+func (cs ContactSheet) Render(paths []string) (pages []*image.RGBA, failed map[string]error) {
+	thumbs := make([]image.Image, len(paths))
+	errs := make([]error, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for t := 0; t < cs.Threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				thumbs[i], errs[i] = cs.thumbnail(paths[i])
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	failed = make(map[string]error)
+	var cells []int
+	for i, err := range errs {
+		if err != nil {
+			failed[paths[i]] = err
+		} else {
+			cells = append(cells, i)
+		}
+	}
+	perPage := len(cells)
+	if cs.Rows > 0 {
+		perPage = cs.Columns * cs.Rows
+	}
+	for start := 0; start < len(cells); start += perPage {
+		end := start + perPage
+		if end > len(cells) {
+			end = len(cells)
+		}
+		page := cs.newPage(end - start)
+		for k, i := range cells[start:end] {
+			cs.drawCell(page, k, thumbs[i], filepath.Base(paths[i]))
+		}
+		pages = append(pages, page)
+	}
+	return pages, failed
+}
+
+// thumbnail decodes the image at path and scales it to fit a cell.
+func (cs ContactSheet) thumbnail(path string) (image.Image, error) {
+	img, _, data, err := decodeImage(path, cs.RawMode, true)
+	if err != nil {
+		return nil, err
+	}
+	if !IsRawFile(path) {
+		img = applyOrientation(img, exifOrientation(readExif(data)))
+	}
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width > cs.CellSize || height > cs.CellSize {
+		if width >= height {
+			width, height = cs.CellSize, height*cs.CellSize/width
+		} else {
+			width, height = width*cs.CellSize/height, cs.CellSize
+		}
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+		img = Resample(img, width, height, resize.Lanczos3)
+	}
+	return img, nil
+}
+
+// gap is the space around cells, fontSize that of captions.
+func (cs ContactSheet) gap() int {
+	if gap := cs.CellSize / 12; gap > 4 {
+		return gap
+	}
+	return 4
+}
+
+func (cs ContactSheet) fontSize() float64 {
+	if size := float64(cs.CellSize) / 14; size > 9 {
+		return size
+	}
+	return 9
+}
+
+// cellHeight is the height of a cell, with its caption.
+func (cs ContactSheet) cellHeight() int {
+	if !cs.Captions {
+		return cs.CellSize
+	}
+	return cs.CellSize + int(cs.fontSize()*1.6)
+}
+
+// newPage returns a blank page for count cells.
+func (cs ContactSheet) newPage(count int) *image.RGBA {
+	gap := cs.gap()
+	rows := (count + cs.Columns - 1) / cs.Columns
+	page := image.NewRGBA(image.Rect(0, 0, cs.Columns*(cs.CellSize+gap)+gap, rows*(cs.cellHeight()+gap)+gap))
+	draw.Draw(page, page.Bounds(), image.NewUniform(cs.Background), image.Point{}, draw.Src)
+	return page
+}
+
+// drawCell draws thumb, centered in the k-th cell of page, and its caption.
+func (cs ContactSheet) drawCell(page *image.RGBA, k int, thumb image.Image, caption string) {
+	gap := cs.gap()
+	cell := image.Pt(gap+(k%cs.Columns)*(cs.CellSize+gap), gap+(k/cs.Columns)*(cs.cellHeight()+gap))
+	size := thumb.Bounds().Size()
+	at := cell.Add(image.Pt((cs.CellSize-size.X)/2, (cs.CellSize-size.Y)/2))
+	draw.Draw(page, image.Rectangle{at, at.Add(size)}, thumb, thumb.Bounds().Min, draw.Over)
+	if !cs.Captions {
+		return
+	}
+
+	// Captions too wide for the cell lose characters before an ellipsis
+	runes := []rune(caption)
+	text := caption
+	shaped := shapeText(cs.Fonts, text, cs.fontSize())
+	for shaped.size().X > cs.CellSize && len(runes) > 1 {
+		runes = runes[:len(runes)-1]
+		text = string(runes) + "..."
+		shaped = shapeText(cs.Fonts, text, cs.fontSize())
+	}
+	mask := image.NewAlpha(image.Rectangle{Max: shaped.size()})
+	shaped.draw(mask, 0)
+	textColor := color.Color(color.Gray{0x30})
+	if r, g, b, _ := cs.Background.RGBA(); 0.299*float64(r)+0.587*float64(g)+0.114*float64(b) < 0x8000 {
+		textColor = color.Gray{0xd0}
+	}
+	captionHeight := cs.cellHeight() - cs.CellSize
+	at = cell.Add(image.Pt((cs.CellSize-mask.Rect.Dx())/2, cs.CellSize+(captionHeight-mask.Rect.Dy())/2))
+	draw.DrawMask(page, image.Rectangle{at, at.Add(mask.Rect.Size())}, image.NewUniform(textColor), image.Point{}, mask, image.Point{}, draw.Over)
+}
@@ -0,0 +1,70 @@
+package compressor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DateSources lists what Options.DateSource can date a file by: its
+// modification time, or the EXIF capture time with the modification time as
+// the fallback for files without one.
+var DateSources = map[string]bool{
+	"mtime": true,
+	"exif":  true,
+}
+
+// dateFormats are the layouts accepted by ParseDate, most specific first.
+var dateFormats = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// ParseDate parses a -since or -until value such as "2023-01-01" or
+// "2023-01-01T18:30:00", in local time unless it has a zone. dateOnly is set
+// when no time of day was given.
+func ParseDate(s string) (date time.Time, dateOnly bool, err error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateFormats {
+		if date, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return date, layout == "2006-01-02", nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("invalid date %q: must be YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS", s)
+}
+
+// fileDate returns the date Plan compares with Options.Since and Until.
+func fileDate(path string, info os.FileInfo, source string) time.Time {
+	if source == "exif" {
+		if date, ok := exifDateTime(readExifHead(path)); ok {
+			return date
+		}
+	}
+	return info.ModTime()
+}
+
+// readExifHead reads the EXIF block of an image from the start of the file:
+// a JPEG's APP1 segment is at most 64KB, and RAW files keep their IFDs near
+// the front. PNGs may put eXIf after the pixels and are read whole.
+func readExifHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var limit int64 = 128 << 10
+	lower := strings.ToLower(path)
+	switch {
+	case IsRawFile(lower):
+		limit = 1 << 20
+	case strings.HasSuffix(lower, ".png"):
+		limit = 1 << 62
+	}
+	data, err := io.ReadAll(io.LimitReader(f, limit))
+	if err != nil {
+		return nil
+	}
+	if IsRawFile(lower) {
+		return data // the file itself is TIFF-structured
+	}
+	return readExif(data)
+}
@@ -0,0 +1,116 @@
+package compressor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DedupeModes lists the -dedupe modes: how a source identical to an earlier
+// one gets that one's outputs instead of being compressed again.
+var DedupeModes = map[string]bool{
+	"off":      true,
+	"hardlink": true,
+	"symlink":  true,
+	"copy":     true,
+}
+
+// Duplicate is a planned file with the same contents as an earlier one.
+type Duplicate struct {
+	Path   string
+	Output string
+	Size   int64
+	Of     string // the first file with these contents, which is compressed
+}
+
+// FindDuplicates splits planned files, given as parallel slices of paths and
+// outputs, into the first file of each set of identical ones and the others.
+// Only files sharing their size with another are hashed.
+func FindDuplicates(paths, outputs []string) (uniquePaths, uniqueOutputs []string, duplicates []Duplicate, err error) {
+	sizes := make([]int64, len(paths))
+	bySize := make(map[int64]int)
+	for i, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		sizes[i] = info.Size()
+		bySize[sizes[i]]++
+	}
+	first := make(map[string]string) // SHA-256 to the first path with it
+	for i, path := range paths {
+		if bySize[sizes[i]] > 1 {
+			sum, err := fileSHA256(path)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to checksum %s: %v", path, err)
+			}
+			key := fmt.Sprintf("%d:%s", sizes[i], sum)
+			if of, ok := first[key]; ok {
+				duplicates = append(duplicates, Duplicate{Path: path, Output: outputs[i], Size: sizes[i], Of: of})
+				continue
+			}
+			first[key] = path
+		}
+		uniquePaths = append(uniquePaths, path)
+		uniqueOutputs = append(uniqueOutputs, outputs[i])
+	}
+	return uniquePaths, uniqueOutputs, duplicates, nil
+}
+
+// LinkDuplicate gives dup the outputs of of, the result of compressing its
+// first copy, by hard link, symlink or copy, and returns the duplicate's own
+// result. thumbnail is where the duplicate's thumbnail would go.
+func LinkDuplicate(dup Duplicate, of FileResult, thumbnail string, opts Options, mode string) (FileResult, error) {
+	result := of
+	result.InputPath, result.OutputPath, result.Outputs = dup.Path, dup.Output, nil
+	result.Thumbnail, result.Before, result.After, result.Deleted = "", nil, nil, false
+	targets := []string{dup.Output}
+	if len(opts.Sizes) > 0 && !IsPDFFile(dup.Output) {
+		targets = targets[:0]
+		for _, width := range opts.Sizes {
+			targets = append(targets, variantPath(dup.Output, width))
+		}
+	}
+	if len(targets) != len(of.Outputs) {
+		return result, fmt.Errorf("%s has %d outputs, expected %d", of.InputPath, len(of.Outputs), len(targets))
+	}
+	for i, target := range targets {
+		if err := linkOutput(of.Outputs[i], target, dup.Path, opts, mode); err != nil {
+			return result, err
+		}
+		result.Outputs = append(result.Outputs, target)
+	}
+	if of.Thumbnail != "" {
+		if err := linkOutput(of.Thumbnail, thumbnail, dup.Path, opts, mode); err != nil {
+			return result, err
+		}
+		result.Thumbnail = thumbnail
+	}
+	return result, nil
+}
+
+func linkOutput(src, dst, input string, opts Options, mode string) error {
+	if err := mkdirLike(filepath.Dir(dst), filepath.Dir(input), opts.PreserveOwner); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	os.Remove(dst) // left by an earlier run
+	var err error
+	switch mode {
+	case "hardlink":
+		err = os.Link(src, dst)
+	case "symlink":
+		var target string
+		if target, err = filepath.Rel(filepath.Dir(dst), src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+	default:
+		var data []byte
+		if data, err = os.ReadFile(src); err == nil {
+			err = writeFileAtomic(dst, data, input, opts)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	return nil
+}
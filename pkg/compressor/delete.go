@@ -0,0 +1,55 @@
+package compressor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// DeleteOriginal removes the source of a compressed file once every output
+// is known to be on disk and readable: each is decoded again and the
+// directories holding them are synced, so a crash can't lose both the
+// original and the output. result.Deleted is set when the source is gone.
+func DeleteOriginal(result *FileResult) error {
+	if result.Err != nil || len(result.Outputs) == 0 {
+		return fmt.Errorf("no verified output")
+	}
+	outputs := result.Outputs
+	if result.Thumbnail != "" {
+		outputs = append(append([]string{}, outputs...), result.Thumbnail)
+	}
+	synced := make(map[string]bool)
+	for _, path := range outputs {
+		if err := decodeFile(path); err != nil {
+			return fmt.Errorf("failed to verify output %s: %v", path, err)
+		}
+		dir := filepath.Dir(path)
+		if synced[dir] {
+			continue
+		}
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("failed to sync %s: %v", dir, err)
+		}
+		synced[dir] = true
+	}
+	if err := os.Remove(result.InputPath); err != nil {
+		return err
+	}
+	result.Deleted = true
+	return nil
+}
+
+// syncDir flushes a directory's entries, such as a file just renamed into
+// it. Windows can't sync directories and doesn't need to.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,147 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// denoiseRadius is how far the bilateral filter looks, in pixels, and
+// denoiseSigma the spread of its spatial weights.
+const (
+	denoiseRadius = 3
+	denoiseSigma  = 1.5
+)
+
+// bilateralWeights are the fixed point weights of a bilateral filter: by
+// offset within the window, and by difference in value, which is what keeps
+// edges from blurring: pixels across an edge differ by more than the noise.
+type bilateralWeights struct {
+	spatial [2*denoiseRadius + 1][2*denoiseRadius + 1]int32
+	rng     [256]int32
+}
+
+func newBilateralWeights(strength float64) *bilateralWeights {
+	b := &bilateralWeights{}
+	for dy := -denoiseRadius; dy <= denoiseRadius; dy++ {
+		for dx := -denoiseRadius; dx <= denoiseRadius; dx++ {
+			d2 := float64(dx*dx + dy*dy)
+			b.spatial[dy+denoiseRadius][dx+denoiseRadius] = int32(math.Round(256 * math.Exp(-d2/(2*denoiseSigma*denoiseSigma))))
+		}
+	}
+	for d := range b.rng {
+		b.rng[d] = int32(math.Round(256 * math.Exp(-float64(d*d)/(2*strength*strength))))
+	}
+	return b
+}
+
+// denoiseImage smooths noise out of img with a bilateral filter whose
+// strength is the noise amplitude, in 8-bit levels, it averages away;
+// differences well above it are kept as detail. YCbCr and gray images are
+// filtered plane by plane, chroma included, and others as RGBA weighted by
+// how much all three colors differ, keeping alpha.
+func denoiseImage(img image.Image, strength float64, threads int) image.Image {
+	weights := newBilateralWeights(strength)
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	switch src := img.(type) {
+	case *image.YCbCr:
+		if shift, ok := chromaShift[src.SubsampleRatio]; ok && src.Rect.Min == (image.Point{}) {
+			dst := newPooledYCbCr(width, height, src.SubsampleRatio)
+			cw, ch := (width+shift.X)>>shift.X, (height+shift.Y)>>shift.Y
+			bilateralPlane(src.Y, src.YStride, dst.Y, dst.YStride, width, height, 1, weights, threads)
+			bilateralPlane(src.Cb, src.CStride, dst.Cb, dst.CStride, cw, ch, 1, weights, threads)
+			bilateralPlane(src.Cr, src.CStride, dst.Cr, dst.CStride, cw, ch, 1, weights, threads)
+			return dst
+		}
+	case *image.Gray:
+		dst := newPooledGray(image.Rect(0, 0, width, height))
+		bilateralPlane(src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, dst.Pix, dst.Stride, width, height, 1, weights, threads)
+		return dst
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = newPooledRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		defer recycleImage(rgba)
+	}
+	dst := newPooledRGBA(image.Rect(0, 0, width, height))
+	bilateralPlane(rgba.Pix[rgba.PixOffset(rgba.Rect.Min.X, rgba.Rect.Min.Y):], rgba.Stride, dst.Pix, dst.Stride, width, height, 4, weights, threads)
+	return dst
+}
+
+// bilateralPlane filters a plane of width x height pixels of channels bytes
+// into dst. With four channels the fourth is alpha, copied as is.
+func bilateralPlane(src []byte, srcStride int, dst []byte, dstStride, width, height, channels int, b *bilateralWeights, threads int) {
+	parallelRows(height, threads, func(y0, y1 int) {
+		var columns [2*denoiseRadius + 1]int
+		for y := y0; y < y1; y++ {
+			out := dst[y*dstStride:]
+			for x := 0; x < width; x++ {
+				for k := range columns {
+					cx := x + k - denoiseRadius
+					if cx < 0 {
+						cx = 0
+					} else if cx >= width {
+						cx = width - 1
+					}
+					columns[k] = cx * channels
+				}
+				center := src[y*srcStride+x*channels:]
+				var total, r, g, bl int32
+				for j := -denoiseRadius; j <= denoiseRadius; j++ {
+					cy := y + j
+					if cy < 0 {
+						cy = 0
+					} else if cy >= height {
+						cy = height - 1
+					}
+					row := src[cy*srcStride:]
+					spatial := &b.spatial[j+denoiseRadius]
+					for k, offset := range columns {
+						p := row[offset:]
+						var d int32
+						if channels == 1 {
+							d = int32(p[0]) - int32(center[0])
+							if d < 0 {
+								d = -d
+							}
+						} else {
+							d = abs32(int32(p[0])-int32(center[0])) + abs32(int32(p[1])-int32(center[1])) + abs32(int32(p[2])-int32(center[2]))
+							d /= 3
+						}
+						w := spatial[k] * b.rng[d]
+						total += w
+						r += w * int32(p[0])
+						if channels == 4 {
+							g += w * int32(p[1])
+							bl += w * int32(p[2])
+						}
+					}
+				}
+				if channels == 1 {
+					out[x] = uint8((r + total/2) / total)
+					continue
+				}
+				// Premultiplied colors stay within the pixel's own alpha
+				alpha := int32(center[3])
+				o := out[x*4 : x*4+4 : x*4+4]
+				o[0], o[1], o[2], o[3] = uint8(min32((r+total/2)/total, alpha)), uint8(min32((g+total/2)/total, alpha)), uint8(min32((bl+total/2)/total, alpha)), center[3]
+			}
+		}
+	})
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func min32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
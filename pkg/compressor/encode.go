@@ -0,0 +1,174 @@
+package compressor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+const minTargetQuality = 20 // lowest JPEG quality tried before downscaling
+
+func encodeImage(w io.Writer, img image.Image, format string, opts Options) error {
+	switch format {
+	case "jpeg":
+		flat := flattenImage(img, opts.Background)
+		if flat != img {
+			defer recycleImage(flat)
+		}
+		if opts.JPEGEncoder == "mozjpeg" {
+			return encodeMozJPEG(w, flat, opts)
+		}
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: opts.JPEGQuality})
+	case "png":
+		if opts.Colors > 0 {
+			img = quantizeImage(img, opts.Colors, opts.Dither)
+		}
+		if opts.PNGOptimize != "" && opts.PNGOptimize != "off" {
+			return encodeOptimizedPNG(w, img, opts.PNGOptimize)
+		}
+		encoder := png.Encoder{CompressionLevel: opts.PNGCompression}
+		return encoder.Encode(w, img)
+	case "gif":
+		// Paletted images keep their transparent index; others are quantized
+		// to a palette without one, which would turn transparency black
+		if _, ok := img.(*image.Paletted); !ok {
+			flat := flattenImage(img, opts.Background)
+			if flat != img {
+				defer recycleImage(flat)
+			}
+			img = flat
+		}
+		if opts.Colors > 0 {
+			img = quantizeImage(img, opts.Colors, opts.Dither)
+		} else if opts.GIFColors > 0 && opts.GIFColors < 256 {
+			// gif's quality setting; image/gif would cut its fixed palette short
+			img = quantizeImage(img, opts.GIFColors, opts.Dither)
+		}
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported image format: %s", format)
+	}
+}
+
+// encodeToTargetSize binary searches the JPEG quality between
+// minTargetQuality and opts.JPEGQuality for the best encoding that fits in
+// opts.TargetSize. When even the lowest quality is too large (or the format
+// has no quality setting) the image is downscaled and the search repeated.
+// Every candidate is measured once finish has added the metadata it is
+// written with, and is returned that way.
+func encodeToTargetSize(img image.Image, format string, opts Options, finish func([]byte) []byte) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	original := img
+	defer func() {
+		if img != original {
+			recycleImage(img)
+		}
+	}()
+	for {
+		var best []byte
+		var smallest int
+
+		try := func(quality int) (bool, error) {
+			o := opts
+			o.JPEGQuality = quality
+			buf.Reset()
+			if err := encodeImage(buf, img, format, o); err != nil {
+				return false, err
+			}
+			candidate := finish(buf.Bytes())
+			if len(candidate) <= int(opts.TargetSize) {
+				best = append(best[:0], candidate...)
+				return true, nil
+			}
+			smallest = len(candidate)
+			return false, nil
+		}
+
+		if format == "jpeg" {
+			lo, hi := minTargetQuality, opts.JPEGQuality
+			if lo > hi {
+				// A quality below the floor was asked for; search only it.
+				lo = hi
+			}
+			for lo <= hi {
+				mid := (lo + hi) / 2
+				fits, err := try(mid)
+				if err != nil {
+					return nil, fmt.Errorf("failed to encode image: %v", err)
+				}
+				if fits {
+					lo = mid + 1
+				} else {
+					hi = mid - 1
+				}
+			}
+		} else if _, err := try(opts.JPEGQuality); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %v", err)
+		}
+
+		if best != nil {
+			return best, nil
+		}
+
+		bounds := img.Bounds()
+		if bounds.Dx() <= 16 || bounds.Dy() <= 16 {
+			return nil, fmt.Errorf("cannot fit image within %s", HumanReadableSize(opts.TargetSize))
+		}
+		scale := math.Sqrt(float64(opts.TargetSize)/float64(smallest)) * 0.95
+		if scale > 0.9 {
+			scale = 0.9
+		}
+		width, height := scaledSize(bounds.Dx(), bounds.Dy(), scale)
+		smaller := Resample(img, int(width), int(height), opts.Filter)
+		if img != original {
+			recycleImage(img)
+		}
+		img = smaller
+	}
+}
+
+// encodeToSSIMTarget binary searches for the lowest JPEG quality whose decoded
+// output still reaches opts.SSIMTarget against img. If no quality reaches it,
+// the quality 100 encoding is returned.
+func encodeToSSIMTarget(img image.Image, opts Options) ([]byte, float64, error) {
+	reference := flattenImage(img, opts.Background)
+	if reference != img {
+		defer recycleImage(reference)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	var best []byte
+	var bestSSIM float64
+	lo, hi := 1, 100
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		o := opts
+		o.JPEGQuality = mid
+		buf.Reset()
+		if err := encodeImage(buf, img, "jpeg", o); err != nil {
+			return nil, 0, fmt.Errorf("failed to encode image: %v", err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode encoded image: %v", err)
+		}
+
+		score := ssim(reference, decoded)
+		if score >= opts.SSIMTarget || mid == 100 {
+			best, bestSSIM = append(best[:0], buf.Bytes()...), score
+		}
+		if score >= opts.SSIMTarget {
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	return best, bestSSIM, nil
+}
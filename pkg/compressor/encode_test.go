@@ -0,0 +1,105 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// noiseJPEG encodes a width x height image of random pixels, which compresses
+// poorly enough to make size targets work for it.
+func noiseJPEG(t *testing.T, width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng := rand.New(rand.NewSource(1))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rng.Intn(256))
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTargetSizeCountsMetadata(t *testing.T) {
+	// A source whose profile and XMP, copied into the output, take up most
+	// of the target
+	data := noiseJPEG(t, 256, 256)
+	data = embedICCProfile(data, append(testProfile(srgbToXYZ, srgbCurve()), make([]byte, 20000)...), "jpeg")
+	xmp := append(append([]byte{}, xmpHeader...), bytes.Repeat([]byte(" "), 15000)...)
+	data = insertJPEGSegment(data, 0xE1, xmp)
+
+	for _, target := range []int64{40000, 60000} {
+		opts := DefaultOptions()
+		opts.TargetSize = target
+		encoded, _, err := CompressBytes(data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(encoded)) > target {
+			t.Errorf("output is %d bytes, over the %d byte target", len(encoded), target)
+		}
+		if readICCProfile(encoded) == nil {
+			t.Errorf("output for the %d byte target lost its color profile", target)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, tc := range []struct{ name, format, err string }{
+		{"JPG", "jpeg", ""},
+		{"png", "png", ""},
+		{"gif", "gif", ""},
+		{"webp", "", "lack of a webp encoder"},
+		{"tiff", "", "must be jpeg, png or gif"},
+	} {
+		format, err := ParseFormat(tc.name)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("ParseFormat(%q) error %v, want one containing %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || format != tc.format {
+			t.Errorf("ParseFormat(%q) = %q, %v, want %q", tc.name, format, err, tc.format)
+		}
+	}
+}
+
+func TestMozJPEGVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake cjpeg is a shell script")
+	}
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	if _, err := MozJPEGVersion(); err == nil || !strings.Contains(err.Error(), "not in PATH") {
+		t.Fatalf("got error %v without a cjpeg, want it missing", err)
+	}
+	for _, tc := range []struct{ banner, version, err string }{
+		{"mozjpeg version 4.1.1 (build 20230412)", "4.1.1", ""},
+		{"mozjpeg version 3.3 (build 20180123)", "3.3", ""},
+		{"mozjpeg version 2.1 (build 20141223)", "", "3.0 or later"},
+		{"libjpeg-turbo version 2.1.5 (build 20230101)", "", "not mozjpeg's"},
+	} {
+		script := "#!/bin/sh\necho '" + tc.banner + "' >&2\n"
+		if err := ioutil.WriteFile(filepath.Join(dir, MozJPEGCommand), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		version, err := MozJPEGVersion()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: got error %v, want one containing %q", tc.banner, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || version != tc.version {
+			t.Errorf("%q: got %q, %v, want version %q", tc.banner, version, err, tc.version)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package compressor
+
+import (
+	"context"
+	"image/png"
+)
+
+// Engines lists the -engine names. "vips" only takes effect in binaries built
+// with -tags vips and "gpu" in those built with -tags gpu; see VipsAvailable
+// and GPUAvailable.
+var Engines = map[string]bool{
+	"go":   true,
+	"vips": true,
+	"gpu":  true,
+}
+
+// VipsAvailable reports whether this binary was built with libvips support.
+func VipsAvailable() bool {
+	return vipsAvailable
+}
+
+// GPUAvailable reports whether this binary was built with OpenCL support.
+func GPUAvailable() bool {
+	return gpuAvailable
+}
+
+// GPUDevice returns the name of the GPU that the gpu engine resizes on, or
+// why there is none usable, in which case resizes stay on the CPU.
+func GPUDevice() (string, error) {
+	return gpuDevice()
+}
+
+// vipsPNGCompression maps the png encoder levels to libvips' zlib levels.
+var vipsPNGCompression = map[png.CompressionLevel]int{
+	png.DefaultCompression: 6,
+	png.NoCompression:      0,
+	png.BestSpeed:          1,
+	png.BestCompression:    9,
+}
+
+// useVips reports whether inputPath should go through libvips. The vips path
+// only decodes, orients, resizes and encodes with the stock encoders; files
+// needing any other processing, or RAW decoding, use the Go pipeline instead.
+func useVips(inputPath string, opts Options) bool {
+	return opts.Engine == "vips" && vipsAvailable &&
+		!IsRawFile(inputPath) &&
+		opts.Watermark.Text == "" && opts.Watermark.Image == nil &&
+		opts.CropWidth == 0 && opts.ThumbWidth == 0 &&
+		opts.TargetSize == 0 && opts.SSIMTarget == 0 && !opts.QualityMetrics && opts.Chroma != "422" &&
+		opts.JPEGEncoder != "mozjpeg" && (opts.PNGOptimize == "" || opts.PNGOptimize == "off") && opts.Colors == 0 &&
+		(opts.GIFColors == 0 || opts.GIFColors == 256) &&
+		len(opts.StripMetadata) == 0 && !opts.ConvertToSRGB && !opts.Grayscale &&
+		opts.Sharpen.Amount == 0 && opts.Denoise == 0 && opts.Adjust == nil && !opts.AutoEnhance
+}
+
+// compressWithVips writes job's outputs through libvips, one per -sizes
+// width or a single one without them.
+func compressWithVips(ctx context.Context, job Job, opts Options, result *FileResult) error {
+	if len(opts.Sizes) == 0 {
+		return vipsWriteOutput(job.Input, job.Output, opts, result)
+	}
+	for _, width := range opts.Sizes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		variant := opts
+		if variant.MaxWidth == 0 || width < variant.MaxWidth {
+			variant.MaxWidth = width
+		}
+		if err := vipsWriteOutput(job.Input, variantPath(job.Output, width), variant, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+//go:build gpu
+
+package compressor
+
+/*
+#cgo !darwin LDFLAGS: -lOpenCL
+#cgo darwin LDFLAGS: -framework OpenCL
+#define CL_TARGET_OPENCL_VERSION 120
+#define CL_USE_DEPRECATED_OPENCL_1_2_APIS
+#ifdef __APPLE__
+#include <OpenCL/opencl.h>
+#else
+#include <CL/cl.h>
+#endif
+#include <stdlib.h>
+
+// Two separable lanczos3 passes: rows into a float buffer of dstW x srcH,
+// then columns into the output. scale is source over destination pixels.
+static const char *gpu_source =
+	"float lanczos3(float x) {\n"
+	"	if (x == 0.0f) return 1.0f;\n"
+	"	if (x <= -3.0f || x >= 3.0f) return 0.0f;\n"
+	"	float px = M_PI_F * x;\n"
+	"	return 3.0f * sin(px) * sin(px / 3.0f) / (px * px);\n"
+	"}\n"
+	"__kernel void resize_h(__global const uchar4 *src, __global float4 *dst, int srcW, int dstW, float scale) {\n"
+	"	int x = get_global_id(0), y = get_global_id(1);\n"
+	"	float f = fmax(scale, 1.0f), center = (x + 0.5f) * scale - 0.5f;\n"
+	"	float4 sum = (float4)(0.0f);\n"
+	"	float total = 0.0f;\n"
+	"	for (int i = (int)ceil(center - 3.0f * f); i <= (int)floor(center + 3.0f * f); i++) {\n"
+	"		float w = lanczos3((i - center) / f);\n"
+	"		sum += w * convert_float4(src[y * srcW + clamp(i, 0, srcW - 1)]);\n"
+	"		total += w;\n"
+	"	}\n"
+	"	dst[y * dstW + x] = sum / total;\n"
+	"}\n"
+	"__kernel void resize_v(__global const float4 *src, __global uchar4 *dst, int srcH, int dstW, float scale) {\n"
+	"	int x = get_global_id(0), y = get_global_id(1);\n"
+	"	float f = fmax(scale, 1.0f), center = (y + 0.5f) * scale - 0.5f;\n"
+	"	float4 sum = (float4)(0.0f);\n"
+	"	float total = 0.0f;\n"
+	"	for (int i = (int)ceil(center - 3.0f * f); i <= (int)floor(center + 3.0f * f); i++) {\n"
+	"		float w = lanczos3((i - center) / f);\n"
+	"		sum += w * src[clamp(i, 0, srcH - 1) * dstW + x];\n"
+	"		total += w;\n"
+	"	}\n"
+	"	dst[y * dstW + x] = convert_uchar4_sat_rte(sum / total);\n"
+	"}\n";
+
+static cl_context gpu_context;
+static cl_command_queue gpu_queue;
+static cl_kernel gpu_resize_h, gpu_resize_v;
+
+// gpu_init sets up the first GPU found, writing its name to name or, when
+// the kernels fail to compile, the build log.
+static cl_int gpu_init(char *name, size_t size) {
+	cl_platform_id platforms[8];
+	cl_uint count = 0;
+	cl_int err = clGetPlatformIDs(8, platforms, &count);
+	if (err != CL_SUCCESS) return err;
+	cl_device_id device;
+	err = CL_DEVICE_NOT_FOUND;
+	for (cl_uint i = 0; i < count && err != CL_SUCCESS; i++) {
+		err = clGetDeviceIDs(platforms[i], CL_DEVICE_TYPE_GPU, 1, &device, NULL);
+	}
+	if (err != CL_SUCCESS) return err;
+	clGetDeviceInfo(device, CL_DEVICE_NAME, size, name, NULL);
+
+	gpu_context = clCreateContext(NULL, 1, &device, NULL, NULL, &err);
+	if (err != CL_SUCCESS) return err;
+	gpu_queue = clCreateCommandQueue(gpu_context, device, 0, &err);
+	if (err != CL_SUCCESS) return err;
+	cl_program program = clCreateProgramWithSource(gpu_context, 1, &gpu_source, NULL, &err);
+	if (err != CL_SUCCESS) return err;
+	if ((err = clBuildProgram(program, 1, &device, "", NULL, NULL)) != CL_SUCCESS) {
+		clGetProgramBuildInfo(program, device, CL_PROGRAM_BUILD_LOG, size, name, NULL);
+		return err;
+	}
+	gpu_resize_h = clCreateKernel(program, "resize_h", &err);
+	if (err != CL_SUCCESS) return err;
+	gpu_resize_v = clCreateKernel(program, "resize_v", &err);
+	return err;
+}
+
+static cl_int gpu_resize(const unsigned char *src, cl_int srcW, cl_int srcH, unsigned char *dst, cl_int dstW, cl_int dstH) {
+	cl_int err;
+	cl_mem in = NULL, mid = NULL, out = NULL;
+	cl_float scaleX = (cl_float)srcW / dstW, scaleY = (cl_float)srcH / dstH;
+	size_t rows[2] = {dstW, srcH}, columns[2] = {dstW, dstH};
+
+	in = clCreateBuffer(gpu_context, CL_MEM_READ_ONLY | CL_MEM_COPY_HOST_PTR, (size_t)srcW * srcH * 4, (void *)src, &err);
+	if (err != CL_SUCCESS) goto done;
+	mid = clCreateBuffer(gpu_context, CL_MEM_READ_WRITE, (size_t)dstW * srcH * 16, NULL, &err);
+	if (err != CL_SUCCESS) goto done;
+	out = clCreateBuffer(gpu_context, CL_MEM_WRITE_ONLY, (size_t)dstW * dstH * 4, NULL, &err);
+	if (err != CL_SUCCESS) goto done;
+
+	clSetKernelArg(gpu_resize_h, 0, sizeof(cl_mem), &in);
+	clSetKernelArg(gpu_resize_h, 1, sizeof(cl_mem), &mid);
+	clSetKernelArg(gpu_resize_h, 2, sizeof(cl_int), &srcW);
+	clSetKernelArg(gpu_resize_h, 3, sizeof(cl_int), &dstW);
+	clSetKernelArg(gpu_resize_h, 4, sizeof(cl_float), &scaleX);
+	if ((err = clEnqueueNDRangeKernel(gpu_queue, gpu_resize_h, 2, NULL, rows, NULL, 0, NULL, NULL)) != CL_SUCCESS) goto done;
+
+	clSetKernelArg(gpu_resize_v, 0, sizeof(cl_mem), &mid);
+	clSetKernelArg(gpu_resize_v, 1, sizeof(cl_mem), &out);
+	clSetKernelArg(gpu_resize_v, 2, sizeof(cl_int), &srcH);
+	clSetKernelArg(gpu_resize_v, 3, sizeof(cl_int), &dstW);
+	clSetKernelArg(gpu_resize_v, 4, sizeof(cl_float), &scaleY);
+	if ((err = clEnqueueNDRangeKernel(gpu_queue, gpu_resize_v, 2, NULL, columns, NULL, 0, NULL, NULL)) != CL_SUCCESS) goto done;
+
+	err = clEnqueueReadBuffer(gpu_queue, out, CL_TRUE, 0, (size_t)dstW * dstH * 4, dst, 0, NULL, NULL);
+done:
+	if (in) clReleaseMemObject(in);
+	if (mid) clReleaseMemObject(mid);
+	if (out) clReleaseMemObject(out);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"sync"
+	"unsafe"
+)
+
+const gpuAvailable = true
+
+var (
+	gpuStartup sync.Once
+	gpuName    string
+	gpuErr     error
+	gpuMu      sync.Mutex // the kernels and queue are shared by every worker
+)
+
+// gpuDevice returns the name of the GPU resizes run on, setting it up on
+// the first call, or why there is none.
+func gpuDevice() (string, error) {
+	gpuStartup.Do(func() {
+		buf := make([]byte, 4096)
+		if code := C.gpu_init((*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf))); code != C.CL_SUCCESS {
+			gpuErr = fmt.Errorf("OpenCL error %d", int(code))
+			if code == C.CL_BUILD_PROGRAM_FAILURE {
+				gpuErr = fmt.Errorf("failed to build the resize kernels: %s", C.GoString((*C.char)(unsafe.Pointer(&buf[0]))))
+			}
+			return
+		}
+		gpuName = C.GoString((*C.char)(unsafe.Pointer(&buf[0])))
+	})
+	return gpuName, gpuErr
+}
+
+// gpuResize resamples img to width x height on the GPU with a lanczos3
+// kernel, whatever -filter says.
+func gpuResize(img image.Image, width, height uint) (image.Image, error) {
+	if _, err := gpuDevice(); err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || src.Rect.Min != (image.Point{}) || src.Stride != 4*bounds.Dx() {
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Rect, img, bounds.Min, draw.Src)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+
+	gpuMu.Lock()
+	defer gpuMu.Unlock()
+	code := C.gpu_resize((*C.uchar)(unsafe.Pointer(&src.Pix[0])), C.cl_int(src.Rect.Dx()), C.cl_int(src.Rect.Dy()),
+		(*C.uchar)(unsafe.Pointer(&dst.Pix[0])), C.cl_int(width), C.cl_int(height))
+	if code != C.CL_SUCCESS {
+		return nil, fmt.Errorf("failed to resize on the gpu: OpenCL error %d", int(code))
+	}
+	return dst, nil
+}
@@ -0,0 +1,18 @@
+//go:build !gpu
+
+package compressor
+
+import (
+	"fmt"
+	"image"
+)
+
+const gpuAvailable = false
+
+func gpuDevice() (string, error) {
+	return "", fmt.Errorf("built without gpu support")
+}
+
+func gpuResize(img image.Image, width, height uint) (image.Image, error) {
+	return nil, fmt.Errorf("built without gpu support")
+}
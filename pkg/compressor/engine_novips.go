@@ -0,0 +1,11 @@
+//go:build !vips
+
+package compressor
+
+import "fmt"
+
+const vipsAvailable = false
+
+func vipsWriteOutput(inputPath, outputPath string, opts Options, result *FileResult) error {
+	return fmt.Errorf("built without vips support")
+}
@@ -0,0 +1,99 @@
+//go:build vips
+
+package compressor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const vipsAvailable = true
+
+var vipsStartup sync.Once
+
+// vipsWriteOutput decodes, orients, resizes and encodes inputPath with
+// libvips, recording the output in result. Resampling always uses libvips'
+// lanczos3 kernel.
+func vipsWriteOutput(inputPath, outputPath string, opts Options, result *FileResult) error {
+	vipsStartup.Do(func() {
+		vips.LoggingSettings(nil, vips.LogLevelWarning)
+		vips.Startup(nil)
+	})
+
+	decodeStart := time.Now()
+	img, err := vips.NewImageFromFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+	defer img.Close()
+	result.DecodeTime += time.Since(decodeStart)
+
+	if opts.AutoOrient {
+		if err := img.AutoRotate(); err != nil {
+			return fmt.Errorf("failed to orient image: %v", err)
+		}
+	}
+
+	if result.Width == 0 {
+		result.Width, result.Height = img.Width(), img.Height()
+	}
+
+	resizeStart := time.Now()
+	if scale := resizeScale(img.Width(), img.Height(), opts); scale < 1 {
+		if err := img.Resize(scale, vips.KernelLanczos3); err != nil {
+			return fmt.Errorf("failed to resize image: %v", err)
+		}
+		result.ResizeTime += time.Since(resizeStart)
+	}
+
+	format := vips.ImageTypes[img.Format()]
+	if opts.ConvertTo != "" {
+		format = opts.ConvertTo
+	}
+
+	var encoded []byte
+	encodeStart := time.Now()
+	switch format {
+	case "jpeg":
+		if img.HasAlpha() {
+			r, g, b, _ := opts.Background.RGBA()
+			if err := img.Flatten(&vips.Color{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8)}); err != nil {
+				return fmt.Errorf("failed to flatten image: %v", err)
+			}
+		}
+		params := vips.NewJpegExportParams()
+		params.Quality = opts.JPEGQuality
+		params.Interlace = opts.Progressive
+		if opts.Chroma == "444" {
+			params.SubsampleMode = vips.VipsForeignSubsampleOff
+		}
+		params.StripMetadata = !opts.KeepMetadata
+		encoded, _, err = img.ExportJpeg(params)
+	case "png":
+		params := vips.NewPngExportParams()
+		params.Compression = vipsPNGCompression[opts.PNGCompression]
+		params.StripMetadata = !opts.KeepMetadata
+		encoded, _, err = img.ExportPng(params)
+	case "gif":
+		encoded, _, err = img.ExportGIF(vips.NewGifExportParams())
+	default:
+		return fmt.Errorf("unsupported image format: %s", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode image: %v", err)
+	}
+	result.EncodeTime += time.Since(encodeStart)
+
+	if err := writeFileAtomic(outputPath, encoded, inputPath, opts); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	result.Outputs = append(result.Outputs, outputPath)
+	result.OutputSize += int64(len(encoded))
+	if result.OutputWidth == 0 {
+		result.OutputWidth, result.OutputHeight = img.Width(), img.Height()
+	}
+	return nil
+}
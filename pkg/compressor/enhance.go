@@ -0,0 +1,102 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+)
+
+// enhanceClip is the share of pixels auto enhancement lets clip to black and
+// to white in each channel, so a few specks don't hold back the stretch.
+const enhanceClip = 0.005
+
+// enhanceMinRange is the narrowest span of levels auto enhancement will
+// stretch; flatter channels, such as a clear sky, are left alone.
+const enhanceMinRange = 16
+
+// autoEnhanceImage stretches the levels of every channel of img to the full
+// range on its own, which also neutralizes color casts such as the yellowing
+// of old prints. YCbCr images become RGBA, as their channels are not colors.
+func autoEnhanceImage(img image.Image, threads int) image.Image {
+	bounds := img.Bounds()
+	if gray, ok := img.(*image.Gray); ok {
+		var histogram [256]int
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for _, v := range gray.Pix[gray.PixOffset(bounds.Min.X, y):gray.PixOffset(bounds.Max.X, y)] {
+				histogram[v]++
+			}
+		}
+		return mapGray(gray, stretchTable(&histogram), threads)
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = newPooledRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		defer recycleImage(rgba)
+	}
+	var histograms [3][256]int
+	for y := rgba.Rect.Min.Y; y < rgba.Rect.Max.Y; y++ {
+		row := rgba.Pix[rgba.PixOffset(rgba.Rect.Min.X, y):rgba.PixOffset(rgba.Rect.Max.X, y)]
+		for x := 0; x < len(row); x += 4 {
+			// Transparent pixels have no color to count
+			alpha := uint32(row[x+3])
+			if alpha == 0 {
+				continue
+			}
+			for i := range histograms {
+				v := uint32(row[x+i])
+				if alpha < 255 {
+					if v = (v*255 + alpha/2) / alpha; v > 255 {
+						v = 255
+					}
+				}
+				histograms[i][v]++
+			}
+		}
+	}
+	var tables [3]*[256]uint8
+	for i := range tables {
+		tables[i] = stretchTable(&histograms[i])
+	}
+	dst := newPooledRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	mapRGBA(rgba, dst, tables, 256, threads)
+	return dst
+}
+
+// stretchTable maps the levels of histogram, less enhanceClip at each end,
+// linearly onto 0-255.
+func stretchTable(histogram *[256]int) *[256]uint8 {
+	total := 0
+	for _, n := range histogram {
+		total += n
+	}
+	clip := int(float64(total) * enhanceClip)
+	low, high := 0, 255
+	for count := 0; low < 255; low++ {
+		if count += histogram[low]; count > clip {
+			break
+		}
+	}
+	for count := 0; high > 0; high-- {
+		if count += histogram[high]; count > clip {
+			break
+		}
+	}
+	var table [256]uint8
+	for i := range table {
+		table[i] = uint8(i)
+	}
+	if high-low < enhanceMinRange {
+		return &table
+	}
+	for i := range table {
+		switch {
+		case i <= low:
+			table[i] = 0
+		case i >= high:
+			table[i] = 255
+		default:
+			table[i] = uint8(((i-low)*255 + (high-low)/2) / (high - low))
+		}
+	}
+	return &table
+}
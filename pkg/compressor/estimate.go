@@ -0,0 +1,73 @@
+package compressor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Estimate projects the output size and wall time of a run from a pilot pass
+// over a sample of its files.
+type Estimate struct {
+	Sampled  int           // files compressed in the pilot
+	Failed   int           // of them, that could not be compressed
+	Ratio    float64       // output bytes per input byte over the sample
+	Size     int64         // projected output size of the whole run
+	Duration time.Duration // projected wall time of the whole run
+}
+
+// EstimateRun compresses up to sample files picked at random from paths in
+// memory with threads workers, as CompressBytes does, and scales the sizes
+// and time they took to totalSize bytes of input. Sizes and thumbnails are
+// not made, so runs with them come out larger than projected.
+func EstimateRun(paths []string, totalSize int64, opts Options, sample, threads int) (Estimate, error) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	order := random.Perm(len(paths))
+	if sample < len(order) {
+		order = order[:sample]
+	}
+	var mu sync.Mutex
+	var est Estimate
+	var inputBytes, outputBytes int64
+	next := make(chan string)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range next {
+				data, err := ioutil.ReadFile(path)
+				var encoded []byte
+				if err == nil {
+					encoded, _, err = CompressBytes(data, opts)
+				}
+				mu.Lock()
+				est.Sampled++
+				if err != nil {
+					est.Failed++
+				} else {
+					inputBytes += int64(len(data))
+					outputBytes += int64(len(encoded))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, i := range order {
+		next <- paths[i]
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if inputBytes == 0 {
+		return est, fmt.Errorf("none of the %d sample files could be compressed", est.Sampled)
+	}
+	est.Ratio = float64(outputBytes) / float64(inputBytes)
+	est.Size = int64(est.Ratio * float64(totalSize))
+	est.Duration = time.Duration(float64(elapsed) * float64(totalSize) / float64(inputBytes))
+	return est, nil
+}
@@ -0,0 +1,186 @@
+package compressor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exifField is a tag an ExifFilter can compare, in IFD0 or the Exif IFD.
+type exifField struct {
+	tag     uint16
+	exifIFD bool
+	numeric bool
+}
+
+// ExifFields lists the fields -exif conditions can name, matched ignoring
+// case. Numeric fields may be written as fractions, e.g. ExposureTime<1/250.
+var ExifFields = map[string]exifField{
+	"Make":         {0x010F, false, false},
+	"Model":        {0x0110, false, false},
+	"Software":     {0x0131, false, false},
+	"LensMake":     {0xA433, true, false},
+	"LensModel":    {0xA434, true, false},
+	"ISO":          {0x8827, true, true},
+	"FNumber":      {0x829D, true, true},
+	"ExposureTime": {0x829A, true, true},
+	"FocalLength":  {0x920A, true, true},
+}
+
+// exifOperators are the comparisons of a condition, two-character ones first.
+var exifOperators = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+type exifCondition struct {
+	text   string
+	name   string
+	field  exifField
+	op     string
+	value  string
+	number float64
+}
+
+// ExifFilter selects the images whose EXIF fields meet every one of its
+// conditions, such as Model=Canon EOS R5 or ISO>3200. Text fields are
+// compared with = and != ignoring case; numeric ones with any operator.
+type ExifFilter struct {
+	conditions []exifCondition
+}
+
+// ParseExifFilter parses comma separated conditions of a field of
+// ExifFields, an operator and a value.
+func ParseExifFilter(s string) (*ExifFilter, error) {
+	f := &ExifFilter{}
+	for _, text := range strings.Split(s, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		c := exifCondition{text: text}
+		at := -1
+		for _, op := range exifOperators {
+			if i := strings.Index(text, op); i > 0 && (at < 0 || i < at) {
+				at, c.op = i, op
+			}
+		}
+		if at < 0 {
+			return nil, fmt.Errorf("invalid EXIF condition %q: must be a field, an operator (=, !=, <, <=, > or >=) and a value", text)
+		}
+		name := strings.TrimSpace(text[:at])
+		c.value = strings.TrimSpace(text[at+len(c.op):])
+		for known, field := range ExifFields {
+			if strings.EqualFold(known, name) {
+				c.name, c.field = known, field
+			}
+		}
+		if c.name == "" {
+			return nil, fmt.Errorf("unknown EXIF field %q: must be one of %s", name, strings.Join(exifFieldNames(), ", "))
+		}
+		if c.field.numeric {
+			number, err := parseExifNumber(c.value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXIF condition %q: %s needs a number", text, c.name)
+			}
+			c.number = number
+		} else if c.op != "=" && c.op != "!=" {
+			return nil, fmt.Errorf("invalid EXIF condition %q: %s can only be compared with = or !=", text, c.name)
+		}
+		f.conditions = append(f.conditions, c)
+	}
+	if len(f.conditions) == 0 {
+		return nil, fmt.Errorf("no EXIF conditions in %q", s)
+	}
+	return f, nil
+}
+
+func exifFieldNames() []string {
+	names := make([]string, 0, len(ExifFields))
+	for name := range ExifFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseExifNumber reads a condition value such as 3200, 2.8, f/2.8, 1/250
+// or 50mm.
+func parseExifNumber(s string) (float64, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(s), "f/"), "mm")
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		num, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0, err
+		}
+		den, err := strconv.ParseFloat(s[i+1:], 64)
+		if err != nil || den == 0 {
+			return 0, fmt.Errorf("invalid fraction %q", s)
+		}
+		return num / den, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// Reason returns why the image with the EXIF block exif is not selected, or
+// "" if it is. Images without a field in a condition are not selected.
+func (f *ExifFilter) Reason(exif []byte) string {
+	if f == nil {
+		return ""
+	}
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return "no EXIF data"
+	}
+	ifd0, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return "no EXIF data"
+	}
+	exifIFD := ifd0
+	if offset, ok := t.uint(ifd0, tagExifIFD); ok {
+		if ifd, err := t.readIFD(offset); err == nil {
+			exifIFD = ifd
+		}
+	}
+	for _, c := range f.conditions {
+		ifd := ifd0
+		if c.field.exifIFD {
+			ifd = exifIFD
+		}
+		if !c.field.numeric {
+			value, ok := t.ascii(ifd, c.field.tag)
+			if !ok {
+				return "no EXIF " + c.name
+			}
+			if strings.EqualFold(value, c.value) != (c.op == "=") {
+				return fmt.Sprintf("EXIF %s %q does not match %s", c.name, value, c.text)
+			}
+			continue
+		}
+		value, ok := t.number(ifd, c.field.tag)
+		if !ok {
+			return "no EXIF " + c.name
+		}
+		if !compareExifNumber(value, c.op, c.number) {
+			return fmt.Sprintf("EXIF %s %s does not match %s", c.name, strconv.FormatFloat(value, 'g', 6, 64), c.text)
+		}
+	}
+	return ""
+}
+
+func compareExifNumber(value float64, op string, limit float64) bool {
+	// Rationals such as 1/3 are compared with a little slack
+	const epsilon = 1e-9
+	switch op {
+	case "=":
+		return value > limit-epsilon && value < limit+epsilon
+	case "!=":
+		return value <= limit-epsilon || value >= limit+epsilon
+	case ">":
+		return value > limit+epsilon
+	case ">=":
+		return value > limit-epsilon
+	case "<":
+		return value < limit-epsilon
+	default:
+		return value < limit+epsilon
+	}
+}
@@ -0,0 +1,129 @@
+package compressor
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathFilter selects the files Plan compresses by their path relative to the
+// input folder, always with forward slashes. Glob patterns are matched like
+// path.Match, with a "**" element matching any number of folders; a pattern
+// without a slash matches the file name alone. A nil filter selects
+// everything.
+type PathFilter struct {
+	include, exclude     []string
+	includeRe, excludeRe *regexp.Regexp
+}
+
+// NewPathFilter builds a filter from glob patterns and optional regular
+// expressions (empty for none). A file is selected when it matches an
+// include pattern, or there are none, and no exclude pattern.
+func NewPathFilter(include, exclude []string, includeRegex, excludeRegex string) (*PathFilter, error) {
+	f := &PathFilter{}
+	for _, list := range []struct {
+		patterns []string
+		dst      *[]string
+	}{{include, &f.include}, {exclude, &f.exclude}} {
+		for _, pattern := range list.patterns {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+			*list.dst = append(*list.dst, pattern)
+		}
+	}
+	var err error
+	if includeRegex != "" {
+		if f.includeRe, err = regexp.Compile(includeRegex); err != nil {
+			return nil, fmt.Errorf("invalid include regex: %v", err)
+		}
+	}
+	if excludeRegex != "" {
+		if f.excludeRe, err = regexp.Compile(excludeRegex); err != nil {
+			return nil, fmt.Errorf("invalid exclude regex: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// Reason returns why the file at rel is not selected, or "" if it is.
+func (f *PathFilter) Reason(rel string) string {
+	if f == nil {
+		return ""
+	}
+	for _, pattern := range f.exclude {
+		if globMatch(pattern, rel) {
+			return "excluded by " + pattern
+		}
+	}
+	if f.excludeRe != nil && f.excludeRe.MatchString(rel) {
+		return "excluded by -exclude-regex"
+	}
+	if len(f.include) > 0 {
+		included := false
+		for _, pattern := range f.include {
+			if globMatch(pattern, rel) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "not matched by -include"
+		}
+	}
+	if f.includeRe != nil && !f.includeRe.MatchString(rel) {
+		return "not matched by -include-regex"
+	}
+	return ""
+}
+
+// SkipDir reports whether every file below the folder at rel is excluded by
+// a pattern such as "**/thumbnails/**", so Plan needn't walk it.
+func (f *PathFilter) SkipDir(rel string) bool {
+	if f == nil {
+		return false
+	}
+	for _, pattern := range f.exclude {
+		if strings.HasSuffix(pattern, "/**") && globMatch(strings.TrimSuffix(pattern, "/**"), rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches name against pattern element by element.
+func globMatch(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		return matchElement(pattern, path.Base(name))
+	}
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try matching the rest at every depth, including this one
+			for i := 0; i <= len(name); i++ {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 || !matchElement(pattern[0], name[0]) {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchElement(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
@@ -0,0 +1,68 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+)
+
+// grayscaleImage converts img to 8-bit grayscale by Rec. 601 luma, the
+// weights of color.GrayModel. A YCbCr image keeps its luma plane as is.
+// Images with transparency become gray NRGBA images that keep their alpha,
+// since image.Gray has none; JPEG output is flattened before this.
+func grayscaleImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	switch src := img.(type) {
+	case *image.Gray:
+		return img
+	case *image.YCbCr:
+		gray := newPooledGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for y := 0; y < bounds.Dy(); y++ {
+			offset := src.YOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(gray.Pix[y*gray.Stride:(y+1)*gray.Stride], src.Y[offset:offset+bounds.Dx()])
+		}
+		return gray
+	}
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = newPooledRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		defer recycleImage(rgba)
+	}
+	origin := rgba.PixOffset(rgba.Rect.Min.X, rgba.Rect.Min.Y)
+	if !rgba.Opaque() {
+		// Premultiplied values are undone so the grays keep their brightness
+		out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		for y := 0; y < bounds.Dy(); y++ {
+			row := rgba.Pix[origin+y*rgba.Stride:]
+			dst := out.Pix[y*out.Stride:]
+			for x := 0; x < bounds.Dx(); x++ {
+				p := row[x*4 : x*4+4 : x*4+4]
+				v, a := luma(p[0], p[1], p[2]), uint32(p[3])
+				if a > 0 && a < 255 {
+					if unpremultiplied := (uint32(v)*255 + a/2) / a; unpremultiplied < 255 {
+						v = uint8(unpremultiplied)
+					} else {
+						v = 255
+					}
+				}
+				dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = v, v, v, p[3]
+			}
+		}
+		return out
+	}
+	gray := newPooledGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		row := rgba.Pix[origin+y*rgba.Stride:]
+		dst := gray.Pix[y*gray.Stride : (y+1)*gray.Stride]
+		for x := range dst {
+			dst[x] = luma(row[x*4], row[x*4+1], row[x*4+2])
+		}
+	}
+	return gray
+}
+
+// luma is the gray of an 8-bit RGB color, rounded like color.GrayModel.
+func luma(r, g, b uint8) uint8 {
+	return uint8((19595*uint32(r) + 38470*uint32(g) + 7471*uint32(b) + 1<<15) >> 16)
+}
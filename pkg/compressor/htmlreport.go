@@ -0,0 +1,164 @@
+package compressor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// HTMLPreviewWidth is the width of the before/after previews embedded in
+// report.html.
+const HTMLPreviewWidth = 320
+
+type htmlFile struct {
+	Name       string
+	Input      string
+	InputSize  int64
+	OutputSize int64
+	Saved      float64 // percentage of the input size saved
+	Dimensions string
+	Duration   time.Duration
+	Error      string
+	Before     template.URL
+	After      template.URL
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"size": HumanReadableSize,
+	"ms":   func(d time.Duration) int64 { return d.Milliseconds() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Image compressor report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 10px; border-bottom: 1px solid #ddd; text-align: left; vertical-align: middle; }
+th { cursor: pointer; background: #f4f4f4; }
+td.num { text-align: right; }
+tr.failed td { color: #b00; }
+.compare { position: relative; display: inline-block; line-height: 0; }
+.compare .after { position: absolute; top: 0; left: 0; height: 100%; width: 50%; overflow: hidden; }
+.compare .after img { max-width: none; }
+.compare input { display: block; width: 100%; }
+</style>
+</head>
+<body>
+<h1>Image compressor report</h1>
+<p>Started {{.Started.Format "2006-01-02 15:04:05"}}, took {{.Duration}}.<br>
+Input: {{.Input}}<br>Output: {{.Output}}</p>
+{{if .Interrupted}}<p><strong>Interrupted: {{.NotStarted}} files were not started.</strong></p>{{end}}
+<p>Files compressed: {{.Compressed}}, failed: {{.Failed}}{{if .TooSmall}}, skipped as too small: {{.TooSmall}}{{end}}. {{size .InputSize}} compressed to {{size .OutputSize}}.</p>
+<p>Drag the slider over a preview to compare the original (right) with the compressed output (left). Click a column to sort.</p>
+<table id="files">
+<thead><tr>
+<th data-type="text">File</th><th data-type="num">Original</th><th data-type="num">Compressed</th>
+<th data-type="num">Saved</th><th data-type="text">Dimensions</th><th data-type="num">Time</th><th>Preview</th>
+</tr></thead>
+<tbody>
+{{range .Files}}<tr{{if .Error}} class="failed"{{end}}>
+<td data-sort="{{.Name}}" title="{{.Input}}">{{.Name}}{{if .Error}}<br>{{.Error}}{{end}}</td>
+<td class="num" data-sort="{{.InputSize}}">{{size .InputSize}}</td>
+<td class="num" data-sort="{{.OutputSize}}">{{if not .Error}}{{size .OutputSize}}{{end}}</td>
+<td class="num" data-sort="{{printf "%.1f" .Saved}}">{{if not .Error}}{{printf "%.1f" .Saved}}%{{end}}</td>
+<td data-sort="{{.Dimensions}}">{{.Dimensions}}</td>
+<td class="num" data-sort="{{ms .Duration}}">{{ms .Duration}} ms</td>
+<td>{{if .After}}<div class="compare"><img src="{{.Before}}" alt="original">
+<div class="after"><img src="{{.After}}" alt="compressed"></div>
+<input type="range" min="0" max="100" value="50" oninput="this.previousElementSibling.style.width = this.value + '%'"></div>{{end}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+<script>
+document.querySelectorAll("#files th[data-type]").forEach(function (th, column) {
+  th.addEventListener("click", function () {
+    var body = document.querySelector("#files tbody");
+    var rows = Array.prototype.slice.call(body.rows);
+    var ascending = th.dataset.order !== "asc";
+    th.dataset.order = ascending ? "asc" : "desc";
+    rows.sort(function (a, b) {
+      var x = a.cells[column].dataset.sort, y = b.cells[column].dataset.sort;
+      var order = th.dataset.type === "num" ? parseFloat(x || 0) - parseFloat(y || 0) : x.localeCompare(y);
+      return ascending ? order : -order;
+    });
+    rows.forEach(function (row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+// WriteHTML saves the report to path as a page with a sortable table of the
+// files and a before/after slider for every file that has previews.
+func (r *Report) WriteHTML(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := r.RenderHTML(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RenderHTML writes the page of WriteHTML to w.
+func (r *Report) RenderHTML(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	page := struct {
+		Started               time.Time
+		Duration              time.Duration
+		Interrupted           bool
+		NotStarted            int
+		TooSmall              int
+		Input, Output         string
+		Compressed, Failed    int
+		InputSize, OutputSize int64
+		Files                 []htmlFile
+	}{Started: r.startTime, Duration: r.Duration, Interrupted: r.Interrupted, NotStarted: r.NotStarted, TooSmall: r.TooSmall, Input: r.inputPath, Output: r.outputDir}
+
+	results := append([]FileResult{}, r.results...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	for _, res := range results {
+		file := htmlFile{
+			Name:       filepath.Base(res.InputPath),
+			Input:      res.InputPath,
+			InputSize:  res.InputSize,
+			OutputSize: res.OutputSize,
+			Duration:   res.Duration,
+		}
+		if res.Err != nil {
+			file.Error = res.Err.Error()
+			page.Failed++
+		} else {
+			page.Compressed++
+			page.InputSize += res.InputSize
+			page.OutputSize += res.OutputSize
+			if res.InputSize > 0 {
+				file.Saved = 100 * float64(res.InputSize-res.OutputSize) / float64(res.InputSize)
+			}
+		}
+		if res.Width > 0 {
+			file.Dimensions = fmt.Sprintf("%dx%d", res.Width, res.Height)
+			if res.OutputWidth > 0 && (res.OutputWidth != res.Width || res.OutputHeight != res.Height) {
+				file.Dimensions += fmt.Sprintf(" → %dx%d", res.OutputWidth, res.OutputHeight)
+			}
+		}
+		if res.Before != nil && res.After != nil {
+			file.Before = template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(res.Before))
+			file.After = template.URL("data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(res.After))
+		}
+		page.Files = append(page.Files, file)
+	}
+
+	return htmlReportTemplate.Execute(w, page)
+}
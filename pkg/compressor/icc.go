@@ -0,0 +1,288 @@
+package compressor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+var iccJPEGHeader = []byte("ICC_PROFILE\x00")
+
+const iccChunkSize = maxAPP1Payload - 14 // room for the header and sequence bytes
+
+// readICCProfile returns the embedded ICC profile of a JPEG (APP2 chunks) or
+// PNG (iCCP chunk) file, or nil when it has none.
+func readICCProfile(data []byte) []byte {
+	type chunk struct {
+		seq  byte
+		data []byte
+	}
+	var chunks []chunk
+	for _, seg := range jpegSegments(data) {
+		if seg.marker == 0xE2 && bytes.HasPrefix(seg.payload, iccJPEGHeader) && len(seg.payload) > len(iccJPEGHeader)+2 {
+			chunks = append(chunks, chunk{seg.payload[len(iccJPEGHeader)], seg.payload[len(iccJPEGHeader)+2:]})
+		}
+	}
+	if len(chunks) > 0 {
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+		var profile []byte
+		for _, c := range chunks {
+			profile = append(profile, c.data...)
+		}
+		return profile
+	}
+
+	var profile []byte
+	pngChunks(data, func(typ string, _ int, body []byte) bool {
+		if typ != "iCCP" {
+			return true
+		}
+		if i := bytes.IndexByte(body, 0); i >= 0 && i+2 <= len(body) {
+			if r, err := zlib.NewReader(bytes.NewReader(body[i+2:])); err == nil {
+				profile, _ = ioutil.ReadAll(r)
+			}
+		}
+		return false
+	})
+	return profile
+}
+
+// keepICCProfile reports whether opts copies color profiles into outputs.
+// They are metadata like any other: off without -keep-metadata, and removed by
+// both the icc and all categories of -strip-metadata.
+func keepICCProfile(opts Options) bool {
+	return opts.KeepMetadata && !opts.StripMetadata["icc"] && !opts.StripMetadata["all"]
+}
+
+// embedICCProfile writes profile into the encoded JPEG or PNG output.
+func embedICCProfile(encoded, profile []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		count := (len(profile) + iccChunkSize - 1) / iccChunkSize
+		if count > 255 {
+			return encoded
+		}
+		// Segments are inserted directly after SOI, so add them in reverse.
+		for i := count - 1; i >= 0; i-- {
+			end := (i + 1) * iccChunkSize
+			if end > len(profile) {
+				end = len(profile)
+			}
+			payload := append(append([]byte{}, iccJPEGHeader...), byte(i+1), byte(count))
+			encoded = insertJPEGSegment(encoded, 0xE2, append(payload, profile[i*iccChunkSize:end]...))
+		}
+	case "png":
+		var body bytes.Buffer
+		body.WriteString("ICC profile\x00\x00")
+		w := zlib.NewWriter(&body)
+		w.Write(profile)
+		w.Close()
+		encoded = insertPNGChunk(encoded, "iCCP", body.Bytes())
+	}
+	return encoded
+}
+
+// iccTransform converts pixels from a matrix/TRC RGB profile to sRGB.
+type iccTransform struct {
+	toLinear [3][256]float64
+	matrix   [3][3]float64 // source linear RGB to sRGB linear RGB
+}
+
+// sRGB primaries adapted to the D50 profile connection space.
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+func parseICCTransform(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 || string(profile[36:40]) != "acsp" {
+		return nil, fmt.Errorf("invalid icc profile")
+	}
+	if string(profile[16:20]) != "RGB " {
+		return nil, fmt.Errorf("unsupported icc color space %q", profile[16:20])
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count && 132+i*12+12 <= len(profile); i++ {
+		p := 132 + i*12
+		offset := int(binary.BigEndian.Uint32(profile[p+4:]))
+		size := int(binary.BigEndian.Uint32(profile[p+8:]))
+		if offset >= 0 && size >= 0 && offset+size <= len(profile) {
+			tags[string(profile[p:p+4])] = profile[offset : offset+size]
+		}
+	}
+
+	t := &iccTransform{}
+	var toXYZ [3][3]float64
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, fmt.Errorf("icc profile has no %sXYZ colorant", name)
+		}
+		for i := 0; i < 3; i++ {
+			toXYZ[i][c] = s15Fixed16(xyz[8+i*4:])
+		}
+		curve, err := parseICCCurve(tags[name+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+		for v := range t.toLinear[c] {
+			t.toLinear[c][v] = curve(float64(v) / 255)
+		}
+	}
+
+	fromXYZ := invert3x3(srgbToXYZ)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				t.matrix[i][j] += fromXYZ[i][k] * toXYZ[k][j]
+			}
+		}
+	}
+	return t, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICCCurve decodes a curv or para tone reproduction curve.
+func parseICCCurve(data []byte) (func(float64) float64, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("missing icc tone curve")
+	}
+	switch string(data[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(data[8:]))
+		if len(data) < 12+n*2 {
+			return nil, fmt.Errorf("truncated icc curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(data[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(data[12+i*2:])) / 65535
+		}
+		return func(v float64) float64 {
+			pos := v * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		fn := int(binary.BigEndian.Uint16(data[8:]))
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if fn >= len(paramCounts) || len(data) < 12+paramCounts[fn]*4 {
+			return nil, fmt.Errorf("unsupported icc parametric curve")
+		}
+		p := make([]float64, 7)
+		for i := 0; i < paramCounts[fn]; i++ {
+			p[i] = s15Fixed16(data[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(v float64) float64 {
+			switch fn {
+			case 0:
+				return math.Pow(v, g)
+			case 1:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g)
+				}
+				return 0
+			case 2:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g) + c
+				}
+				return c
+			case 3:
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			default:
+				if v >= d {
+					return math.Pow(a*v+b, g) + e
+				}
+				return c*v + f
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported icc curve type %q", data[:4])
+}
+
+func invert3x3(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv
+}
+
+func srgbEncode(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint8(v*255 + 0.5)
+}
+
+// convert returns img transformed into sRGB, keeping its alpha channel.
+func (t *iccTransform) convert(img image.Image) image.Image {
+	var encode [4096]uint8
+	for i := range encode {
+		encode[i] = srgbEncode(float64(i) / float64(len(encode)-1))
+	}
+	lookup := func(v float64) uint8 {
+		i := int(v*float64(len(encode)-1) + 0.5)
+		if i < 0 {
+			i = 0
+		} else if i >= len(encode) {
+			i = len(encode) - 1
+		}
+		return encode[i]
+	}
+
+	dst := image.NewNRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		r := t.toLinear[0][dst.Pix[i]]
+		g := t.toLinear[1][dst.Pix[i+1]]
+		b := t.toLinear[2][dst.Pix[i+2]]
+		m := &t.matrix
+		dst.Pix[i] = lookup(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+		dst.Pix[i+1] = lookup(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		dst.Pix[i+2] = lookup(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+	}
+	return dst
+}
@@ -0,0 +1,258 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+)
+
+func s15Fixed16Bytes(v float64) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(int32(math.Round(v*65536))))
+	return b
+}
+
+// srgbCurve is the sRGB tone curve as a para tag, function type 3.
+func srgbCurve() []byte {
+	curve := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, p := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		curve = append(curve, s15Fixed16Bytes(p)...)
+	}
+	return curve
+}
+
+// testProfile builds an RGB matrix/TRC profile with the colorants of
+// toXYZ, whose columns are the red, green and blue primaries, and curve for
+// every channel.
+func testProfile(toXYZ [3][3]float64, curve []byte) []byte {
+	tags := map[string][]byte{"rTRC": curve, "gTRC": curve, "bTRC": curve}
+	for c, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for i := 0; i < 3; i++ {
+			xyz = append(xyz, s15Fixed16Bytes(toXYZ[i][c])...)
+		}
+		tags[name] = xyz
+	}
+	names := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+
+	profile := make([]byte, 132+len(names)*12)
+	copy(profile[16:], "RGB ")
+	copy(profile[20:], "XYZ ")
+	copy(profile[36:], "acsp")
+	binary.BigEndian.PutUint32(profile[128:], uint32(len(names)))
+	for i, name := range names {
+		entry := profile[132+i*12:]
+		copy(entry, name)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(profile)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tags[name])))
+		profile = append(profile, tags[name]...)
+	}
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func TestICCProfileRoundTrip(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	var jpegData, pngData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+
+	small := testProfile(srgbToXYZ, srgbCurve())
+	// Larger than one APP2 segment holds, so it is split in chunks
+	large := append(append([]byte{}, small...), bytes.Repeat([]byte{0x5A}, 2*iccChunkSize)...)
+	for _, tc := range []struct {
+		name, format string
+		data         []byte
+		profile      []byte
+	}{
+		{"jpeg", "jpeg", jpegData.Bytes(), small},
+		{"jpeg chunked", "jpeg", jpegData.Bytes(), large},
+		{"png", "png", pngData.Bytes(), small},
+		{"png large", "png", pngData.Bytes(), large},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if profile := readICCProfile(tc.data); profile != nil {
+				t.Fatalf("got a %d byte profile before embedding one", len(profile))
+			}
+			encoded := embedICCProfile(tc.data, tc.profile, tc.format)
+			if got := readICCProfile(encoded); !bytes.Equal(got, tc.profile) {
+				t.Fatalf("read back %d bytes, want the %d embedded", len(got), len(tc.profile))
+			}
+			if _, _, err := image.Decode(bytes.NewReader(encoded)); err != nil {
+				t.Fatalf("output with profile does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseICCCurve(t *testing.T) {
+	curv := func(values ...uint16) []byte {
+		data := []byte("curv\x00\x00\x00\x00")
+		data = binary.BigEndian.AppendUint32(data, uint32(len(values)))
+		for _, v := range values {
+			data = binary.BigEndian.AppendUint16(data, v)
+		}
+		return data
+	}
+	para := func(fn uint16, params ...float64) []byte {
+		data := []byte("para\x00\x00\x00\x00")
+		data = binary.BigEndian.AppendUint16(data, fn)
+		data = append(data, 0, 0)
+		for _, p := range params {
+			data = append(data, s15Fixed16Bytes(p)...)
+		}
+		return data
+	}
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		in, out float64
+		err     string
+	}{
+		{name: "identity", data: curv(), in: 0.3, out: 0.3},
+		{name: "gamma", data: curv(2 << 8), in: 0.5, out: 0.25},
+		{name: "table", data: curv(0, 65535), in: 0.25, out: 0.25},
+		{name: "table end", data: curv(0, 32768, 65535), in: 1, out: 1},
+		{name: "para gamma", data: para(0, 2), in: 0.5, out: 0.25},
+		{name: "para srgb", data: srgbCurve(), in: 0.5, out: 0.214},
+		{name: "para srgb linear", data: srgbCurve(), in: 0.02, out: 0.02 / 12.92},
+		{name: "missing", data: nil, err: "missing"},
+		{name: "truncated table", data: curv(0, 1, 2)[:16], err: "truncated"},
+		{name: "truncated para", data: para(4, 1, 2, 3), err: "unsupported icc parametric"},
+		{name: "unknown para", data: para(5, 1, 2, 3, 4, 5, 6, 7), err: "unsupported icc parametric"},
+		{name: "unknown type", data: []byte("sf32\x00\x00\x00\x00\x00\x00\x00\x00"), err: "unsupported icc curve"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			curve, err := parseICCCurve(tc.data)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := curve(tc.in); math.Abs(got-tc.out) > 0.001 {
+				t.Fatalf("curve(%v) = %v, want %v", tc.in, got, tc.out)
+			}
+		})
+	}
+}
+
+func TestParseICCTransformErrors(t *testing.T) {
+	valid := testProfile(srgbToXYZ, srgbCurve())
+	unsigned := append([]byte{}, valid...)
+	copy(unsigned[36:], "xxxx")
+	cmyk := append([]byte{}, valid...)
+	copy(cmyk[16:], "CMYK")
+	noColorant := append([]byte{}, valid...)
+	copy(noColorant[132:], "wtpt") // rename the rXYZ tag
+	outOfRange := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(outOfRange[132+4:], 1<<31) // rXYZ offset
+	manyTags := append([]byte{}, valid...)
+	binary.BigEndian.PutUint32(manyTags[128:], 1<<30)
+
+	for _, tc := range []struct {
+		name    string
+		profile []byte
+		err     string
+	}{
+		{"short", valid[:100], "invalid"},
+		{"no signature", unsigned, "invalid"},
+		{"cmyk", cmyk, "unsupported icc color space"},
+		{"no colorant", noColorant, "no rXYZ"},
+		{"tag out of range", outOfRange, "no rXYZ"},
+		{"tag count past the end", manyTags, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseICCTransform(tc.profile)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want the tags present used", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got error %v, want one containing %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestICCTransformConvert(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	for x, c := range []color.NRGBA{{0, 0, 0, 255}, {255, 255, 255, 255}, {200, 40, 90, 255}, {10, 180, 250, 128}} {
+		img.SetNRGBA(x, 0, c)
+	}
+
+	// An sRGB profile leaves sRGB pixels as they are
+	transform, err := parseICCTransform(testProfile(srgbToXYZ, srgbCurve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := transform.convert(img).(*image.NRGBA)
+	for i, v := range img.Pix {
+		if d := int(converted.Pix[i]) - int(v); d < -1 || d > 1 {
+			t.Fatalf("byte %d converted from %d to %d, want it kept", i, v, converted.Pix[i])
+		}
+	}
+
+	// Wider primaries than sRGB's push saturated colors further out, and keep
+	// gray gray
+	wide := srgbToXYZ
+	for i := 0; i < 3; i++ {
+		avg := (wide[i][0] + wide[i][1] + wide[i][2]) / 3
+		for c := 0; c < 3; c++ {
+			wide[i][c] = avg + (wide[i][c]-avg)*1.2
+		}
+	}
+	transform, err = parseICCTransform(testProfile(wide, srgbCurve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted = transform.convert(img).(*image.NRGBA)
+	if white := converted.NRGBAAt(1, 0); white.R < 254 || white.G < 254 || white.B < 254 {
+		t.Fatalf("white converted to %v", white)
+	}
+	if got, src := converted.NRGBAAt(2, 0), img.NRGBAAt(2, 0); got.R <= src.R || got.G >= src.G {
+		t.Fatalf("%v converted to %v, want it more saturated", src, got)
+	}
+	if got := converted.NRGBAAt(3, 0); got.A != 128 {
+		t.Fatalf("alpha converted to %d, want 128", got.A)
+	}
+}
+
+func TestKeepICCProfile(t *testing.T) {
+	for _, tc := range []struct {
+		keep  bool
+		strip string
+		want  bool
+	}{
+		{true, "", true},
+		{true, "gps", true},
+		{true, "icc", false},
+		{true, "all", false},
+		{false, "", false},
+	} {
+		opts := DefaultOptions()
+		opts.KeepMetadata = tc.keep
+		opts.StripMetadata = map[string]bool{}
+		if tc.strip != "" {
+			opts.StripMetadata[tc.strip] = true
+		}
+		if got := keepICCProfile(opts); got != tc.want {
+			t.Errorf("keepICCProfile(keep %v, strip %q) = %v, want %v", tc.keep, tc.strip, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package compressor
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// JPEGTranCommand is the lossless JPEG optimizer used by Options.Lossless.
+const JPEGTranCommand = "jpegtran"
+
+// writeLossless rewrites inputPath into outputPath without changing a single
+// pixel: JPEGs get optimized Huffman tables from jpegtran and PNGs are
+// re-deflated. Metadata is then carried over as in writeOutput, so the strip
+// options still apply.
+func writeLossless(inputPath, outputPath string, opts Options, result *FileResult) error {
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+
+	var format string
+	var encoded []byte
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		format = "jpeg"
+		encoded, err = optimizeJPEG(data, opts.Progressive)
+		if err != nil {
+			return err
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		format = "png"
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to decode image: %v", err)
+		}
+		var buf bytes.Buffer
+		switch img.(type) {
+		case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+			// The optimizer works in 8 bits per channel
+			encoder := png.Encoder{CompressionLevel: png.BestCompression}
+			err = encoder.Encode(&buf, img)
+		default:
+			err = encodeOptimizedPNG(&buf, img, "lossless")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode image: %v", err)
+		}
+		encoded = buf.Bytes()
+	default:
+		return fmt.Errorf("lossless mode only supports jpeg and png files")
+	}
+
+	if profile := readICCProfile(data); profile != nil && keepICCProfile(opts) {
+		encoded = embedICCProfile(encoded, profile, format)
+	}
+	if opts.KeepMetadata {
+		encoded = copyMetadata(encoded, data, format, opts.StripMetadata, false, 0, 0)
+	}
+
+	if err := writeFileAtomic(outputPath, encoded, inputPath, opts); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	result.Outputs = append(result.Outputs, outputPath)
+	result.OutputSize += int64(len(encoded))
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		result.Width, result.Height = config.Width, config.Height
+		result.OutputWidth, result.OutputHeight = config.Width, config.Height
+	}
+	return nil
+}
+
+// optimizeJPEG losslessly recompresses a JPEG with optimized Huffman tables
+// and no metadata. Without jpegtran in PATH only the metadata is dropped.
+func optimizeJPEG(data []byte, progressive bool) ([]byte, error) {
+	if _, err := exec.LookPath(JPEGTranCommand); err != nil {
+		return stripJPEGMetadata(data), nil
+	}
+
+	args := []string{"-optimize", "-copy", "none"}
+	if progressive {
+		args = append(args, "-progressive")
+	}
+	cmd := exec.Command(JPEGTranCommand, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", JPEGTranCommand, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// stripJPEGMetadata drops the APPn and COM segments of a JPEG, except JFIF
+// (APP0) and Adobe (APP14), which decoders need to interpret the scan.
+func stripJPEGMetadata(data []byte) []byte {
+	segments := jpegSegments(data)
+	if len(segments) == 0 {
+		return data
+	}
+	out := append([]byte{}, data[:2]...)
+	end := 2
+	for _, seg := range segments {
+		end = seg.start + 4 + len(seg.payload)
+		metadata := seg.marker == 0xFE || (seg.marker >= 0xE1 && seg.marker <= 0xEF && seg.marker != 0xEE)
+		if !metadata {
+			out = append(out, data[seg.start:end]...)
+		}
+	}
+	return append(out, data[end:]...)
+}
@@ -0,0 +1,266 @@
+package compressor
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ManifestEntry is one line of a run manifest, recorded once a file is
+// finished. Later lines for the same input replace earlier ones.
+type ManifestEntry struct {
+	Input        string           `json:"input"`
+	InputSize    int64            `json:"input_size"`
+	InputModTime time.Time        `json:"input_mtime"`
+	InputSHA256  string           `json:"input_sha256,omitempty"`
+	Status       string           `json:"status"` // "done" or "failed"
+	Outputs      []ManifestOutput `json:"outputs,omitempty"`
+	Error        string           `json:"error,omitempty"`
+	Time         time.Time        `json:"time"`
+}
+
+// ManifestOutput is a file written for an entry and its SHA-256.
+type ManifestOutput struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// ChangeDetectionModes lists the -incremental modes: "mtime" treats a source
+// as changed when its size or modification time differ from the manifest,
+// "hash" when its size or SHA-256 do.
+var ChangeDetectionModes = map[string]bool{
+	"mtime": true,
+	"hash":  true,
+}
+
+// Manifest is an append-only JSONL log of finished files, used to resume an
+// interrupted run or skip unchanged sources. It is safe for concurrent use.
+type Manifest struct {
+	// ChangeDetection is one of ChangeDetectionModes, or empty to consider
+	// every finished file current regardless of its source.
+	ChangeDetection string
+
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]ManifestEntry
+}
+
+// LoadManifest reads the manifest at path without opening it for writing; a
+// missing file gives an empty manifest. A truncated last line from a killed
+// run is ignored. Record must not be called on the result.
+func LoadManifest(path string) (*Manifest, error) {
+	m := &Manifest{entries: make(map[string]ManifestEntry)}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var entry ManifestEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				m.entries[entry.Input] = entry
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read manifest: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// OpenManifest loads the manifest at path, if there is one, and opens it for
+// appending.
+func OpenManifest(path string) (*Manifest, error) {
+	m, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	m.f = f
+	return m, nil
+}
+
+// Record appends the outcome of res, with checksums of everything it wrote.
+// Those taken by CompressFile are reused rather than read again. An input
+// replaced in place is recorded as the replacement now at its path, so that
+// change detection does not take it for a new original on the next run.
+func (m *Manifest) Record(res FileResult) error {
+	entry := ManifestEntry{Input: res.InputPath, Status: "done", Time: time.Now(), InputSHA256: res.InputSHA256}
+	if res.Replaced {
+		entry.InputSHA256 = ""
+	}
+	if info, err := os.Stat(res.InputPath); err == nil {
+		entry.InputSize, entry.InputModTime = info.Size(), info.ModTime()
+	}
+	if entry.InputSHA256 == "" {
+		if sum, err := fileSHA256(res.InputPath); err == nil {
+			entry.InputSHA256 = sum
+		}
+	}
+	if res.Err != nil {
+		entry.Status = "failed"
+		entry.Error = res.Err.Error()
+	} else {
+		outputs := res.Outputs
+		if res.Thumbnail != "" {
+			outputs = append(append([]string{}, outputs...), res.Thumbnail)
+		}
+		for i, path := range outputs {
+			if i < len(res.OutputSHA256) {
+				entry.Outputs = append(entry.Outputs, ManifestOutput{Path: path, SHA256: res.OutputSHA256[i]})
+				continue
+			}
+			sum, err := fileSHA256(path)
+			if err != nil {
+				return fmt.Errorf("failed to checksum output: %v", err)
+			}
+			entry.Outputs = append(entry.Outputs, ManifestOutput{Path: path, SHA256: sum})
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[entry.Input] = entry
+	if _, err := m.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// checksumResult records the SHA-256 of the source and outputs of a
+// compressed file in result.
+func checksumResult(result *FileResult) error {
+	sum, err := fileSHA256(result.InputPath)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", result.InputPath, err)
+	}
+	result.InputSHA256 = sum
+	for _, path := range result.Outputs {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", path, err)
+		}
+		result.OutputSHA256 = append(result.OutputSHA256, sum)
+	}
+	return nil
+}
+
+// Done reports whether input was completed by an earlier run, all of its
+// outputs are still intact and, with ChangeDetection set, the source hasn't
+// changed since.
+func (m *Manifest) Done(input string) bool {
+	m.mu.Lock()
+	entry, ok := m.entries[input]
+	m.mu.Unlock()
+	if !ok || entry.Status != "done" {
+		return false
+	}
+	if m.ChangeDetection != "" {
+		info, err := os.Stat(input)
+		if err != nil || info.Size() != entry.InputSize {
+			return false
+		}
+		switch m.ChangeDetection {
+		case "mtime":
+			if !info.ModTime().Equal(entry.InputModTime) {
+				return false
+			}
+		case "hash":
+			if sum, err := fileSHA256(input); err != nil || sum != entry.InputSHA256 {
+				return false
+			}
+		}
+	}
+	for _, out := range entry.Outputs {
+		if sum, err := fileSHA256(out.Path); err != nil || sum != out.SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// Entries returns the latest entry of every input, sorted by input path.
+func (m *Manifest) Entries() []ManifestEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]ManifestEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Input < entries[j].Input })
+	return entries
+}
+
+// WriteOutputMap saves a CSV of the original and output path of every file
+// the manifest records as done, a row for each output, so outputs whose
+// names no longer mirror their sources can be traced back.
+func (m *Manifest) WriteOutputMap(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write output map: %v", err)
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"original", "output"})
+	for _, entry := range m.Entries() {
+		if entry.Status != "done" {
+			continue
+		}
+		for _, out := range entry.Outputs {
+			w.Write([]string{entry.Input, out.Path})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write output map: %v", err)
+	}
+	return f.Close()
+}
+
+// VerifyOutput checks that a recorded output still has its checksum and
+// decodes as an image.
+func VerifyOutput(out ManifestOutput) error {
+	sum, err := fileSHA256(out.Path)
+	if err != nil {
+		return err
+	}
+	if sum != out.SHA256 {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return decodeFile(out.Path)
+}
+
+// Close closes the manifest file, if it was opened for writing.
+func (m *Manifest) Close() error {
+	if m.f == nil {
+		return nil
+	}
+	return m.f.Close()
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
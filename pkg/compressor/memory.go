@@ -0,0 +1,76 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+)
+
+// TIFF tags holding the pixel dimensions of an IFD's image.
+const (
+	tagImageWidth  = 0x0100
+	tagImageLength = 0x0101
+)
+
+// decodedBytesPerPixel is the cost of one pixel once decoded to RGBA, which
+// is what most of the pipeline works on.
+const decodedBytesPerPixel = 4
+
+// EstimateMemory returns roughly how many bytes compressing path will hold at
+// once: the encoded file plus its decoded pixels. Only the image header is
+// read, so this is cheap enough to call before admitting a file.
+func EstimateMemory(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat image: %v", err)
+	}
+	width, height, err := imageDimensions(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size() + int64(width)*int64(height)*decodedBytesPerPixel, nil
+}
+
+func imageDimensions(path string) (int, int, error) {
+	if IsRawFile(path) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to open image: %v", err)
+		}
+		return rawDimensions(data)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open image: %v", err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read image header: %v", err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// rawDimensions returns the largest image described by a RAW file's IFDs,
+// which is the sensor data rather than one of the embedded previews.
+func rawDimensions(data []byte) (int, int, error) {
+	t, err := newTIFFReader(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	var width, height uint32
+	t.walk(func(ifd *tiffIFD) {
+		w, okW := t.uint(ifd, tagImageWidth)
+		h, okH := t.uint(ifd, tagImageLength)
+		if okW && okH && uint64(w)*uint64(h) > uint64(width)*uint64(height) {
+			width, height = w, h
+		}
+	})
+	if width == 0 || height == 0 {
+		return 0, 0, fmt.Errorf("no image dimensions in raw file")
+	}
+	return int(width), int(height), nil
+}
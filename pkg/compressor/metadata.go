@@ -0,0 +1,375 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"regexp"
+	"time"
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iptcHeader = []byte("Photoshop 3.0\x00")
+)
+
+// EXIF tags removed by the -strip-metadata categories.
+const (
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagMakerNote          = 0x927C
+	tagPixelXDimension    = 0xA002
+	tagPixelYDimension    = 0xA003
+	tagBodySerialNumber   = 0xA431
+	tagLensSerialNumber   = 0xA435
+	tagCameraSerialNumber = 0xC62F
+)
+
+// MetadataCategories lists the accepted Options.StripMetadata keys.
+var MetadataCategories = map[string]bool{
+	"gps": true, "serial": true, "exif": true, "xmp": true, "iptc": true, "icc": true, "all": true,
+}
+
+var (
+	xmpGPSPattern    = regexp.MustCompile(`(?s)\s(exif:GPS\w+)="[^"]*"|<(exif:GPS\w+)\b.*?</exif:GPS\w+>`)
+	xmpSerialPattern = regexp.MustCompile(`(?s)\s(\w+:\w*SerialNumber)="[^"]*"|<(\w+:\w*SerialNumber)\b.*?</\w+:\w*SerialNumber>`)
+)
+
+const maxAPP1Payload = 0xFFFF - 2
+
+// jpegSegment is a marker segment that precedes the image scan.
+type jpegSegment struct {
+	marker  byte
+	start   int // offset of the 0xFF marker byte
+	payload []byte
+}
+
+// jpegSegments lists the marker segments of a JPEG up to the first SOS.
+func jpegSegments(data []byte) []jpegSegment {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil
+	}
+	var segments []jpegSegment
+	p := 2
+	for p+4 <= len(data) && data[p] == 0xFF {
+		marker := data[p+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[p+2:]))
+		if length < 2 || p+2+length > len(data) {
+			break
+		}
+		segments = append(segments, jpegSegment{marker: marker, start: p, payload: data[p+4 : p+2+length]})
+		p += 2 + length
+	}
+	return segments
+}
+
+// pngChunks calls visit for every chunk of a PNG file until visit returns false.
+func pngChunks(data []byte, visit func(typ string, start int, body []byte) bool) {
+	if len(data) < 8 || string(data[1:4]) != "PNG" {
+		return
+	}
+	p := 8
+	for p+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[p:]))
+		if length < 0 || p+12+length > len(data) {
+			return
+		}
+		if !visit(string(data[p+4:p+8]), p, data[p+8:p+8+length]) {
+			return
+		}
+		p += 12 + length
+	}
+}
+
+// findJPEGSegment returns the payload (minus prefix) of the first segment with
+// the given marker whose payload starts with prefix.
+func findJPEGSegment(data []byte, marker byte, prefix []byte) []byte {
+	for _, seg := range jpegSegments(data) {
+		if seg.marker == marker && bytes.HasPrefix(seg.payload, prefix) {
+			return seg.payload[len(prefix):]
+		}
+	}
+	return nil
+}
+
+// readExif returns the TIFF-structured EXIF payload of a JPEG (APP1) or PNG
+// (eXIf chunk) file, or nil when it carries none.
+func readExif(data []byte) []byte {
+	if exif := findJPEGSegment(data, 0xE1, exifHeader); exif != nil {
+		return exif
+	}
+	var exif []byte
+	pngChunks(data, func(typ string, _ int, body []byte) bool {
+		if typ == "eXIf" {
+			exif = body
+			return false
+		}
+		return true
+	})
+	return exif
+}
+
+// exifDateTime returns the capture time recorded in an EXIF block, preferring
+// DateTimeOriginal over the IFD0 modification DateTime.
+func exifDateTime(exif []byte) (time.Time, bool) {
+	t, err := newTIFFReader(exif)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ifd0, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var value string
+	if offset, ok := t.uint(ifd0, tagExifIFD); ok {
+		if exifIFD, err := t.readIFD(offset); err == nil {
+			value, _ = t.ascii(exifIFD, tagDateTimeOriginal)
+		}
+	}
+	if value == "" {
+		value, _ = t.ascii(ifd0, tagDateTime)
+	}
+	date, err := time.ParseInLocation("2006:01:02 15:04:05", value, time.Local)
+	return date, err == nil
+}
+
+// insertJPEGSegment places a marker segment directly after the SOI marker.
+func insertJPEGSegment(encoded []byte, marker byte, payload []byte) []byte {
+	if len(encoded) < 2 || len(payload) > maxAPP1Payload {
+		return encoded
+	}
+	out := make([]byte, 0, len(encoded)+len(payload)+4)
+	out = append(out, encoded[:2]...)
+	out = append(out, 0xFF, marker, byte((len(payload)+2)>>8), byte(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, encoded[2:]...)
+}
+
+// insertPNGChunk places a chunk directly after the IHDR chunk.
+func insertPNGChunk(encoded []byte, typ string, body []byte) []byte {
+	const ihdrEnd = 8 + 12 + 13
+	if len(encoded) < ihdrEnd {
+		return encoded
+	}
+	chunk := make([]byte, 8, len(body)+12)
+	binary.BigEndian.PutUint32(chunk, uint32(len(body)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(encoded)+len(chunk))
+	out = append(out, encoded[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, encoded[ihdrEnd:]...)
+}
+
+// zeroTIFFValue blanks the out-of-line value of an entry so removed data
+// cannot be recovered from the file.
+func zeroTIFFValue(t *tiffReader, e tiffEntry) {
+	size := tiffTypeSizes[e.typ] * int(e.count)
+	if size <= 4 || e.offset < 0 || e.offset+size > len(t.data) {
+		return
+	}
+	for i := e.offset; i < e.offset+size; i++ {
+		t.data[i] = 0
+	}
+}
+
+// zeroTIFFIFD blanks a whole IFD and the values it references.
+func zeroTIFFIFD(t *tiffReader, offset uint32) {
+	ifd, err := t.readIFD(offset)
+	if err != nil {
+		return
+	}
+	for _, e := range ifd.entries {
+		zeroTIFFValue(t, e)
+	}
+	for i := ifd.offset; i < ifd.offset+2+len(ifd.entries)*12+4; i++ {
+		t.data[i] = 0
+	}
+}
+
+// removeTIFFEntries deletes the entries with the given tags from an IFD by
+// compacting its entry table in place, so every other offset stays valid.
+// Removed values are zeroed; removed GPS IFD pointers take their IFD along.
+func removeTIFFEntries(t *tiffReader, ifd *tiffIFD, tags map[uint16]bool) {
+	var kept []int
+	for i, e := range ifd.entries {
+		if !tags[e.tag] {
+			kept = append(kept, i)
+			continue
+		}
+		if e.tag == tagGPSIFD {
+			if values := t.uints(e); len(values) == 1 {
+				zeroTIFFIFD(t, values[0])
+			}
+		}
+		zeroTIFFValue(t, e)
+	}
+	if len(kept) == len(ifd.entries) {
+		return
+	}
+
+	table := t.data[ifd.offset+2:]
+	entries := make([]byte, 0, len(kept)*12)
+	for _, i := range kept {
+		entries = append(entries, table[i*12:i*12+12]...)
+	}
+	t.order.PutUint16(t.data[ifd.offset:], uint16(len(kept)))
+	copy(table, entries)
+	t.order.PutUint32(table[len(entries):], ifd.next)
+	for i := len(entries) + 4; i < len(ifd.entries)*12+4; i++ {
+		table[i] = 0
+	}
+}
+
+// stripExif returns a copy of exif without the tags selected by the strip
+// categories.
+func stripExif(exif []byte, strip map[string]bool) []byte {
+	ifd0Tags := map[uint16]bool{}
+	exifTags := map[uint16]bool{}
+	if strip["gps"] {
+		ifd0Tags[tagGPSIFD] = true
+	}
+	if strip["serial"] {
+		ifd0Tags[tagCameraSerialNumber] = true
+		exifTags[tagBodySerialNumber] = true
+		exifTags[tagLensSerialNumber] = true
+		exifTags[tagMakerNote] = true
+	}
+	if len(ifd0Tags) == 0 && len(exifTags) == 0 {
+		return exif
+	}
+
+	t, err := newTIFFReader(append([]byte{}, exif...))
+	if err != nil {
+		return nil
+	}
+	ifd0, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return nil
+	}
+	if offset, ok := t.uint(ifd0, tagExifIFD); ok && len(exifTags) > 0 {
+		if exifIFD, err := t.readIFD(offset); err == nil {
+			removeTIFFEntries(t, exifIFD, exifTags)
+		}
+	}
+	removeTIFFEntries(t, ifd0, ifd0Tags)
+	return t.data
+}
+
+// fitExif returns a copy of exif describing an output of width x height
+// pixels: the IFD1 thumbnail, of the source's uncropped and unwatermarked
+// pixels, is removed, and the Exif IFD's pixel dimensions are rewritten.
+// Dimensions of 0 leave those tags as they are.
+func fitExif(exif []byte, width, height int) []byte {
+	t, err := newTIFFReader(append([]byte{}, exif...))
+	if err != nil {
+		return exif
+	}
+	ifd0, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return exif
+	}
+
+	if ifd0.next != 0 {
+		end := len(t.data)
+		if ifd1, err := t.readIFD(ifd0.next); err == nil {
+			for _, pair := range [][2]uint16{{tagJPEGInterchangeFormat, tagJPEGInterchangeLength}, {tagStripOffsets, tagStripByteCounts}} {
+				start, ok := t.uint(ifd1, pair[0])
+				length, ok2 := t.uint(ifd1, pair[1])
+				if !ok || !ok2 || int(start) < 0 || int(start)+int(length) > len(t.data) {
+					continue
+				}
+				for i := int(start); i < int(start)+int(length); i++ {
+					t.data[i] = 0
+				}
+				if int(start)+int(length) == end {
+					end = int(start) // the usual layout, with the thumbnail last
+				}
+			}
+			zeroTIFFIFD(t, ifd0.next)
+		}
+		t.order.PutUint32(t.data[ifd0.offset+2+len(ifd0.entries)*12:], 0)
+		t.data = t.data[:end]
+	}
+
+	if offset, ok := t.uint(ifd0, tagExifIFD); ok && width > 0 && height > 0 {
+		if exifIFD, err := t.readIFD(offset); err == nil {
+			for tag, value := range map[uint16]int{tagPixelXDimension: width, tagPixelYDimension: height} {
+				e, ok := exifIFD.find(tag)
+				if !ok || e.count != 1 || e.offset+4 > len(t.data) {
+					continue
+				}
+				switch e.typ {
+				case 3:
+					t.order.PutUint16(t.data[e.offset:], uint16(value))
+				case 4:
+					t.order.PutUint32(t.data[e.offset:], uint32(value))
+				}
+			}
+		}
+	}
+	return t.data
+}
+
+func stripXMP(xmp []byte, strip map[string]bool) []byte {
+	if strip["gps"] {
+		xmp = xmpGPSPattern.ReplaceAll(xmp, nil)
+	}
+	if strip["serial"] {
+		xmp = xmpSerialPattern.ReplaceAll(xmp, nil)
+	}
+	return xmp
+}
+
+// copyMetadata splices the metadata of the source file into the encoded
+// output, minus the categories selected in strip. EXIF is carried into JPEG
+// and PNG outputs; XMP and IPTC only between JPEGs. When oriented is set the
+// pixels have already been rotated and the orientation tag is reset. The EXIF
+// is fitted to the output of width x height pixels; see fitExif.
+func copyMetadata(encoded, source []byte, format string, strip map[string]bool, oriented bool, width, height int) []byte {
+	if strip["all"] {
+		return encoded
+	}
+
+	var exif []byte
+	if !strip["exif"] {
+		exif = readExif(source)
+		if exif != nil {
+			exif = stripExif(exif, strip)
+		}
+		if exif != nil && oriented {
+			exif = resetExifOrientation(exif)
+		}
+		if exif != nil {
+			exif = fitExif(exif, width, height)
+		}
+	}
+
+	switch format {
+	case "jpeg":
+		// Segments are inserted directly after SOI, so add them in reverse.
+		if iptc := findJPEGSegment(source, 0xED, iptcHeader); iptc != nil && !strip["iptc"] {
+			encoded = insertJPEGSegment(encoded, 0xED, append(append([]byte{}, iptcHeader...), iptc...))
+		}
+		if xmp := findJPEGSegment(source, 0xE1, xmpHeader); xmp != nil && !strip["xmp"] {
+			encoded = insertJPEGSegment(encoded, 0xE1, append(append([]byte{}, xmpHeader...), stripXMP(xmp, strip)...))
+		}
+		if exif != nil {
+			encoded = insertJPEGSegment(encoded, 0xE1, append(append([]byte{}, exifHeader...), exif...))
+		}
+	case "png":
+		if exif != nil {
+			encoded = insertPNGChunk(encoded, "eXIf", exif)
+		}
+	}
+	return encoded
+}
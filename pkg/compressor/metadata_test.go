@@ -0,0 +1,94 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+var testThumbnail = []byte("\xFF\xD8 source thumbnail \xFF\xD9")
+
+// thumbnailExif builds a little-endian EXIF block of a 4000 x 3000 photo
+// with an IFD1 thumbnail, laid out with the thumbnail last as cameras do.
+func thumbnailExif() []byte {
+	le := binary.LittleEndian
+	entry := func(b []byte, tag, typ uint16, value uint32) []byte {
+		b = le.AppendUint16(b, tag)
+		b = le.AppendUint16(b, typ)
+		b = le.AppendUint32(b, 1)
+		if typ == 3 {
+			b = le.AppendUint16(b, uint16(value))
+			return append(b, 0, 0)
+		}
+		return le.AppendUint32(b, value)
+	}
+	const ifd0, exifIFD, ifd1, thumb = 8, 26, 56, 86
+	b := []byte("II*\x00")
+	b = le.AppendUint32(b, ifd0)
+	b = le.AppendUint16(b, 1)
+	b = entry(b, tagExifIFD, 4, exifIFD)
+	b = le.AppendUint32(b, ifd1)
+	b = le.AppendUint16(b, 2)
+	b = entry(b, tagPixelXDimension, 4, 4000)
+	b = entry(b, tagPixelYDimension, 3, 3000)
+	b = le.AppendUint32(b, 0)
+	b = le.AppendUint16(b, 2)
+	b = entry(b, tagJPEGInterchangeFormat, 4, thumb)
+	b = entry(b, tagJPEGInterchangeLength, 4, uint32(len(testThumbnail)))
+	b = le.AppendUint32(b, 0)
+	return append(b, testThumbnail...)
+}
+
+// checkFittedExif fails unless exif has no thumbnail and the dimensions of a
+// width x height output.
+func checkFittedExif(t *testing.T, exif []byte, width, height uint32) {
+	t.Helper()
+	if bytes.Contains(exif, testThumbnail) {
+		t.Fatalf("the source's thumbnail is still in the EXIF")
+	}
+	r, err := newTIFFReader(exif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifd0, err := r.readIFD(r.firstIFD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifd0.next != 0 {
+		t.Fatalf("IFD0 still links to IFD1 at %d", ifd0.next)
+	}
+	offset, _ := r.uint(ifd0, tagExifIFD)
+	exifIFD, err := r.readIFD(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _ := r.uint(exifIFD, tagPixelXDimension)
+	y, _ := r.uint(exifIFD, tagPixelYDimension)
+	if x != width || y != height {
+		t.Fatalf("EXIF dimensions are %dx%d, want %dx%d", x, y, width, height)
+	}
+}
+
+func TestFitExif(t *testing.T) {
+	exif := thumbnailExif()
+	fitted := fitExif(exif, 640, 480)
+	checkFittedExif(t, fitted, 640, 480)
+	if len(fitted) != len(exif)-len(testThumbnail) {
+		t.Errorf("fitted EXIF is %d bytes, want the thumbnail cut from the %d", len(fitted), len(exif))
+	}
+	if !bytes.Contains(exif, testThumbnail) {
+		t.Errorf("fitExif changed its input")
+	}
+	checkFittedExif(t, fitExif(exif, 0, 0), 4000, 3000)
+}
+
+func TestCopyMetadataFitsExif(t *testing.T) {
+	data := insertJPEGSegment(noiseJPEG(t, 200, 100), 0xE1, append(append([]byte{}, exifHeader...), thumbnailExif()...))
+	opts := DefaultOptions()
+	opts.MaxWidth = 50
+	encoded, _, err := CompressBytes(data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFittedExif(t, readExif(encoded), 50, 25)
+}
@@ -0,0 +1,87 @@
+package compressor
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const ssimWindow = 8
+
+// lumaPlane converts img to a row-major slice of 8-bit luma values.
+func lumaPlane(img image.Image) ([]float64, int, int) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	plane := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			g := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			plane[y*w+x] = float64(g.Y)
+		}
+	}
+	return plane, w, h
+}
+
+// ssim computes the mean structural similarity of the luma channels of two
+// equally sized images over 8x8 windows with a stride of half a window.
+func ssim(a, b image.Image) float64 {
+	pa, w, h := lumaPlane(a)
+	pb, wb, hb := lumaPlane(b)
+	if w != wb || h != hb || w < ssimWindow || h < ssimWindow {
+		return 0
+	}
+
+	const c1 = (0.01 * 255) * (0.01 * 255)
+	const c2 = (0.03 * 255) * (0.03 * 255)
+	const n = ssimWindow * ssimWindow
+
+	var total float64
+	var windows int
+	for y := 0; y+ssimWindow <= h; y += ssimWindow / 2 {
+		for x := 0; x+ssimWindow <= w; x += ssimWindow / 2 {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for j := 0; j < ssimWindow; j++ {
+				row := (y+j)*w + x
+				for i := 0; i < ssimWindow; i++ {
+					va, vb := pa[row+i], pb[row+i]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	return total / float64(windows)
+}
+
+// psnr computes the peak signal-to-noise ratio in dB of the RGB channels of
+// two equally sized images, capped at 100 for identical ones.
+func psnr(a, b image.Image) float64 {
+	ba, bb := a.Bounds(), b.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() || ba.Empty() {
+		return 0
+	}
+	var sum float64
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			ca := color.NRGBAModel.Convert(a.At(ba.Min.X+x, ba.Min.Y+y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(bb.Min.X+x, bb.Min.Y+y)).(color.NRGBA)
+			for _, d := range []float64{float64(ca.R) - float64(cb.R), float64(ca.G) - float64(cb.G), float64(ca.B) - float64(cb.B)} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*ba.Dx()*ba.Dy())
+	if mse == 0 {
+		return 100
+	}
+	return math.Min(100, 10*math.Log10(255*255/mse))
+}
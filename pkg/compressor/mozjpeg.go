@@ -0,0 +1,127 @@
+package compressor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JPEGEncoders lists the -jpeg-encoder names. "mozjpeg" runs mozjpeg's cjpeg,
+// which must be first in PATH, trading speed for smaller files.
+var JPEGEncoders = map[string]bool{
+	"std":     true,
+	"mozjpeg": true,
+}
+
+// ChromaSubsampling maps the -chroma names to cjpeg's -sample factors for the
+// luma channel; image/jpeg always uses 4:2:0.
+var ChromaSubsampling = map[string]string{
+	"444": "1x1",
+	"422": "2x1",
+	"420": "2x2",
+}
+
+// MozJPEGCommand is the mozjpeg encoder run for -jpeg-encoder mozjpeg.
+const MozJPEGCommand = "cjpeg"
+
+// minMozJPEGMajor is the oldest mozjpeg release accepted: 3.0 made trellis
+// quantization and its tuned quantization tables the defaults.
+const minMozJPEGMajor = 3
+
+var mozJPEGVersionPattern = regexp.MustCompile(`mozjpeg version (\d+)\.\d+(\.\d+)?`)
+
+// MozJPEGVersion returns the version of the cjpeg first in PATH, e.g. "4.1.1".
+// It fails unless that cjpeg is mozjpeg 3.0 or later: libjpeg-turbo and IJG
+// ship a cjpeg too, which takes the same options but writes larger files.
+func MozJPEGVersion() (string, error) {
+	path, err := exec.LookPath(MozJPEGCommand)
+	if err != nil {
+		return "", fmt.Errorf("mozjpeg's %s is not in PATH: %v", MozJPEGCommand, err)
+	}
+	// cjpeg prints its version to stderr and exits; IJG's rejects -version
+	out, _ := exec.Command(path, "-version").CombinedOutput()
+	match := mozJPEGVersionPattern.FindSubmatch(out)
+	if match == nil {
+		return "", fmt.Errorf("%s is not mozjpeg's %s: -version printed %q", path, MozJPEGCommand, firstLine(out))
+	}
+	version := strings.TrimPrefix(string(match[0]), "mozjpeg version ")
+	if major, _ := strconv.Atoi(string(match[1])); major < minMozJPEGMajor {
+		return "", fmt.Errorf("%s is mozjpeg %s: %d.0 or later is needed", path, version, minMozJPEGMajor)
+	}
+	return version, nil
+}
+
+func firstLine(b []byte) string {
+	line := strings.TrimSpace(string(b))
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+// encodeMozJPEG encodes an opaque img as JPEG by piping it to cjpeg as a PPM.
+func encodeMozJPEG(w io.Writer, img image.Image, opts Options) error {
+	args := []string{"-quality", strconv.Itoa(opts.JPEGQuality), "-optimize", "-baseline"}
+	if opts.Progressive {
+		args[len(args)-1] = "-progressive"
+	}
+	if sample, ok := ChromaSubsampling[opts.Chroma]; ok {
+		args = append(args, "-sample", sample)
+	}
+	if opts.Grayscale {
+		args = append(args, "-grayscale")
+	}
+	cmd := exec.Command(MozJPEGCommand, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run %s: %v", MozJPEGCommand, err)
+	}
+
+	writeErr := writePPM(in, img)
+	in.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", MozJPEGCommand, err, strings.TrimSpace(stderr.String()))
+	}
+	if writeErr != nil {
+		return fmt.Errorf("failed to write %s input: %v", MozJPEGCommand, writeErr)
+	}
+	_, err = w.Write(stdout.Bytes())
+	return err
+}
+
+// writePPM writes img as a binary (P6) portable pixmap, dropping alpha.
+func writePPM(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(bounds)
+		draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy())
+	row := make([]byte, bounds.Dx()*3)
+	for y := 0; y < bounds.Dy(); y++ {
+		pix := rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < bounds.Dx(); x++ {
+			copy(row[x*3:x*3+3], pix[x*4:x*4+3])
+		}
+		if _, err := bw.Write(row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,86 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+)
+
+const tagOrientation = 0x0112
+
+// exifOrientation returns the EXIF orientation (1-8) stored in IFD0 of a
+// TIFF-structured block, or 1 when it is missing.
+func exifOrientation(tiff []byte) int {
+	t, err := newTIFFReader(tiff)
+	if err != nil {
+		return 1
+	}
+	ifd0, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return 1
+	}
+	if o, ok := t.uint(ifd0, tagOrientation); ok && o >= 1 && o <= 8 {
+		return int(o)
+	}
+	return 1
+}
+
+// resetExifOrientation returns a copy of exif with the orientation tag set to
+// 1, for outputs whose pixels have already been rotated.
+func resetExifOrientation(exif []byte) []byte {
+	t, err := newTIFFReader(append([]byte{}, exif...))
+	if err != nil {
+		return exif
+	}
+	ifd0, err := t.readIFD(t.firstIFD())
+	if err != nil {
+		return exif
+	}
+	if e, ok := ifd0.find(tagOrientation); ok && e.typ == 3 && e.offset+2 <= len(t.data) {
+		t.order.PutUint16(t.data[e.offset:], 1)
+	}
+	return t.data
+}
+
+// applyOrientation rotates and flips img so that it displays upright without
+// relying on the EXIF orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	src := newPooledRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	defer recycleImage(src)
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := newPooledRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
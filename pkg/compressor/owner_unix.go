@@ -0,0 +1,17 @@
+//go:build !windows
+
+package compressor
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the uid and gid of info's file.
+func fileOwner(info os.FileInfo) (int, int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
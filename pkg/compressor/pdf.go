@@ -0,0 +1,219 @@
+package compressor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// PDFPage is a page of WritePDF holding one image.
+type PDFPage struct {
+	Image                 []byte     // JPEG data, embedded as is
+	Width, Height         int        // of the image, in pixels
+	Gray                  bool       // one gray component rather than RGB
+	Flate                 bool       // Image holds zlib compressed 8-bit samples rather than a JPEG
+	PageWidth, PageHeight float64    // in points, 1/72 inch
+	ImageRect             [4]float64 // x, y, width and height of the image in points, from the bottom left corner
+}
+
+// WritePDF writes a PDF document of pages to w.
+func WritePDF(w io.Writer, pages []PDFPage) error {
+	out := bufio.NewWriter(w)
+	var offset int
+	var offsets []int
+	write := func(format string, args ...interface{}) {
+		n, _ := fmt.Fprintf(out, format, args...)
+		offset += n
+	}
+	// Objects 1 and 2 are the catalog and page tree; each page then takes
+	// three: the page, its image and its content stream
+	object := func() {
+		offsets = append(offsets, offset)
+		write("%d 0 obj\n", len(offsets))
+	}
+
+	write("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	object()
+	write("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	object()
+	write("<< /Type /Pages /Count %d /Kids [", len(pages))
+	for i := range pages {
+		write(" %d 0 R", 3+3*i)
+	}
+	write(" ] >>\nendobj\n")
+
+	for i, page := range pages {
+		first := 3 + 3*i
+		object()
+		write("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pdfNumber(page.PageWidth), pdfNumber(page.PageHeight), first+1, first+2)
+
+		colorSpace, filter := "/DeviceRGB", "/DCTDecode"
+		if page.Gray {
+			colorSpace = "/DeviceGray"
+		}
+		if page.Flate {
+			filter = "/FlateDecode"
+		}
+		object()
+		write("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter %s /Length %d >>\nstream\n",
+			page.Width, page.Height, colorSpace, filter, len(page.Image))
+		n, _ := out.Write(page.Image)
+		offset += n
+		write("\nendstream\nendobj\n")
+
+		r := page.ImageRect
+		content := fmt.Sprintf("q %s 0 0 %s %s %s cm /Im0 Do Q", pdfNumber(r[2]), pdfNumber(r[3]), pdfNumber(r[0]), pdfNumber(r[1]))
+		object()
+		write("<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+	}
+
+	xref := offset
+	write("xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		write("%010d 00000 n \n", o)
+	}
+	write("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Flush()
+}
+
+// pdfNumber formats v with at most two decimals, as PDF reals have no
+// exponent notation.
+func pdfNumber(v float64) string {
+	return fmt.Sprintf("%.2f", v)
+}
+
+// PDFPageSizes lists the -pdf-page-size names, in points; "fit" sizes every
+// page to its image.
+var PDFPageSizes = map[string][2]float64{
+	"fit":    {0, 0},
+	"a3":     {841.89, 1190.55},
+	"a4":     {595.28, 841.89},
+	"a5":     {419.53, 595.28},
+	"letter": {612, 792},
+	"legal":  {612, 1008},
+}
+
+// Album describes the PDF of WriteAlbum: images are drawn at DPI, shrunk to
+// fit pages of PageSize they would overflow, and centered.
+type Album struct {
+	PageSize   string // one of PDFPageSizes
+	DPI        int
+	Background color.Color // transparency is flattened onto it
+}
+
+// WriteAlbum saves the first output of every compressed file to path as a
+// PDF of one page per image, in the order the files were queued.
+func (r *Report) WriteAlbum(path string, album Album) error {
+	r.mu.Lock()
+	results := append([]FileResult{}, r.results...)
+	r.mu.Unlock()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+
+	var pages []PDFPage
+	for _, res := range results {
+		if res.Err != nil || len(res.Outputs) == 0 {
+			continue
+		}
+		page, err := albumPage(res.Outputs[0], album)
+		if err != nil {
+			return fmt.Errorf("failed to add %s to the PDF: %v", res.Outputs[0], err)
+		}
+		pages = append(pages, page)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write PDF: %v", err)
+	}
+	if err := WritePDF(f, pages); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return f.Close()
+}
+
+// albumPage lays the image at path out on a page of album. Baseline and
+// progressive YCbCr or gray JPEGs are embedded as they are; other images as
+// zlib compressed samples.
+func albumPage(path string, album Album) (PDFPage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PDFPage{}, err
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return PDFPage{}, err
+	}
+	page := PDFPage{Image: data, Width: cfg.Width, Height: cfg.Height, Gray: cfg.ColorModel == color.GrayModel}
+	if format != "jpeg" || (cfg.ColorModel != color.YCbCrModel && cfg.ColorModel != color.GrayModel) {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return PDFPage{}, err
+		}
+		if page.Image, page.Gray, err = flateSamples(img, album.Background); err != nil {
+			return PDFPage{}, err
+		}
+		page.Flate = true
+	}
+
+	points := func(pixels int) float64 { return float64(pixels) * 72 / float64(album.DPI) }
+	width, height := points(cfg.Width), points(cfg.Height)
+	size := PDFPageSizes[album.PageSize]
+	if size[0] == 0 {
+		page.PageWidth, page.PageHeight = width, height
+		page.ImageRect = [4]float64{0, 0, width, height}
+		return page, nil
+	}
+	// Landscape images get landscape pages
+	if cfg.Width > cfg.Height {
+		size[0], size[1] = size[1], size[0]
+	}
+	page.PageWidth, page.PageHeight = size[0], size[1]
+	if scale := size[0] / width; scale < 1 {
+		width, height = width*scale, height*scale
+	}
+	if scale := size[1] / height; scale < 1 {
+		width, height = width*scale, height*scale
+	}
+	page.ImageRect = [4]float64{(size[0] - width) / 2, (size[1] - height) / 2, width, height}
+	return page, nil
+}
+
+// flateSamples returns the 8-bit gray or RGB samples of img, flattened onto
+// background, zlib compressed.
+func flateSamples(img image.Image, background color.Color) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	bounds := img.Bounds()
+	gray, isGray := img.(*image.Gray)
+	if isGray {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			z.Write(gray.Pix[gray.PixOffset(bounds.Min.X, y):gray.PixOffset(bounds.Max.X, y)])
+		}
+	} else {
+		flat := flattenImage(img, background)
+		row := make([]byte, 3*bounds.Dx())
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, _ := flat.At(x, y).RGBA()
+				i := 3 * (x - bounds.Min.X)
+				row[i], row[i+1], row[i+2] = uint8(r>>8), uint8(g>>8), uint8(b>>8)
+			}
+			z.Write(row)
+		}
+		if flat != img {
+			recycleImage(flat)
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), isGray, nil
+}
@@ -0,0 +1,1110 @@
+package compressor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsPDFFile reports whether path has a .pdf extension.
+func IsPDFFile(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".pdf")
+}
+
+// isPDFData reports whether data starts like a PDF, whose header may follow
+// up to 1024 bytes of junk.
+func isPDFData(data []byte) bool {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	return bytes.Contains(head, []byte("%PDF-"))
+}
+
+// minPDFImagePixels is the smallest PDF image recompressed; smaller ones are
+// mostly logos and icons, which JPEG would blur for a few bytes.
+const minPDFImagePixels = 64 * 64
+
+// maxPDFStreamSize caps what any one stream of a PDF may inflate to, against
+// zlib bombs; images are held to the size of their samples.
+const maxPDFStreamSize = 256 << 20
+
+// maxPDFObjectNumber is the largest object number the PDF specification
+// allows. Numbers are also held below the trailer's /Size and the file's
+// length, as the rebuilt cross-reference table grows with the largest one.
+const maxPDFObjectNumber = 8388607
+
+// PDF values as parsed. Names, strings and numbers keep the bytes they were
+// written with, so objects are written back as they were.
+type (
+	pdfName    string // without the leading slash
+	pdfString  []byte // delimiters included
+	pdfNum     string
+	pdfKeyword string
+	pdfArray   []interface{}
+	pdfDict    map[pdfName]interface{}
+	pdfRef     struct{ num, gen int }
+)
+
+func pdfInt(n int) pdfNum {
+	return pdfNum(strconv.Itoa(n))
+}
+
+// intValue returns v as an int, if it is a number.
+func intValue(v interface{}) (int, bool) {
+	num, ok := v.(pdfNum)
+	if !ok {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(string(num)); err == nil {
+		return n, true
+	}
+	f, err := strconv.ParseFloat(string(num), 64)
+	return int(f), err == nil
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// pdfLexer reads PDF values from data, starting at pos.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+// skipSpace moves past white space and comments.
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		} else if isPDFSpace(c) {
+			l.pos++
+		} else {
+			return
+		}
+	}
+}
+
+// regular reads a run of regular characters, such as a number or keyword.
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// value reads the next value. Keywords, such as obj and stream, are returned
+// as pdfKeyword.
+func (l *pdfLexer) value() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	start := l.pos
+	switch c := l.data[l.pos]; {
+	case c == '/':
+		l.pos++
+		return pdfName(l.regular()), nil
+	case c == '(':
+		depth := 0
+		for ; l.pos < len(l.data); l.pos++ {
+			switch l.data[l.pos] {
+			case '\\':
+				l.pos++
+			case '(':
+				depth++
+			case ')':
+				if depth--; depth == 0 {
+					l.pos++
+					return pdfString(l.data[start:l.pos]), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("unterminated string at offset %d", start)
+	case c == '<' && l.pos+1 < len(l.data) && l.data[l.pos+1] == '<':
+		l.pos += 2
+		dict := pdfDict{}
+		for {
+			l.skipSpace()
+			if bytes.HasPrefix(l.data[l.pos:], []byte(">>")) {
+				l.pos += 2
+				return dict, nil
+			}
+			key, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key at offset %d is not a name", start)
+			}
+			if dict[name], err = l.value(); err != nil {
+				return nil, err
+			}
+		}
+	case c == '<':
+		end := bytes.IndexByte(l.data[l.pos:], '>')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string at offset %d", start)
+		}
+		l.pos += end + 1
+		return pdfString(l.data[start:l.pos]), nil
+	case c == '[':
+		l.pos++
+		array := pdfArray{}
+		for {
+			l.skipSpace()
+			if l.pos < len(l.data) && l.data[l.pos] == ']' {
+				l.pos++
+				return array, nil
+			}
+			v, err := l.value()
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, v)
+		}
+	case isPDFDelimiter(c):
+		return nil, fmt.Errorf("unexpected %q at offset %d", c, start)
+	}
+
+	token := l.regular()
+	switch token {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if c := token[0]; c == '+' || c == '-' || c == '.' || c >= '0' && c <= '9' {
+		// Two unsigned integers and R make a reference
+		if num, err := strconv.Atoi(token); err == nil && num >= 0 {
+			end := l.pos
+			l.skipSpace()
+			if gen, err := strconv.Atoi(l.regular()); err == nil && gen >= 0 {
+				l.skipSpace()
+				if l.regular() == "R" {
+					return pdfRef{num, gen}, nil
+				}
+			}
+			l.pos = end
+		}
+		return pdfNum(token), nil
+	}
+	return pdfKeyword(token), nil
+}
+
+// writePDFValue writes v to buf in PDF syntax; dictionary keys are sorted.
+func writePDFValue(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case pdfName:
+		buf.WriteString("/" + string(v))
+	case pdfString:
+		buf.Write(v)
+	case pdfNum:
+		buf.WriteString(string(v))
+	case pdfKeyword:
+		buf.WriteString(string(v))
+	case pdfRef:
+		fmt.Fprintf(buf, "%d %d R", v.num, v.gen)
+	case pdfArray:
+		buf.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(" ")
+			}
+			writePDFValue(buf, item)
+		}
+		buf.WriteString("]")
+	case pdfDict:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, string(key))
+		}
+		sort.Strings(keys)
+		buf.WriteString("<<")
+		for _, key := range keys {
+			buf.WriteString(" /" + key + " ")
+			writePDFValue(buf, v[pdfName(key)])
+		}
+		buf.WriteString(" >>")
+	}
+}
+
+// pdfXref locates an object: at offset in the file, or as the index-th
+// object of object stream stream.
+type pdfXref struct {
+	free   bool
+	offset int
+	gen    int
+	stream int
+	index  int
+}
+
+// pdfObject is an object as read: its value, the bytes it was written with,
+// and for streams their encoded data.
+type pdfObject struct {
+	value  interface{}
+	raw    []byte
+	stream []byte // nil for objects other than streams
+}
+
+// pdfObjectStream is a decoded object stream and the offsets of its objects.
+type pdfObjectStream struct {
+	data    []byte
+	offsets []int
+}
+
+// pdfFile is a parsed PDF, of which only the newest revision of every object
+// is kept.
+type pdfFile struct {
+	data       []byte
+	xref       map[int]pdfXref
+	trailer    pdfDict
+	objStreams map[int]*pdfObjectStream
+	loading    map[int]bool // objects being read, against reference loops
+}
+
+// parsePDF reads the cross-reference sections of data, classic tables and
+// streams alike, following /Prev through earlier revisions. Files whose
+// sections are missing or point to the wrong places are read by scanning for
+// objects instead. Encrypted files are refused.
+func parsePDF(data []byte) (*pdfFile, error) {
+	f := &pdfFile{data: data, objStreams: make(map[int]*pdfObjectStream), loading: make(map[int]bool)}
+	if err := f.readXref(); err != nil || f.trailer["Root"] == nil || !f.xrefValid() {
+		if err := f.scanObjects(); err != nil {
+			return nil, err
+		}
+	}
+	if f.trailer["Encrypt"] != nil {
+		return nil, fmt.Errorf("encrypted PDFs are not supported")
+	}
+	if size, ok := intValue(f.trailer["Size"]); ok && size > 0 {
+		for num := range f.xref {
+			if num >= size {
+				delete(f.xref, num)
+			}
+		}
+	}
+	return f, nil
+}
+
+// validObject reports whether num can be the number of an object of f.
+func (f *pdfFile) validObject(num int) bool {
+	return num > 0 && num <= maxPDFObjectNumber && num <= len(f.data)
+}
+
+// setXref records where object num is, unless a newer revision already did.
+// The free entries classic tables have for objects in the stream of a hybrid
+// file are overridden by that stream.
+func (f *pdfFile) setXref(num int, entry pdfXref, hybrid bool) {
+	if !f.validObject(num) {
+		return
+	}
+	if old, ok := f.xref[num]; ok && !(hybrid && old.free) {
+		return
+	}
+	f.xref[num] = entry
+}
+
+func (f *pdfFile) readXref() error {
+	f.xref = make(map[int]pdfXref)
+	f.trailer = nil
+	start := bytes.LastIndex(f.data, []byte("startxref"))
+	if start < 0 {
+		return fmt.Errorf("no startxref")
+	}
+	l := &pdfLexer{data: f.data, pos: start + len("startxref")}
+	v, err := l.value()
+	if err != nil {
+		return err
+	}
+	offset, ok := intValue(v)
+	seen := make(map[int]bool)
+	for ok && !seen[offset] {
+		seen[offset] = true
+		trailer, err := f.readXrefSection(offset, false)
+		if err != nil {
+			return err
+		}
+		if f.trailer == nil {
+			f.trailer = trailer
+		}
+		if stream, ok := intValue(trailer["XRefStm"]); ok {
+			if _, err := f.readXrefSection(stream, true); err != nil {
+				return err
+			}
+		}
+		offset, ok = intValue(trailer["Prev"])
+	}
+	return nil
+}
+
+// readXrefSection reads the table or stream at offset and returns its
+// trailer dictionary.
+func (f *pdfFile) readXrefSection(offset int, hybrid bool) (pdfDict, error) {
+	if offset < 0 || offset >= len(f.data) {
+		return nil, fmt.Errorf("xref offset %d is outside the file", offset)
+	}
+	l := &pdfLexer{data: f.data, pos: offset}
+	l.skipSpace()
+	if !bytes.HasPrefix(f.data[l.pos:], []byte("xref")) {
+		return f.readXrefStream(l.pos, hybrid)
+	}
+	l.pos += len("xref")
+	for {
+		v, err := l.value()
+		if err != nil {
+			return nil, err
+		}
+		if v == pdfKeyword("trailer") {
+			v, err = l.value()
+			trailer, ok := v.(pdfDict)
+			if err != nil || !ok {
+				return nil, fmt.Errorf("malformed trailer at offset %d", offset)
+			}
+			return trailer, nil
+		}
+		first, ok := intValue(v)
+		v, err = l.value()
+		count, ok2 := intValue(v)
+		if err != nil || !ok || !ok2 {
+			return nil, fmt.Errorf("malformed xref table at offset %d", offset)
+		}
+		for i := 0; i < count; i++ {
+			v, _ := l.value()
+			at, ok := intValue(v)
+			v, _ = l.value()
+			gen, ok2 := intValue(v)
+			kind, _ := l.value()
+			switch {
+			case !ok || !ok2:
+				return nil, fmt.Errorf("malformed xref table at offset %d", offset)
+			case kind == pdfKeyword("n"):
+				f.setXref(first+i, pdfXref{offset: at, gen: gen}, hybrid)
+			case kind == pdfKeyword("f"):
+				f.setXref(first+i, pdfXref{free: true}, hybrid)
+			default:
+				return nil, fmt.Errorf("malformed xref table at offset %d", offset)
+			}
+		}
+	}
+}
+
+// readXrefStream reads the cross-reference stream object at offset.
+func (f *pdfFile) readXrefStream(offset int, hybrid bool) (pdfDict, error) {
+	obj, _, err := f.objectAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	dict, _ := obj.value.(pdfDict)
+	if obj.stream == nil || dict["Type"] != pdfName("XRef") {
+		return nil, fmt.Errorf("no xref at offset %d", offset)
+	}
+	data, err := f.decodeStream(dict, obj.stream, maxPDFStreamSize)
+	if err != nil {
+		return nil, err
+	}
+	widths, _ := dict["W"].(pdfArray)
+	var w [3]int
+	for i := range w {
+		if i < len(widths) {
+			w[i], _ = intValue(widths[i])
+		}
+		if w[i] < 0 || w[i] > 8 {
+			return nil, fmt.Errorf("invalid field width %d in xref stream at offset %d", w[i], offset)
+		}
+	}
+	index, _ := dict["Index"].(pdfArray)
+	if index == nil {
+		index = pdfArray{pdfNum("0"), dict["Size"]}
+	}
+	field := func(b []byte) int {
+		n := 0
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+		return n
+	}
+	row := w[0] + w[1] + w[2]
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		first, _ := intValue(index[i])
+		count, _ := intValue(index[i+1])
+		for n := 0; n < count; n++ {
+			if pos+row > len(data) {
+				return nil, fmt.Errorf("truncated xref stream at offset %d", offset)
+			}
+			kind := 1 // the default when the type field is left out
+			if w[0] > 0 {
+				kind = field(data[pos : pos+w[0]])
+			}
+			a, b := field(data[pos+w[0]:pos+w[0]+w[1]]), field(data[pos+w[0]+w[1]:pos+row])
+			pos += row
+			switch kind {
+			case 0:
+				f.setXref(first+n, pdfXref{free: true}, hybrid)
+			case 1:
+				f.setXref(first+n, pdfXref{offset: a, gen: b}, hybrid)
+			case 2:
+				f.setXref(first+n, pdfXref{stream: a, index: b}, hybrid)
+			}
+		}
+	}
+	return dict, nil
+}
+
+// xrefValid reports whether every object of the file is where the
+// cross-reference sections say.
+func (f *pdfFile) xrefValid() bool {
+	for num, entry := range f.xref {
+		if entry.free || entry.stream > 0 {
+			continue
+		}
+		if at, ok := f.headerAt(entry.offset); !ok || at != num {
+			return false
+		}
+	}
+	return true
+}
+
+// headerAt returns the number of the object whose "num gen obj" header is at
+// offset.
+func (f *pdfFile) headerAt(offset int) (int, bool) {
+	if offset < 0 || offset >= len(f.data) {
+		return 0, false
+	}
+	l := &pdfLexer{data: f.data, pos: offset}
+	num, _ := l.value()
+	gen, _ := l.value()
+	keyword, _ := l.value()
+	n, ok := intValue(num)
+	_, ok2 := intValue(gen)
+	return n, ok && ok2 && keyword == pdfKeyword("obj")
+}
+
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// scanObjects rebuilds the cross-reference of a damaged file from the object
+// headers in it, the last of each number winning as a later revision would,
+// and from the object streams found. The trailer is the last one in the file,
+// or failing that has the catalog found as its root.
+func (f *pdfFile) scanObjects() error {
+	f.xref = make(map[int]pdfXref)
+	f.trailer = nil
+	for _, m := range pdfObjectHeader.FindAllSubmatchIndex(f.data, -1) {
+		if m[0] > 0 && !isPDFSpace(f.data[m[0]-1]) && !isPDFDelimiter(f.data[m[0]-1]) {
+			continue
+		}
+		num, err := strconv.Atoi(string(f.data[m[2]:m[3]]))
+		if err != nil || !f.validObject(num) {
+			continue
+		}
+		gen, _ := strconv.Atoi(string(f.data[m[4]:m[5]]))
+		f.xref[num] = pdfXref{offset: m[0], gen: gen}
+	}
+
+	var catalog, xrefStream pdfDict
+	var catalogRef pdfRef
+	nums := make([]int, 0, len(f.xref))
+	for num := range f.xref {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		obj, _, err := f.objectAt(f.xref[num].offset)
+		if err != nil {
+			continue
+		}
+		dict, _ := obj.value.(pdfDict)
+		switch {
+		case dict["Type"] == pdfName("Catalog"):
+			catalog, catalogRef = dict, pdfRef{num, f.xref[num].gen}
+		case dict["Type"] == pdfName("XRef") && dict["Root"] != nil:
+			xrefStream = dict
+		case dict["Type"] == pdfName("ObjStm") && obj.stream != nil:
+			stream, err := f.objectStream(num)
+			if err != nil {
+				continue
+			}
+			l := &pdfLexer{data: stream.data}
+			for i := range stream.offsets {
+				v, _ := l.value()
+				member, ok := intValue(v)
+				l.value()
+				if !ok || !f.validObject(member) {
+					continue
+				}
+				if _, ok := f.xref[member]; !ok {
+					f.xref[member] = pdfXref{stream: num, index: i}
+				}
+			}
+		}
+	}
+
+	if at := bytes.LastIndex(f.data, []byte("trailer")); at >= 0 {
+		l := &pdfLexer{data: f.data, pos: at + len("trailer")}
+		if v, err := l.value(); err == nil {
+			f.trailer, _ = v.(pdfDict)
+		}
+	}
+	if f.trailer["Root"] == nil {
+		f.trailer = xrefStream
+	}
+	if f.trailer["Root"] == nil {
+		if catalog == nil {
+			return fmt.Errorf("no document catalog")
+		}
+		f.trailer = pdfDict{"Root": catalogRef}
+	}
+	return nil
+}
+
+// object returns object num, or a null object when it is free or missing.
+func (f *pdfFile) object(num int) (pdfObject, error) {
+	entry, ok := f.xref[num]
+	if !ok || entry.free {
+		return pdfObject{}, nil
+	}
+	if f.loading[num] {
+		return pdfObject{}, fmt.Errorf("object %d refers to itself", num)
+	}
+	f.loading[num] = true
+	defer delete(f.loading, num)
+	if entry.stream == 0 {
+		obj, _, err := f.objectAt(entry.offset)
+		return obj, err
+	}
+	stream, err := f.objectStream(entry.stream)
+	if err != nil {
+		return pdfObject{}, err
+	}
+	if entry.index >= len(stream.offsets) {
+		return pdfObject{}, fmt.Errorf("object %d is missing from object stream %d", num, entry.stream)
+	}
+	l := &pdfLexer{data: stream.data, pos: stream.offsets[entry.index]}
+	l.skipSpace()
+	start := l.pos
+	value, err := l.value()
+	if err != nil {
+		return pdfObject{}, err
+	}
+	return pdfObject{value: value, raw: stream.data[start:l.pos]}, nil
+}
+
+// resolve returns the value v refers to, or v itself if it is direct.
+func (f *pdfFile) resolve(v interface{}) interface{} {
+	if ref, ok := v.(pdfRef); ok {
+		obj, _ := f.object(ref.num)
+		return obj.value
+	}
+	return v
+}
+
+// objectAt reads the object whose header is at offset, returning it and its
+// number.
+func (f *pdfFile) objectAt(offset int) (pdfObject, int, error) {
+	num, ok := f.headerAt(offset)
+	if !ok {
+		return pdfObject{}, 0, fmt.Errorf("no object at offset %d", offset)
+	}
+	l := &pdfLexer{data: f.data, pos: offset}
+	for i := 0; i < 3; i++ {
+		l.value()
+	}
+	l.skipSpace()
+	start := l.pos
+	value, err := l.value()
+	if err != nil {
+		return pdfObject{}, 0, fmt.Errorf("failed to read object %d: %v", num, err)
+	}
+	obj := pdfObject{value: value, raw: f.data[start:l.pos]}
+	l.skipSpace()
+	if dict, ok := value.(pdfDict); ok && bytes.HasPrefix(f.data[l.pos:], []byte("stream")) {
+		pos := l.pos + len("stream")
+		if pos < len(f.data) && f.data[pos] == '\r' {
+			pos++
+		}
+		if pos < len(f.data) && f.data[pos] == '\n' {
+			pos++
+		}
+		if obj.stream, err = f.streamData(dict, pos); err != nil {
+			return pdfObject{}, 0, fmt.Errorf("failed to read object %d: %v", num, err)
+		}
+	}
+	return obj, num, nil
+}
+
+// streamData returns the data of the stream of dict starting at start. A
+// wrong /Length is common enough to fall back on looking for endstream.
+func (f *pdfFile) streamData(dict pdfDict, start int) ([]byte, error) {
+	if length, ok := intValue(f.resolve(dict["Length"])); ok && length >= 0 && start+length <= len(f.data) {
+		l := &pdfLexer{data: f.data, pos: start + length}
+		l.skipSpace()
+		if bytes.HasPrefix(f.data[l.pos:], []byte("endstream")) {
+			return f.data[start : start+length], nil
+		}
+	}
+	end := bytes.Index(f.data[start:], []byte("endstream"))
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated stream")
+	}
+	data := f.data[start : start+end]
+	if bytes.HasSuffix(data, []byte("\r\n")) {
+		data = data[:len(data)-2]
+	} else if bytes.HasSuffix(data, []byte("\n")) || bytes.HasSuffix(data, []byte("\r")) {
+		data = data[:len(data)-1]
+	}
+	return data, nil
+}
+
+// objectStream returns object stream num, decoded once.
+func (f *pdfFile) objectStream(num int) (*pdfObjectStream, error) {
+	if stream, ok := f.objStreams[num]; ok {
+		return stream, nil
+	}
+	obj, err := f.object(num)
+	if err != nil {
+		return nil, err
+	}
+	dict, _ := obj.value.(pdfDict)
+	if obj.stream == nil || dict["Type"] != pdfName("ObjStm") {
+		return nil, fmt.Errorf("object %d is not an object stream", num)
+	}
+	data, err := f.decodeStream(dict, obj.stream, maxPDFStreamSize)
+	if err != nil {
+		return nil, err
+	}
+	count, _ := intValue(f.resolve(dict["N"]))
+	first, _ := intValue(f.resolve(dict["First"]))
+	stream := &pdfObjectStream{data: data}
+	l := &pdfLexer{data: data}
+	for i := 0; i < count; i++ {
+		l.value()
+		v, err := l.value()
+		offset, ok := intValue(v)
+		if err != nil || !ok || first < 0 || offset < 0 || first+offset > len(data) {
+			return nil, fmt.Errorf("malformed object stream %d", num)
+		}
+		stream.offsets = append(stream.offsets, first+offset)
+	}
+	f.objStreams[num] = stream
+	return stream, nil
+}
+
+// filters returns the names of the filters of a stream, in the order they
+// decode it, with their parameters.
+func (f *pdfFile) filters(dict pdfDict) ([]pdfName, []pdfDict) {
+	var names []pdfName
+	var parms []pdfDict
+	filter, decodeParms := f.resolve(dict["Filter"]), f.resolve(dict["DecodeParms"])
+	switch filter := filter.(type) {
+	case pdfName:
+		names = []pdfName{filter}
+		parm, _ := decodeParms.(pdfDict)
+		parms = []pdfDict{parm}
+	case pdfArray:
+		array, _ := decodeParms.(pdfArray)
+		for i, name := range filter {
+			name, _ := f.resolve(name).(pdfName)
+			var parm pdfDict
+			if i < len(array) {
+				parm, _ = f.resolve(array[i]).(pdfDict)
+			}
+			names, parms = append(names, name), append(parms, parm)
+		}
+	}
+	return names, parms
+}
+
+// decodeStream undoes the filters of a stream, of which only Flate, with or
+// without PNG predictors, is supported. Streams inflating past limit bytes are
+// refused.
+func (f *pdfFile) decodeStream(dict pdfDict, data []byte, limit int) ([]byte, error) {
+	names, parms := f.filters(dict)
+	for i, name := range names {
+		if name != "FlateDecode" && name != "Fl" {
+			return nil, fmt.Errorf("unsupported filter %s", name)
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to inflate stream: %v", err)
+		}
+		inflated, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+		// Streams cut short of their checksum still hold their data
+		if err != nil && err != io.ErrUnexpectedEOF && err != zlib.ErrChecksum {
+			return nil, fmt.Errorf("failed to inflate stream: %v", err)
+		}
+		if len(inflated) > limit {
+			return nil, fmt.Errorf("stream inflates past %s", HumanReadableSize(int64(limit)))
+		}
+		if data, err = unpredict(inflated, parms[i]); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// unpredict reverses the PNG row filters a Flate stream with a /Predictor of
+// 10 or more was encoded with.
+func unpredict(data []byte, parms pdfDict) ([]byte, error) {
+	predictor, _ := intValue(parms["Predictor"])
+	if predictor == 2 {
+		return nil, fmt.Errorf("unsupported TIFF predictor")
+	}
+	if predictor < 10 {
+		return data, nil
+	}
+	param := func(name pdfName, fallback int) int {
+		if v, ok := intValue(parms[name]); ok && v > 0 {
+			return v
+		}
+		return fallback
+	}
+	colors, bits, columns := param("Colors", 1), param("BitsPerComponent", 8), param("Columns", 1)
+	bpp := (colors*bits + 7) / 8
+	rowLen := (columns*colors*bits + 7) / 8
+	out := make([]byte, 0, len(data))
+	prev := make([]byte, rowLen)
+	for pos := 0; pos+1+rowLen <= len(data); pos += 1 + rowLen {
+		start := len(out)
+		out = append(out, data[pos+1:pos+1+rowLen]...)
+		row := out[start:]
+		for i := range row {
+			var left, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			switch data[pos] {
+			case 0:
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += prev[i]
+			case 3:
+				row[i] += byte((int(left) + int(prev[i])) / 2)
+			case 4:
+				row[i] += paeth(left, prev[i], upLeft)
+			default:
+				return nil, fmt.Errorf("unknown PNG predictor %d", data[pos])
+			}
+		}
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// components returns the number of color components of an RGB or gray color
+// space, device or ICC based.
+func (f *pdfFile) components(colorSpace interface{}) (int, bool) {
+	switch cs := f.resolve(colorSpace).(type) {
+	case pdfName:
+		switch cs {
+		case "DeviceRGB", "RGB":
+			return 3, true
+		case "DeviceGray", "G":
+			return 1, true
+		}
+	case pdfArray:
+		if len(cs) == 2 && f.resolve(cs[0]) == pdfName("ICCBased") {
+			profile, _ := f.resolve(cs[1]).(pdfDict)
+			if n, ok := intValue(f.resolve(profile["N"])); ok && (n == 1 || n == 3) {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// pdfImageOptions returns opts for the images inside a PDF, which keep their
+// place on the page: they are re-encoded as JPEG without crops, watermarks,
+// metadata or file size targets.
+func pdfImageOptions(opts Options) Options {
+	opts.ConvertTo = "jpeg"
+	opts.CropWidth, opts.CropHeight = 0, 0
+	opts.Watermark = Watermark{}
+	opts.TargetSize = 0
+	opts.KeepMetadata = false
+	return opts
+}
+
+// recompressPDF rebuilds the PDF data with its 8-bit RGB and gray images run
+// through the pipeline of opts and replaced by the JPEG made of each, when
+// that is smaller. JPEG images are re-encoded; uncompressed and Flate images
+// too, unless they are masks, color keyed or have a /Decode array. The file
+// is written without the object and cross-reference streams it may have had,
+// and without older revisions. With opts.Lossless only that rewrite is done.
+// Should the rebuilt file be no smaller, data itself is returned.
+func recompressPDF(data []byte, opts Options, result *FileResult) ([]byte, error) {
+	f, err := parsePDF(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF: %v", err)
+	}
+	nums := make([]int, 0, len(f.xref))
+	for num, entry := range f.xref {
+		if !entry.free && num > 0 {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+
+	version := "1.4"
+	if at := bytes.Index(data, []byte("%PDF-")); at >= 0 && at+8 <= len(data) {
+		version = string(data[at+5 : at+8])
+	}
+	var out bytes.Buffer
+	out.WriteString("%PDF-" + version + "\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make(map[int]int)
+	imageOpts := pdfImageOptions(opts)
+	for _, num := range nums {
+		obj, err := f.object(num)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PDF: %v", err)
+		}
+		dict, _ := obj.value.(pdfDict)
+		if obj.stream != nil && (dict["Type"] == pdfName("XRef") || dict["Type"] == pdfName("ObjStm")) {
+			continue
+		}
+		if dict["Linearized"] != nil {
+			continue // its hints no longer match
+		}
+		offsets[num] = out.Len()
+		fmt.Fprintf(&out, "%d %d obj\n", num, f.xref[num].gen)
+		if obj.stream == nil {
+			out.Write(obj.raw)
+		} else {
+			stream := obj.stream
+			if f.resolve(dict["Subtype"]) == pdfName("Image") {
+				result.PDFImages++
+				if !opts.Lossless {
+					if encoded, ok := f.recompressImage(dict, stream, imageOpts, result); ok {
+						stream = encoded
+						result.PDFReplaced++
+					}
+				}
+			}
+			dict["Length"] = pdfInt(len(stream))
+			writePDFValue(&out, dict)
+			out.WriteString("\nstream\n")
+			out.Write(stream)
+			out.WriteString("\nendstream")
+		}
+		out.WriteString("\nendobj\n")
+		if out.Len() >= len(data) {
+			result.PDFReplaced = 0
+			return data, nil
+		}
+	}
+
+	// One subsection per run of consecutive objects written, so the table
+	// holds only those
+	xref := out.Len()
+	out.WriteString("xref\n0 1\n0000000000 65535 f \n")
+	size := 1
+	for i := 0; i < len(nums); {
+		if _, ok := offsets[nums[i]]; !ok {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(nums) && nums[j] == nums[j-1]+1 {
+			if _, ok := offsets[nums[j]]; !ok {
+				break
+			}
+			j++
+		}
+		fmt.Fprintf(&out, "%d %d\n", nums[i], j-i)
+		for _, num := range nums[i:j] {
+			fmt.Fprintf(&out, "%010d %05d n \n", offsets[num], f.xref[num].gen)
+		}
+		size = nums[j-1] + 1
+		i = j
+	}
+	trailer := pdfDict{"Size": pdfInt(size), "Root": f.trailer["Root"]}
+	for _, key := range []pdfName{"Info", "ID"} {
+		if v := f.trailer[key]; v != nil {
+			trailer[key] = v
+		}
+	}
+	out.WriteString("trailer\n")
+	writePDFValue(&out, trailer)
+	fmt.Fprintf(&out, "\nstartxref\n%d\n%%%%EOF\n", xref)
+
+	if out.Len() >= len(data) {
+		result.PDFReplaced = 0
+		return data, nil
+	}
+	return out.Bytes(), nil
+}
+
+// recompressImage returns the image XObject of dict and stream as a JPEG made
+// by renderOutput, updating dict to match, if it is worth recompressing and
+// comes out smaller.
+func (f *pdfFile) recompressImage(dict pdfDict, stream []byte, opts Options, result *FileResult) ([]byte, bool) {
+	if mask, _ := f.resolve(dict["ImageMask"]).(bool); mask || dict["Decode"] != nil {
+		return nil, false
+	}
+	if _, colorKey := f.resolve(dict["Mask"]).(pdfArray); colorKey {
+		return nil, false
+	}
+	width, _ := intValue(f.resolve(dict["Width"]))
+	height, _ := intValue(f.resolve(dict["Height"]))
+	bits, _ := intValue(f.resolve(dict["BitsPerComponent"]))
+	components, ok := f.components(dict["ColorSpace"])
+	if !ok || bits != 8 || width <= 0 || height <= 0 || width*height < minPDFImagePixels {
+		return nil, false
+	}
+	// Room for the samples and a PNG predictor byte per row
+	limit := int64(width)*int64(height)*int64(components) + int64(height)
+	if limit > maxPDFStreamSize {
+		return nil, false
+	}
+
+	decodeStart := time.Now()
+	var img image.Image
+	names, parms := f.filters(dict)
+	switch {
+	case len(names) == 1 && (names[0] == "DCTDecode" || names[0] == "DCT") && parms[0] == nil:
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(stream))
+		if err != nil || cfg.Width != width || cfg.Height != height {
+			return nil, false
+		}
+		if !(cfg.ColorModel == color.YCbCrModel && components == 3 || cfg.ColorModel == color.GrayModel && components == 1) {
+			return nil, false
+		}
+		if img, err = jpeg.Decode(bytes.NewReader(stream)); err != nil {
+			return nil, false
+		}
+	case len(names) == 0 || len(names) == 1 && (names[0] == "FlateDecode" || names[0] == "Fl"):
+		samples, err := f.decodeStream(dict, stream, int(limit))
+		if err != nil || len(samples) < width*height*components {
+			return nil, false
+		}
+		rect := image.Rect(0, 0, width, height)
+		if components == 1 {
+			img = &image.Gray{Pix: samples, Stride: width, Rect: rect}
+		} else {
+			rgba := newPooledRGBA(rect)
+			defer recycleImage(rgba)
+			for i := 0; i < width*height; i++ {
+				copy(rgba.Pix[4*i:4*i+3], samples[3*i:3*i+3])
+				rgba.Pix[4*i+3] = 0xff
+			}
+			img = rgba
+		}
+	default:
+		return nil, false
+	}
+	result.DecodeTime += time.Since(decodeStart)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var res FileResult
+	encoded, err := renderOutput(sourceImage{img: img, format: "jpeg"}, opts, &res, buf)
+	result.ResizeTime += res.ResizeTime
+	result.EncodeTime += res.EncodeTime
+	if res.Engine == "gpu" {
+		result.Engine = "gpu"
+	}
+	if err != nil || len(encoded) >= len(stream) {
+		return nil, false
+	}
+	// The report shows the worst image of the document
+	if res.SSIM > 0 && (result.SSIM == 0 || res.SSIM < result.SSIM) {
+		result.SSIM = res.SSIM
+	}
+	if res.PSNR > 0 && (result.PSNR == 0 || res.PSNR < result.PSNR) {
+		result.PSNR = res.PSNR
+	}
+
+	dict["Width"], dict["Height"] = pdfInt(res.OutputWidth), pdfInt(res.OutputHeight)
+	dict["BitsPerComponent"] = pdfInt(8)
+	dict["Filter"] = pdfName("DCTDecode")
+	delete(dict, "DecodeParms")
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(encoded)); err == nil && cfg.ColorModel == color.GrayModel && components != 1 {
+		dict["ColorSpace"] = pdfName("DeviceGray")
+	}
+	return append([]byte(nil), encoded...), true
+}
+
+// checkPDF reads every object of the PDF data, as a check it is readable.
+func checkPDF(data []byte) error {
+	f, err := parsePDF(data)
+	if err != nil {
+		return fmt.Errorf("failed to read PDF: %v", err)
+	}
+	for num := range f.xref {
+		if _, err := f.object(num); err != nil {
+			return fmt.Errorf("failed to read PDF: %v", err)
+		}
+	}
+	return nil
+}
+
+// compressPDF writes inputPath, a PDF, to outputPath with its images
+// recompressed by recompressPDF.
+func compressPDF(inputPath, outputPath string, opts Options, result *FileResult) error {
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to open PDF: %w", err)
+	}
+	encoded, err := recompressPDF(data, opts, result)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(outputPath, encoded, inputPath, opts); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	result.Outputs = append(result.Outputs, outputPath)
+	result.OutputSize = int64(len(encoded))
+	return nil
+}
@@ -0,0 +1,353 @@
+package compressor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testObjects are the objects of a one page document every test PDF holds.
+var testObjects = map[int]string{
+	1: "<< /Type /Catalog /Pages 2 0 R >>",
+	2: "<< /Type /Pages /Count 1 /Kids [3 0 R] >>",
+	3: "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R >>",
+}
+
+const testContent = "q 1 0 0 1 0 0 cm Q"
+
+func zlibBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write(data)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// classicPDF writes testObjects and the content stream, object 4, with a
+// cross-reference table.
+func classicPDF() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, 5)
+	for num := 1; num <= 3; num++ {
+		offsets[num] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", num, testObjects[num])
+	}
+	offsets[4] = buf.Len()
+	fmt.Fprintf(&buf, "4 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(testContent), testContent)
+	xref := buf.Len()
+	buf.WriteString("xref\n0 5\n0000000000 65535 f \n")
+	for _, offset := range offsets[1:] {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size 5 /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+// streamPDF writes testObjects into object stream 5 and indexes it, the
+// content stream and itself with cross-reference stream 6, whose rows are
+// encoded with the PNG Up predictor.
+func streamPDF(t testing.TB) []byte {
+	var header, body bytes.Buffer
+	for num := 1; num <= 3; num++ {
+		fmt.Fprintf(&header, "%d %d ", num, body.Len())
+		body.WriteString(testObjects[num] + "\n")
+	}
+	objStm := zlibBytes(t, append(header.Bytes(), body.Bytes()...))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	offsets := make(map[int]int)
+	offsets[4] = buf.Len()
+	fmt.Fprintf(&buf, "4 0 obj\n<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(testContent), testContent)
+	offsets[5] = buf.Len()
+	// /First is padded for tests to change it in place
+	fmt.Fprintf(&buf, "5 0 obj\n<< /Type /ObjStm /N 3 /First %-6d /Filter /FlateDecode /Length %d >>\nstream\n", header.Len(), len(objStm))
+	buf.Write(objStm)
+	buf.WriteString("\nendstream\nendobj\n")
+	offsets[6] = buf.Len()
+
+	var rows []byte
+	prev := make([]byte, 7)
+	for num := 0; num <= 6; num++ {
+		row := make([]byte, 7)
+		switch {
+		case num >= 1 && num <= 3:
+			row[0] = 2
+			binary.BigEndian.PutUint32(row[1:], 5)
+			binary.BigEndian.PutUint16(row[5:], uint16(num-1))
+		case num > 3:
+			row[0] = 1
+			binary.BigEndian.PutUint32(row[1:], uint32(offsets[num]))
+		}
+		rows = append(rows, 2)
+		for i := range row {
+			rows = append(rows, row[i]-prev[i])
+		}
+		prev = row
+	}
+	xref := zlibBytes(t, rows)
+	fmt.Fprintf(&buf, "6 0 obj\n<< /Type /XRef /Size 7 /W [1 4 2] /Root 1 0 R /Filter /FlateDecode /DecodeParms << /Columns 7 /Predictor 12 >> /Length %d >>\nstream\n", len(xref))
+	buf.Write(xref)
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", offsets[6])
+	return buf.Bytes()
+}
+
+func TestParsePDF(t *testing.T) {
+	classic := classicPDF()
+	shifted := append([]byte("%PDF-1.4\n% junk that moves every object\n"), classic[len("%PDF-1.4\n"):]...)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"classic xref", classic},
+		{"xref stream and object stream", streamPDF(t)},
+		{"wrong offsets", shifted},
+		{"no xref", classic[:bytes.Index(classic, []byte("xref"))]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := parsePDF(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root := f.trailer["Root"]; root != (pdfRef{1, 0}) {
+				t.Errorf("Root is %v, want 1 0 R", root)
+			}
+			for num, want := range testObjects {
+				obj, err := f.object(num)
+				if err != nil {
+					t.Fatalf("object %d: %v", num, err)
+				}
+				if string(obj.raw) != want {
+					t.Errorf("object %d is %q, want %q", num, obj.raw, want)
+				}
+			}
+			obj, err := f.object(4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(obj.stream) != testContent {
+				t.Errorf("content stream is %q, want %q", obj.stream, testContent)
+			}
+		})
+	}
+}
+
+func TestObjectStreamLookup(t *testing.T) {
+	f, err := parsePDF(streamPDF(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num := 1; num <= 3; num++ {
+		if entry := f.xref[num]; entry.stream != 5 || entry.index != num-1 {
+			t.Errorf("object %d is at %+v, want index %d of stream 5", num, entry, num-1)
+		}
+	}
+	pages, ok := f.resolve(pdfRef{2, 0}).(pdfDict)
+	if !ok || pages["Count"] != pdfNum("1") {
+		t.Errorf("page tree is %v", pages)
+	}
+	if _, err := f.object(7); err != nil {
+		t.Errorf("missing object: %v", err)
+	}
+
+	for _, first := range []string{"-100", "100000"} {
+		data := streamPDF(t)
+		at := bytes.Index(data, []byte("/First ")) + len("/First ")
+		copy(data[at:at+6], fmt.Sprintf("%-6s", first))
+		f, err := parsePDF(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.object(1); err == nil {
+			t.Errorf("/First %s: object 1 read from a malformed object stream", first)
+		}
+	}
+}
+
+func TestRecompressPDF(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 200, 100))
+	rgb := image.NewRGBA(image.Rect(0, 0, 120, 90))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			gray.SetGray(x, y, color.Gray{uint8(x*7 ^ y*13)})
+			if x < 120 && y < 90 {
+				rgb.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 3), uint8(x ^ y), 255})
+			}
+		}
+	}
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, rgb, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	samples, _, err := flateSamples(gray, color.White)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := func(data []byte, width, height int, gray, flate bool) PDFPage {
+		return PDFPage{Image: data, Width: width, Height: height, Gray: gray, Flate: flate, PageWidth: 100, PageHeight: 100, ImageRect: [4]float64{0, 0, 100, 100}}
+	}
+	var in bytes.Buffer
+	if err := WritePDF(&in, []PDFPage{page(photo.Bytes(), 120, 90, false, false), page(samples, 200, 100, true, true)}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.JPEGQuality = 50
+	var result FileResult
+	out, err := recompressPDF(in.Bytes(), opts, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.PDFImages != 2 || result.PDFReplaced != 2 {
+		t.Errorf("%d of %d images replaced, want 2 of 2", result.PDFReplaced, result.PDFImages)
+	}
+	if len(out) >= in.Len() {
+		t.Errorf("rebuilt PDF is %d bytes, from %d", len(out), in.Len())
+	}
+	if err := checkPDF(out); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parsePDF(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, num := range []int{4, 7} {
+		obj, err := f.object(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dict := obj.value.(pdfDict)
+		if dict["Filter"] != pdfName("DCTDecode") {
+			t.Errorf("image %d has filter %v, want DCTDecode", num, dict["Filter"])
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(obj.stream)); err != nil {
+			t.Errorf("image %d: %v", num, err)
+		}
+	}
+
+	opts.Lossless = true
+	result = FileResult{}
+	if _, err := recompressPDF(in.Bytes(), opts, &result); err != nil || result.PDFReplaced != 0 {
+		t.Errorf("lossless replaced %d images: %v", result.PDFReplaced, err)
+	}
+}
+
+func TestUnpredict(t *testing.T) {
+	parms := pdfDict{"Predictor": pdfNum("12"), "Columns": pdfNum("3")}
+	tests := []struct {
+		name  string
+		parms pdfDict
+		data  []byte
+		want  []byte
+		err   bool
+	}{
+		{"no predictor", nil, []byte{1, 2, 3}, []byte{1, 2, 3}, false},
+		{"none", parms, []byte{0, 10, 20, 30}, []byte{10, 20, 30}, false},
+		{"sub", parms, []byte{1, 10, 10, 10}, []byte{10, 20, 30}, false},
+		{"up", parms, []byte{0, 10, 20, 30, 2, 5, 5, 5}, []byte{10, 20, 30, 15, 25, 35}, false},
+		{"average", parms, []byte{0, 15, 25, 35, 3, 13, 8, 8}, []byte{15, 25, 35, 20, 30, 40}, false},
+		{"paeth", parms, []byte{0, 20, 30, 40, 4, 5, 5, 5}, []byte{20, 30, 40, 25, 35, 45}, false},
+		{"rgb sub", pdfDict{"Predictor": pdfNum("15"), "Columns": pdfNum("2"), "Colors": pdfNum("3")}, []byte{1, 1, 2, 3, 1, 1, 1}, []byte{1, 2, 3, 2, 3, 4}, false},
+		{"partial row dropped", parms, []byte{0, 1, 2, 3, 0, 4}, []byte{1, 2, 3}, false},
+		{"unknown row filter", parms, []byte{7, 1, 2, 3}, nil, true},
+		{"tiff predictor", pdfDict{"Predictor": pdfNum("2")}, []byte{1, 2, 3}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := unpredict(test.data, test.parms)
+			if test.err {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeStreamLimit(t *testing.T) {
+	f := &pdfFile{loading: make(map[int]bool)}
+	dict := pdfDict{"Filter": pdfName("FlateDecode")}
+	data := zlibBytes(t, make([]byte, 10000))
+	if _, err := f.decodeStream(dict, data, 1000); err == nil || !strings.Contains(err.Error(), "inflates past") {
+		t.Errorf("got %v, want an error for inflating past the limit", err)
+	}
+	if out, err := f.decodeStream(dict, data, 10000); err != nil || len(out) != 10000 {
+		t.Errorf("got %d bytes and %v, want 10000 bytes", len(out), err)
+	}
+}
+
+func TestXrefStreamWidths(t *testing.T) {
+	for _, widths := range []string{"[-1 4 2]", "[1 9 2]"} {
+		data := bytes.Replace(streamPDF(t), []byte("/W [1 4 2]"), []byte("/W "+widths), 1)
+		f := &pdfFile{data: data, objStreams: make(map[int]*pdfObjectStream), loading: make(map[int]bool)}
+		if err := f.readXref(); err == nil {
+			t.Errorf("/W %s: xref stream accepted", widths)
+		}
+	}
+}
+
+// hugeObjectPDF numbers its only object 100000004, which once had the
+// rebuilt cross-reference table list every number below it.
+const hugeObjectPDF = "000000000100000004 0 obj trailer<</0000 0 /Root 0 0 R >>startxref270"
+
+func TestObjectNumberLimits(t *testing.T) {
+	f, err := parsePDF([]byte(hugeObjectPDF))
+	if err == nil && len(f.xref) > 0 {
+		t.Fatalf("kept object numbers %v past the file's length", f.xref)
+	}
+	var result FileResult
+	if out, err := recompressPDF([]byte(hugeObjectPDF), DefaultOptions(), &result); err == nil && len(out) > len(hugeObjectPDF) {
+		t.Fatalf("rebuilt a %d byte file into %d bytes", len(hugeObjectPDF), len(out))
+	}
+
+	// Objects past the trailer's /Size are dropped
+	data := strings.Replace(string(classicPDF()), "/Size 5", "/Size 4", 1)
+	if f, err = parsePDF([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.xref[4]; ok {
+		t.Fatalf("object 4 kept past /Size 4")
+	}
+}
+
+func FuzzPDF(f *testing.F) {
+	f.Add(classicPDF())
+	f.Add(streamPDF(f))
+	var buf bytes.Buffer
+	WritePDF(&buf, []PDFPage{{Image: zlibBytes(f, make([]byte, 64*64)), Width: 64, Height: 64, Gray: true, Flate: true, PageWidth: 10, PageHeight: 10}})
+	f.Add(buf.Bytes())
+	f.Add([]byte(hugeObjectPDF))
+	opts := DefaultOptions()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var result FileResult
+		recompressPDF(data, opts, &result)
+		if pdf, err := parsePDF(data); err == nil {
+			nums := make([]int, 0, len(pdf.xref))
+			for num := range pdf.xref {
+				nums = append(nums, num)
+			}
+			sort.Ints(nums)
+			for _, num := range nums {
+				pdf.object(num)
+			}
+		}
+	})
+}
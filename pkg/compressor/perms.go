@@ -0,0 +1,46 @@
+package compressor
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// copyPermissions gives path the permission bits of src and, with owner, its
+// uid and gid as well (which needs root).
+func copyPermissions(path string, src os.FileInfo, owner bool) error {
+	if err := os.Chmod(path, src.Mode().Perm()); err != nil {
+		return err
+	}
+	if owner {
+		if uid, gid, ok := fileOwner(src); ok {
+			return os.Chown(path, uid, gid)
+		}
+	}
+	return nil
+}
+
+// mkdirLike creates dir and any missing parents, giving each one the
+// permissions of the matching directory of srcDir's tree: dir's parent
+// mirrors srcDir's parent, and so on up.
+func mkdirLike(dir, srcDir string, owner bool) error {
+	var missing, sources []string
+	for d, s := dir, srcDir; ; d, s = filepath.Dir(d), filepath.Dir(s) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+		sources = append(sources, s)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	for i, d := range missing {
+		if info, err := os.Stat(sources[i]); err == nil && info.IsDir() {
+			copyPermissions(d, info, owner)
+		}
+	}
+	return nil
+}
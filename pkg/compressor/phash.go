@@ -0,0 +1,202 @@
+package compressor
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+)
+
+// PerceptualHashes lists the -hash algorithms: dhash compares the brightness
+// of neighbouring cells of a 9x8 grid, phash the low frequencies of a 32x32
+// grid's DCT, which survives small crops and exposure changes better.
+var PerceptualHashes = map[string]func(image.Image) uint64{
+	"dhash": DHash,
+	"phash": PHash,
+}
+
+// DHash returns the difference hash of img: bit y*8+x is set when cell x of
+// row y of a 9x8 grayscale grid is brighter than cell x+1.
+func DHash(img image.Image) uint64 {
+	grid := grayGrid(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if grid[y*9+x] > grid[y*9+x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return hash
+}
+
+// PHash returns the perceptual hash of img: bit v*8+u is set when DCT
+// coefficient (u, v) of a 32x32 grayscale grid is above the median of the
+// 8x8 lowest frequencies, leaving out the average brightness.
+func PHash(img image.Image) uint64 {
+	const n = 32
+	grid := grayGrid(img, n, n)
+	var cosines [8][n]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < n; x++ {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+	var coefficients [64]float64
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					sum += grid[y*n+x] * cosines[u][x] * cosines[v][y]
+				}
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// grayGrid averages the luminance of img over a width x height grid of
+// cells, sampling at most 16x16 pixels of each so large images stay cheap.
+func grayGrid(img image.Image, width, height int) []float64 {
+	b := img.Bounds()
+	grid := make([]float64, width*height)
+	for cy := 0; cy < height; cy++ {
+		y0, y1 := b.Min.Y+cy*b.Dy()/height, b.Min.Y+(cy+1)*b.Dy()/height
+		for cx := 0; cx < width; cx++ {
+			x0, x1 := b.Min.X+cx*b.Dx()/width, b.Min.X+(cx+1)*b.Dx()/width
+			stepX, stepY := (x1-x0)/16+1, (y1-y0)/16+1
+			var sum float64
+			var count int
+			for y := y0; y < y1 || y == y0; y += stepY {
+				for x := x0; x < x1 || x == x0; x += stepX {
+					r, g, b, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					count++
+				}
+			}
+			grid[cy*width+cx] = sum / float64(count)
+		}
+	}
+	return grid
+}
+
+// HashImage decodes the image at path, oriented as compress would, and
+// returns its perceptual hash by algorithm, one of PerceptualHashes.
+func HashImage(path, algorithm, rawMode string) (uint64, error) {
+	img, _, data, err := decodeImage(path, rawMode, true)
+	if err != nil {
+		return 0, err
+	}
+	if !IsRawFile(path) {
+		img = applyOrientation(img, exifOrientation(readExif(data)))
+	}
+	return PerceptualHashes[algorithm](img), nil
+}
+
+// NearDuplicateSet is a set of images whose hashes are within the distance
+// given to FindNearDuplicates of one another, through a chain of them if not
+// directly. Keep is the largest file; the others are redundant.
+type NearDuplicateSet struct {
+	Keep      string
+	Others    []string
+	Distances []int // of each of Others from Keep, in differing bits of 64
+}
+
+// FindNearDuplicates hashes paths with threads workers and groups the
+// images whose hashes differ in at most maxDistance bits. Images that cannot
+// be decoded are returned in failed and left out. Every pair of hashes is
+// compared, which takes seconds for a hundred thousand images.
+func FindNearDuplicates(paths []string, algorithm string, maxDistance, threads int, rawMode string) (sets []NearDuplicateSet, failed map[string]error) {
+	hashes := make([]uint64, len(paths))
+	errs := make([]error, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				hashes[i], errs[i] = HashImage(paths[i], algorithm, rawMode)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	failed = make(map[string]error)
+	var hashed []int
+	for i, err := range errs {
+		if err != nil {
+			failed[paths[i]] = err
+		} else {
+			hashed = append(hashed, i)
+		}
+	}
+
+	// Union-find over every pair within the distance, on positions in hashed
+	parent := make([]int, len(hashed))
+	for k := range parent {
+		parent[k] = k
+	}
+	var find func(int) int
+	find = func(k int) int {
+		if parent[k] != k {
+			parent[k] = find(parent[k])
+		}
+		return parent[k]
+	}
+	for a := range hashed {
+		for b := a + 1; b < len(hashed); b++ {
+			if bits.OnesCount64(hashes[hashed[a]]^hashes[hashed[b]]) <= maxDistance {
+				parent[find(b)] = find(a)
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	var roots []int
+	for k, i := range hashed {
+		root := find(k)
+		if len(groups[root]) == 0 {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], i)
+	}
+	for _, root := range roots {
+		members := groups[root]
+		if len(members) < 2 {
+			continue
+		}
+		keep, keepSize := members[0], int64(-1)
+		for _, i := range members {
+			if info, err := os.Stat(paths[i]); err == nil && info.Size() > keepSize {
+				keep, keepSize = i, info.Size()
+			}
+		}
+		set := NearDuplicateSet{Keep: paths[keep]}
+		for _, i := range members {
+			if i != keep {
+				set.Others = append(set.Others, paths[i])
+				set.Distances = append(set.Distances, bits.OnesCount64(hashes[i]^hashes[keep]))
+			}
+		}
+		sets = append(sets, set)
+	}
+	return sets, failed
+}
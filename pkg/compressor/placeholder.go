@@ -0,0 +1,175 @@
+package compressor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+// PlaceholderKinds lists the -placeholders kinds: a BlurHash string, and a
+// tiny JPEG as a data URI (LQIP, low quality image placeholder).
+var PlaceholderKinds = map[string]bool{
+	"blurhash": true,
+	"lqip":     true,
+}
+
+const (
+	blurHashSize = 32 // longest side the image is reduced to before hashing
+	lqipSize     = 16 // longest side of the LQIP
+	lqipQuality  = 50
+)
+
+// addPlaceholders stores the placeholders of opts.Placeholders for the first
+// output of a finished file in result, decoded from the output so they match
+// what is served. Failures only leave them out.
+func addPlaceholders(result *FileResult, opts Options) {
+	if len(opts.Placeholders) == 0 || len(result.Outputs) == 0 {
+		return
+	}
+	f, err := os.Open(result.Outputs[0])
+	if err != nil {
+		return
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+	if flat := flattenImage(img, opts.Background); flat != img {
+		defer recycleImage(flat)
+		img = flat
+	}
+	if opts.Placeholders["blurhash"] {
+		components := [2]int{4, 3}
+		if img.Bounds().Dy() > img.Bounds().Dx() {
+			components = [2]int{3, 4}
+		}
+		result.BlurHash = BlurHash(shrinkTo(img, blurHashSize), components[0], components[1])
+	}
+	if opts.Placeholders["lqip"] {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, shrinkTo(img, lqipSize), &jpeg.Options{Quality: lqipQuality}); err == nil {
+			result.LQIP = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+}
+
+// shrinkTo scales img down so its longest side is at most size pixels.
+func shrinkTo(img image.Image, size int) image.Image {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	if width >= height {
+		width, height = size, height*size/width
+	} else {
+		width, height = width*size/height, size
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return Resample(img, width, height, resize.Lanczos3)
+}
+
+const base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash encodes img as a BlurHash (blurha.sh) of x by y cosine components,
+// each between 1 and 9. Alpha is ignored, so img should be flattened first.
+func BlurHash(img image.Image, x, y int) string {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var linear [256]float64
+	for i := range linear {
+		linear[i] = sRGBToLinear(i)
+	}
+	factors := make([][3]float64, 0, x*y)
+	for j := 0; j < y; j++ {
+		for i := 0; i < x; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for py := 0; py < height; py++ {
+				row := nrgba.Pix[py*nrgba.Stride:]
+				cy := math.Cos(math.Pi * float64(j) * float64(py) / float64(height))
+				for px := 0; px < width; px++ {
+					basis := normalisation * cy * math.Cos(math.Pi*float64(i)*float64(px)/float64(width))
+					for c := range f {
+						f[c] += basis * linear[row[px*4+c]]
+					}
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	hash := encodeBase83((x-1)+(y-1)*9, 1)
+	maximum := 1.0
+	if len(factors) > 1 {
+		var largest float64
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				largest = math.Max(largest, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(largest*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash += encodeBase83(quantised, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+	dc := factors[0]
+	hash += encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		var value int
+		for _, v := range f {
+			q := int(math.Max(0, math.Min(18, math.Floor(signedPow(v/maximum, 0.5)*9+9.5))))
+			value = value*19 + q
+		}
+		hash += encodeBase83(value, 2)
+	}
+	return hash
+}
+
+func encodeBase83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Digits[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+func sRGBToLinear(value int) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signedPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
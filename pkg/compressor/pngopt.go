@@ -0,0 +1,218 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"sort"
+)
+
+// PNGOptimizeModes lists the -png-optimize modes. "lossless" stores images in
+// the smallest exact representation (palette or grayscale) at maximum deflate;
+// "lossy" additionally tries quantizing images with more than 256 colors.
+var PNGOptimizeModes = map[string]bool{
+	"off":      true,
+	"lossless": true,
+	"lossy":    true,
+}
+
+const maxPaletteColors = 256
+
+// encodeOptimizedPNG encodes img at maximum compression in the most compact
+// form mode allows. Pixels only change in "lossy" mode, and only when that
+// actually produces a smaller file.
+func encodeOptimizedPNG(w io.Writer, img image.Image, mode string) error {
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	var best []byte
+	for _, candidate := range pngCandidates(img, mode) {
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, candidate); err != nil {
+			return err
+		}
+		if best == nil || buf.Len() < len(best) {
+			best = buf.Bytes()
+		}
+	}
+	_, err := w.Write(best)
+	return err
+}
+
+// pngCandidates returns the representations of img worth encoding for mode.
+// Dithered quantization bloats flat graphics such as screenshots, so lossy mode
+// keeps the truecolor image as a candidate too.
+func pngCandidates(img image.Image, mode string) []image.Image {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	if palette, ok := exactPalette(nrgba); ok {
+		paletted := image.NewPaletted(bounds, palette)
+		draw.Draw(paletted, bounds, nrgba, bounds.Min, draw.Src)
+		return []image.Image{paletted}
+	}
+	if gray, ok := grayImage(nrgba); ok {
+		return []image.Image{gray}
+	}
+	if mode != "lossy" {
+		return []image.Image{nrgba}
+	}
+
+	dithered := image.NewPaletted(bounds, medianCut(nrgba, maxPaletteColors))
+	draw.FloydSteinberg.Draw(dithered, bounds, nrgba, bounds.Min)
+	return []image.Image{nrgba, dithered}
+}
+
+// exactPalette returns every color of img when there are few enough to fit a
+// palette, so it can be stored paletted without loss.
+func exactPalette(img *image.NRGBA) (color.Palette, bool) {
+	seen := make(map[color.NRGBA]bool)
+	var palette color.Palette
+	for i := 0; i+4 <= len(img.Pix); i += 4 {
+		c := color.NRGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+		if c.A == 0 {
+			c = color.NRGBA{}
+		}
+		if !seen[c] {
+			if len(palette) == maxPaletteColors {
+				return nil, false
+			}
+			seen[c] = true
+			palette = append(palette, c)
+		}
+	}
+	return palette, true
+}
+
+// grayImage returns img as 8-bit grayscale when it is opaque and every pixel
+// is already gray.
+func grayImage(img *image.NRGBA) (*image.Gray, bool) {
+	gray := image.NewGray(img.Bounds())
+	for i, j := 0, 0; i+4 <= len(img.Pix); i, j = i+4, j+1 {
+		r, g, b, a := img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]
+		if a != 255 || r != g || g != b {
+			return nil, false
+		}
+		gray.Pix[j] = r
+	}
+	return gray, true
+}
+
+// colorCount is a histogram bucket: the summed channels of every pixel that
+// fell into it, and how many there were.
+type colorCount struct {
+	sum [4]uint64
+	n   uint64
+}
+
+func (c colorCount) mean(channel int) uint8 {
+	return uint8(c.sum[channel] / c.n)
+}
+
+// medianCut picks a palette of up to size colors for img by repeatedly
+// splitting the bucket box with the most pixels spread along its widest
+// channel, at the pixel-weighted median.
+func medianCut(img *image.NRGBA, size int) color.Palette {
+	// A 5-bit-per-channel histogram keeps the box count manageable
+	buckets := make(map[uint32]*colorCount)
+	for i := 0; i+4 <= len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4]
+		key := uint32(p[0]>>3)<<15 | uint32(p[1]>>3)<<10 | uint32(p[2]>>3)<<5 | uint32(p[3]>>3)
+		c := buckets[key]
+		if c == nil {
+			c = &colorCount{}
+			buckets[key] = c
+		}
+		for ch := 0; ch < 4; ch++ {
+			c.sum[ch] += uint64(p[ch])
+		}
+		c.n++
+	}
+
+	keys := make([]uint32, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	all := make([]colorCount, 0, len(keys))
+	for _, key := range keys {
+		all = append(all, *buckets[key])
+	}
+	boxes := [][]colorCount{all}
+
+	for len(boxes) < size {
+		best, bestChannel := -1, 0
+		var bestScore uint64
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			channel, spread := widestChannel(box)
+			var pixels uint64
+			for _, c := range box {
+				pixels += c.n
+			}
+			if score := pixels * uint64(spread); score > bestScore {
+				best, bestChannel, bestScore = i, channel, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].mean(bestChannel) < box[j].mean(bestChannel) })
+		var total, running uint64
+		for _, c := range box {
+			total += c.n
+		}
+		cut := 1
+		for i, c := range box[:len(box)-1] {
+			running += c.n
+			cut = i + 1
+			if running*2 >= total {
+				break
+			}
+		}
+		boxes[best] = box[:cut]
+		boxes = append(boxes, box[cut:])
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var total colorCount
+		for _, c := range box {
+			for ch := 0; ch < 4; ch++ {
+				total.sum[ch] += c.sum[ch]
+			}
+			total.n += c.n
+		}
+		palette = append(palette, color.NRGBA{total.mean(0), total.mean(1), total.mean(2), total.mean(3)})
+	}
+	return palette
+}
+
+// widestChannel returns the channel whose bucket means vary most across box,
+// and by how much.
+func widestChannel(box []colorCount) (int, uint8) {
+	var channel int
+	var widest uint8
+	for ch := 0; ch < 4; ch++ {
+		lo, hi := uint8(255), uint8(0)
+		for _, c := range box {
+			v := c.mean(ch)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > widest {
+			channel, widest = ch, hi-lo
+		}
+	}
+	return channel, widest
+}
@@ -0,0 +1,104 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"math/bits"
+	"sync"
+)
+
+// Pixel and encode buffers are pooled, so a worker reuses the memory of its
+// previous file instead of allocating tens of megabytes per image for the
+// garbage collector to clear. sync.Pool keeps one set per CPU and drops what
+// sits unused through two collections, so idle runs give the memory back.
+
+// minPooledPixels is the smallest buffer worth pooling; thumbnails and
+// previews are cheaper to allocate.
+const minPooledPixels = 64 << 10
+
+// pixelPools[i] holds pixel buffers with a capacity of at least 1<<i bytes.
+var pixelPools [40]sync.Pool
+
+// getPixels returns a buffer of n bytes, which may hold an earlier image's
+// pixels: callers overwrite all of it.
+func getPixels(n int) []byte {
+	i := bits.Len(uint(n - 1))
+	if n < minPooledPixels || i >= len(pixelPools) {
+		return make([]byte, n)
+	}
+	if p, ok := pixelPools[i].Get().(*[]byte); ok {
+		return (*p)[:n]
+	}
+	return make([]byte, n, 1<<i)
+}
+
+// putPixels gives buf back for a later getPixels. Nothing may use it after.
+func putPixels(buf []byte) {
+	i := bits.Len(uint(cap(buf))) - 1
+	if cap(buf) < minPooledPixels || i >= len(pixelPools) {
+		return
+	}
+	buf = buf[:0]
+	pixelPools[i].Put(&buf)
+}
+
+func newPooledRGBA(r image.Rectangle) *image.RGBA {
+	return &image.RGBA{Pix: getPixels(4 * r.Dx() * r.Dy()), Stride: 4 * r.Dx(), Rect: r}
+}
+
+func newPooledGray(r image.Rectangle) *image.Gray {
+	return &image.Gray{Pix: getPixels(r.Dx() * r.Dy()), Stride: r.Dx(), Rect: r}
+}
+
+// newPooledYCbCr lays out a YCbCr image at the origin with one of the
+// chromaShift ratios like image.NewYCbCr, with a buffer for each plane.
+func newPooledYCbCr(width, height int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	shift := chromaShift[ratio]
+	cw, ch := (width+shift.X)>>shift.X, (height+shift.Y)>>shift.Y
+	return &image.YCbCr{
+		Y:              getPixels(width * height),
+		Cb:             getPixels(cw * ch),
+		Cr:             getPixels(cw * ch),
+		YStride:        width,
+		CStride:        cw,
+		SubsampleRatio: ratio,
+		Rect:           image.Rect(0, 0, width, height),
+	}
+}
+
+// recycleImage gives the pixels of img back to the pool. Nothing may use
+// img after, so only images made for one output, never a decoded source, are
+// recycled.
+func recycleImage(img image.Image) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		putPixels(img.Pix)
+	case *image.NRGBA:
+		putPixels(img.Pix)
+	case *image.Gray:
+		putPixels(img.Pix)
+	case *image.YCbCr:
+		putPixels(img.Y)
+		putPixels(img.Cb)
+		putPixels(img.Cr)
+	}
+}
+
+// maxPooledBuffer is the largest encode buffer kept for reuse.
+const maxPooledBuffer = 64 << 20
+
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer resets buf and gives it back for a later getBuffer. Nothing may
+// use its bytes after.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,64 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+
+	"github.com/nfnt/resize"
+)
+
+// addPreviews stores small before and after JPEGs of a finished file in
+// result for the HTML report. before is the decoded, oriented source, or nil
+// to decode it again. The after preview is decoded from the first output, so
+// it shows the actual compression artifacts. Failures only leave the previews
+// out.
+func addPreviews(result *FileResult, before image.Image, opts Options) {
+	if opts.PreviewWidth <= 0 || len(result.Outputs) == 0 {
+		return
+	}
+	if before == nil {
+		img, _, data, err := decodeImage(result.InputPath, opts.RawMode, opts.AutoOrient)
+		if err != nil {
+			return
+		}
+		if opts.AutoOrient && !IsRawFile(result.InputPath) {
+			img = applyOrientation(img, exifOrientation(readExif(data)))
+		}
+		before = img
+	}
+
+	f, err := os.Open(result.Outputs[0])
+	if err != nil {
+		return
+	}
+	after, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	// Both previews share the source's aspect ratio, so they line up under
+	// the slider even when the output was cropped or padded
+	width := opts.PreviewWidth
+	if before.Bounds().Dx() < width {
+		width = before.Bounds().Dx()
+	}
+	height := before.Bounds().Dy() * width / before.Bounds().Dx()
+	if height < 1 {
+		height = 1
+	}
+	result.Before = previewJPEG(before, width, height)
+	result.After = previewJPEG(after, width, height)
+}
+
+func previewJPEG(img image.Image, width, height int) []byte {
+	small := Resample(img, width, height, resize.Lanczos3)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flattenImage(small, color.White), &jpeg.Options{Quality: 90}); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,28 @@
+package compressor
+
+import (
+	"image"
+	"image/draw"
+)
+
+// DitherModes lists the -dither modes of color quantization.
+var DitherModes = map[string]bool{
+	"floyd-steinberg": true,
+	"none":            true,
+}
+
+// quantizeImage reduces img to a median cut palette of up to colors colors,
+// spreading the rounding error over neighboring pixels unless dither is
+// "none". Screenshots and diagrams keep their look with far fewer bytes.
+func quantizeImage(img image.Image, colors int, dither string) *image.Paletted {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	paletted := image.NewPaletted(bounds, medianCut(nrgba, colors))
+	var drawer draw.Drawer = draw.FloydSteinberg
+	if dither == "none" {
+		drawer = draw.Src
+	}
+	drawer.Draw(paletted, bounds, nrgba, bounds.Min)
+	return paletted
+}
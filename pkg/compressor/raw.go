@@ -0,0 +1,168 @@
+package compressor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var rawExtensions = map[string]bool{
+	".cr2": true,
+	".nef": true,
+	".arw": true,
+	".dng": true,
+}
+
+// IsRawFile reports whether path has a camera RAW extension.
+func IsRawFile(path string) bool {
+	return rawExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// decodeRaw decodes a camera RAW file. In "preview" mode the largest embedded
+// JPEG is used, rotated by the RAW's orientation tag when autoOrient is set,
+// and returned alongside the image; in "full" mode the sensor data is
+// demosaiced by dcraw, which always applies the orientation.
+func decodeRaw(path, mode string, autoOrient bool) (image.Image, []byte, error) {
+	switch mode {
+	case "preview":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		preview, err := extractRawPreview(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(preview))
+		if err != nil {
+			return nil, nil, err
+		}
+		if autoOrient {
+			img = applyOrientation(img, exifOrientation(data))
+		}
+		return img, preview, nil
+	case "full":
+		img, err := decodeRawWithDcraw(path)
+		return img, nil, err
+	default:
+		return nil, nil, fmt.Errorf("unknown raw mode: %s", mode)
+	}
+}
+
+// extractRawPreview returns the largest decodable JPEG embedded in a
+// TIFF-based RAW container (CR2, NEF, ARW and DNG all share this layout).
+func extractRawPreview(data []byte) ([]byte, error) {
+	t, err := newTIFFReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var best []byte
+	bestPixels := 0
+	consider := func(offset, length uint32) {
+		start, end := int(offset), int(offset)+int(length)
+		if length < 2 || start < 0 || end > len(data) || data[start] != 0xFF || data[start+1] != 0xD8 {
+			return
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data[start:end]))
+		if err != nil {
+			return
+		}
+		if pixels := cfg.Width * cfg.Height; pixels > bestPixels {
+			best, bestPixels = data[start:end], pixels
+		}
+	}
+
+	t.walk(func(ifd *tiffIFD) {
+		if offset, ok := t.uint(ifd, tagJPEGInterchangeFormat); ok {
+			if length, ok := t.uint(ifd, tagJPEGInterchangeLength); ok {
+				consider(offset, length)
+			}
+		}
+		if compression, ok := t.uint(ifd, tagCompression); ok && (compression == 6 || compression == 7) {
+			offsets, _ := ifd.find(tagStripOffsets)
+			counts, _ := ifd.find(tagStripByteCounts)
+			o, c := t.uints(offsets), t.uints(counts)
+			if len(o) == 1 && len(c) == 1 {
+				consider(o[0], c[0])
+			}
+		}
+	})
+
+	if best == nil {
+		return nil, fmt.Errorf("no embedded jpeg preview found")
+	}
+	return best, nil
+}
+
+func decodeRawWithDcraw(path string) (image.Image, error) {
+	cmd := exec.Command("dcraw", "-c", "-w", path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run dcraw: %v", err)
+	}
+
+	img, decodeErr := decodePPM(bufio.NewReader(out))
+	io.Copy(ioutil.Discard, out)
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("dcraw failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("failed to read dcraw output: %v", decodeErr)
+	}
+	return img, nil
+}
+
+// decodePPM reads a binary (P6) portable pixmap as written by dcraw.
+func decodePPM(r *bufio.Reader) (image.Image, error) {
+	var magic string
+	var width, height, maxVal int
+	if _, err := fmt.Fscan(r, &magic, &width, &height, &maxVal); err != nil {
+		return nil, err
+	}
+	if magic != "P6" || width <= 0 || height <= 0 || maxVal <= 0 || maxVal > 65535 {
+		return nil, fmt.Errorf("unsupported pnm header")
+	}
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	bytesPerSample := 1
+	if maxVal > 255 {
+		bytesPerSample = 2
+	}
+	row := make([]byte, width*3*bytesPerSample)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			p := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				var v int
+				if bytesPerSample == 1 {
+					v = int(row[x*3+c])
+				} else {
+					i := (x*3 + c) * 2
+					v = int(row[i])<<8 | int(row[i+1])
+				}
+				img.Pix[p+c] = uint8(v * 255 / maxVal)
+			}
+			img.Pix[p+3] = 0xFF
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,715 @@
+package compressor
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileResult describes the outcome of compressing one file.
+type FileResult struct {
+	Index        int // 1-based position of the file in the run
+	InputPath    string
+	OutputPath   string
+	Outputs      []string // every file written, more than one with -sizes
+	InputSize    int64
+	OutputSize   int64 // total size of outputs
+	Width        int   // source dimensions, after auto-orientation
+	Height       int
+	OutputWidth  int // dimensions of the first output
+	OutputHeight int
+	Thumbnail    string // thumbnail written alongside the outputs, if any
+	Duration     time.Duration
+	DecodeTime   time.Duration // time spent reading and decoding the source
+	ResizeTime   time.Duration // time spent resampling, 0 when the image was not resized
+	EncodeTime   time.Duration // time spent encoding outputs, including size searches
+	Retries      int           // attempts after the first, failed with transient errors
+	Verified     bool          // the outputs were read back and decoded, with Options.Verify
+	InputSHA256  string        // checksum of the source, and of each of Outputs, once compressed
+	OutputSHA256 []string
+	SSIM         float64 // 0 when not measured
+	PSNR         float64 // in dB, with Options.QualityMetrics; 0 when not measured
+	Engine       string  // "go" or "vips", whichever compressed the file, or "gpu" when go resized it on the GPU
+	Before       []byte  // jpeg previews of the source and first output, with Options.PreviewWidth
+	After        []byte
+	BlurHash     string // placeholders of the first output, with Options.Placeholders
+	LQIP         string // data URI
+	PDFImages    int    // raster images of a PDF input, and how many of them were replaced by smaller JPEGs
+	PDFReplaced  int
+	Deleted      bool // the source was removed by DeleteOriginal
+	Replaced     bool // the source was overwritten by its output by ReplaceInPlace
+	Err          error
+}
+
+// Report collects per-file results from all workers and is written to
+// report.txt once the run finishes.
+type Report struct {
+	Duration    time.Duration // wall time of the run, set before Write
+	Interrupted bool          // the run was stopped by a signal before every file was started
+	NotStarted  int           // files left in the queue when it was interrupted
+	TooSmall    int           // files skipped by Options.MinSize or MinPixels
+
+	mu        sync.Mutex
+	startTime time.Time
+	inputPath string
+	outputDir string
+	settings  [][2]string
+	renames   [][3]string
+	results   []FileResult
+	dedupe    string
+	dupes     []Duplicate
+	nearDupes []NearDuplicateSet
+}
+
+// NewReport starts a report for a run over inputPath.
+func NewReport(inputPath, outputDir string) *Report {
+	return &Report{startTime: time.Now(), inputPath: inputPath, outputDir: outputDir}
+}
+
+// AddSetting records a setting listed at the top of the report.
+func (r *Report) AddSetting(name, value string) {
+	r.settings = append(r.settings, [2]string{name, value})
+}
+
+// AddRename records that input is written to output, a numbered name,
+// because its usual output name was taken by conflict.
+func (r *Report) AddRename(input, output, conflict string) {
+	r.renames = append(r.renames, [3]string{input, output, conflict})
+}
+
+// AddDuplicate records a file given the outputs of an identical one by
+// -dedupe mode.
+func (r *Report) AddDuplicate(dup Duplicate, mode string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dedupe = mode
+	r.dupes = append(r.dupes, dup)
+}
+
+// AddNearDuplicates records sets of near-duplicates of which only the kept
+// image was compressed.
+func (r *Report) AddNearDuplicates(sets []NearDuplicateSet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nearDupes = append(r.nearDupes, sets...)
+}
+
+// ResultsByInput returns the results recorded so far by input path.
+func (r *Report) ResultsByInput() map[string]FileResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make(map[string]FileResult, len(r.results))
+	for _, res := range r.results {
+		results[res.InputPath] = res
+	}
+	return results
+}
+
+// AddResult records a file result; it is safe for concurrent use.
+func (r *Report) AddResult(res FileResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, res)
+}
+
+// Counts returns how many files were compressed and failed, and the total
+// input and output size of the compressed ones.
+func (r *Report) Counts() (compressed, failed int, inputSize, outputSize int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, res := range r.results {
+		if res.Err != nil {
+			failed++
+			continue
+		}
+		compressed++
+		inputSize += res.InputSize
+		outputSize += res.OutputSize
+	}
+	return compressed, failed, inputSize, outputSize
+}
+
+// RunSummary is the totals of a run, for notifications sent when it ends.
+type RunSummary struct {
+	Input           string       `json:"input"`
+	Output          string       `json:"output"`
+	Started         time.Time    `json:"started"`
+	DurationMS      int64        `json:"duration_ms"`
+	Interrupted     bool         `json:"interrupted"`
+	FilesCompressed int          `json:"files_compressed"`
+	FilesFailed     int          `json:"files_failed"`
+	NotStarted      int          `json:"not_started,omitempty"`
+	SkippedTooSmall int          `json:"skipped_too_small,omitempty"`
+	InputSize       int64        `json:"input_size"`
+	OutputSize      int64        `json:"output_size"`
+	SavedBytes      int64        `json:"saved_bytes"`
+	SavedPercent    float64      `json:"saved_percent"`
+	Failures        []RunFailure `json:"failures,omitempty"`
+}
+
+// RunFailure is a file that failed to compress.
+type RunFailure struct {
+	Input string `json:"input"`
+	Error string `json:"error"`
+}
+
+// Summary returns the run's totals and failed files, in queue order.
+func (r *Report) Summary() RunSummary {
+	r.mu.Lock()
+	summary := RunSummary{
+		Input:           r.inputPath,
+		Output:          r.outputDir,
+		Started:         r.startTime,
+		DurationMS:      r.Duration.Milliseconds(),
+		Interrupted:     r.Interrupted,
+		NotStarted:      r.NotStarted,
+		SkippedTooSmall: r.TooSmall,
+	}
+	results := append([]FileResult{}, r.results...)
+	r.mu.Unlock()
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	for _, res := range results {
+		if res.Err != nil {
+			summary.FilesFailed++
+			summary.Failures = append(summary.Failures, RunFailure{Input: res.InputPath, Error: res.Err.Error()})
+			continue
+		}
+		summary.FilesCompressed++
+		summary.InputSize += res.InputSize
+		summary.OutputSize += res.OutputSize
+	}
+	summary.SavedBytes = summary.InputSize - summary.OutputSize
+	if summary.InputSize > 0 {
+		summary.SavedPercent = math.Round(float64(summary.SavedBytes)*1000/float64(summary.InputSize)) / 10
+	}
+	return summary
+}
+
+// ReportFormats maps each -report-format to the file name it is written to.
+var ReportFormats = map[string]string{
+	"text": "report.txt",
+	"json": "report.json",
+	"csv":  "report.csv",
+}
+
+// WriteFormat saves the report to path in one of ReportFormats.
+func (r *Report) WriteFormat(path, format string) error {
+	switch format {
+	case "json":
+		return r.WriteJSON(path)
+	case "csv":
+		return r.WriteCSV(path)
+	default:
+		return r.Write(path)
+	}
+}
+
+// Write saves the report as text to path.
+func (r *Report) Write(path string) error {
+	return os.WriteFile(path, []byte(r.Text()), 0644)
+}
+
+// Text returns the report as written by Write.
+func (r *Report) Text() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var compressed, outputs, thumbnails int
+	var inputBytes, outputBytes int64
+	var resized, retried, verified int
+	var resizeTime time.Duration
+	var done, failed, measured, deleted, pdfs []FileResult
+	engines := make(map[string]int)
+	for _, res := range r.results {
+		if res.Engine != "" {
+			engines[res.Engine]++
+		}
+		if res.SSIM > 0 {
+			measured = append(measured, res)
+		}
+		if res.Deleted {
+			deleted = append(deleted, res)
+		}
+		if res.ResizeTime > 0 {
+			resized++
+			resizeTime += res.ResizeTime
+		}
+		if res.Retries > 0 {
+			retried++
+		}
+		if res.Verified {
+			verified++
+		}
+		if res.Err != nil {
+			failed = append(failed, res)
+			continue
+		}
+		compressed++
+		done = append(done, res)
+		if IsPDFFile(res.InputPath) {
+			pdfs = append(pdfs, res)
+		}
+		outputs += len(res.Outputs)
+		if res.Thumbnail != "" {
+			thumbnails++
+		}
+		inputBytes += res.InputSize
+		outputBytes += res.OutputSize
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Image compressor report\n")
+	fmt.Fprintf(&b, "Started: %s\n", r.startTime.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Duration: %v\n", r.Duration)
+	if r.Interrupted {
+		fmt.Fprintf(&b, "Interrupted: %d files were not started\n", r.NotStarted)
+	}
+	fmt.Fprintf(&b, "Input: %s\n", r.inputPath)
+	fmt.Fprintf(&b, "Output: %s\n", r.outputDir)
+	fmt.Fprintf(&b, "\nSettings:\n")
+	for _, s := range r.settings {
+		fmt.Fprintf(&b, "  %s: %s\n", s[0], s[1])
+	}
+	fmt.Fprintf(&b, "\nFiles compressed: %d\n", compressed)
+	if outputs != compressed {
+		fmt.Fprintf(&b, "Files written: %d\n", outputs)
+	}
+	if thumbnails > 0 {
+		fmt.Fprintf(&b, "Thumbnails written: %d\n", thumbnails)
+	}
+	fmt.Fprintf(&b, "Files failed: %d\n", len(failed))
+	if verified > 0 {
+		fmt.Fprintf(&b, "Files verified: %d\n", verified)
+	}
+	if retried > 0 {
+		fmt.Fprintf(&b, "Files retried after IO errors: %d\n", retried)
+	}
+	if r.TooSmall > 0 {
+		fmt.Fprintf(&b, "Files skipped as too small: %d\n", r.TooSmall)
+	}
+	fmt.Fprintf(&b, "Original size: %s\n", HumanReadableSize(inputBytes))
+	fmt.Fprintf(&b, "Compressed size: %s\n", HumanReadableSize(outputBytes))
+	if engines["vips"] > 0 {
+		fmt.Fprintf(&b, "Engine: vips for %d files, go for %d\n", engines["vips"], engines["go"])
+	}
+	if engines["gpu"] > 0 {
+		fmt.Fprintf(&b, "Engine: gpu resizing for %d files, cpu for %d\n", engines["gpu"], engines["go"])
+	}
+	if resized > 0 {
+		fmt.Fprintf(&b, "Files resized: %d (%v resampling, %v per file)\n", resized, resizeTime, resizeTime/time.Duration(resized))
+	}
+	if len(done) > 0 {
+		largest, savings, grew := sizeRankings(done)
+		fmt.Fprintf(&b, "\nLargest files:\n")
+		for _, res := range largest {
+			fmt.Fprintf(&b, "  %s: %s\n", res.InputPath, sizeChange(res))
+		}
+		if len(savings) > 0 {
+			fmt.Fprintf(&b, "\nBest savings:\n")
+			for _, res := range savings {
+				fmt.Fprintf(&b, "  %s: %s\n", res.InputPath, sizeChange(res))
+			}
+		}
+		if len(grew) > 0 {
+			fmt.Fprintf(&b, "\nFiles that got bigger: %d\n", len(grew))
+			for _, res := range grew {
+				fmt.Fprintf(&b, "  %s: %s\n", res.InputPath, sizeChange(res))
+			}
+		}
+		sort.SliceStable(done, func(i, j int) bool { return done[i].Index < done[j].Index })
+		fmt.Fprintf(&b, "\nSizes per file:\n")
+		for _, res := range done {
+			fmt.Fprintf(&b, "  %s: %s\n", res.InputPath, sizeChange(res))
+		}
+	}
+	if len(pdfs) > 0 {
+		sort.SliceStable(pdfs, func(i, j int) bool { return pdfs[i].Index < pdfs[j].Index })
+		fmt.Fprintf(&b, "\nPDF documents:\n")
+		for _, res := range pdfs {
+			fmt.Fprintf(&b, "  %s: %s, %d of %d images recompressed\n", res.InputPath, sizeChange(res), res.PDFReplaced, res.PDFImages)
+		}
+	}
+	if len(measured) > 0 && measured[0].PSNR > 0 {
+		var sumSSIM, sumPSNR float64
+		worst := measured[0]
+		for _, res := range measured {
+			sumSSIM += res.SSIM
+			sumPSNR += res.PSNR
+			if res.SSIM < worst.SSIM {
+				worst = res
+			}
+		}
+		n := float64(len(measured))
+		fmt.Fprintf(&b, "\nQuality: mean SSIM %.4f, mean PSNR %.2f dB, worst SSIM %.4f (%s)\n", sumSSIM/n, sumPSNR/n, worst.SSIM, worst.InputPath)
+		fmt.Fprintf(&b, "\nSSIM and PSNR per file:\n")
+		for _, res := range measured {
+			fmt.Fprintf(&b, "  %s: %.4f, %.2f dB\n", res.InputPath, res.SSIM, res.PSNR)
+		}
+	} else if len(measured) > 0 {
+		fmt.Fprintf(&b, "\nSSIM per file:\n")
+		for _, res := range measured {
+			fmt.Fprintf(&b, "  %s: %.4f\n", res.InputPath, res.SSIM)
+		}
+	}
+	if len(r.renames) > 0 {
+		fmt.Fprintf(&b, "\nRenamed outputs:\n")
+		for _, rename := range r.renames {
+			fmt.Fprintf(&b, "  %s -> %s (same output as %s)\n", rename[0], rename[1], rename[2])
+		}
+	}
+	if len(r.dupes) > 0 {
+		fmt.Fprintf(&b, "\nDuplicates given the outputs of their first copy by %s: %d\n", r.dedupe, len(r.dupes))
+		for _, dup := range r.dupes {
+			fmt.Fprintf(&b, "  %s = %s\n", dup.Path, dup.Of)
+		}
+	}
+	if len(r.nearDupes) > 0 {
+		var skipped int
+		for _, set := range r.nearDupes {
+			skipped += len(set.Others)
+		}
+		fmt.Fprintf(&b, "\nNear-duplicates skipped: %d\n", skipped)
+		for _, set := range r.nearDupes {
+			for i, other := range set.Others {
+				fmt.Fprintf(&b, "  %s ~ %s (%d bits apart)\n", other, set.Keep, set.Distances[i])
+			}
+		}
+	}
+	if len(deleted) > 0 {
+		fmt.Fprintf(&b, "\nDeleted originals: %d\n", len(deleted))
+		for _, res := range deleted {
+			fmt.Fprintf(&b, "  %s\n", res.InputPath)
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(&b, "\nFailed files:\n")
+		for _, res := range failed {
+			fmt.Fprintf(&b, "  %s: %v\n", res.InputPath, res.Err)
+		}
+	}
+	return b.String()
+}
+
+// topFiles is how many files the largest and best savings lists show.
+const topFiles = 20
+
+// sizeRankings returns the topFiles largest sources among compressed files,
+// the topFiles that saved the most bytes, and every one whose outputs are
+// bigger than its source, biggest growth first.
+func sizeRankings(done []FileResult) (largest, savings, grew []FileResult) {
+	largest = append([]FileResult{}, done...)
+	sort.SliceStable(largest, func(i, j int) bool { return largest[i].InputSize > largest[j].InputSize })
+	savings = append([]FileResult{}, done...)
+	sort.SliceStable(savings, func(i, j int) bool {
+		return savings[i].InputSize-savings[i].OutputSize > savings[j].InputSize-savings[j].OutputSize
+	})
+	for _, res := range savings {
+		if res.OutputSize > res.InputSize {
+			grew = append([]FileResult{res}, grew...)
+		}
+	}
+	if len(largest) > topFiles {
+		largest = largest[:topFiles]
+	}
+	for len(savings) > 0 && savings[len(savings)-1].OutputSize >= savings[len(savings)-1].InputSize {
+		savings = savings[:len(savings)-1]
+	}
+	if len(savings) > topFiles {
+		savings = savings[:topFiles]
+	}
+	return largest, savings, grew
+}
+
+// sizeChange describes the sizes of a compressed file, e.g.
+// "2.00 MB -> 512.00 KB (-75.0%)".
+func sizeChange(res FileResult) string {
+	change := fmt.Sprintf("%s -> %s", HumanReadableSize(res.InputSize), HumanReadableSize(res.OutputSize))
+	if res.InputSize > 0 {
+		change += fmt.Sprintf(" (%+.1f%%)", float64(res.OutputSize-res.InputSize)*100/float64(res.InputSize))
+	}
+	return change
+}
+
+type jsonReport struct {
+	Started         time.Time         `json:"started"`
+	DurationMS      int64             `json:"duration_ms"`
+	Interrupted     bool              `json:"interrupted"`
+	NotStarted      int               `json:"not_started,omitempty"`
+	Input           string            `json:"input"`
+	Output          string            `json:"output"`
+	Settings        map[string]string `json:"settings"`
+	Renames         []jsonRename      `json:"renames,omitempty"`
+	Duplicates      []jsonDuplicate   `json:"duplicates,omitempty"`
+	NearDuplicates  []jsonNearDupe    `json:"near_duplicates_skipped,omitempty"`
+	FilesCompressed int               `json:"files_compressed"`
+	FilesFailed     int               `json:"files_failed"`
+	SkippedTooSmall int               `json:"skipped_too_small,omitempty"`
+	Deleted         []string          `json:"deleted_originals,omitempty"`
+	InputSize       int64             `json:"input_size"`
+	OutputSize      int64             `json:"output_size"`
+	Largest         []string          `json:"largest,omitempty"`      // inputs of the 20 largest compressed files
+	BestSavings     []string          `json:"best_savings,omitempty"` // and of the 20 saving the most bytes
+	Grew            []string          `json:"grew,omitempty"`         // and of every one that got bigger
+	Files           []jsonFileResult  `json:"files"`
+}
+
+type jsonDuplicate struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Of     string `json:"of"`
+}
+
+type jsonNearDupe struct {
+	Input    string `json:"input"`
+	Kept     string `json:"kept"`
+	Distance int    `json:"distance"`
+}
+
+type jsonRename struct {
+	Input    string `json:"input"`
+	Output   string `json:"output"`
+	Conflict string `json:"conflict"`
+}
+
+type jsonFileResult struct {
+	Input         string   `json:"input"`
+	Output        string   `json:"output"`
+	Outputs       []string `json:"outputs,omitempty"`
+	Thumbnail     string   `json:"thumbnail,omitempty"`
+	InputSize     int64    `json:"input_size"`
+	OutputSize    int64    `json:"output_size"`
+	Width         int      `json:"width,omitempty"`
+	Height        int      `json:"height,omitempty"`
+	OutputWidth   int      `json:"output_width,omitempty"`
+	OutputHeight  int      `json:"output_height,omitempty"`
+	DurationMS    int64    `json:"duration_ms"`
+	SSIM          float64  `json:"ssim,omitempty"`
+	PSNR          float64  `json:"psnr,omitempty"`
+	Engine        string   `json:"engine,omitempty"`
+	Deleted       bool     `json:"original_deleted,omitempty"`
+	Retries       int      `json:"retries,omitempty"`
+	Verified      bool     `json:"verified,omitempty"`
+	InputSHA256   string   `json:"input_sha256,omitempty"`
+	OutputSHA256  string   `json:"output_sha256,omitempty"`
+	OutputsSHA256 []string `json:"outputs_sha256,omitempty"` // with more than one output
+	PDFImages     int      `json:"pdf_images,omitempty"`
+	PDFReplaced   int      `json:"pdf_images_recompressed,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// WriteJSON saves the report to path as a JSON document with run totals and
+// one entry per file, in the order the files were queued.
+func (r *Report) WriteJSON(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := jsonReport{
+		Started:         r.startTime,
+		DurationMS:      r.Duration.Milliseconds(),
+		Interrupted:     r.Interrupted,
+		NotStarted:      r.NotStarted,
+		SkippedTooSmall: r.TooSmall,
+		Input:           r.inputPath,
+		Output:          r.outputDir,
+		Settings:        make(map[string]string),
+		Files:           make([]jsonFileResult, 0, len(r.results)),
+	}
+	for _, s := range r.settings {
+		out.Settings[s[0]] = s[1]
+	}
+	for _, rename := range r.renames {
+		out.Renames = append(out.Renames, jsonRename{Input: rename[0], Output: rename[1], Conflict: rename[2]})
+	}
+	for _, dup := range r.dupes {
+		out.Duplicates = append(out.Duplicates, jsonDuplicate{Input: dup.Path, Output: dup.Output, Of: dup.Of})
+	}
+	for _, set := range r.nearDupes {
+		for i, other := range set.Others {
+			out.NearDuplicates = append(out.NearDuplicates, jsonNearDupe{Input: other, Kept: set.Keep, Distance: set.Distances[i]})
+		}
+	}
+	results := append([]FileResult{}, r.results...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	for _, res := range results {
+		file := jsonFileResult{
+			Input:        res.InputPath,
+			Output:       res.OutputPath,
+			Thumbnail:    res.Thumbnail,
+			InputSize:    res.InputSize,
+			OutputSize:   res.OutputSize,
+			Width:        res.Width,
+			Height:       res.Height,
+			OutputWidth:  res.OutputWidth,
+			OutputHeight: res.OutputHeight,
+			DurationMS:   res.Duration.Milliseconds(),
+			SSIM:         res.SSIM,
+			PSNR:         res.PSNR,
+			Engine:       res.Engine,
+			Deleted:      res.Deleted,
+			Retries:      res.Retries,
+			Verified:     res.Verified,
+			InputSHA256:  res.InputSHA256,
+			PDFImages:    res.PDFImages,
+			PDFReplaced:  res.PDFReplaced,
+		}
+		if res.Deleted {
+			out.Deleted = append(out.Deleted, res.InputPath)
+		}
+		if len(res.Outputs) > 0 {
+			file.Output = res.Outputs[0]
+		}
+		if len(res.OutputSHA256) > 0 {
+			file.OutputSHA256 = res.OutputSHA256[0]
+		}
+		if len(res.Outputs) > 1 {
+			file.Outputs = res.Outputs
+			file.OutputsSHA256 = res.OutputSHA256
+		}
+		if res.Err != nil {
+			file.Error = res.Err.Error()
+			out.FilesFailed++
+		} else {
+			out.FilesCompressed++
+			out.InputSize += res.InputSize
+			out.OutputSize += res.OutputSize
+		}
+		out.Files = append(out.Files, file)
+	}
+
+	var done []FileResult
+	for _, res := range results {
+		if res.Err == nil {
+			done = append(done, res)
+		}
+	}
+	largest, savings, grew := sizeRankings(done)
+	for _, res := range largest {
+		out.Largest = append(out.Largest, res.InputPath)
+	}
+	for _, res := range savings {
+		out.BestSavings = append(out.BestSavings, res.InputPath)
+	}
+	for _, res := range grew {
+		out.Grew = append(out.Grew, res.InputPath)
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+type jsonPlaceholder struct {
+	Input    string `json:"input"`
+	Output   string `json:"output"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	BlurHash string `json:"blurhash,omitempty"`
+	LQIP     string `json:"lqip,omitempty"`
+}
+
+// WritePlaceholders saves the placeholders of every compressed file to path
+// as a JSON array, in the order the files were queued, for lazy loading.
+func (r *Report) WritePlaceholders(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	results := append([]FileResult{}, r.results...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+	out := make([]jsonPlaceholder, 0, len(results))
+	for _, res := range results {
+		if res.Err != nil || len(res.Outputs) == 0 || (res.BlurHash == "" && res.LQIP == "") {
+			continue
+		}
+		out = append(out, jsonPlaceholder{
+			Input:    res.InputPath,
+			Output:   res.Outputs[0],
+			Width:    res.OutputWidth,
+			Height:   res.OutputHeight,
+			BlurHash: res.BlurHash,
+			LQIP:     res.LQIP,
+		})
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// WriteCSV saves one row per file to path, in the order the files were queued.
+// ratio is compressed bytes over original bytes; dimensions and sizes are
+// left empty where they are unknown.
+func (r *Report) WriteCSV(path string) error {
+	r.mu.Lock()
+	results := append([]FileResult{}, r.results...)
+	r.mu.Unlock()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Index < results[j].Index })
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"path", "original_bytes", "compressed_bytes", "ratio", "width", "height", "output_width", "output_height", "duration_ms", "status", "error", "original_deleted", "verified", "input_sha256", "output_sha256", "ssim", "psnr"})
+	for _, res := range results {
+		status, errText, compressed, ratio := "done", "", strconv.FormatInt(res.OutputSize, 10), ""
+		var outputSHA256 string
+		if len(res.OutputSHA256) > 0 {
+			outputSHA256 = res.OutputSHA256[0]
+		}
+		if res.Err != nil {
+			status, errText, compressed = "failed", res.Err.Error(), ""
+		} else if res.InputSize > 0 {
+			ratio = strconv.FormatFloat(float64(res.OutputSize)/float64(res.InputSize), 'f', 4, 64)
+		}
+		w.Write([]string{
+			res.InputPath,
+			strconv.FormatInt(res.InputSize, 10),
+			compressed,
+			ratio,
+			csvDimension(res.Width),
+			csvDimension(res.Height),
+			csvDimension(res.OutputWidth),
+			csvDimension(res.OutputHeight),
+			strconv.FormatInt(res.Duration.Milliseconds(), 10),
+			status,
+			errText,
+			strconv.FormatBool(res.Deleted),
+			strconv.FormatBool(res.Verified),
+			res.InputSHA256,
+			outputSHA256,
+			csvMetric(res.SSIM, 4),
+			csvMetric(res.PSNR, 2),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func csvMetric(v float64, decimals int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', decimals, 64)
+}
+
+func csvDimension(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
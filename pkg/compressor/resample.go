@@ -0,0 +1,308 @@
+package compressor
+
+import (
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"math"
+	"sync"
+
+	"github.com/nfnt/resize"
+)
+
+// resampleKernel is a separable filter: its support in pixels either side
+// of the center at scale 1, and its weight at a distance. Nearest has no
+// weight function: it takes the one pixel under each center.
+type resampleKernel struct {
+	support float64
+	weight  func(float64) float64
+}
+
+// resampleKernels are the kernels of the -filter names, matching nfnt/resize.
+var resampleKernels = map[resize.InterpolationFunction]resampleKernel{
+	resize.NearestNeighbor: {},
+	resize.Bilinear: {1, func(x float64) float64 {
+		return 1 - x
+	}},
+	resize.Bicubic: {2, func(x float64) float64 {
+		if x <= 1 {
+			return x*x*(1.5*x-2.5) + 1
+		}
+		return x*(x*(2.5-0.5*x)-4) + 2
+	}},
+	resize.Lanczos2: {2, func(x float64) float64 { return sinc(x) * sinc(x/2) }},
+	resize.Lanczos3: {3, func(x float64) float64 { return sinc(x) * sinc(x/3) }},
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// weightBits is the fixed point precision of the resampling weights.
+const weightBits = 14
+
+// resampleWeights are the weights of n consecutive source pixels, from
+// start[i], making up destination pixel i. Pixels beyond the edges are folded
+// onto the edge pixels, so the passes never need to check bounds.
+type resampleWeights struct {
+	n       int
+	start   []int
+	weights []int16
+}
+
+// makeResampleWeights computes the weights of a scale from srcSize to
+// dstSize pixels, with n rounded up to a multiple of align (padded with zero
+// weights) for the vector kernels while it fits in srcSize.
+func makeResampleWeights(srcSize, dstSize int, kernel resampleKernel, align int) resampleWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	stretch := math.Max(scale, 1) // widen the kernel when shrinking, to average away aliasing
+	support := kernel.support * stretch
+	n := int(math.Ceil(2*support)) + 1
+	n = (n + align - 1) / align * align
+	if n > srcSize {
+		n = srcSize
+	}
+	w := resampleWeights{n: n, start: make([]int, dstSize), weights: make([]int16, dstSize*n)}
+	taps := make([]float64, n)
+	for i := 0; i < dstSize; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		first, last := int(math.Ceil(center-support)), int(math.Floor(center+support))
+		if kernel.weight == nil {
+			first = int(math.Floor(center + 0.5))
+			last = first
+		}
+		start := first
+		if start > srcSize-n {
+			start = srcSize - n
+		}
+		if start < 0 {
+			start = 0
+		}
+		for k := range taps {
+			taps[k] = 0
+		}
+		var total float64
+		for j := first; j <= last; j++ {
+			v := 1.0
+			if kernel.weight != nil {
+				d := math.Abs(float64(j)-center) / stretch
+				if d >= kernel.support {
+					continue
+				}
+				v = kernel.weight(d)
+			}
+			src := j
+			if src < 0 {
+				src = 0
+			} else if src >= srcSize {
+				src = srcSize - 1
+			}
+			taps[src-start] += v
+			total += v
+		}
+		w.start[i] = start
+		row := w.weights[i*n : (i+1)*n]
+		var sum int
+		peak := 0
+		for k, v := range taps {
+			row[k] = int16(math.Round(v / total * (1 << weightBits)))
+			sum += int(row[k])
+			if row[k] > row[peak] {
+				peak = k
+			}
+		}
+		row[peak] += int16(1<<weightBits - sum) // so flat areas stay exactly flat
+	}
+	return w
+}
+
+// Resample scales img to width x height with filter, like nfnt/resize's
+// Resize but several times faster for RGBA, NRGBA, gray and YCbCr images:
+// it works in fixed point on whole rows, and resizes the planes of a YCbCr
+// image at their own resolution instead of converting it to RGB first.
+// Other images go through nfnt/resize.
+func Resample(img image.Image, width, height int, filter resize.InterpolationFunction) image.Image {
+	return resample(img, width, height, filter, 1)
+}
+
+// resample is Resample splitting each pass into threads strips of rows
+// resampled at once. The strips write straight into the shared output, so it
+// looks the same however many there are.
+func resample(img image.Image, width, height int, filter resize.InterpolationFunction, threads int) image.Image {
+	kernel, ok := resampleKernels[filter]
+	bounds := img.Bounds()
+	if !ok || width <= 0 || height <= 0 || bounds.Empty() {
+		return resize.Resize(uint(width), uint(height), img, filter)
+	}
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+	switch src := img.(type) {
+	case *image.YCbCr:
+		if ratio, ok := chromaShift[src.SubsampleRatio]; ok && src.Rect.Min == (image.Point{}) {
+			dst := newPooledYCbCr(width, height, src.SubsampleRatio)
+			cw, ch := (bounds.Dx()+ratio.X)>>ratio.X, (bounds.Dy()+ratio.Y)>>ratio.Y
+			resamplePlane(src.Y, src.YStride, bounds.Dx(), bounds.Dy(), dst.Y, dst.YStride, width, height, 1, kernel, threads)
+			dcw, dch := (width+ratio.X)>>ratio.X, (height+ratio.Y)>>ratio.Y
+			resamplePlane(src.Cb, src.CStride, cw, ch, dst.Cb, dst.CStride, dcw, dch, 1, kernel, threads)
+			resamplePlane(src.Cr, src.CStride, cw, ch, dst.Cr, dst.CStride, dcw, dch, 1, kernel, threads)
+			return dst
+		}
+	case *image.Gray:
+		dst := newPooledGray(image.Rect(0, 0, width, height))
+		resamplePlane(src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, bounds.Dx(), bounds.Dy(), dst.Pix, dst.Stride, width, height, 1, kernel, threads)
+		return dst
+	case *image.RGBA:
+		dst := newPooledRGBA(image.Rect(0, 0, width, height))
+		resamplePlane(src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, bounds.Dx(), bounds.Dy(), dst.Pix, dst.Stride, width, height, 4, kernel, threads)
+		return dst
+	case *image.NRGBA:
+		// Premultiplied first, or transparent pixels would bleed their color
+		rgba := newPooledRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		parallelRows(bounds.Dy(), threads, func(y0, y1 int) {
+			strip := image.Rect(0, y0, bounds.Dx(), y1)
+			draw.Draw(rgba, strip, src, bounds.Min.Add(strip.Min), draw.Src)
+		})
+		defer recycleImage(rgba)
+		return resample(rgba, width, height, filter, threads)
+	}
+	return resize.Resize(uint(width), uint(height), img, filter)
+}
+
+// chromaShift is how many bits the chroma planes of each subsampling ratio
+// are shifted by horizontally (X) and vertically (Y).
+var chromaShift = map[image.YCbCrSubsampleRatio]image.Point{
+	image.YCbCrSubsampleRatio444: {0, 0},
+	image.YCbCrSubsampleRatio422: {1, 0},
+	image.YCbCrSubsampleRatio420: {1, 1},
+	image.YCbCrSubsampleRatio440: {0, 1},
+}
+
+// resamplePlane scales a plane of sw x sh pixels of channels interleaved
+// bytes each into one of dw x dh, rows first and then columns.
+func resamplePlane(src []byte, srcStride, sw, sh int, dst []byte, dstStride, dw, dh, channels int, kernel resampleKernel, threads int) {
+	rowAlign := 2 // the vector kernels take taps in pairs of pixels
+	if channels == 1 {
+		rowAlign = 8 // or eight bytes at a time
+	}
+	rows := makeResampleWeights(sw, dw, kernel, rowAlign)
+	mid := getPixels(dw * channels * sh)
+	defer putPixels(mid)
+	parallelRows(sh, threads, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			resampleRow(mid[y*dw*channels:(y+1)*dw*channels], src[y*srcStride:], rows, channels)
+		}
+	})
+	columns := makeResampleWeights(sh, dh, kernel, 2)
+	parallelRows(dh, threads, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			weights := columns.weights[y*columns.n : (y+1)*columns.n]
+			resampleColumn(dst[y*dstStride:y*dstStride+dw*channels], mid, dw*channels, columns.start[y], weights)
+		}
+	})
+}
+
+// parallelRows calls fn on threads consecutive strips of rows 0 to n at
+// once, or on all of them when there are too few rows to share.
+func parallelRows(n, threads int, fn func(y0, y1 int)) {
+	if threads <= 1 || n < 16*threads {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(t*n/threads, (t+1)*n/threads)
+	}
+	wg.Wait()
+}
+
+// resampleRowGo resamples a row of in horizontally into out.
+func resampleRowGo(out, in []byte, w resampleWeights, channels int) {
+	n := w.n
+	if channels == 1 {
+		for x, start := range w.start {
+			taps := in[start : start+n]
+			weights := w.weights[x*n : x*n+n]
+			var acc int32
+			for k, v := range taps {
+				acc += int32(weights[k]) * int32(v)
+			}
+			out[x] = clampWeighted(acc)
+		}
+		return
+	}
+	for x, start := range w.start {
+		taps := in[start*4 : start*4+n*4]
+		weights := w.weights[x*n : x*n+n]
+		var r, g, b, a int32
+		for k, weight := range weights {
+			p := binary.LittleEndian.Uint32(taps[k*4:])
+			r += int32(weight) * int32(p&0xff)
+			g += int32(weight) * int32(p>>8&0xff)
+			b += int32(weight) * int32(p>>16&0xff)
+			a += int32(weight) * int32(p>>24)
+		}
+		p := out[x*4 : x*4+4 : x*4+4]
+		p[0], p[1], p[2], p[3] = clampWeighted(r), clampWeighted(g), clampWeighted(b), clampWeighted(a)
+	}
+}
+
+// resampleColumnGo sums the rows of src from start, stride bytes apart, by
+// weights into out. It goes a chunk of columns and two rows at a time, so
+// every read is sequential and the sums stay in the L1 cache.
+func resampleColumnGo(out, src []byte, stride, start int, weights []int16) {
+	const chunk = 2048
+	var acc [chunk]int32
+	for c0 := 0; c0 < len(out); c0 += chunk {
+		c1 := c0 + chunk
+		if c1 > len(out) {
+			c1 = len(out)
+		}
+		sums := acc[:c1-c0]
+		for i := range sums {
+			sums[i] = 0
+		}
+		k := 0
+		for ; k+1 < len(weights); k += 2 {
+			w0, w1 := int32(weights[k]), int32(weights[k+1])
+			r0 := src[(start+k)*stride+c0 : (start+k)*stride+c1]
+			r1 := src[(start+k+1)*stride+c0 : (start+k+1)*stride+c1]
+			r1 = r1[:len(r0)]
+			sums := sums[:len(r0)]
+			for i, v := range r0 {
+				sums[i] += w0*int32(v) + w1*int32(r1[i])
+			}
+		}
+		if k < len(weights) {
+			row := src[(start+k)*stride+c0 : (start+k)*stride+c1]
+			sums := sums[:len(row)]
+			for i, v := range row {
+				sums[i] += int32(weights[k]) * int32(v)
+			}
+		}
+		out := out[c0:c1]
+		for i, v := range sums {
+			out[i] = clampWeighted(v)
+		}
+	}
+}
+
+// clampWeighted rounds a sum of weighted bytes back to a byte.
+func clampWeighted(v int32) uint8 {
+	v = (v + 1<<(weightBits-1)) >> weightBits
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
@@ -0,0 +1,41 @@
+//go:build !purego
+
+package compressor
+
+// The SSE2 kernels, which every amd64 CPU has, multiply and add pairs of
+// taps at a time with PMADDWD.
+
+//go:noescape
+func resampleRow4SSE2(out, in []byte, start []int, weights []int16, n int)
+
+//go:noescape
+func resampleRow1SSE2(out, in []byte, start []int, weights []int16, n int)
+
+// resampleColumnSSE2 handles len(out), a multiple of 8, bytes.
+//
+//go:noescape
+func resampleColumnSSE2(out, src []byte, stride, start int, weights []int16)
+
+// resampleRow resamples a row of in horizontally into out.
+func resampleRow(out, in []byte, w resampleWeights, channels int) {
+	switch {
+	case channels == 4 && w.n%2 == 0:
+		resampleRow4SSE2(out, in, w.start, w.weights, w.n)
+	case channels == 1 && w.n%8 == 0:
+		resampleRow1SSE2(out, in, w.start, w.weights, w.n)
+	default:
+		resampleRowGo(out, in, w, channels)
+	}
+}
+
+// resampleColumn sums the rows of src from start, stride bytes apart, by
+// weights into out.
+func resampleColumn(out, src []byte, stride, start int, weights []int16) {
+	if len(weights)%2 != 0 {
+		resampleColumnGo(out, src, stride, start, weights)
+		return
+	}
+	done := len(out) &^ 7
+	resampleColumnSSE2(out[:done], src, stride, start, weights)
+	resampleColumnGo(out[done:], src[done:], stride, start, weights)
+}
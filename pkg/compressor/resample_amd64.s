@@ -0,0 +1,165 @@
+//go:build !purego
+
+#include "textflag.h"
+
+// Every kernel rounds its sums by adding 1<<13 before shifting them down by
+// weightBits, 14, and lets the saturating packs clamp them to bytes.
+
+// func resampleRow4SSE2(out, in []byte, start []int, weights []int16, n int)
+TEXT ·resampleRow4SSE2(SB), NOSPLIT, $0-104
+	MOVQ out_base+0(FP), DI
+	MOVQ in_base+24(FP), SI
+	MOVQ start_base+48(FP), R8
+	MOVQ start_len+56(FP), CX
+	MOVQ weights_base+72(FP), R11
+	MOVQ n+96(FP), R9
+	SHRQ $1, R9
+	PXOR X7, X7
+	MOVL $8192, AX
+	MOVL AX, X6
+	PSHUFD $0, X6, X6
+
+row4pixel:
+	TESTQ CX, CX
+	JZ    row4done
+	MOVQ  (R8), AX
+	LEAQ  (SI)(AX*4), R10
+	MOVO  X6, X0
+	MOVQ  R9, R12
+
+row4taps:
+	// Interleave pixels k and k+1 as r0 r1 g0 g1 b0 b1 a0 a1 words, so
+	// PMADDWD sums each channel of both by their weights.
+	MOVL      (R10), X2
+	MOVL      4(R10), X3
+	PUNPCKLBW X3, X2
+	PUNPCKLBW X7, X2
+	MOVL      (R11), X5
+	PSHUFD    $0, X5, X5
+	PMADDWL   X5, X2
+	PADDL     X2, X0
+	ADDQ      $8, R10
+	ADDQ      $4, R11
+	DECQ      R12
+	JNZ       row4taps
+
+	PSRAL    $14, X0
+	PACKSSLW X0, X0
+	PACKUSWB X0, X0
+	MOVL     X0, (DI)
+	ADDQ     $4, DI
+	ADDQ     $8, R8
+	DECQ     CX
+	JMP      row4pixel
+
+row4done:
+	RET
+
+// func resampleRow1SSE2(out, in []byte, start []int, weights []int16, n int)
+TEXT ·resampleRow1SSE2(SB), NOSPLIT, $0-104
+	MOVQ out_base+0(FP), DI
+	MOVQ in_base+24(FP), SI
+	MOVQ start_base+48(FP), R8
+	MOVQ start_len+56(FP), CX
+	MOVQ weights_base+72(FP), R11
+	MOVQ n+96(FP), R9
+	SHRQ $3, R9
+	PXOR X7, X7
+	MOVL $8192, AX
+	MOVL AX, X6
+
+row1pixel:
+	TESTQ CX, CX
+	JZ    row1done
+	MOVQ  (R8), AX
+	LEAQ  (SI)(AX*1), R10
+	PXOR  X0, X0
+	MOVQ  R9, R12
+
+row1taps:
+	// Eight taps at a time, summed in pairs into four lanes
+	MOVQ      (R10), X2
+	PUNPCKLBW X7, X2
+	MOVOU     (R11), X5
+	PMADDWL   X5, X2
+	PADDL     X2, X0
+	ADDQ      $8, R10
+	ADDQ      $16, R11
+	DECQ      R12
+	JNZ       row1taps
+
+	PSHUFD   $0x4e, X0, X1
+	PADDL    X1, X0
+	PSHUFD   $0xb1, X0, X1
+	PADDL    X1, X0
+	PADDL    X6, X0
+	PSRAL    $14, X0
+	PACKSSLW X0, X0
+	PACKUSWB X0, X0
+	MOVL     X0, AX
+	MOVB     AX, (DI)
+	INCQ     DI
+	ADDQ     $8, R8
+	DECQ     CX
+	JMP      row1pixel
+
+row1done:
+	RET
+
+// func resampleColumnSSE2(out, src []byte, stride, start int, weights []int16)
+TEXT ·resampleColumnSSE2(SB), NOSPLIT, $0-88
+	MOVQ  out_base+0(FP), DI
+	MOVQ  out_len+8(FP), CX
+	MOVQ  src_base+24(FP), SI
+	MOVQ  stride+48(FP), DX
+	MOVQ  start+56(FP), AX
+	IMULQ DX, AX
+	ADDQ  AX, SI
+	MOVQ  weights_base+64(FP), R8
+	MOVQ  weights_len+72(FP), R9
+	SHRQ  $1, R9
+	PXOR  X7, X7
+	MOVL  $8192, AX
+	MOVL  AX, X6
+	PSHUFD $0, X6, X6
+	XORQ  BX, BX
+
+column:
+	CMPQ BX, CX
+	JGE  columndone
+	MOVO X6, X0
+	MOVO X6, X1
+	LEAQ (SI)(BX*1), R10
+	MOVQ R8, R11
+	MOVQ R9, R12
+
+columnrows:
+	// Eight bytes of rows k and k+1, interleaved as words for PMADDWD
+	MOVQ      (R10), X2
+	MOVQ      (R10)(DX*1), X3
+	PUNPCKLBW X7, X2
+	PUNPCKLBW X7, X3
+	MOVO      X2, X4
+	PUNPCKLWL X3, X2
+	PUNPCKHWL X3, X4
+	MOVL      (R11), X5
+	PSHUFD    $0, X5, X5
+	PMADDWL   X5, X2
+	PMADDWL   X5, X4
+	PADDL     X2, X0
+	PADDL     X4, X1
+	LEAQ      (R10)(DX*2), R10
+	ADDQ      $4, R11
+	DECQ      R12
+	JNZ       columnrows
+
+	PSRAL    $14, X0
+	PSRAL    $14, X1
+	PACKSSLW X1, X0
+	PACKUSWB X0, X0
+	MOVQ     X0, (DI)(BX*1)
+	ADDQ     $8, BX
+	JMP      column
+
+columndone:
+	RET
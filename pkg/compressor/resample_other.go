@@ -0,0 +1,11 @@
+//go:build !amd64 || purego
+
+package compressor
+
+func resampleRow(out, in []byte, w resampleWeights, channels int) {
+	resampleRowGo(out, in, w, channels)
+}
+
+func resampleColumn(out, src []byte, stride, start int, weights []int16) {
+	resampleColumnGo(out, src, stride, start, weights)
+}
@@ -0,0 +1,90 @@
+package compressor
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+// referenceSum is the weighted sum of taps, step bytes apart, that every
+// resampling kernel computes for one output byte.
+func referenceSum(taps []byte, step int, weights []int16) uint8 {
+	var acc int32
+	for k, w := range weights {
+		acc += int32(w) * int32(taps[k*step])
+	}
+	return clampWeighted(acc)
+}
+
+func randomBytes(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	return b
+}
+
+// randomWeights returns the weights of a scale from srcSize to dstSize with
+// a random kernel, or random weights, strong enough to clamp, half the time.
+func randomWeights(rng *rand.Rand, srcSize, dstSize, align int) resampleWeights {
+	kernels := []resize.InterpolationFunction{resize.NearestNeighbor, resize.Bilinear, resize.Bicubic, resize.Lanczos2, resize.Lanczos3}
+	w := makeResampleWeights(srcSize, dstSize, resampleKernels[kernels[rng.Intn(len(kernels))]], align)
+	if rng.Intn(2) == 0 {
+		for i := range w.weights {
+			w.weights[i] = int16(rng.Intn(1<<16) - 1<<15)
+		}
+	}
+	return w
+}
+
+// TestResampleKernels checks the kernels resampling runs with, SSE2 on amd64
+// and Go elsewhere or with the purego tag, and the Go ones, against plain
+// weighted sums, over widths leaving every tail length and tap counts from
+// one to many.
+func TestResampleKernels(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		srcSize := 1 + rng.Intn(200)
+		dstSize := 1 + rng.Intn(200)
+		for _, channels := range []int{1, 4} {
+			align := []int{1, 2, 8}[rng.Intn(3)]
+			w := randomWeights(rng, srcSize, dstSize, align)
+			in := randomBytes(rng, srcSize*channels)
+			want := make([]byte, dstSize*channels)
+			for x, start := range w.start {
+				for c := 0; c < channels; c++ {
+					want[x*channels+c] = referenceSum(in[start*channels+c:], channels, w.weights[x*w.n:(x+1)*w.n])
+				}
+			}
+			for name, row := range map[string]func(out, in []byte, w resampleWeights, channels int){"resampleRow": resampleRow, "resampleRowGo": resampleRowGo} {
+				out := make([]byte, len(want))
+				row(out, in, w, channels)
+				if !bytes.Equal(out, want) {
+					t.Fatalf("%s of %d to %d pixels of %d channels with %d taps differs from the weighted sums", name, srcSize, dstSize, channels, w.n)
+				}
+			}
+		}
+
+		// Columns, with an odd width now and then and past one chunk of the
+		// Go kernel
+		width := 1 + rng.Intn(64)
+		if rng.Intn(10) == 0 {
+			width = 2048 + rng.Intn(64)
+		}
+		w := randomWeights(rng, srcSize, dstSize, []int{1, 2}[rng.Intn(2)])
+		src := randomBytes(rng, srcSize*width)
+		y := rng.Intn(dstSize)
+		weights := w.weights[y*w.n : (y+1)*w.n]
+		want := make([]byte, width)
+		for x := range want {
+			want[x] = referenceSum(src[w.start[y]*width+x:], width, weights)
+		}
+		for name, column := range map[string]func(out, src []byte, stride, start int, weights []int16){"resampleColumn": resampleColumn, "resampleColumnGo": resampleColumnGo} {
+			out := make([]byte, width)
+			column(out, src, width, w.start[y], weights)
+			if !bytes.Equal(out, want) {
+				t.Fatalf("%s of %d bytes from %d rows with %d taps differs from the weighted sums", name, width, srcSize, len(weights))
+			}
+		}
+	}
+}
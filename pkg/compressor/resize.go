@@ -0,0 +1,173 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// ResizeFilters lists the resampling filters from fastest to sharpest.
+var ResizeFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// CropGravities maps each -crop-gravity to the fraction of the excess width
+// and height cut away on the left and top.
+var CropGravities = map[string][2]float64{
+	"center": {0.5, 0.5},
+	"top":    {0.5, 0},
+	"bottom": {0.5, 1},
+	"left":   {0, 0.5},
+	"right":  {1, 0.5},
+	"tl":     {0, 0},
+	"tr":     {1, 0},
+	"bl":     {0, 1},
+	"br":     {1, 1},
+}
+
+// ParseDimensions parses a WIDTHxHEIGHT pair such as "1920x1080".
+func ParseDimensions(s string) (int, int, error) {
+	parts := strings.Split(strings.ToLower(s), "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid dimensions %q", s)
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 {
+		return 0, 0, fmt.Errorf("invalid dimensions %q", s)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid dimensions %q", s)
+	}
+	return width, height, nil
+}
+
+// ParseScale parses a downscale ratio such as "50%" (the percent sign is
+// optional) into a factor in (0, 1].
+func ParseScale(s string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || value <= 0 || value > 100 {
+		return 0, fmt.Errorf("invalid scale %q", s)
+	}
+	return value / 100, nil
+}
+
+// resizeScale returns the factor, at most 1, that shrinks a width x height
+// image by opts.Scale and then further if needed to satisfy every configured
+// limit; the tightest limit wins.
+func resizeScale(width, height int, opts Options) float64 {
+	scale := 1.0
+	if opts.Scale > 0 {
+		scale = opts.Scale
+	}
+	if pixels := float64(width*height) * scale * scale; opts.MaxPixels > 0 && pixels > float64(opts.MaxPixels) {
+		scale *= math.Sqrt(float64(opts.MaxPixels) / pixels)
+	}
+	if opts.MaxWidth > 0 && float64(width)*scale > float64(opts.MaxWidth) {
+		scale = float64(opts.MaxWidth) / float64(width)
+	}
+	if opts.MaxHeight > 0 && float64(height)*scale > float64(opts.MaxHeight) {
+		scale = float64(opts.MaxHeight) / float64(height)
+	}
+	return scale
+}
+
+// scaledSize returns the dimensions of a width x height image scaled by scale,
+// never smaller than one pixel.
+func scaledSize(width, height int, scale float64) (uint, uint) {
+	w := uint(math.Max(1, math.Round(float64(width)*scale)))
+	h := uint(math.Max(1, math.Round(float64(height)*scale)))
+	return w, h
+}
+
+// resizeImage shrinks img to fit the configured limits, returning it
+// unchanged when it already fits. With the gpu engine it resamples on the GPU
+// when it can, reporting so, and on the CPU otherwise.
+func resizeImage(img image.Image, opts Options) (image.Image, bool) {
+	bounds := img.Bounds()
+	scale := resizeScale(bounds.Dx(), bounds.Dy(), opts)
+	if scale >= 1 {
+		return img, false
+	}
+	width, height := scaledSize(bounds.Dx(), bounds.Dy(), scale)
+	if opts.Engine == "gpu" && gpuAvailable {
+		if resized, err := gpuResize(img, width, height); err == nil {
+			return resized, true
+		}
+	}
+	return resample(img, int(width), int(height), opts.Filter, stripThreads(bounds, opts)), false
+}
+
+// stripThreads is how many strips of rows an image of bounds is processed
+// in at once: one per CPU from opts.TilePixels pixels, else one.
+func stripThreads(bounds image.Rectangle, opts Options) int {
+	if opts.TilePixels > 0 && bounds.Dx()*bounds.Dy() >= opts.TilePixels {
+		return runtime.GOMAXPROCS(0)
+	}
+	return 1
+}
+
+// cropSize returns the size cropImage scales a w x h image to for a width x
+// height crop, and the size of the crop it then cuts.
+func cropSize(w, h, width, height int) (scaledWidth, scaledHeight, cropWidth, cropHeight int) {
+	aspect := float64(width) / float64(height)
+	scale := math.Max(float64(width)/float64(w), float64(height)/float64(h))
+	if scale < 1 {
+		sw, sh := scaledSize(w, h, scale)
+		w, h = int(sw), int(sh)
+	} else if float64(w) > float64(h)*aspect {
+		height = h
+		width = int(math.Round(float64(height) * aspect))
+	} else {
+		width = w
+		height = int(math.Round(float64(width) / aspect))
+	}
+	if width > w {
+		width = w
+	}
+	if height > h {
+		height = h
+	}
+	// extreme aspect ratios round a small image's crop down to nothing
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return w, h, width, height
+}
+
+// cropImage scales img down until it just covers width x height and cuts the
+// excess according to gravity. Images smaller than the crop are not enlarged;
+// they are only cut to its aspect ratio.
+func cropImage(img image.Image, width, height int, gravity string, filter resize.InterpolationFunction) image.Image {
+	bounds := img.Bounds()
+	scaledWidth, scaledHeight, width, height := cropSize(bounds.Dx(), bounds.Dy(), width, height)
+	if scaledWidth != bounds.Dx() || scaledHeight != bounds.Dy() {
+		if resized := Resample(img, scaledWidth, scaledHeight, filter); resized != img {
+			defer recycleImage(resized)
+			img = resized
+		}
+		bounds = img.Bounds()
+	}
+
+	g := CropGravities[gravity]
+	min := bounds.Min.Add(image.Pt(
+		int(math.Round(float64(bounds.Dx()-width)*g[0])),
+		int(math.Round(float64(bounds.Dy()-height)*g[1])),
+	))
+	dst := newPooledRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), img, min, draw.Src)
+	return dst
+}
@@ -0,0 +1,37 @@
+package compressor
+
+import (
+	"errors"
+	"syscall"
+)
+
+// transientErrnos are the IO errors worth retrying: the disk or the network
+// share behind it may answer next time. Missing files, permissions and
+// undecodable images fail the same way every time.
+var transientErrnos = []syscall.Errno{
+	syscall.EIO,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.EBUSY,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+	syscall.ECONNRESET,
+	syscall.ECONNABORTED,
+	syscall.ENETUNREACH,
+	syscall.EHOSTUNREACH,
+}
+
+// IsTransient reports whether err comes from an IO error that may not happen
+// again, as opposed to one that will.
+func IsTransient(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, transient := range transientErrnos {
+		if errno == transient {
+			return true
+		}
+	}
+	return false
+}
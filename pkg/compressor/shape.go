@@ -0,0 +1,221 @@
+package compressor
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+	"golang.org/x/text/unicode/bidi"
+)
+
+// LoadFonts parses the comma separated list of TrueType/OpenType font files in
+// paths. The embedded Go Regular font (BSD licensed, shipped with
+// golang.org/x/image) is always appended as the last fallback.
+func LoadFonts(paths string) ([]*font.Font, error) {
+	var files [][]byte
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, data)
+	}
+	files = append(files, goregular.TTF)
+
+	fonts := make([]*font.Font, len(files))
+	for i, data := range files {
+		face, err := font.ParseTTF(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		fonts[i] = face.Font
+	}
+	return fonts, nil
+}
+
+// fontFallback picks, for each rune, the first face that has a glyph for it.
+type fontFallback []*font.Face
+
+func (faces fontFallback) ResolveFace(r rune) *font.Face {
+	for _, f := range faces {
+		if _, ok := f.NominalGlyph(r); ok {
+			return f
+		}
+	}
+	return faces[0]
+}
+
+// shapedText is a single line of text shaped into positioned glyphs. Runs are
+// stored in visual (left to right) order.
+type shapedText struct {
+	runs []shaping.Output
+	ink  fixed.Rectangle26_6 // glyph bounds relative to the start of the baseline, y down
+}
+
+// shapeText splits text into bidi, script and font runs, shapes each run with
+// HarfBuzz so that joining scripts (Arabic, Devanagari, ...) get their
+// contextual forms and ligatures, and lays the runs out in visual order.
+// Faces are created per call because they are not safe for concurrent use.
+func shapeText(fonts []*font.Font, text string, size float64) shapedText {
+	faces := make(fontFallback, len(fonts))
+	for i, f := range fonts {
+		faces[i] = font.NewFace(f)
+	}
+
+	runes := []rune(text)
+	input := shaping.Input{
+		Text:      runes,
+		RunEnd:    len(runes),
+		Direction: baseDirection(runes),
+		Size:      fixed.Int26_6(size * 64),
+	}
+	var seg shaping.Segmenter
+	var shaper shaping.HarfbuzzShaper
+	var runs []shaping.Output
+	for _, run := range seg.Split(input, faces) {
+		runs = append(runs, shaper.Shape(run))
+	}
+	runs = visualOrder(runs, runes, input.Direction)
+
+	s := shapedText{runs: runs}
+	first := true
+	var pen fixed.Int26_6
+	for _, run := range runs {
+		for _, g := range run.Glyphs {
+			x := pen + g.XOffset + g.XBearing
+			y := -(g.YOffset + g.YBearing)
+			glyph := fixed.Rectangle26_6{
+				Min: fixed.Point26_6{X: x, Y: y},
+				Max: fixed.Point26_6{X: x + g.Width, Y: y - g.Height},
+			}
+			pen += g.XAdvance
+			if g.Width == 0 || g.Height == 0 {
+				continue
+			}
+			if first {
+				s.ink, first = glyph, false
+			} else {
+				s.ink = s.ink.Union(glyph)
+			}
+		}
+	}
+	return s
+}
+
+// baseDirection returns the paragraph direction given by the first strongly
+// directional character, as in rules P2 and P3 of the Unicode bidi algorithm.
+func baseDirection(runes []rune) di.Direction {
+	for _, r := range runes {
+		props, _ := bidi.LookupRune(r)
+		switch props.Class() {
+		case bidi.R, bidi.AL:
+			return di.DirectionRTL
+		case bidi.L:
+			return di.DirectionLTR
+		}
+	}
+	return di.DirectionLTR
+}
+
+// visualOrder reorders runs given in logical order for display (rule L2 of
+// the Unicode bidi algorithm): right-to-left runs get embedding level 1,
+// left-to-right runs inside right-to-left text (including numbers embedded
+// in it) level 2, and every sequence at or above each level is reversed,
+// highest first.
+func visualOrder(runs []shaping.Output, text []rune, base di.Direction) []shaping.Output {
+	levels := make([]int, len(runs))
+	maxLevel := 0
+	for i, run := range runs {
+		switch {
+		case run.Direction.Progression() == di.TowardTopLeft:
+			levels[i] = 1
+		case base == di.DirectionRTL || !hasStrongLTR(text[run.Runes.Offset:run.Runes.Offset+run.Runes.Count]):
+			levels[i] = 2
+		}
+		if levels[i] > maxLevel {
+			maxLevel = levels[i]
+		}
+	}
+	for level := maxLevel; level > 0; level-- {
+		for i := 0; i < len(runs); {
+			if levels[i] < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(runs) && levels[j] >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				runs[a], runs[b] = runs[b], runs[a]
+				levels[a], levels[b] = levels[b], levels[a]
+			}
+			i = j
+		}
+	}
+	return runs
+}
+
+func hasStrongLTR(runes []rune) bool {
+	for _, r := range runes {
+		if props, _ := bidi.LookupRune(r); props.Class() == bidi.L {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the pixel dimensions of the inked area.
+func (s shapedText) size() image.Point {
+	return image.Pt((s.ink.Max.X - s.ink.Min.X).Ceil(), (s.ink.Max.Y - s.ink.Min.Y).Ceil())
+}
+
+// draw rasterizes the glyph outlines into mask so that the inked area starts
+// pad pixels from its top-left corner.
+func (s shapedText) draw(mask *image.Alpha, pad int) {
+	z := vector.NewRasterizer(mask.Rect.Dx(), mask.Rect.Dy())
+	originX := float32(pad) - float32(s.ink.Min.X)/64
+	baseline := float32(pad) - float32(s.ink.Min.Y)/64
+
+	pen := originX
+	for _, run := range s.runs {
+		scale := float32(run.Size) / 64 / float32(run.Face.Upem())
+		for _, g := range run.Glyphs {
+			x := pen + float32(g.XOffset)/64
+			y := baseline - float32(g.YOffset)/64
+			pen += float32(g.XAdvance) / 64
+
+			outline, ok := run.Face.GlyphData(g.GlyphID).(font.GlyphOutline)
+			if !ok {
+				continue
+			}
+			for _, seg := range outline.Segments {
+				p := seg.Args
+				switch seg.Op {
+				case ot.SegmentOpMoveTo:
+					z.ClosePath()
+					z.MoveTo(x+p[0].X*scale, y-p[0].Y*scale)
+				case ot.SegmentOpLineTo:
+					z.LineTo(x+p[0].X*scale, y-p[0].Y*scale)
+				case ot.SegmentOpQuadTo:
+					z.QuadTo(x+p[0].X*scale, y-p[0].Y*scale, x+p[1].X*scale, y-p[1].Y*scale)
+				case ot.SegmentOpCubeTo:
+					z.CubeTo(x+p[0].X*scale, y-p[0].Y*scale, x+p[1].X*scale, y-p[1].Y*scale, x+p[2].X*scale, y-p[2].Y*scale)
+				}
+			}
+			z.ClosePath()
+		}
+	}
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+}
@@ -0,0 +1,129 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Sharpen is an unsharp mask: the difference between each pixel and a
+// Gaussian blur of the image is scaled by Amount and added back, where it is
+// more than Threshold. A zero Amount disables it.
+type Sharpen struct {
+	Amount    float64 // 1 adds the difference once (100%)
+	Radius    float64 // standard deviation of the blur, in pixels
+	Threshold int     // 0-255; smaller differences, such as noise in flat areas, are left alone
+}
+
+// ParseSharpen parses "amount,radius,threshold" such as "0.8,1,2". The radius
+// defaults to 1 pixel and the threshold to 0.
+func ParseSharpen(s string) (Sharpen, error) {
+	sharpen := Sharpen{Radius: 1}
+	fields := strings.Split(s, ",")
+	if len(fields) > 3 {
+		return sharpen, fmt.Errorf("invalid sharpen %q: must be amount,radius,threshold", s)
+	}
+	var err error
+	if sharpen.Amount, err = strconv.ParseFloat(strings.TrimSpace(fields[0]), 64); err != nil || sharpen.Amount <= 0 || sharpen.Amount > 5 {
+		return sharpen, fmt.Errorf("invalid sharpen amount %q: must be above 0 and at most 5", fields[0])
+	}
+	if len(fields) > 1 {
+		if sharpen.Radius, err = strconv.ParseFloat(strings.TrimSpace(fields[1]), 64); err != nil || sharpen.Radius < 0.1 || sharpen.Radius > 50 {
+			return sharpen, fmt.Errorf("invalid sharpen radius %q: must be between 0.1 and 50 pixels", fields[1])
+		}
+	}
+	if len(fields) > 2 {
+		if sharpen.Threshold, err = strconv.Atoi(strings.TrimSpace(fields[2])); err != nil || sharpen.Threshold < 0 || sharpen.Threshold > 255 {
+			return sharpen, fmt.Errorf("invalid sharpen threshold %q: must be between 0 and 255", fields[2])
+		}
+	}
+	return sharpen, nil
+}
+
+// gaussianKernel is a Gaussian blur of standard deviation sigma pixels, cut
+// off at three of them, for resamplePlane at scale 1.
+func gaussianKernel(sigma float64) resampleKernel {
+	return resampleKernel{3 * sigma, func(x float64) float64 {
+		return math.Exp(-x * x / (2 * sigma * sigma))
+	}}
+}
+
+// sharpenImage applies s to img, splitting the work over threads strips of
+// rows. YCbCr and gray images are sharpened in their luma alone, which
+// leaves no color fringes; others as RGBA without touching alpha.
+func sharpenImage(img image.Image, s Sharpen, threads int) image.Image {
+	kernel := gaussianKernel(s.Radius)
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	switch src := img.(type) {
+	case *image.YCbCr:
+		if shift, ok := chromaShift[src.SubsampleRatio]; ok && src.Rect.Min == (image.Point{}) {
+			dst := newPooledYCbCr(width, height, src.SubsampleRatio)
+			cw, ch := (width+shift.X)>>shift.X, (height+shift.Y)>>shift.Y
+			for y := 0; y < ch; y++ {
+				copy(dst.Cb[y*dst.CStride:y*dst.CStride+cw], src.Cb[y*src.CStride:])
+				copy(dst.Cr[y*dst.CStride:y*dst.CStride+cw], src.Cr[y*src.CStride:])
+			}
+			unsharpPlane(src.Y, src.YStride, dst.Y, dst.YStride, width, height, 1, kernel, s, threads)
+			return dst
+		}
+	case *image.Gray:
+		dst := newPooledGray(image.Rect(0, 0, width, height))
+		unsharpPlane(src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y):], src.Stride, dst.Pix, dst.Stride, width, height, 1, kernel, s, threads)
+		return dst
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = newPooledRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+		defer recycleImage(rgba)
+	}
+	dst := newPooledRGBA(image.Rect(0, 0, width, height))
+	unsharpPlane(rgba.Pix[rgba.PixOffset(rgba.Rect.Min.X, rgba.Rect.Min.Y):], rgba.Stride, dst.Pix, dst.Stride, width, height, 4, kernel, s, threads)
+	return dst
+}
+
+// unsharpPlane writes the unsharp mask of a plane of width x height pixels
+// of channels bytes into dst. With four channels the fourth is alpha, copied
+// as is and bounding the premultiplied colors.
+func unsharpPlane(src []byte, srcStride int, dst []byte, dstStride, width, height, channels int, kernel resampleKernel, s Sharpen, threads int) {
+	rowBytes := width * channels
+	blurred := getPixels(rowBytes * height)
+	defer putPixels(blurred)
+	resamplePlane(src, srcStride, width, height, blurred, rowBytes, width, height, channels, kernel, threads)
+
+	amount := int32(math.Round(s.Amount * 256))
+	threshold := int32(s.Threshold)
+	parallelRows(height, threads, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := src[y*srcStride : y*srcStride+rowBytes]
+			blur := blurred[y*rowBytes : (y+1)*rowBytes]
+			out := dst[y*dstStride : y*dstStride+rowBytes]
+			for i, v := range row {
+				limit := int32(255)
+				if channels == 4 {
+					if i&3 == 3 {
+						out[i] = v
+						continue
+					}
+					limit = int32(row[i|3])
+				}
+				d := int32(v) - int32(blur[i])
+				if d <= threshold && -d <= threshold {
+					out[i] = v
+					continue
+				}
+				x := int32(v) + (amount*d+128)>>8
+				if x < 0 {
+					x = 0
+				} else if x > limit {
+					x = limit
+				}
+				out[i] = uint8(x)
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package compressor
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NameTemplatePlaceholders lists the placeholders of Options.NameTemplate.
+// Those shared with watermark text are expanded the same way; see
+// expandWatermarkText.
+var NameTemplatePlaceholders = map[string]bool{
+	"basename": true,
+	"filename": true,
+	"dir":      true,
+	"ext":      true, // of the output, without the dot
+	"width":    true, // of the output
+	"height":   true,
+	"quality":  true, // JPEG quality
+	"index":    true, // 1-based position of the file in the plan, {index:4} zero padded
+	"date":     true, // EXIF capture time, else modification time; {date:<go layout>}
+}
+
+// ValidateNameTemplate checks that template only names files, with known
+// placeholders and no folders.
+func ValidateNameTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("name template is empty")
+	}
+	if strings.ContainsAny(template, `/\`) {
+		return fmt.Errorf("name template %q must not contain folders", template)
+	}
+	for rest := template; ; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			return nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("unclosed placeholder in name template %q", template)
+		}
+		name := rest[start+1 : start+end]
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name = name[:i]
+		}
+		if !NameTemplatePlaceholders[name] {
+			return fmt.Errorf("unknown placeholder {%s} in name template %q", name, template)
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// templatedOutputPath renames output, planned for path as the index-th file,
+// after opts.NameTemplate in the same folder.
+func templatedOutputPath(output, path string, info os.FileInfo, index int, opts Options) string {
+	width, height, _ := outputDimensions(path, opts)
+	name := expandWatermarkText(opts.NameTemplate, path, index, fileDate(path, info, "exif"))
+	name = strings.NewReplacer(
+		"{ext}", strings.TrimPrefix(filepath.Ext(output), "."),
+		"{width}", strconv.Itoa(width),
+		"{height}", strconv.Itoa(height),
+		"{quality}", strconv.Itoa(opts.JPEGQuality),
+	).Replace(name)
+	return filepath.Join(filepath.Dir(output), name)
+}
+
+// outputDimensions works out the size of the output of path from its header:
+// oriented, scaled to the limits of opts and cropped as compressFile would.
+func outputDimensions(path string, opts Options) (int, int, error) {
+	var width, height int
+	var err error
+	if IsRawFile(path) && opts.RawMode != "full" {
+		data, readErr := ioutil.ReadFile(path)
+		if readErr != nil {
+			return 0, 0, readErr
+		}
+		preview, previewErr := extractRawPreview(data)
+		if previewErr != nil {
+			return 0, 0, previewErr
+		}
+		cfg, configErr := jpeg.DecodeConfig(bytes.NewReader(preview))
+		width, height, err = cfg.Width, cfg.Height, configErr
+		if opts.AutoOrient && exifOrientation(data) >= 5 {
+			width, height = height, width
+		}
+	} else {
+		width, height, err = imageDimensions(path)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if opts.AutoOrient && !IsRawFile(path) && exifOrientation(readExifHead(path)) >= 5 {
+		width, height = height, width // rotated by 90 degrees
+	}
+	if scale := resizeScale(width, height, opts); scale < 1 {
+		w, h := scaledSize(width, height, scale)
+		width, height = int(w), int(h)
+	}
+	if opts.CropWidth > 0 {
+		_, _, width, height = cropSize(width, height, opts.CropWidth, opts.CropHeight)
+	}
+	return width, height, nil
+}
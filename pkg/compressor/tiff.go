@@ -0,0 +1,192 @@
+package compressor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// TIFF tags used when walking RAW and EXIF structures.
+const (
+	tagCompression           = 0x0103
+	tagStripOffsets          = 0x0111
+	tagStripByteCounts       = 0x0117
+	tagSubIFDs               = 0x014A
+	tagJPEGInterchangeFormat = 0x0201
+	tagJPEGInterchangeLength = 0x0202
+)
+
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+type tiffEntry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset int // position of the value (inline or out-of-line) within the TIFF data
+}
+
+type tiffIFD struct {
+	offset  int
+	entries []tiffEntry
+	next    uint32
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("tiff header too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order")
+	}
+	if order.Uint16(data[2:4]) != 42 {
+		return nil, fmt.Errorf("invalid tiff magic")
+	}
+	return &tiffReader{data: data, order: order}, nil
+}
+
+func (t *tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:8])
+}
+
+func (t *tiffReader) readIFD(offset uint32) (*tiffIFD, error) {
+	start := int(offset)
+	if start < 0 || start+2 > len(t.data) {
+		return nil, fmt.Errorf("ifd offset %d out of range", offset)
+	}
+	count := int(t.order.Uint16(t.data[start:]))
+	end := start + 2 + count*12
+	if end+4 > len(t.data) {
+		return nil, fmt.Errorf("ifd at %d truncated", offset)
+	}
+
+	ifd := &tiffIFD{offset: start, next: t.order.Uint32(t.data[end:])}
+	for i := 0; i < count; i++ {
+		p := start + 2 + i*12
+		e := tiffEntry{
+			tag:    t.order.Uint16(t.data[p:]),
+			typ:    t.order.Uint16(t.data[p+2:]),
+			count:  t.order.Uint32(t.data[p+4:]),
+			offset: p + 8,
+		}
+		if size := tiffTypeSizes[e.typ] * int(e.count); size > 4 {
+			e.offset = int(t.order.Uint32(t.data[p+8:]))
+		}
+		ifd.entries = append(ifd.entries, e)
+	}
+	return ifd, nil
+}
+
+func (ifd *tiffIFD) find(tag uint16) (tiffEntry, bool) {
+	for _, e := range ifd.entries {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return tiffEntry{}, false
+}
+
+// uints returns the integer values of a BYTE, SHORT or LONG entry.
+func (t *tiffReader) uints(e tiffEntry) []uint32 {
+	size := tiffTypeSizes[e.typ]
+	if size == 0 || e.offset < 0 || e.offset+size*int(e.count) > len(t.data) {
+		return nil
+	}
+	values := make([]uint32, e.count)
+	for i := range values {
+		p := e.offset + i*size
+		switch e.typ {
+		case 1, 6, 7:
+			values[i] = uint32(t.data[p])
+		case 3, 8:
+			values[i] = uint32(t.order.Uint16(t.data[p:]))
+		case 4, 9, 13:
+			values[i] = t.order.Uint32(t.data[p:])
+		default:
+			return nil
+		}
+	}
+	return values
+}
+
+func (t *tiffReader) uint(ifd *tiffIFD, tag uint16) (uint32, bool) {
+	e, ok := ifd.find(tag)
+	if !ok {
+		return 0, false
+	}
+	values := t.uints(e)
+	if len(values) == 0 {
+		return 0, false
+	}
+	return values[0], true
+}
+
+// number returns the first value of an integer or (signed) RATIONAL entry.
+func (t *tiffReader) number(ifd *tiffIFD, tag uint16) (float64, bool) {
+	e, ok := ifd.find(tag)
+	if !ok {
+		return 0, false
+	}
+	if e.typ != 5 && e.typ != 10 {
+		values := t.uints(e)
+		if len(values) == 0 {
+			return 0, false
+		}
+		return float64(values[0]), true
+	}
+	if e.count == 0 || e.offset < 0 || e.offset+8 > len(t.data) {
+		return 0, false
+	}
+	num, den := t.order.Uint32(t.data[e.offset:]), t.order.Uint32(t.data[e.offset+4:])
+	if den == 0 {
+		return 0, false
+	}
+	if e.typ == 10 {
+		return float64(int32(num)) / float64(int32(den)), true
+	}
+	return float64(num) / float64(den), true
+}
+
+func (t *tiffReader) ascii(ifd *tiffIFD, tag uint16) (string, bool) {
+	e, ok := ifd.find(tag)
+	if !ok || e.typ != 2 || e.offset < 0 || e.offset+int(e.count) > len(t.data) {
+		return "", false
+	}
+	return strings.TrimRight(string(t.data[e.offset:e.offset+int(e.count)]), "\x00 "), true
+}
+
+// walk visits every IFD reachable from the header through the IFD chain and
+// SubIFD pointers, guarding against loops in malformed files.
+func (t *tiffReader) walk(visit func(*tiffIFD)) {
+	seen := make(map[uint32]bool)
+	var follow func(offset uint32, depth int)
+	follow = func(offset uint32, depth int) {
+		for offset != 0 && !seen[offset] && depth < 8 {
+			seen[offset] = true
+			ifd, err := t.readIFD(offset)
+			if err != nil {
+				return
+			}
+			visit(ifd)
+			if e, ok := ifd.find(tagSubIFDs); ok {
+				for _, sub := range t.uints(e) {
+					follow(sub, depth+1)
+				}
+			}
+			offset = ifd.next
+		}
+	}
+	follow(t.firstIFD(), 0)
+}
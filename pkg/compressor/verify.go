@@ -0,0 +1,45 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"os"
+)
+
+// verifyOutputs reads back every output and the thumbnail of a compressed
+// file and decodes them in full, checking the first output has the
+// dimensions it was encoded with.
+func verifyOutputs(result *FileResult) error {
+	for i, path := range result.Outputs {
+		width, height, err := decodeDimensions(path)
+		if err != nil {
+			return fmt.Errorf("failed to verify %s: %w", path, err)
+		}
+		if i == 0 && result.OutputWidth > 0 && (width != result.OutputWidth || height != result.OutputHeight) {
+			return fmt.Errorf("failed to verify %s: decodes as %dx%d, encoded as %dx%d", path, width, height, result.OutputWidth, result.OutputHeight)
+		}
+	}
+	if result.Thumbnail != "" {
+		if _, _, err := decodeDimensions(result.Thumbnail); err != nil {
+			return fmt.Errorf("failed to verify %s: %w", result.Thumbnail, err)
+		}
+	}
+	result.Verified = true
+	return nil
+}
+
+func decodeDimensions(path string) (int, int, error) {
+	if IsPDFFile(path) {
+		return 0, 0, decodeFile(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to decode image: %v", err)
+	}
+	return img.Bounds().Dx(), img.Bounds().Dy(), nil
+}
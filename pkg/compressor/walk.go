@@ -0,0 +1,358 @@
+package compressor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsSupportedImage reports whether name has a JPEG, PNG, RAW or PDF
+// extension.
+func IsSupportedImage(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasSuffix(lower, ".jpg") || strings.HasSuffix(lower, ".png") || IsRawFile(lower) || IsPDFFile(lower)
+}
+
+// OutputPath mirrors the location of path below inputDir into outputDir.
+// RAW inputs are written as JPEG unless convertTo selects another format;
+// PDFs stay PDFs.
+func OutputPath(path, inputDir, outputDir, convertTo string) string {
+	outputFile := filepath.Join(outputDir, strings.TrimPrefix(path, inputDir))
+	ext := filepath.Ext(outputFile)
+	newExt := ext
+	if convertTo != "" && !IsPDFFile(path) {
+		newExt = FormatExtensions[convertTo]
+	} else if IsRawFile(path) {
+		newExt = ".jpg"
+	}
+	return strings.TrimSuffix(outputFile, ext) + "_compressed" + newExt
+}
+
+// PlannedOutputPath is the output Plan gives path as the index-th file:
+// OutputPath, in the YYYY/MM/DD folder of outputDir for the date of the image
+// with opts.OrganizeByDate (see datedOutputPath) or directly in outputDir
+// with opts.Flatten, and named after opts.NameTemplate if set. Of a path
+// that does not exist, only the folder and name it would get are planned.
+func PlannedOutputPath(path, inputDir, outputDir string, index int, opts Options) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		if opts.Flatten {
+			inputDir = filepath.Dir(path)
+		}
+		return OutputPath(path, inputDir, outputDir, opts.ConvertTo)
+	}
+	return plannedOutputPath(path, info, inputDir, outputDir, index, opts)
+}
+
+func plannedOutputPath(path string, info os.FileInfo, inputDir, outputDir string, index int, opts Options) string {
+	output := OutputPath(path, inputDir, outputDir, opts.ConvertTo)
+	switch {
+	case opts.OrganizeByDate:
+		output = datedOutputPath(path, info, outputDir, opts.ConvertTo)
+	case opts.Flatten:
+		output = OutputPath(path, filepath.Dir(path), outputDir, opts.ConvertTo)
+	}
+	if opts.NameTemplate != "" {
+		output = templatedOutputPath(output, path, info, index, opts)
+	}
+	return output
+}
+
+// datedOutputPath names the output of path in a YYYY/MM/DD folder of
+// outputDir for the EXIF capture time of the image, or its modification time
+// without one, instead of mirroring the input tree.
+func datedOutputPath(path string, info os.FileInfo, outputDir, convertTo string) string {
+	date := fileDate(path, info, "exif")
+	return OutputPath(path, filepath.Dir(path), filepath.Join(outputDir, date.Format("2006"), date.Format("01"), date.Format("02")), convertTo)
+}
+
+// variantPath names the width-limited variant of a compressed output, e.g.
+// photo_compressed.jpg becomes photo_640.jpg.
+func variantPath(outputPath string, width int) string {
+	ext := filepath.Ext(outputPath)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(outputPath, "_compressed"+ext), width, ext)
+}
+
+// LastOutput returns the file written last for output: the widest -sizes
+// variant, or output itself, which PDFs always write. Once it exists the file
+// is compressed.
+func LastOutput(output string, opts Options) string {
+	if len(opts.Sizes) > 0 && !IsPDFFile(output) {
+		return variantPath(output, opts.Sizes[len(opts.Sizes)-1])
+	}
+	return output
+}
+
+// SymlinkPolicies lists what Options.OutsideSymlinks can do with a symlink,
+// followed with Options.FollowSymlinks, whose target is outside the input
+// tree: skip it, copy the link itself into the output tree, or follow it.
+var SymlinkPolicies = map[string]bool{
+	"skip":      true,
+	"copy-link": true,
+	"follow":    true,
+}
+
+// numberedPath inserts n before the _compressed suffix of outputPath, e.g.
+// photo_compressed.jpg becomes photo_2_compressed.jpg, or before the
+// extension of names without one.
+func numberedPath(outputPath string, n int) string {
+	ext := filepath.Ext(outputPath)
+	if base := strings.TrimSuffix(outputPath, "_compressed"+ext); base != outputPath {
+		return fmt.Sprintf("%s_%d_compressed%s", base, n, ext)
+	}
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(outputPath, ext), n, ext)
+}
+
+// PlannedFile is a supported image found by Plan and what a run would do
+// with it.
+type PlannedFile struct {
+	Path   string
+	Output string
+	Size   int64
+	Action string // "compress", "overwrite" (an output already exists), "link" or "skip"
+	Reason string // why the file is skipped
+	Link   string // absolute target of a symlink copied by CopyLink
+	// Conflict is the file whose output name this one would have shared,
+	// ignoring case; Output then has a numeric suffix, e.g. photo_2_compressed.jpg
+	Conflict string
+	TooSmall bool // skipped by Options.MinSize or MinPixels
+}
+
+// Plan lists the supported images below folderPath and whether each still
+// needs compressing. With a manifest that means every file it doesn't record
+// as done; otherwise files with no output in outputFolder yet. Output folders
+// of earlier runs are skipped.
+//
+// Files whose outputs would collide, such as a.png and a.PNG, a.jpg and
+// a.dng, or photos of the same name and day with opts.OrganizeByDate (or of
+// the same name with opts.Flatten), are given numbered output names in walk
+// order; see PlannedFile.Conflict.
+//
+// Only files selected by opts.PathFilter are compressed; folders it excludes
+// entirely are not walked. Images under opts.MinSize bytes or opts.MinPixels
+// pixels are skipped as too small, with opts.Since or opts.Until those
+// dated outside the range, and those opts.ExifFilter does not select.
+//
+// Symlinked images are compressed like the files they point to. Symlinked
+// folders are only entered with opts.FollowSymlinks, which skips links back
+// into a folder being walked and applies opts.OutsideSymlinks to links leaving
+// the input tree.
+func Plan(folderPath, outputFolder string, opts Options, manifest *Manifest) ([]PlannedFile, error) {
+	var files []PlannedFile
+
+	// taken maps each lowercased output path to the file it was planned for
+	taken := make(map[string]string)
+	var selected int // images passing the filters so far, for {index}
+	addImage := func(path string, info os.FileInfo) {
+		if opts.MinSize > 0 && info.Size() < opts.MinSize {
+			files = append(files, PlannedFile{Path: path, Size: info.Size(), Action: "skip", Reason: "smaller than " + HumanReadableSize(opts.MinSize), TooSmall: true})
+			return
+		}
+		if opts.MinPixels > 0 {
+			// Files whose header can't be read are left to fail when compressed
+			if width, height, err := imageDimensions(path); err == nil && width*height < opts.MinPixels {
+				files = append(files, PlannedFile{Path: path, Size: info.Size(), Action: "skip", Reason: fmt.Sprintf("%dx%d is under %d pixels", width, height, opts.MinPixels), TooSmall: true})
+				return
+			}
+		}
+		if !opts.Since.IsZero() || !opts.Until.IsZero() {
+			date := fileDate(path, info, opts.DateSource)
+			if date.Before(opts.Since) || (!opts.Until.IsZero() && !date.Before(opts.Until)) {
+				files = append(files, PlannedFile{Path: path, Size: info.Size(), Action: "skip", Reason: "dated " + date.Format("2006-01-02") + ", outside the date range"})
+				return
+			}
+		}
+		if opts.ExifFilter != nil {
+			if reason := opts.ExifFilter.Reason(readExifHead(path)); reason != "" {
+				files = append(files, PlannedFile{Path: path, Size: info.Size(), Action: "skip", Reason: reason})
+				return
+			}
+		}
+		selected++
+		file := PlannedFile{Path: path, Output: plannedOutputPath(path, info, folderPath, outputFolder, selected, opts), Size: info.Size(), Action: "compress"}
+		// Outputs gathered from many folders, whose originals were moved away
+		// after earlier runs, are numbered past those runs' outputs too
+		shared := (opts.Flatten || opts.OrganizeByDate) && manifest == nil
+		base := file.Output
+		for n := 2; ; n++ {
+			first, ok := taken[strings.ToLower(file.Output)]
+			if !ok {
+				if _, err := os.Stat(LastOutput(file.Output, opts)); !shared || err != nil {
+					break
+				}
+			} else if file.Conflict == "" {
+				file.Conflict = first
+			}
+			file.Output = numberedPath(base, n)
+		}
+		taken[strings.ToLower(file.Output)] = path
+		_, statErr := os.Stat(LastOutput(file.Output, opts))
+		exists := statErr == nil
+
+		switch {
+		case manifest != nil && manifest.Done(path):
+			file.Action, file.Reason = "skip", "done in manifest"
+		case manifest == nil && exists:
+			file.Action, file.Reason = "skip", "output exists"
+		case exists:
+			file.Action = "overwrite"
+		}
+		files = append(files, file)
+	}
+
+	info, err := os.Stat(folderPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk the directory: %v", err)
+	}
+	if !info.IsDir() {
+		if IsSupportedImage(info.Name()) {
+			addImage(folderPath, info)
+		}
+		return files, nil
+	}
+	root, err := filepath.EvalSymlinks(folderPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk the directory: %v", err)
+	}
+	root, _ = filepath.Abs(root)
+
+	// walking holds the real paths of the folders being walked, to detect
+	// symlink loops, and planned those of the images found so far, so a file
+	// reached through several links is only compressed once, preferably
+	// under its own path
+	type plannedImage struct {
+		index  int
+		linked bool
+	}
+	walking := make(map[string]bool)
+	planned := make(map[string]plannedImage)
+	var walk func(dir, realDir string, dirLinked bool) error
+	walk = func(dir, realDir string, dirLinked bool) error {
+		walking[realDir] = true
+		defer delete(walking, realDir)
+
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range entries {
+			path := filepath.Join(dir, info.Name())
+			realPath := filepath.Join(realDir, info.Name())
+			linked := dirLinked
+			rel := filepath.ToSlash(strings.TrimPrefix(strings.TrimPrefix(path, folderPath), string(filepath.Separator)))
+			if !info.IsDir() && IsSupportedImage(info.Name()) {
+				if reason := opts.PathFilter.Reason(rel); reason != "" {
+					files = append(files, PlannedFile{Path: path, Size: info.Size(), Action: "skip", Reason: reason})
+					continue
+				}
+			}
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					if IsSupportedImage(info.Name()) {
+						files = append(files, PlannedFile{Path: path, Action: "skip", Reason: "broken symlink"})
+					}
+					continue
+				}
+				target, _ = filepath.Abs(target)
+				targetInfo, err := os.Stat(target)
+				if err != nil {
+					continue
+				}
+				if targetInfo.IsDir() && !opts.FollowSymlinks {
+					continue
+				}
+				if opts.FollowSymlinks && !withinDir(root, target) {
+					switch opts.OutsideSymlinks {
+					case "copy-link":
+						if targetInfo.IsDir() || IsSupportedImage(info.Name()) {
+							output := filepath.Join(outputFolder, strings.TrimPrefix(path, folderPath))
+							if !targetInfo.IsDir() {
+								output = OutputPath(path, folderPath, outputFolder, opts.ConvertTo)
+							}
+							files = append(files, PlannedFile{Path: path, Output: output, Action: "link", Link: target})
+						}
+						continue
+					case "follow":
+					default:
+						if IsSupportedImage(info.Name()) {
+							files = append(files, PlannedFile{Path: path, Action: "skip", Reason: "symlink outside the input tree"})
+						}
+						continue
+					}
+				}
+				info, realPath, linked = targetInfo, target, true
+			}
+
+			if info.IsDir() {
+				if info.Name() == "compressed_files" || info.Name() == "processed_files" || info.Name() == "backup_files" || path == outputFolder {
+					continue
+				}
+				if opts.PathFilter.SkipDir(rel) {
+					continue
+				}
+				if walking[realPath] {
+					continue // a symlink back into a folder being walked
+				}
+				if err := walk(path, realPath, linked); err != nil {
+					return err
+				}
+				continue
+			}
+			if IsSupportedImage(info.Name()) {
+				if first, ok := planned[realPath]; ok {
+					if linked || !first.linked {
+						files = append(files, PlannedFile{Path: path, Action: "skip", Reason: "same file as " + files[first.index].Path})
+						continue
+					}
+					files[first.index].Action, files[first.index].Reason = "skip", "same file as "+path
+				}
+				planned[realPath] = plannedImage{index: len(files), linked: linked}
+				addImage(path, info)
+			}
+		}
+		return nil
+	}
+	if err := walk(folderPath, root, false); err != nil {
+		return nil, fmt.Errorf("failed to walk the directory: %v", err)
+	}
+
+	return files, nil
+}
+
+// withinDir reports whether path is dir or below it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// CopyLink recreates a symlink planned with the "link" action at its output
+// path, pointing at the same target.
+func CopyLink(file PlannedFile) error {
+	if err := os.MkdirAll(filepath.Dir(file.Output), os.ModePerm); err != nil {
+		return err
+	}
+	os.Remove(file.Output)
+	return os.Symlink(file.Link, file.Output)
+}
+
+// Walk returns the files Plan would compress, and their total size.
+func Walk(folderPath, outputFolder string, opts Options, manifest *Manifest) ([]string, int64, error) {
+	files, err := Plan(folderPath, outputFolder, opts, manifest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var totalSize int64
+	var filePaths []string
+	for _, file := range files {
+		if file.Action != "skip" {
+			totalSize += file.Size
+			filePaths = append(filePaths, file.Path)
+		}
+	}
+	return filePaths, totalSize, nil
+}
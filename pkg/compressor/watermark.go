@@ -0,0 +1,360 @@
+package compressor
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-text/typesetting/font"
+	"github.com/nfnt/resize"
+)
+
+// Watermark describes the text and/or logo stamped onto each image.
+type Watermark struct {
+	Text       string
+	Fonts      []*font.Font // in fallback order; see LoadFonts
+	Image      image.Image  // logo composited over each image; nil disables it
+	ImageScale float64      // logo width as a fraction of the image width
+	Position   string       // one of WatermarkPositions
+	Margin     int          // distance in pixels from the nearest edges
+	Size       WatermarkSize
+	Color      color.NRGBA
+	Opacity    float64 // 0 (invisible) to 1 (opaque), applied to text and logo
+	Tile       bool    // repeat the text across the whole image
+	TileAngle  float64 // tile rotation in degrees, counter-clockwise
+	TileGap    int     // pixels between repeated texts
+
+	OutlineWidth int // 0 disables the outline
+	OutlineColor color.NRGBA
+	ShadowOffset int // 0 disables the drop shadow
+	ShadowColor  color.NRGBA
+
+	AutoContrast string      // "", "color" or "box"; see applyAutoContrast
+	BoxColor     color.NRGBA // backing box behind the text; transparent disables it
+}
+
+// AutoContrastModes lists the accepted Watermark.AutoContrast values.
+var AutoContrastModes = map[string]bool{"": true, "off": true, "color": true, "box": true}
+
+// WatermarkSize is a font size in points, or a percentage of the image width
+// when relative is set.
+type WatermarkSize struct {
+	Value    float64
+	Relative bool
+}
+
+// ParseWatermarkSize parses a size such as "20" (points) or "5%".
+func ParseWatermarkSize(s string) (WatermarkSize, error) {
+	size := WatermarkSize{Relative: strings.HasSuffix(s, "%")}
+	value, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || value <= 0 {
+		return size, fmt.Errorf("invalid watermark size %q", s)
+	}
+	size.Value = value
+	return size, nil
+}
+
+func (s WatermarkSize) points(imageWidth int) float64 {
+	if s.Relative {
+		return float64(imageWidth) * s.Value / 100
+	}
+	return s.Value
+}
+
+// WatermarkPositions lists the accepted Watermark.Position values.
+var WatermarkPositions = map[string]bool{"tl": true, "tr": true, "bl": true, "br": true, "center": true}
+
+// expandWatermarkText replaces {name} and {name:arg} placeholders in text:
+// {filename} and {basename} (without extension), {dir}, {index:width} and
+// {date:layout} with a Go time layout. Unknown placeholders are left intact.
+func expandWatermarkText(text, path string, index int, date time.Time) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(text, '{')
+		end := strings.IndexByte(text[start+1:], '}')
+		if start < 0 || end < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		end += start + 1
+		b.WriteString(text[:start])
+
+		name, arg := text[start+1:end], ""
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			name, arg = name[:i], name[i+1:]
+		}
+		switch name {
+		case "filename":
+			b.WriteString(filepath.Base(path))
+		case "basename":
+			b.WriteString(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+		case "dir":
+			b.WriteString(filepath.Base(filepath.Dir(path)))
+		case "index":
+			width, _ := strconv.Atoi(arg)
+			fmt.Fprintf(&b, "%0*d", width, index)
+		case "date":
+			if arg == "" {
+				arg = "2006-01-02"
+			}
+			b.WriteString(date.Format(arg))
+		default:
+			b.WriteString(text[start : end+1])
+		}
+		text = text[end+1:]
+	}
+}
+
+// watermarkOrigin returns the top-left corner of a watermark of the given
+// size placed inside canvas.
+func watermarkOrigin(canvas image.Rectangle, size image.Point, position string, margin int) image.Point {
+	left := canvas.Min.X + margin
+	right := canvas.Max.X - size.X - margin
+	top := canvas.Min.Y + margin
+	bottom := canvas.Max.Y - size.Y - margin
+
+	switch position {
+	case "tl":
+		return image.Pt(left, top)
+	case "tr":
+		return image.Pt(right, top)
+	case "bl":
+		return image.Pt(left, bottom)
+	case "center":
+		return image.Pt(canvas.Min.X+(canvas.Dx()-size.X)/2, canvas.Min.Y+(canvas.Dy()-size.Y)/2)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
+
+func addWatermark(img image.Image, wm Watermark) (image.Image, error) {
+	rgba := newPooledRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, image.Point{}, draw.Src)
+
+	fontSize := wm.Size.points(rgba.Bounds().Dx())
+	size := textStampSize(wm, fontSize)
+	origin := watermarkOrigin(rgba.Bounds(), size, wm.Position, wm.Margin)
+	if wm.AutoContrast == "color" || wm.AutoContrast == "box" {
+		region := image.Rectangle{origin, origin.Add(size)}
+		if wm.Tile {
+			region = rgba.Bounds()
+		}
+		wm = applyAutoContrast(wm, averageLuminance(rgba, region))
+	}
+
+	stamp := textStamp(wm, fontSize)
+	if wm.Tile {
+		drawTiled(rgba, stamp, wm.TileAngle, wm.TileGap)
+		return rgba, nil
+	}
+	draw.Draw(rgba, image.Rectangle{origin, origin.Add(size)}, stamp, image.Point{}, draw.Over)
+	return rgba, nil
+}
+
+// averageLuminance returns the mean Rec. 601 luma (0-255) of img within r.
+func averageLuminance(img *image.RGBA, r image.Rectangle) float64 {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return 0
+	}
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			p := img.PixOffset(x, y)
+			sum += 0.299*float64(img.Pix[p]) + 0.587*float64(img.Pix[p+1]) + 0.114*float64(img.Pix[p+2])
+		}
+	}
+	return sum / float64(r.Dx()*r.Dy())
+}
+
+// minContrast is the luma difference below which "box" mode backs the text.
+const minContrast = 96
+
+// applyAutoContrast picks black text on bright backgrounds and white text on
+// dark ones. In "box" mode the text keeps its color and, when it is too close
+// to the background, sits on a translucent box contrasting with it instead.
+func applyAutoContrast(wm Watermark, luminance float64) Watermark {
+	dark := color.NRGBA{A: wm.Color.A}
+	light := color.NRGBA{R: 255, G: 255, B: 255, A: wm.Color.A}
+
+	if wm.AutoContrast == "box" {
+		textLuma := 0.299*float64(wm.Color.R) + 0.587*float64(wm.Color.G) + 0.114*float64(wm.Color.B)
+		if math.Abs(textLuma-luminance) >= minContrast {
+			return wm
+		}
+		if textLuma < 128 {
+			wm.BoxColor = color.NRGBA{R: 255, G: 255, B: 255, A: 0x99}
+		} else {
+			wm.BoxColor = color.NRGBA{A: 0x99}
+		}
+		return wm
+	}
+
+	if luminance >= 128 {
+		wm.Color = dark
+		wm.OutlineColor.R, wm.OutlineColor.G, wm.OutlineColor.B = 255, 255, 255
+	} else {
+		wm.Color = light
+		wm.OutlineColor.R, wm.OutlineColor.G, wm.OutlineColor.B = 0, 0, 0
+	}
+	return wm
+}
+
+// stampPadding is the free space around the text needed by the outline,
+// shadow and backing box.
+func stampPadding(wm Watermark, size float64) int {
+	pad := wm.OutlineWidth + wm.ShadowOffset
+	if wm.AutoContrast == "box" {
+		pad += int(size/4) + 1
+	}
+	return pad
+}
+
+func textStampSize(wm Watermark, size float64) image.Point {
+	pad := stampPadding(wm, size)
+	return shapeText(wm.Fonts, wm.Text, size).size().Add(image.Pt(2*pad, 2*pad))
+}
+
+// textMask renders text into an alpha mask holding it with pad pixels of
+// free space on every side.
+func textMask(fonts []*font.Font, text string, size float64, pad int) *image.Alpha {
+	shaped := shapeText(fonts, text, size)
+	mask := image.NewAlpha(image.Rectangle{Max: shaped.size().Add(image.Pt(2*pad, 2*pad))})
+	shaped.draw(mask, pad)
+	return mask
+}
+
+// dilateMask grows the shapes in mask by radius pixels, producing an outline
+// once the original mask is drawn on top.
+func dilateMask(mask *image.Alpha, radius int) *image.Alpha {
+	out := image.NewAlpha(mask.Rect)
+	w, h := mask.Rect.Dx(), mask.Rect.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var max uint8
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					px, py := x+dx, y+dy
+					if dx*dx+dy*dy > radius*radius || px < 0 || py < 0 || px >= w || py >= h {
+						continue
+					}
+					if v := mask.Pix[py*mask.Stride+px]; v > max {
+						max = v
+					}
+				}
+			}
+			out.Pix[y*out.Stride+x] = max
+		}
+	}
+	return out
+}
+
+// textStamp renders the watermark text, with its optional shadow and outline,
+// into a transparent image with wm.Opacity already applied.
+func textStamp(wm Watermark, size float64) *image.RGBA {
+	mask := textMask(wm.Fonts, wm.Text, size, stampPadding(wm, size))
+	shape := mask
+	if wm.OutlineWidth > 0 {
+		shape = dilateMask(mask, wm.OutlineWidth)
+	}
+
+	stamp := image.NewRGBA(mask.Rect)
+	if wm.BoxColor.A > 0 {
+		draw.Draw(stamp, stamp.Bounds(), image.NewUniform(wm.BoxColor), image.Point{}, draw.Src)
+	}
+	if wm.ShadowOffset > 0 {
+		offset := image.Pt(wm.ShadowOffset, wm.ShadowOffset)
+		draw.DrawMask(stamp, stamp.Bounds().Add(offset), image.NewUniform(wm.ShadowColor), image.Point{}, shape, image.Point{}, draw.Over)
+	}
+	if wm.OutlineWidth > 0 {
+		draw.DrawMask(stamp, stamp.Bounds(), image.NewUniform(wm.OutlineColor), image.Point{}, shape, image.Point{}, draw.Over)
+	}
+	draw.DrawMask(stamp, stamp.Bounds(), image.NewUniform(wm.Color), image.Point{}, mask, image.Point{}, draw.Over)
+
+	if wm.Opacity < 1 {
+		for i := range stamp.Pix {
+			stamp.Pix[i] = uint8(float64(stamp.Pix[i]) * wm.Opacity)
+		}
+	}
+	return stamp
+}
+
+// sampleRGBA bilinearly samples the premultiplied stamp at a fractional
+// position, treating everything outside it as transparent.
+func sampleRGBA(stamp *image.RGBA, x, y float64) [4]float64 {
+	x, y = x-0.5, y-0.5
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	var out [4]float64
+	add := func(px, py int, weight float64) {
+		if weight == 0 || px < 0 || py < 0 || px >= stamp.Rect.Dx() || py >= stamp.Rect.Dy() {
+			return
+		}
+		p := py*stamp.Stride + px*4
+		for c := 0; c < 4; c++ {
+			out[c] += float64(stamp.Pix[p+c]) * weight
+		}
+	}
+	add(x0, y0, (1-fx)*(1-fy))
+	add(x0+1, y0, fx*(1-fy))
+	add(x0, y0+1, (1-fx)*fy)
+	add(x0+1, y0+1, fx*fy)
+	return out
+}
+
+// drawTiled repeats stamp over the whole of dst in staggered rows rotated by
+// angle degrees.
+func drawTiled(dst *image.RGBA, stamp *image.RGBA, angle float64, gap int) {
+	cellW := float64(stamp.Rect.Dx() + gap)
+	cellH := float64(stamp.Rect.Dy() + gap)
+	if cellW <= 0 || cellH <= 0 {
+		return
+	}
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+
+	bounds := dst.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Map the pixel into the unrotated tile pattern
+			u := float64(x)*cos - float64(y)*sin
+			v := float64(x)*sin + float64(y)*cos
+			row := math.Floor(v / cellH)
+			u -= math.Mod(row, 2) * cellW / 2 // stagger alternate rows
+			src := sampleRGBA(stamp, u-math.Floor(u/cellW)*cellW, v-row*cellH)
+			if src[3] == 0 {
+				continue
+			}
+			p := dst.PixOffset(x, y)
+			inv := 1 - src[3]/255
+			for c := 0; c < 4; c++ {
+				dst.Pix[p+c] = uint8(math.Min(src[c]+float64(dst.Pix[p+c])*inv+0.5, 255))
+			}
+		}
+	}
+}
+
+// addImageWatermark composites the logo over img, scaled so that its width is
+// wm.ImageScale times the width of img.
+func addImageWatermark(img image.Image, wm Watermark) image.Image {
+	rgba := newPooledRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	logoWidth := uint(float64(rgba.Bounds().Dx()) * wm.ImageScale)
+	if logoWidth == 0 {
+		return rgba
+	}
+	scaled := resize.Resize(logoWidth, 0, wm.Image, resize.Lanczos3)
+
+	size := scaled.Bounds().Size()
+	min := watermarkOrigin(rgba.Bounds(), size, wm.Position, wm.Margin)
+	mask := image.NewUniform(color.Alpha{uint8(255 * wm.Opacity)})
+	draw.DrawMask(rgba, image.Rectangle{min, min.Add(size)}, scaled, scaled.Bounds().Min, mask, image.Point{}, draw.Over)
+	return rgba
+}
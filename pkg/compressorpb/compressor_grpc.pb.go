@@ -0,0 +1,220 @@
+// The compression pipeline of the serve command over gRPC, for services that
+// would rather not speak its HTTP API. Regenerate the Go code with go generate.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: compressor.proto
+
+package compressorpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Compressor_Compress_FullMethodName      = "/imagecompressor.v1.Compressor/Compress"
+	Compressor_BatchCompress_FullMethodName = "/imagecompressor.v1.Compressor/BatchCompress"
+)
+
+// CompressorClient is the client API for Compressor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CompressorClient interface {
+	// Compress compresses one image. The client streams the image in chunks,
+	// options on the first, and closes its side; the server streams back the
+	// compressed image, its details on the first chunk.
+	Compress(ctx context.Context, opts ...grpc.CallOption) (Compressor_CompressClient, error)
+	// BatchCompress compresses a folder, file or storage URL on the server as
+	// POST /jobs would, streaming a message per compressed file and a last one
+	// when the job ends. Cancelling the call cancels the job.
+	BatchCompress(ctx context.Context, in *BatchCompressRequest, opts ...grpc.CallOption) (Compressor_BatchCompressClient, error)
+}
+
+type compressorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCompressorClient(cc grpc.ClientConnInterface) CompressorClient {
+	return &compressorClient{cc}
+}
+
+func (c *compressorClient) Compress(ctx context.Context, opts ...grpc.CallOption) (Compressor_CompressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Compressor_ServiceDesc.Streams[0], Compressor_Compress_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &compressorCompressClient{stream}
+	return x, nil
+}
+
+type Compressor_CompressClient interface {
+	Send(*CompressRequest) error
+	Recv() (*CompressResponse, error)
+	grpc.ClientStream
+}
+
+type compressorCompressClient struct {
+	grpc.ClientStream
+}
+
+func (x *compressorCompressClient) Send(m *CompressRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *compressorCompressClient) Recv() (*CompressResponse, error) {
+	m := new(CompressResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *compressorClient) BatchCompress(ctx context.Context, in *BatchCompressRequest, opts ...grpc.CallOption) (Compressor_BatchCompressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Compressor_ServiceDesc.Streams[1], Compressor_BatchCompress_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &compressorBatchCompressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Compressor_BatchCompressClient interface {
+	Recv() (*BatchCompressResponse, error)
+	grpc.ClientStream
+}
+
+type compressorBatchCompressClient struct {
+	grpc.ClientStream
+}
+
+func (x *compressorBatchCompressClient) Recv() (*BatchCompressResponse, error) {
+	m := new(BatchCompressResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CompressorServer is the server API for Compressor service.
+// All implementations must embed UnimplementedCompressorServer
+// for forward compatibility
+type CompressorServer interface {
+	// Compress compresses one image. The client streams the image in chunks,
+	// options on the first, and closes its side; the server streams back the
+	// compressed image, its details on the first chunk.
+	Compress(Compressor_CompressServer) error
+	// BatchCompress compresses a folder, file or storage URL on the server as
+	// POST /jobs would, streaming a message per compressed file and a last one
+	// when the job ends. Cancelling the call cancels the job.
+	BatchCompress(*BatchCompressRequest, Compressor_BatchCompressServer) error
+	mustEmbedUnimplementedCompressorServer()
+}
+
+// UnimplementedCompressorServer must be embedded to have forward compatible implementations.
+type UnimplementedCompressorServer struct {
+}
+
+func (UnimplementedCompressorServer) Compress(Compressor_CompressServer) error {
+	return status.Errorf(codes.Unimplemented, "method Compress not implemented")
+}
+func (UnimplementedCompressorServer) BatchCompress(*BatchCompressRequest, Compressor_BatchCompressServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchCompress not implemented")
+}
+func (UnimplementedCompressorServer) mustEmbedUnimplementedCompressorServer() {}
+
+// UnsafeCompressorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CompressorServer will
+// result in compilation errors.
+type UnsafeCompressorServer interface {
+	mustEmbedUnimplementedCompressorServer()
+}
+
+func RegisterCompressorServer(s grpc.ServiceRegistrar, srv CompressorServer) {
+	s.RegisterService(&Compressor_ServiceDesc, srv)
+}
+
+func _Compressor_Compress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CompressorServer).Compress(&compressorCompressServer{stream})
+}
+
+type Compressor_CompressServer interface {
+	Send(*CompressResponse) error
+	Recv() (*CompressRequest, error)
+	grpc.ServerStream
+}
+
+type compressorCompressServer struct {
+	grpc.ServerStream
+}
+
+func (x *compressorCompressServer) Send(m *CompressResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *compressorCompressServer) Recv() (*CompressRequest, error) {
+	m := new(CompressRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Compressor_BatchCompress_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BatchCompressRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CompressorServer).BatchCompress(m, &compressorBatchCompressServer{stream})
+}
+
+type Compressor_BatchCompressServer interface {
+	Send(*BatchCompressResponse) error
+	grpc.ServerStream
+}
+
+type compressorBatchCompressServer struct {
+	grpc.ServerStream
+}
+
+func (x *compressorBatchCompressServer) Send(m *BatchCompressResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Compressor_ServiceDesc is the grpc.ServiceDesc for Compressor service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Compressor_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "imagecompressor.v1.Compressor",
+	HandlerType: (*CompressorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Compress",
+			Handler:       _Compressor_Compress_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "BatchCompress",
+			Handler:       _Compressor_BatchCompress_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "compressor.proto",
+}
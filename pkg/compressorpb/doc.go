@@ -0,0 +1,5 @@
+// Package compressorpb holds the gRPC service that the serve command offers
+// with -grpc-addr, generated from compressor.proto.
+package compressorpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative compressor.proto
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// azureStore is a container prefix in Azure Blob Storage, named
+// az://container/prefix. The storage account comes from the account query
+// parameter or AZURE_STORAGE_ACCOUNT, and endpoint overrides the account's
+// blob endpoint, e.g. for Azurite. It authenticates with the first of:
+//   - a SAS token in AZURE_STORAGE_SAS_TOKEN
+//   - an account key in AZURE_STORAGE_KEY
+//   - a managed identity, with auth=managed-identity (and client-id for a
+//     user assigned one)
+//   - otherwise the default Azure chain: environment, workload identity,
+//     managed identity and the Azure CLI's login
+type azureStore struct {
+	client    *container.Client
+	container string
+	prefix    string
+}
+
+// azureSourceETagKey stands for SourceETagKey: blob metadata names must be
+// C# identifiers, which have no hyphens.
+const azureSourceETagKey = "source_etag"
+
+func openAzure(ctx context.Context, u *url.URL) (Store, error) {
+	query := u.Query()
+	account := query.Get("account")
+	if account == "" {
+		account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if account == "" {
+		return nil, fmt.Errorf("no storage account for %s: add ?account= or set AZURE_STORAGE_ACCOUNT", u.Redacted())
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	containerURL := strings.TrimSuffix(endpoint, "/") + "/" + u.Host
+
+	var client *container.Client
+	var err error
+	switch {
+	case os.Getenv("AZURE_STORAGE_SAS_TOKEN") != "":
+		client, err = container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?"), nil)
+	case os.Getenv("AZURE_STORAGE_KEY") != "":
+		var cred *container.SharedKeyCredential
+		if cred, err = container.NewSharedKeyCredential(account, os.Getenv("AZURE_STORAGE_KEY")); err == nil {
+			client, err = container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+		}
+	default:
+		var cred azcore.TokenCredential
+		switch auth := query.Get("auth"); auth {
+		case "managed-identity":
+			options := &azidentity.ManagedIdentityCredentialOptions{}
+			if id := query.Get("client-id"); id != "" {
+				options.ID = azidentity.ClientID(id)
+			}
+			cred, err = azidentity.NewManagedIdentityCredential(options)
+		case "", "default":
+			cred, err = azidentity.NewDefaultAzureCredential(nil)
+		default:
+			return nil, fmt.Errorf("invalid auth %q for %s: must be default or managed-identity", auth, u.Redacted())
+		}
+		if err == nil {
+			client, err = container.NewClient(containerURL, cred, nil)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob Storage client: %v", err)
+	}
+	return &azureStore{client: client, container: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+func (s *azureStore) URL(key string) string {
+	return "az://" + s.container + "/" + joinKey(s.prefix, key)
+}
+
+func (s *azureStore) List(ctx context.Context) ([]Object, error) {
+	options := &container.ListBlobsFlatOptions{Include: container.ListBlobsInclude{Metadata: true}}
+	if s.prefix != "" {
+		options.Prefix = to(s.prefix + "/")
+	}
+	var objects []Object
+	pages := s.client.NewListBlobsFlatPager(options)
+	for pages.More() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list az://%s/%s: %v", s.container, s.prefix, err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			name := deref(item.Name)
+			if strings.HasSuffix(name, "/") || item.Properties == nil {
+				continue // a folder placeholder
+			}
+			object := Object{
+				Key:         strings.TrimPrefix(name, s.prefix+"/"),
+				Size:        derefInt(item.Properties.ContentLength),
+				ContentType: deref(item.Properties.ContentType),
+				Metadata:    fromAzureMetadata(item.Metadata),
+			}
+			if item.Properties.ETag != nil {
+				object.ETag = strings.Trim(string(*item.Properties.ETag), `"`)
+			}
+			if item.Properties.LastModified != nil {
+				object.ModTime = *item.Properties.LastModified
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+func (s *azureStore) Stat(ctx context.Context, key string) (Object, error) {
+	props, err := s.client.NewBlobClient(joinKey(s.prefix, key)).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return Object{}, ErrNotExist
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	object := Object{
+		Key:         key,
+		Size:        derefInt(props.ContentLength),
+		ContentType: deref(props.ContentType),
+		Metadata:    fromAzureMetadata(props.Metadata),
+	}
+	if props.ETag != nil {
+		object.ETag = strings.Trim(string(*props.ETag), `"`)
+	}
+	if props.LastModified != nil {
+		object.ModTime = *props.LastModified
+	}
+	return object, nil
+}
+
+func (s *azureStore) Download(ctx context.Context, key, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.NewBlobClient(joinKey(s.prefix, key)).DownloadFile(ctx, f, nil); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to download %s: %v", s.URL(key), err)
+	}
+	return f.Close()
+}
+
+func (s *azureStore) Upload(ctx context.Context, path, key, contentType string, metadata map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Large outputs go up as blocks staged in parallel
+	_, err = s.client.NewBlockBlobClient(joinKey(s.prefix, key)).UploadFile(ctx, f, &blockblob.UploadFileOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: to(contentType)},
+		Metadata:    toAzureMetadata(metadata),
+		Concurrency: 4,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	return nil
+}
+
+func (s *azureStore) Delete(ctx context.Context, key string) error {
+	if _, err := s.client.NewBlobClient(joinKey(s.prefix, key)).Delete(ctx, nil); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", s.URL(key), err)
+	}
+	return nil
+}
+
+// toAzureMetadata converts metadata for an upload, renaming SourceETagKey.
+func toAzureMetadata(metadata map[string]string) map[string]*string {
+	converted := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		if k == SourceETagKey {
+			k = azureSourceETagKey
+		}
+		converted[k] = to(v)
+	}
+	return converted
+}
+
+// fromAzureMetadata undoes toAzureMetadata. Names come back capitalized as
+// HTTP headers, and are case insensitive, so they are lowercased.
+func fromAzureMetadata(metadata map[string]*string) map[string]string {
+	converted := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		k = strings.ToLower(k)
+		if k == azureSourceETagKey {
+			k = SourceETagKey
+		}
+		converted[k] = deref(v)
+	}
+	return converted
+}
+
+func to(s string) *string { return &s }
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func derefInt(n *int64) int64 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsStore is a bucket prefix in Google Cloud Storage. Credentials come from
+// Application Default Credentials: GOOGLE_APPLICATION_CREDENTIALS, gcloud's
+// login, or the metadata server on Google Cloud. STORAGE_EMULATOR_HOST points
+// it at an emulator instead.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+	name   string
+	prefix string
+}
+
+// gcsChunkSize is the size of each request of a resumable upload, which
+// retries only the failed chunk.
+const gcsChunkSize = 16 << 20
+
+func openGCS(ctx context.Context, u *url.URL) (Store, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cloud Storage client: %v", err)
+	}
+	return &gcsStore{bucket: client.Bucket(u.Host), name: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+func (s *gcsStore) URL(key string) string {
+	return "gs://" + s.name + "/" + joinKey(s.prefix, key)
+}
+
+func (s *gcsStore) List(ctx context.Context) ([]Object, error) {
+	query := &storage.Query{}
+	if s.prefix != "" {
+		query.Prefix = s.prefix + "/"
+	}
+	var objects []Object
+	it := s.bucket.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list gs://%s/%s: %v", s.name, s.prefix, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue // a folder placeholder
+		}
+		object := gcsObject(attrs)
+		object.Key = strings.TrimPrefix(attrs.Name, s.prefix+"/")
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func gcsObject(attrs *storage.ObjectAttrs) Object {
+	return Object{
+		Size:        attrs.Size,
+		ETag:        strings.Trim(attrs.Etag, `"`),
+		ModTime:     attrs.Updated,
+		ContentType: attrs.ContentType,
+		Metadata:    attrs.Metadata,
+	}
+}
+
+func (s *gcsStore) Stat(ctx context.Context, key string) (Object, error) {
+	attrs, err := s.bucket.Object(joinKey(s.prefix, key)).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return Object{}, ErrNotExist
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	object := gcsObject(attrs)
+	object.Key = key
+	return object, nil
+}
+
+func (s *gcsStore) Download(ctx context.Context, key, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	r, err := s.bucket.Object(joinKey(s.prefix, key)).NewReader(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", s.URL(key), err)
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to download %s: %v", s.URL(key), err)
+	}
+	return f.Close()
+}
+
+func (s *gcsStore) Upload(ctx context.Context, path, key, contentType string, metadata map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := s.bucket.Object(joinKey(s.prefix, key)).NewWriter(ctx)
+	w.ChunkSize = gcsChunkSize
+	w.ContentType = contentType
+	w.Metadata = metadata
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	return nil
+}
+
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	if err := s.bucket.Object(joinKey(s.prefix, key)).Delete(ctx); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", s.URL(key), err)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// s3Store is a bucket prefix in S3 or an S3 compatible store. Credentials
+// and the default region come from the standard AWS chain: environment,
+// shared config and credentials files, SSO, and instance or container roles.
+// The URL query may set region, and endpoint for other S3 implementations
+// such as MinIO, which are then addressed by path.
+type s3Store struct {
+	client     *s3.Client
+	uploader   *manager.Uploader
+	downloader *manager.Downloader
+	bucket     string
+	prefix     string
+}
+
+func openS3(ctx context.Context, u *url.URL) (Store, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+	query := u.Query()
+	if region := query.Get("region"); region != "" {
+		cfg.Region = region
+	}
+	endpoint := query.Get("endpoint")
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	if endpoint == "" && query.Get("region") == "" {
+		// Buckets answer only in their own region
+		if region, err := manager.GetBucketRegion(ctx, client, u.Host); err == nil && region != cfg.Region {
+			cfg.Region = region
+			client = s3.NewFromConfig(cfg)
+		}
+	}
+	return &s3Store{
+		client: client,
+		// Large outputs go up as concurrent multipart uploads
+		uploader:   manager.NewUploader(client, func(u *manager.Uploader) { u.Concurrency = 4 }),
+		downloader: manager.NewDownloader(client),
+		bucket:     u.Host,
+		prefix:     strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func (s *s3Store) URL(key string) string {
+	return "s3://" + s.bucket + "/" + joinKey(s.prefix, key)
+}
+
+func (s *s3Store) List(ctx context.Context) ([]Object, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(s.bucket)}
+	if s.prefix != "" {
+		input.Prefix = aws.String(s.prefix + "/")
+	}
+	var objects []Object
+	pages := s3.NewListObjectsV2Paginator(s.client, input)
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %v", s.bucket, s.prefix, err)
+		}
+		for _, item := range page.Contents {
+			key := aws.ToString(item.Key)
+			if strings.HasSuffix(key, "/") {
+				continue // a folder placeholder
+			}
+			objects = append(objects, Object{
+				Key:     strings.TrimPrefix(key, s.prefix+"/"),
+				Size:    aws.ToInt64(item.Size),
+				ETag:    strings.Trim(aws.ToString(item.ETag), `"`),
+				ModTime: aws.ToTime(item.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, key string) (Object, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(joinKey(s.prefix, key))})
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NotFound" || apiErr.ErrorCode() == "NoSuchKey") {
+			return Object{}, ErrNotExist
+		}
+		return Object{}, err
+	}
+	return Object{
+		Key:         key,
+		Size:        aws.ToInt64(out.ContentLength),
+		ETag:        strings.Trim(aws.ToString(out.ETag), `"`),
+		ModTime:     aws.ToTime(out.LastModified),
+		ContentType: aws.ToString(out.ContentType),
+		Metadata:    out.Metadata,
+	}, nil
+}
+
+func (s *s3Store) Download(ctx context.Context, key, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := s.downloader.Download(ctx, f, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(joinKey(s.prefix, key))}); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to download %s: %v", s.URL(key), err)
+	}
+	return f.Close()
+}
+
+func (s *s3Store) Upload(ctx context.Context, path, key, contentType string, metadata map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(joinKey(s.prefix, key)),
+		Body:        f,
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	return nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	if _, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(joinKey(s.prefix, key))}); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", s.URL(key), err)
+	}
+	return nil
+}
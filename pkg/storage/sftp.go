@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpStore is a folder on an SSH server, named sftp://user@host:port/path,
+// reached over a pool of connections (connections query parameter, default
+// 4) so several files transfer at once. It authenticates with the password
+// in the URL or SFTP_PASSWORD, the SSH agent, and the default keys in
+// ~/.ssh, and checks the host key against ~/.ssh/known_hosts or the file
+// given as known-hosts.
+//
+// Files have no metadata, so a file's ETag is its size and modification time
+// and outputs are current when they are newer than their source (see
+// HasMetadata).
+type sftpStore struct {
+	host string
+	root string
+	pool chan *sftp.Client
+}
+
+func openSFTP(ctx context.Context, u *url.URL) (Store, error) {
+	query := u.Query()
+	connections := 4
+	if value := query.Get("connections"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid connections %q for %s: must be at least 1", value, u.Redacted())
+		}
+		connections = n
+	}
+	config, err := sshConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	s := &sftpStore{host: u.Host, root: "/" + strings.Trim(u.Path, "/"), pool: make(chan *sftp.Client, connections)}
+	for i := 0; i < connections; i++ {
+		conn, err := ssh.Dial("tcp", host, config)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("failed to connect to %s: %v", u.Host, err)
+		}
+		client, err := sftp.NewClient(conn, sftp.UseConcurrentReads(true), sftp.UseConcurrentWrites(true))
+		if err != nil {
+			conn.Close()
+			s.close()
+			return nil, fmt.Errorf("failed to start SFTP on %s: %v", u.Host, err)
+		}
+		s.pool <- client
+	}
+	return s, nil
+}
+
+// sshConfig returns the client settings for u: its user, every available
+// authentication method and the host key check.
+func sshConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	var methods []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	} else if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	home, _ := os.UserHomeDir()
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		key, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(key); err == nil {
+			signers = append(signers, signer) // passphrase protected keys need the agent
+		}
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	knownHosts := u.Query().Get("known-hosts")
+	if knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts %s: %v", knownHosts, err)
+	}
+	return &ssh.ClientConfig{User: user, Auth: methods, HostKeyCallback: hostKeys}, nil
+}
+
+// acquire takes a connection from the pool until the returned function
+// gives it back.
+func (s *sftpStore) acquire() (*sftp.Client, func()) {
+	client := <-s.pool
+	return client, func() { s.pool <- client }
+}
+
+func (s *sftpStore) close() {
+	for {
+		select {
+		case client := <-s.pool:
+			client.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (s *sftpStore) URL(key string) string {
+	return "sftp://" + s.host + path.Join(s.root, key)
+}
+
+func (s *sftpStore) List(ctx context.Context) ([]Object, error) {
+	client, release := s.acquire()
+	defer release()
+	var objects []Object
+	walker := client.Walk(s.root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %v", s.URL(""), err)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		info := walker.Stat()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		object := sftpObject(info)
+		object.Key = strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.root), "/")
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func sftpObject(info os.FileInfo) Object {
+	return Object{
+		Size:    info.Size(),
+		ETag:    fmt.Sprintf("%x-%x", info.Size(), info.ModTime().Unix()),
+		ModTime: info.ModTime(),
+	}
+}
+
+func (s *sftpStore) Stat(ctx context.Context, key string) (Object, error) {
+	client, release := s.acquire()
+	defer release()
+	info, err := client.Stat(path.Join(s.root, key))
+	if os.IsNotExist(err) {
+		return Object{}, ErrNotExist
+	}
+	if err != nil {
+		return Object{}, err
+	}
+	object := sftpObject(info)
+	object.Key = key
+	return object, nil
+}
+
+func (s *sftpStore) Download(ctx context.Context, key, localPath string) error {
+	client, release := s.acquire()
+	defer release()
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	remote, err := client.Open(path.Join(s.root, key))
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", s.URL(key), err)
+	}
+	defer remote.Close()
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	if _, err := remote.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(localPath)
+		return fmt.Errorf("failed to download %s: %v", s.URL(key), err)
+	}
+	return f.Close()
+}
+
+// Upload writes a temporary file next to key and renames it over key, so
+// readers never see half an image. Content type and metadata are dropped.
+func (s *sftpStore) Upload(ctx context.Context, localPath, key, contentType string, metadata map[string]string) error {
+	client, release := s.acquire()
+	defer release()
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	target := path.Join(s.root, key)
+	if err := client.MkdirAll(path.Dir(target)); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	temp := target + ".part"
+	remote, err := client.Create(temp)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	if _, err := remote.ReadFrom(f); err != nil {
+		remote.Close()
+		client.Remove(temp)
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	if err := remote.Close(); err != nil {
+		client.Remove(temp)
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	if err = client.PosixRename(temp, target); err != nil {
+		// Without the posix-rename extension, rename cannot replace a file
+		client.Remove(target)
+		err = client.Rename(temp, target)
+	}
+	if err != nil {
+		client.Remove(temp)
+		return fmt.Errorf("failed to upload %s: %v", s.URL(key), err)
+	}
+	return nil
+}
+
+func (s *sftpStore) Delete(ctx context.Context, key string) error {
+	client, release := s.acquire()
+	defer release()
+	if err := client.Remove(path.Join(s.root, key)); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", s.URL(key), err)
+	}
+	return nil
+}
+
+func (s *sftpStore) noMetadata() {}
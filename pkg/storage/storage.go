@@ -0,0 +1,140 @@
+// Package storage reads and writes the images of a run in remote stores, such
+// as s3://bucket/prefix, gs://bucket/prefix, az://container/prefix or
+// sftp://user@host/path, so the compressor can work on them through a local
+// staging folder.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SourceETagKey is the metadata key recording, on every uploaded output, the
+// ETag of the object it was compressed from. It lets a later run skip
+// unchanged sources and recognize its own outputs.
+const SourceETagKey = "source-etag"
+
+// ErrNotExist is returned by Stat for a missing object.
+var ErrNotExist = errors.New("object does not exist")
+
+// Object is a file in a store. Key is relative to the store's prefix and
+// always uses forward slashes. ContentType and Metadata are only filled in
+// by List where the store returns them with the listing.
+type Object struct {
+	Key         string
+	Size        int64
+	ETag        string
+	ModTime     time.Time
+	ContentType string
+	Metadata    map[string]string
+}
+
+// Store is a folder of a remote object store: a bucket and a key prefix.
+// Implementations are safe for concurrent use.
+type Store interface {
+	// List returns every object below the prefix.
+	List(ctx context.Context) ([]Object, error)
+	// Stat returns the object at key, with its metadata, or ErrNotExist.
+	Stat(ctx context.Context, key string) (Object, error)
+	// Download copies the object at key to the local file path.
+	Download(ctx context.Context, key, path string) error
+	// Upload copies the local file path to key with the given content type
+	// and metadata, replacing any object there.
+	Upload(ctx context.Context, path, key, contentType string, metadata map[string]string) error
+	// Delete removes the object at key.
+	Delete(ctx context.Context, key string) error
+	// URL returns the full URL of key, for messages.
+	URL(key string) string
+}
+
+// backends maps each URL scheme to the function opening a store for it.
+var backends = map[string]func(ctx context.Context, u *url.URL) (Store, error){
+	"s3":   openS3,
+	"gs":   openGCS,
+	"az":   openAzure,
+	"sftp": openSFTP,
+}
+
+// IsURL reports whether path names a remote store rather than a local file.
+func IsURL(path string) bool {
+	u, err := url.Parse(path)
+	return err == nil && backends[u.Scheme] != nil
+}
+
+// Open returns the store named by rawURL, e.g. s3://bucket/photos.
+func Open(ctx context.Context, rawURL string) (Store, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage URL %q: %v", rawURL, err)
+	}
+	open := backends[u.Scheme]
+	if open == nil {
+		return nil, fmt.Errorf("unsupported storage URL %q", rawURL)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid storage URL %q: no bucket", rawURL)
+	}
+	return open(ctx, u)
+}
+
+// HasMetadata reports whether s keeps the metadata given to Upload. Outputs
+// in stores without it, such as SFTP, are current when they are newer than
+// their source.
+func HasMetadata(s Store) bool {
+	_, none := s.(interface{ noMetadata() })
+	return !none
+}
+
+// Same reports whether a and b name the same folder of the same store.
+func Same(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// ContentType returns the MIME type stored with an output named key.
+func ContentType(key string) string {
+	if t := mime.TypeByExtension(strings.ToLower(path.Ext(key))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// LocalPath returns where the object at key is staged below dir. Absolute
+// keys and keys with .. segments, which would be staged outside dir, are
+// refused.
+func LocalPath(dir, key string) (string, error) {
+	local := filepath.FromSlash(key)
+	if path.IsAbs(key) || filepath.IsAbs(local) || filepath.VolumeName(local) != "" || strings.HasPrefix(key, `\`) {
+		return "", fmt.Errorf("object key %q is absolute", key)
+	}
+	for _, segment := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return "", fmt.Errorf("object key %q is outside the folder", key)
+		}
+	}
+	return filepath.Join(dir, local), nil
+}
+
+// Key returns the key of the local file path staged below dir.
+func Key(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// joinKey joins a store prefix and a relative key.
+func joinKey(prefix, key string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"image-compressor/pkg/compressor"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// progressModes lists the -progress values. "auto" draws bars on a terminal
+// and prints plain lines when stdout is redirected.
+var progressModes = map[string]bool{
+	"auto":  true,
+	"bar":   true,
+	"plain": true,
+	"off":   true,
+}
+
+// stdoutIsTerminal reports whether stdout is a terminal rather than a file,
+// pipe or CI log.
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// etaSample is how many files must be done before an ETA is shown, so it
+// comes from measured throughput rather than the first file alone.
+const etaSample = 5
+
+// progress shows how far a run is: one bar over the bytes of every queued
+// file with throughput and ETA, or with perWorker a bar per worker and the
+// workers' own status lines. In plain mode the bars are replaced by a
+// progress line every interval and every everyFiles files.
+type progress struct {
+	mu         sync.Mutex
+	bar        *progressbar.ProgressBar
+	workers    []*progressbar.ProgressBar
+	perWorker  bool
+	plain      bool
+	everyFiles int
+	stop       chan struct{}
+	start      time.Time
+	totalFiles int
+	totalBytes int64
+	doneFiles  int
+	doneBytes  int64
+}
+
+func newProgress(totalFiles int, totalBytes int64, numThreads int, mode string, perWorker bool, interval time.Duration, everyFiles int) *progress {
+	p := &progress{
+		perWorker:  perWorker,
+		plain:      mode == "plain" || (mode == "auto" && !stdoutIsTerminal()),
+		everyFiles: everyFiles,
+		start:      time.Now(),
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+	}
+	if p.plain {
+		if interval > 0 {
+			p.stop = make(chan struct{})
+			go p.tick(interval)
+		}
+		return p
+	}
+	if mode == "off" {
+		return p
+	}
+	if perWorker {
+		// How many files each worker gets isn't known up front
+		p.workers = make([]*progressbar.ProgressBar, numThreads)
+		for i := range p.workers {
+			p.workers[i] = progressbar.NewOptions(-1, progressbar.OptionSetDescription(fmt.Sprintf("Thread %d", i+1)))
+		}
+		return p
+	}
+	p.bar = progressbar.NewOptions64(totalBytes,
+		progressbar.OptionSetDescription(p.describe()),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWidth(30),
+		progressbar.OptionSetPredictTime(false), // bytes alone; describe has a better one
+		progressbar.OptionThrottle(100*time.Millisecond),
+		progressbar.OptionOnCompletion(func() { fmt.Println() }),
+	)
+	p.bar.RenderBlank()
+	return p
+}
+
+func (p *progress) describe() string {
+	description := fmt.Sprintf("Files %d/%d", p.doneFiles, p.totalFiles)
+	if eta, ok := p.eta(); ok {
+		description += fmt.Sprintf(", ETA %v", eta)
+	}
+	return description
+}
+
+// eta estimates the time left from the throughput so far, once etaSample
+// files are done: the mean of the estimates by bytes per second and by files
+// per second, as runs of small files are slowed by per-file work and runs of
+// large ones by their pixels. p.mu must be held.
+func (p *progress) eta() (time.Duration, bool) {
+	elapsed := time.Since(p.start)
+	if p.doneFiles < etaSample || p.doneFiles >= p.totalFiles || elapsed <= 0 {
+		return 0, false
+	}
+	byFiles := float64(p.totalFiles-p.doneFiles) / (float64(p.doneFiles) / elapsed.Seconds())
+	byBytes := byFiles
+	if p.doneBytes > 0 {
+		byBytes = float64(p.totalBytes-p.doneBytes) / (float64(p.doneBytes) / elapsed.Seconds())
+	}
+	eta := time.Duration((byFiles + byBytes) / 2 * float64(time.Second))
+	if eta >= time.Second {
+		return eta.Round(time.Second), true
+	}
+	return eta.Round(time.Millisecond), true
+}
+
+func (p *progress) tick(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.printLine()
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// printLine prints the plain progress line; p.mu must be held.
+func (p *progress) printLine() {
+	elapsed := time.Since(p.start)
+	line := fmt.Sprintf("Progress: %d/%d files, %s/%s", p.doneFiles, p.totalFiles,
+		compressor.HumanReadableSize(p.doneBytes), compressor.HumanReadableSize(p.totalBytes))
+	if p.doneBytes > 0 && elapsed > 0 {
+		line += fmt.Sprintf(", %s/s", compressor.HumanReadableSize(int64(float64(p.doneBytes)/elapsed.Seconds())))
+	}
+	if eta, ok := p.eta(); ok {
+		line += fmt.Sprintf(", ETA %v", eta)
+	}
+	fmt.Println(line)
+}
+
+// fileDone counts a finished file of size bytes, compressed or failed, for
+// worker threadID.
+func (p *progress) fileDone(threadID int, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.doneFiles++
+	p.doneBytes += size
+	switch {
+	case p.plain:
+		if p.everyFiles > 0 && p.doneFiles%p.everyFiles == 0 {
+			p.printLine()
+		}
+	case p.workers != nil:
+		p.workers[threadID-1].Add(1)
+	case p.bar != nil:
+		p.bar.Describe(p.describe())
+		p.bar.Add64(size)
+	}
+}
+
+// workerf logs a worker status line, shown by the per-worker display and
+// otherwise only with -vv.
+func (p *progress) workerf(format string, args ...interface{}) {
+	if p.perWorker {
+		logger.Infof(format, args...)
+	} else {
+		logger.Tracef(format, args...)
+	}
+}
+
+// printf prints a line, such as an error, without breaking up the bar.
+func (p *progress) printf(format string, args ...interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bar == nil {
+		fmt.Printf(format, args...)
+		return
+	}
+	p.bar.Clear()
+	fmt.Printf(format, args...)
+	p.bar.RenderBlank()
+}
+
+// finish completes the overall bar, or prints the last plain line, once every
+// worker is done.
+func (p *progress) finish() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.plain {
+		p.printLine()
+	} else if p.bar != nil {
+		p.bar.Finish()
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"image-compressor/pkg/compressor"
+	"image-compressor/pkg/storage"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// remoteRun is a compress run whose input or output (-d) is a storage URL.
+// Remote sources are downloaded into a staging folder, the run works on it
+// as on any local folder, and the outputs are uploaded afterwards, keyed by
+// their path below the local output folder: s3://b/photos/a.jpg is written
+// to s3://b/photos/compressed_files/a_compressed.jpg, as it would be on disk.
+type remoteRun struct {
+	src, dst  storage.Store // src is nil for a local input
+	inputDir  string        // local folder the run reads
+	outputDir string        // local folder the run writes, uploaded to dst
+	inPlace   bool
+	threads   int
+
+	mu     sync.Mutex
+	staged map[string]storage.Object // staged local path to source object
+	temp   []string
+}
+
+// newRemoteRun opens the stores of a run over input into outputDir, either of
+// which may be a URL, and creates the local folders standing in for them.
+func newRemoteRun(ctx context.Context, input, outputDir string, inPlace bool, threads int) (*remoteRun, error) {
+	r := &remoteRun{inputDir: input, outputDir: outputDir, inPlace: inPlace, threads: threads, staged: make(map[string]storage.Object)}
+	var err error
+	if storage.IsURL(input) {
+		if r.src, err = storage.Open(ctx, input); err != nil {
+			return nil, err
+		}
+		if r.inputDir, err = r.tempDir(); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case storage.IsURL(outputDir):
+		if r.src != nil && storage.Same(input, outputDir) {
+			r.dst = r.src
+		} else if r.dst, err = storage.Open(ctx, outputDir); err != nil {
+			return nil, err
+		}
+		if r.src != nil {
+			r.outputDir = r.inputDir
+		} else if r.outputDir, err = r.tempDir(); err != nil {
+			return nil, err
+		}
+	case outputDir == "" && r.src != nil:
+		r.dst, r.outputDir = r.src, r.inputDir
+	}
+	if inPlace && (r.src == nil || r.dst != r.src) {
+		return nil, fmt.Errorf("-in-place with storage URLs needs a remote input and no -d")
+	}
+	if inPlace && !storage.HasMetadata(r.src) {
+		return nil, fmt.Errorf("-in-place needs a store that keeps metadata, to recognize replaced images")
+	}
+	return r, nil
+}
+
+func (r *remoteRun) tempDir() (string, error) {
+	dir, err := ioutil.TempDir("", "image-compressor-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging folder: %v", err)
+	}
+	r.temp = append(r.temp, dir)
+	return dir, nil
+}
+
+// url returns where a file of the staged output folder ends up once
+// uploaded.
+func (r *remoteRun) url(localPath string) string {
+	if r.dst == nil {
+		return localPath
+	}
+	return r.dst.URL(storage.Key(r.outputDir, localPath))
+}
+
+// cleanup removes the staging folders.
+func (r *remoteRun) cleanup() {
+	for _, dir := range r.temp {
+		os.RemoveAll(dir)
+	}
+}
+
+// skipFolders are the folders of earlier runs below an input, which Plan skips
+// locally and staging skips remotely.
+var skipFolders = []string{"compressed_files/", "processed_files/", "backup_files/"}
+
+// stage downloads the source images that still need compressing: those
+// selected by the filters of opts and, going by the source ETag recorded on
+// every output, not compressed since they last changed. It returns how many
+// were downloaded and skipped.
+func (r *remoteRun) stage(ctx context.Context, opts compressor.Options) (downloaded, skipped int, err error) {
+	if r.src == nil {
+		return 0, 0, nil
+	}
+	objects, err := r.src.List(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	compressedFolder := filepath.Join(r.outputDir, "compressed_files")
+
+	var mu sync.Mutex
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(r.threads)
+	for _, obj := range objects {
+		obj := obj
+		if !compressor.IsSupportedImage(path.Base(obj.Key)) || inSkippedFolder(obj.Key) {
+			continue
+		}
+		local, err := storage.LocalPath(r.inputDir, obj.Key)
+		if err != nil {
+			logger.Warnf("Skipping %s: %v", r.src.URL(obj.Key), err)
+			continue
+		}
+		if opts.PathFilter.Reason(obj.Key) != "" || obj.Size < opts.MinSize {
+			mu.Lock()
+			skipped++
+			mu.Unlock()
+			continue
+		}
+		group.Go(func() error {
+			// Outputs dated or named after the image are only known once it
+			// is downloaded
+			fetched := opts.OrganizeByDate || opts.NameTemplate != ""
+			if fetched {
+				if err := r.src.Download(ctx, obj.Key, local); err != nil {
+					return err
+				}
+			}
+			if r.compressed(ctx, obj, local, compressedFolder, opts) {
+				logger.Debugf("Skipping %s: unchanged since it was compressed", r.src.URL(obj.Key))
+				if fetched {
+					os.Remove(local)
+				}
+				mu.Lock()
+				skipped++
+				mu.Unlock()
+				return nil
+			}
+			if !fetched {
+				if err := r.src.Download(ctx, obj.Key, local); err != nil {
+					return err
+				}
+			}
+			logger.Tracef("Downloaded %s", r.src.URL(obj.Key))
+			r.mu.Lock()
+			r.staged[local] = obj
+			r.mu.Unlock()
+			mu.Lock()
+			downloaded++
+			mu.Unlock()
+			return nil
+		})
+	}
+	err = group.Wait()
+	return downloaded, skipped, err
+}
+
+func inSkippedFolder(key string) bool {
+	for _, folder := range skipFolders {
+		if strings.HasPrefix(key, folder) || strings.Contains(key, "/"+folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressed reports whether obj already has an up to date output: in place,
+// it is one itself; otherwise the output Plan would give it records obj's
+// ETag, or is newer in stores without metadata. Local outputs are left to
+// Plan, which skips those already written. Names numbered by {index} count
+// the files staged, so with those every image is staged again to keep the
+// numbering of a full run.
+func (r *remoteRun) compressed(ctx context.Context, obj storage.Object, local, compressedFolder string, opts compressor.Options) bool {
+	switch {
+	case r.dst == nil || strings.Contains(opts.NameTemplate, "{index}"):
+		return false
+	case r.inPlace:
+		info, err := r.src.Stat(ctx, obj.Key)
+		return err == nil && info.Metadata[storage.SourceETagKey] != ""
+	}
+	output := compressor.LastOutput(compressor.PlannedOutputPath(local, r.inputDir, compressedFolder, 0, opts), opts)
+	info, err := r.dst.Stat(ctx, storage.Key(r.outputDir, output))
+	if err == nil && !storage.HasMetadata(r.dst) {
+		return info.ModTime.After(obj.ModTime)
+	}
+	return err == nil && info.Metadata[storage.SourceETagKey] == obj.ETag
+}
+
+// upload sends the outputs of every file the run finished, as recorded in its
+// manifest, its reports and the album written to album, if any, to the
+// destination. In place, originals' backups go up first and each replacement
+// then overwrites its source object.
+func (r *remoteRun) upload(ctx context.Context, compressedFolder, album string) error {
+	if r.dst == nil {
+		return nil
+	}
+	manifest, err := compressor.LoadManifest(filepath.Join(compressedFolder, "manifest.jsonl"))
+	if err != nil {
+		return err
+	}
+
+	type upload struct {
+		path, key string
+		metadata  map[string]string
+		mimeType  string
+	}
+	var backups, uploads []upload
+	var replaced []string // originals whose replacement has another name
+	if r.inPlace {
+		entries, err := compressor.LoadBackupLog(filepath.Join(r.outputDir, "backup_files", "backups.jsonl"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, entry := range entries {
+			key := storage.Key(r.outputDir, entry.Backup)
+			backups = append(backups, upload{path: entry.Backup, key: key, mimeType: storage.ContentType(key)})
+			if entry.Replacement != entry.Original {
+				replaced = append(replaced, storage.Key(r.inputDir, entry.Original))
+			}
+		}
+	}
+	for _, entry := range manifest.Entries() {
+		if entry.Status != "done" {
+			continue
+		}
+		// Outputs keep the custom metadata of their source, and its content
+		// type unless they were converted
+		obj, staged := r.staged[entry.Input]
+		metadata := map[string]string{storage.SourceETagKey: entry.InputSHA256}
+		if staged {
+			for k, v := range obj.Metadata {
+				metadata[k] = v
+			}
+			metadata[storage.SourceETagKey] = obj.ETag
+		}
+		for _, out := range entry.Outputs {
+			key := storage.Key(r.outputDir, out.Path)
+			mimeType := storage.ContentType(key)
+			if staged && obj.ContentType != "" && strings.EqualFold(path.Ext(obj.Key), path.Ext(key)) {
+				mimeType = obj.ContentType
+			}
+			uploads = append(uploads, upload{path: out.Path, key: key, metadata: metadata, mimeType: mimeType})
+		}
+	}
+	var extras []string
+	for _, name := range []string{"report.txt", "report.json", "report.csv", "report.html", "output_map.csv", "placeholders.json"} {
+		extras = append(extras, filepath.Join(compressedFolder, name))
+	}
+	if album != "" {
+		abs, err := filepath.Abs(album)
+		if err != nil {
+			return err
+		}
+		extras = append(extras, abs)
+	}
+	for _, extra := range extras {
+		if _, err := os.Stat(extra); err != nil {
+			continue
+		}
+		key := storage.Key(r.outputDir, extra)
+		if key == ".." || strings.HasPrefix(key, "../") {
+			// An album written outside the output folder goes up next to
+			// the reports
+			key = storage.Key(r.outputDir, filepath.Join(compressedFolder, filepath.Base(extra)))
+		}
+		uploads = append(uploads, upload{path: extra, key: key, mimeType: storage.ContentType(key)})
+	}
+
+	for _, batch := range [][]upload{backups, uploads} {
+		group, ctx := errgroup.WithContext(ctx)
+		group.SetLimit(r.threads)
+		for _, u := range batch {
+			u := u
+			group.Go(func() error {
+				if err := r.dst.Upload(ctx, u.path, u.key, u.mimeType, u.metadata); err != nil {
+					return err
+				}
+				logger.Debugf("Uploaded %s", r.dst.URL(u.key))
+				return nil
+			})
+		}
+		if err := group.Wait(); err != nil {
+			return err
+		}
+	}
+	for _, key := range replaced {
+		if err := r.dst.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	logger.Summaryf("Uploaded %d files to %s", len(backups)+len(uploads), r.dst.URL(""))
+	return nil
+}
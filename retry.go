@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// failedRun is what the retry command reads from an earlier run: where it
+// compressed from and to, and the files that failed.
+type failedRun struct {
+	input  string // the input folder or file of the run
+	output string // its compressed_files folder
+	files  []string
+}
+
+// loadFailedRun reads the failed files of a run from its report.txt,
+// report.json or manifest.jsonl, or from the compressed_files folder holding
+// them. A manifest does not name the input, so it is taken from the report
+// next to it, or else the folder above compressed_files.
+func loadFailedRun(path string) (failedRun, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		for _, name := range []string{"report.json", "report.txt", "manifest.jsonl"} {
+			if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+				return loadFailedRun(filepath.Join(path, name))
+			}
+		}
+		return failedRun{}, fmt.Errorf("no report or manifest in %s", path)
+	}
+	switch filepath.Ext(path) {
+	case ".txt":
+		return loadTextReport(path)
+	case ".json":
+		return loadJSONReport(path)
+	case ".jsonl":
+		manifest, err := loadManifestArg(path)
+		if err != nil {
+			return failedRun{}, err
+		}
+		dir := filepath.Dir(path)
+		run := failedRun{input: filepath.Dir(dir), output: dir}
+		for _, name := range []string{"report.json", "report.txt"} {
+			if report, err := loadFailedRun(filepath.Join(dir, name)); err == nil {
+				run.input = report.input
+				break
+			}
+		}
+		for _, entry := range manifest.Entries() {
+			if entry.Status == "failed" {
+				run.files = append(run.files, entry.Input)
+			}
+		}
+		return run, nil
+	}
+	return failedRun{}, fmt.Errorf("unknown report %s: must be report.txt, report.json or manifest.jsonl", path)
+}
+
+func loadJSONReport(path string) (failedRun, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return failedRun{}, fmt.Errorf("failed to read report: %v", err)
+	}
+	var report struct {
+		Input  string `json:"input"`
+		Output string `json:"output"`
+		Files  []struct {
+			Input string `json:"input"`
+			Error string `json:"error"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &report); err != nil {
+		return failedRun{}, fmt.Errorf("failed to parse report %s: %v", path, err)
+	}
+	run := failedRun{input: report.Input, output: report.Output}
+	for _, file := range report.Files {
+		if file.Error != "" {
+			run.files = append(run.files, file.Input)
+		}
+	}
+	return run, nil
+}
+
+// loadTextReport reads the Input and Output lines and the "Failed files"
+// section of report.txt, whose lines are "  path: error".
+func loadTextReport(path string) (failedRun, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return failedRun{}, fmt.Errorf("failed to read report: %v", err)
+	}
+	defer f.Close()
+	var run failedRun
+	inFailed := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "Input: ") && run.input == "":
+			run.input = strings.TrimPrefix(line, "Input: ")
+		case strings.HasPrefix(line, "Output: ") && run.output == "":
+			run.output = strings.TrimPrefix(line, "Output: ")
+		case line == "Failed files:":
+			inFailed = true
+		case inFailed && strings.HasPrefix(line, "  "):
+			run.files = append(run.files, failedPath(strings.TrimPrefix(line, "  ")))
+		default:
+			inFailed = false
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return failedRun{}, fmt.Errorf("failed to read report: %v", err)
+	}
+	if run.input == "" {
+		return failedRun{}, fmt.Errorf("%s is not a report: it has no Input line", path)
+	}
+	return run, nil
+}
+
+// failedPath takes the path off a "path: error" line. Paths may contain
+// ": " themselves, so the first prefix naming an existing file wins.
+func failedPath(line string) string {
+	for i := strings.Index(line, ": "); i >= 0; {
+		if _, err := os.Stat(line[:i]); err == nil {
+			return line[:i]
+		}
+		next := strings.Index(line[i+2:], ": ")
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	path, _, _ := strings.Cut(line, ": ")
+	return path
+}
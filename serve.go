@@ -0,0 +1,369 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"image-compressor/pkg/compressor"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// compressServer handles the serve command's requests. Each upload is
+// compressed with the server's options, adjusted by the request's query.
+type compressServer struct {
+	opts      compressor.Options
+	maxUpload int64
+	threads   int
+	slots     *semaphore.Weighted // compressions running at once
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var addr, grpcAddr, maxUpload, jobRoot string
+	var threads, jobs, quality, maxWidth, maxHeight int
+	fs.StringVar(&addr, "addr", ":8080", "address to listen on")
+	fs.StringVar(&grpcAddr, "grpc-addr", "", "address to also serve gRPC on, e.g. :9090 (see pkg/compressorpb/compressor.proto)")
+	fs.StringVar(&maxUpload, "max-upload", "50MB", "largest request body accepted")
+	fs.IntVar(&threads, "t", 4, "number of images compressed at once, by uploads and jobs together; others wait")
+	fs.StringVar(&jobRoot, "job-root", ".", "folder that the local paths of /jobs must be inside, and are relative to")
+	fs.IntVar(&jobs, "jobs", 1, "number of /jobs run at once; later ones are queued")
+	fs.IntVar(&quality, "q", 80, "default JPEG quality (1-100)")
+	fs.IntVar(&maxWidth, "max-width", 0, "default maximum width in pixels (0 for no limit)")
+	fs.IntVar(&maxHeight, "max-height", 0, "default maximum height in pixels (0 for no limit)")
+	fs.Usage = func() {
+		fmt.Println(`Usage: image-compressor serve [flags]
+
+POST an image to /compress to get it back compressed, or a multipart form of
+images to get a zip of them. Query parameters override the defaults below:
+quality, max-width, max-height, scale, format, target-size and strip-metadata.
+
+POST {"input": "<folder, file or URL>", "output": "<folder>", "options": {...}}
+to /jobs to compress a folder in the background, taking the same options, and
+GET /jobs/<id> for its status and results or DELETE it to cancel.
+
+With -grpc-addr, the Compress and BatchCompress RPCs of compressor.proto do
+the same over gRPC. GET /metrics gives Prometheus metrics.`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if threads < 1 {
+		fmt.Printf("Invalid thread count %d: must be at least 1\n", threads)
+		return
+	}
+	if jobs < 1 {
+		fmt.Printf("Invalid job count %d: must be at least 1\n", jobs)
+		return
+	}
+	limit, err := compressor.ParseSize(maxUpload)
+	if err != nil || limit == 0 {
+		fmt.Printf("Invalid max upload %q\n", maxUpload)
+		return
+	}
+	opts := compressor.DefaultOptions()
+	opts.JPEGQuality, opts.MaxWidth, opts.MaxHeight = quality, maxWidth, maxHeight
+	if _, err := requestOptions(opts, nil); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	server := &compressServer{opts: opts, maxUpload: limit, threads: threads, slots: semaphore.NewWeighted(int64(threads))}
+	queue, err := newJobQueue(server, jobRoot, jobs)
+	if err != nil {
+		fmt.Printf("Invalid job root %q: %v\n", jobRoot, err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/compress", server.handleCompress)
+	mux.HandleFunc("/jobs", queue.handleJobs)
+	mux.HandleFunc("/jobs/", queue.handleJobs)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintln(w, "ok") })
+	if grpcAddr != "" {
+		listener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Serving gRPC on %s\n", grpcAddr)
+		go func() {
+			if err := newGRPCServer(server, queue).Serve(listener); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	fmt.Printf("Listening on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// requestOptions applies a request's query parameters to the server options
+// and checks the result the same way the compress flags are checked.
+func requestOptions(opts compressor.Options, query map[string][]string) (compressor.Options, error) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	atoi := func(name string, dst *int) error {
+		if value := get(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q", name, value)
+			}
+			*dst = n
+		}
+		return nil
+	}
+	if err := atoi("quality", &opts.JPEGQuality); err != nil {
+		return opts, err
+	}
+	if err := atoi("max-width", &opts.MaxWidth); err != nil {
+		return opts, err
+	}
+	if err := atoi("max-height", &opts.MaxHeight); err != nil {
+		return opts, err
+	}
+	if value := get("scale"); value != "" {
+		scale, err := compressor.ParseScale(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid scale %q: must be a percentage between 0 and 100", value)
+		}
+		opts.Scale = scale
+	}
+	if value := get("format"); value != "" {
+		format, err := compressor.ParseFormat(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid format %q: %v", value, err)
+		}
+		opts.ConvertTo = format
+	}
+	if value := get("strip-metadata"); value != "" {
+		strip := make(map[string]bool)
+		for _, category := range strings.Split(value, ",") {
+			category = strings.TrimSpace(strings.ToLower(category))
+			if !compressor.MetadataCategories[category] {
+				return opts, fmt.Errorf("invalid metadata category %q: must be gps, serial, exif, xmp, iptc, icc or all", category)
+			}
+			strip[category] = true
+		}
+		opts.StripMetadata = strip
+	}
+	if value := get("target-size"); value != "" {
+		size, err := compressor.ParseSize(value)
+		if err != nil || size == 0 {
+			return opts, fmt.Errorf("invalid target size %q", value)
+		}
+		opts.TargetSize = size
+	}
+
+	if opts.JPEGQuality < 1 || opts.JPEGQuality > 100 {
+		return opts, fmt.Errorf("invalid quality %d: must be between 1 and 100", opts.JPEGQuality)
+	}
+	if opts.MaxWidth < 0 || opts.MaxHeight < 0 {
+		return opts, fmt.Errorf("invalid max width %d or height %d: must not be negative", opts.MaxWidth, opts.MaxHeight)
+	}
+	return opts, nil
+}
+
+func (s *compressServer) handleCompress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("POST an image"))
+		return
+	}
+	opts, err := requestOptions(s.opts, r.URL.Query())
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUpload)
+
+	dir, err := ioutil.TempDir("", "image-compressor-")
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		s.compressSingle(w, r, dir, opts)
+		return
+	}
+	s.compressBatch(w, r, dir, opts)
+}
+
+// compressSingle compresses a request whose body is the image itself, named
+// by the name query parameter or else recognized by its content.
+func (s *compressServer) compressSingle(w http.ResponseWriter, r *http.Request, dir string, opts compressor.Options) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	output, result, status, err := s.compressUpload(r.Context(), dir, name, data, opts)
+	if err != nil {
+		httpError(w, status, err)
+		return
+	}
+	compressed, err := ioutil.ReadFile(output)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType(output))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filepath.Base(output)))
+	w.Header().Set("X-Original-Size", strconv.FormatInt(result.InputSize, 10))
+	w.Header().Set("X-Compressed-Size", strconv.FormatInt(result.OutputSize, 10))
+	w.Write(compressed)
+}
+
+// compressBatch compresses every file of a multipart form and answers with a
+// zip of the outputs, in the order they were sent. One bad file fails the
+// request, naming it.
+func (s *compressServer) compressBatch(w http.ResponseWriter, r *http.Request, dir string, opts compressor.Options) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+	var outputs []string
+	for i := 1; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			httpError(w, http.StatusBadRequest, err)
+			return
+		}
+		if part.FileName() == "" {
+			continue // a plain form field
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			httpError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		// Each part gets its own folder, so equal names don't collide
+		partDir := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(partDir, 0700); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		output, _, status, err := s.compressUpload(r.Context(), partDir, part.FileName(), data, opts)
+		if err != nil {
+			httpError(w, status, fmt.Errorf("%s: %v", part.FileName(), err))
+			return
+		}
+		outputs = append(outputs, output)
+	}
+	if len(outputs) == 0 {
+		httpError(w, http.StatusBadRequest, fmt.Errorf("no files in the form"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="compressed.zip"`)
+	archive := zip.NewWriter(w)
+	used := make(map[string]bool)
+	for i, output := range outputs {
+		name := filepath.Base(output)
+		if used[name] {
+			name = fmt.Sprintf("%d_%s", i+1, name) // two uploads with the same name
+		}
+		used[name] = true
+		entry, err := archive.Create(name)
+		if err != nil {
+			return
+		}
+		f, err := os.Open(output)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(entry, f)
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+	archive.Close()
+}
+
+// compressUpload saves an uploaded image in dir and compresses it there,
+// returning the output path, or an error with the HTTP status it deserves.
+func (s *compressServer) compressUpload(ctx context.Context, dir, name string, data []byte, opts compressor.Options) (string, compressor.FileResult, int, error) {
+	name = filepath.Base(name)
+	if name == "." || name == string(filepath.Separator) || !compressor.IsSupportedImage(name) {
+		switch http.DetectContentType(data) {
+		case "image/jpeg":
+			name = "upload.jpg"
+		case "image/png":
+			name = "upload.png"
+		case "application/pdf":
+			name = "upload.pdf"
+		default:
+			return "", compressor.FileResult{}, http.StatusUnsupportedMediaType, fmt.Errorf("not a JPEG, PNG, PDF or RAW image; name RAW uploads with ?name=")
+		}
+	}
+	input := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(input, data, 0600); err != nil {
+		return "", compressor.FileResult{}, http.StatusInternalServerError, err
+	}
+
+	if err := s.acquire(ctx); err != nil {
+		return "", compressor.FileResult{}, http.StatusServiceUnavailable, err
+	}
+	defer s.slots.Release(1)
+	start := time.Now()
+	output := compressor.OutputPath(input, dir, dir, opts.ConvertTo)
+	result, err := compressor.CompressFile(ctx, compressor.Job{Input: input, Output: output, Index: 1}, opts)
+	observeResult(result)
+	if err != nil {
+		logger.Errorf("Failed to compress upload %s: %v", name, err)
+		return "", result, http.StatusUnprocessableEntity, err
+	}
+	logger.Debugf("Compressed upload %s (%s to %s in %v)", name, compressor.HumanReadableSize(result.InputSize),
+		compressor.HumanReadableSize(result.OutputSize), time.Since(start).Round(time.Millisecond))
+	return output, result, http.StatusOK, nil
+}
+
+// acquire waits for a free compression slot, counted in the queue depth
+// metric meanwhile.
+func (s *compressServer) acquire(ctx context.Context) error {
+	queueDepth.Inc()
+	defer queueDepth.Dec()
+	return s.slots.Acquire(ctx, 1)
+}
+
+func contentType(path string) string {
+	if t := mime.TypeByExtension(strings.ToLower(filepath.Ext(path))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func httpError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFolder calls run once, and again each time images have been created
+// or written below dir and the folder has then been quiet for debounce. The
+// ignored folders (the outputs, moved and backed up originals) are not
+// watched. It returns on SIGINT or SIGTERM between runs; run itself stops on
+// one during a run.
+func watchFolder(dir string, ignored []string, debounce time.Duration, run func()) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Errorf("Failed to start watching: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	skip := make(map[string]bool)
+	for _, path := range ignored {
+		if abs, err := filepath.Abs(path); err == nil {
+			skip[abs] = true
+		}
+	}
+	// fsnotify watches single folders, so every subfolder is added, including
+	// ones created later
+	addTree := func(root string) {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			abs, _ := filepath.Abs(path)
+			if skip[abs] || info.Name() == "compressed_files" || info.Name() == "processed_files" || info.Name() == "backup_files" {
+				return filepath.SkipDir
+			}
+			if err := watcher.Add(path); err != nil {
+				logger.Errorf("Failed to watch %s: %v", path, err)
+			}
+			return nil
+		})
+	}
+	addTree(dir)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	run()
+	logger.Infof("Watching %s for new images", dir)
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				if event.Op&fsnotify.Create != 0 {
+					addTree(event.Name)
+				}
+				continue
+			}
+			logger.Tracef("Watch: %s %s", event.Op, event.Name)
+			// Every write pushes the run back, so a file still being copied
+			// isn't compressed half-written
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Errorf("Watch error: %v", err)
+		case <-timer.C:
+			run()
+			logger.Infof("Watching %s for new images", dir)
+		case <-signals:
+			logger.Summaryf("Stopped watching %s", dir)
+			return
+		}
+	}
+}